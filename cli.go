@@ -0,0 +1,452 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/krobertson/chia-plot-sink-multi/sink"
+)
+
+// commands are the subcommands which can be ran against a running sink through
+// its control interface.
+var commands = map[string]func(c *controlClient, args []string) error{
+	"status":    cmdStatus,
+	"transfers": cmdTransfers,
+	"find":      cmdFind,
+	"pause":     cmdTargetAction("pause"),
+	"resume":    cmdTargetAction("resume"),
+	"disable":   cmdTargetAction("disable"),
+	"drain":     cmdDrain,
+	"reload":    cmdReload,
+	"cancel":    cmdCancel,
+	"rebalance": cmdRebalance,
+	"job":       cmdJob,
+	"evacuate":  cmdEvacuate,
+	"import":    cmdImport,
+}
+
+// localCommands are the subcommands which don't need a running sink.
+var localCommands = map[string]func(args []string) error{
+	"init":     cmdInit,
+	"migrate":  cmdMigrate,
+	"simulate": cmdSimulate,
+	"report":   cmdReport,
+}
+
+// usage prints the flags along with the available subcommands.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [command] [args]\n\n", os.Args[0])
+	fmt.Fprintln(out, "With no command, the sink is started. Commands for a running sink:")
+	fmt.Fprintln(out, "  status                  show groups and paths")
+	fmt.Fprintln(out, "  transfers               show in-flight transfers")
+	fmt.Fprintln(out, "  find <id|filename>      show which path holds a plot")
+	fmt.Fprintln(out, "  pause <path|group>      stop placing plots on a path or group")
+	fmt.Fprintln(out, "  resume <path|group>     resume a paused or disabled path or group")
+	fmt.Fprintln(out, "  disable <path|group>    take a path or group out of rotation")
+	fmt.Fprintln(out, "  drain <group>           let in-flight transfers finish, then stop the group")
+	fmt.Fprintln(out, "  reload                  re-read the config file and apply group changes")
+	fmt.Fprintln(out, "  cancel <id|filename>    abort an in-flight transfer")
+	fmt.Fprintln(out, "  rebalance [flags]       move stored plots to even out fill levels")
+	fmt.Fprintln(out, "  evacuate [flags] <path> move all plots off a path onto other destinations")
+	fmt.Fprintln(out, "  import [flags] <dir>    place plots from a local directory onto destinations")
+	fmt.Fprintln(out, "  job [cancel]            show or cancel the running maintenance job")
+	fmt.Fprintln(out, "\nOther commands:")
+	fmt.Fprintln(out, "  init [-o file] [-force]  scan mounted disks and write a starter config")
+	fmt.Fprintln(out, "  migrate [flags] <host:port|name> <dir>...")
+	fmt.Fprintln(out, "                          send the plots in local directories to another sink,")
+	fmt.Fprintln(out, "                          or those published in DNS SRV records for the name")
+	fmt.Fprintln(out, "  report [-local]          show the space, plots, and state of every path, from")
+	fmt.Fprintln(out, "                          the running sink or else the disks")
+	fmt.Fprintln(out, "  simulate [flags] <layout>")
+	fmt.Fprintln(out, "                          compare strategies by replaying plots onto a disk layout")
+	fmt.Fprintln(out, "\nFlags:")
+	flag.PrintDefaults()
+	fmt.Fprintln(out, "\nEnvironment, used when the matching flag isn't given:")
+	fmt.Fprintln(out, "  PLOT_SINK_PORT          port to listen on (-p)")
+	fmt.Fprintln(out, "  PLOT_SINK_CONFIG        config file (-c)")
+	fmt.Fprintln(out, "  PLOT_SINK_CONCURRENCY   concurrency of every destination group")
+	fmt.Fprintln(out, "  PLOT_SINK_CACHE         cache paths, separated by colons")
+}
+
+// runCommand executes the subcommand and returns the process exit code.
+func runCommand(args []string) int {
+	if cmd, ok := localCommands[args[0]]; ok {
+		if err := cmd(args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+		usage()
+		return 2
+	}
+
+	c, err := newControlClient()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	if err := cmd(c, args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// controlClient talks to the control interface of a running sink.
+type controlClient struct {
+	base   string
+	token  string
+	client *http.Client
+}
+
+// newControlClient determines the control interface address and token from the
+// flags, falling back to the config file. The unix socket is preferred when one
+// is configured. A socket can also be given to -control as an absolute path.
+func newControlClient() (*controlClient, error) {
+	c := &controlClient{
+		base:   controlAddr,
+		token:  controlToken,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+
+	if c.base == "" || c.token == "" {
+		if cfg, err := sink.LoadConfig(cfgFile); err == nil {
+			if c.base == "" {
+				c.base = cfg.ControlListen
+				if cfg.ControlSocket != "" {
+					c.base = cfg.ControlSocket
+				}
+			}
+			if c.token == "" {
+				c.token = cfg.ControlToken
+			}
+		}
+	}
+	if c.base == "" {
+		return nil, errors.New("no control interface address, set -control or control_listen/control_socket in the config")
+	}
+
+	// connect over the unix socket
+	if socket, ok := strings.CutPrefix(c.base, "unix:"); ok || strings.HasPrefix(c.base, "/") {
+		if !ok {
+			socket = c.base
+		}
+		c.base = "http://unix"
+		c.client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		return c, nil
+	}
+
+	if !strings.Contains(c.base, "://") {
+		c.base = "http://" + c.base
+	}
+	c.base = strings.TrimSuffix(c.base, "/")
+	return c, nil
+}
+
+// get requests the endpoint and decodes the JSON response into v.
+func (c *controlClient) get(path string, v any) error {
+	resp, err := c.client.Get(c.base + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var ar sink.AdminResponse
+		if json.NewDecoder(resp.Body).Decode(&ar) == nil && ar.Error != "" {
+			return errors.New(ar.Error)
+		}
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// post calls an admin endpoint and returns its message.
+func (c *controlClient) post(path string, query url.Values) (string, error) {
+	ar, err := c.postMoves(path, query)
+	if err != nil {
+		return "", err
+	}
+	return ar.Message, nil
+}
+
+// printMoves prints the message and any planned moves of an admin response.
+func (c *controlClient) printMoves(ar *sink.AdminResponse, err error) error {
+	if err != nil {
+		return err
+	}
+	fmt.Println(ar.Message)
+	if len(ar.Moves) == 0 {
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FILENAME\tSIZE\tFROM\tTO")
+	for _, m := range ar.Moves {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", m.Filename, humanize.IBytes(m.Size), m.From, m.To)
+	}
+	return w.Flush()
+}
+
+// postMoves calls an admin endpoint and returns the full response.
+func (c *controlClient) postMoves(path string, query url.Values) (*sink.AdminResponse, error) {
+	req, err := http.NewRequest(http.MethodPost, c.base+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var ar sink.AdminResponse
+	b, _ := io.ReadAll(resp.Body)
+	if err := json.Unmarshal(b, &ar); err != nil {
+		return nil, fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	if ar.Error != "" {
+		return nil, errors.New(ar.Error)
+	}
+	return &ar, nil
+}
+
+func cmdStatus(c *controlClient, args []string) error {
+	var st sink.StatusResponse
+	if err := c.get("/status", &st); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tPATH\tTRANSFERS\tFREE\tTOTAL\tSTATE")
+	for _, gs := range append([]*sink.GroupStatus{st.Cache}, st.Destinations...) {
+		fmt.Fprintf(w, "%s\t\t%d/%d\t%s\t%s\t%s\n", gs.Name, gs.Transfers, gs.Concurrency,
+			humanize.IBytes(gs.FreeSpace), humanize.IBytes(gs.TotalSpace), gs.State())
+		for _, ps := range gs.Paths {
+			fmt.Fprintf(w, "\t%s\t%d\t%s\t%s\t%s\n", ps.Path, ps.Transfers,
+				humanize.IBytes(ps.FreeSpace), humanize.IBytes(ps.TotalSpace), ps.State())
+		}
+	}
+	return w.Flush()
+}
+
+func cmdTransfers(c *controlClient, args []string) error {
+	var st sink.StatusResponse
+	if err := c.get("/status", &st); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tFILENAME\tSOURCE\tPHASE\tPROGRESS\tDESTINATION\tSTARTED")
+	for _, ti := range st.Transfers {
+		done := ti.Received
+		if ti.Phase == sink.PhaseMoving {
+			done = ti.Moved
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s / %s\t%s\t%s\n", ti.ID, ti.Filename, ti.Source, ti.Phase,
+			humanize.IBytes(uint64(done)), humanize.IBytes(ti.Size), ti.Destination, humanize.Time(ti.Started))
+	}
+	return w.Flush()
+}
+
+func cmdFind(c *controlClient, args []string) error {
+	if len(args) != 1 {
+		return errors.New("find requires a plot id or filename")
+	}
+
+	var found []sink.StoredPlot
+	if err := c.get("/plots/lookup?"+url.Values{"plot": {args[0]}}.Encode(), &found); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tPATH\tFILENAME\tSIZE\tSTORED")
+	for _, p := range found {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", p.Group, p.Path, p.Filename, humanize.IBytes(p.Size), humanize.Time(p.Time))
+	}
+	return w.Flush()
+}
+
+// cmdTargetAction returns a command applying the action to a path, when the
+// argument is an absolute path, or otherwise a group.
+func cmdTargetAction(action string) func(c *controlClient, args []string) error {
+	return func(c *controlClient, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("%s requires a path or group name", action)
+		}
+
+		var msg string
+		var err error
+		if strings.HasPrefix(args[0], "/") {
+			msg, err = c.post("/admin/paths/"+action, url.Values{"path": {args[0]}})
+		} else {
+			msg, err = c.post("/admin/groups/"+action, url.Values{"group": {args[0]}})
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Println(msg)
+		return nil
+	}
+}
+
+func cmdDrain(c *controlClient, args []string) error {
+	if len(args) != 1 {
+		return errors.New("drain requires a group name")
+	}
+	msg, err := c.post("/admin/groups/drain", url.Values{"group": {args[0]}})
+	if err != nil {
+		return err
+	}
+	fmt.Println(msg)
+	return nil
+}
+
+func cmdReload(c *controlClient, args []string) error {
+	msg, err := c.post("/admin/reload", nil)
+	if err != nil {
+		return err
+	}
+	fmt.Println(msg)
+	return nil
+}
+
+func cmdCancel(c *controlClient, args []string) error {
+	if len(args) != 1 {
+		return errors.New("cancel requires a transfer id or filename")
+	}
+	query := url.Values{"filename": {args[0]}}
+	if _, err := strconv.ParseUint(args[0], 10, 64); err == nil {
+		query = url.Values{"id": {args[0]}}
+	}
+	msg, err := c.post("/admin/transfers/cancel", query)
+	if err != nil {
+		return err
+	}
+	fmt.Println(msg)
+	return nil
+}
+
+func cmdRebalance(c *controlClient, args []string) error {
+	fs := flag.NewFlagSet("rebalance", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "only show the moves which would be made")
+	group := fs.String("group", "", "only rebalance paths within this group")
+	bwlimit := fs.String("bwlimit", "", "bandwidth limit for moves, such as 100MiB")
+	tolerance := fs.Float64("tolerance", 2, "allowed spread in percent used between paths")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	query := url.Values{
+		"dry_run":   {strconv.FormatBool(*dryRun)},
+		"group":     {*group},
+		"bwlimit":   {*bwlimit},
+		"tolerance": {strconv.FormatFloat(*tolerance, 'f', -1, 64)},
+	}
+	return c.printMoves(c.postMoves("/admin/rebalance", query))
+}
+
+func cmdEvacuate(c *controlClient, args []string) error {
+	fs := flag.NewFlagSet("evacuate", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "only show the moves which would be made")
+	bwlimit := fs.String("bwlimit", "", "bandwidth limit for moves, such as 100MiB")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("evacuate requires a path")
+	}
+
+	query := url.Values{
+		"path":    {fs.Arg(0)},
+		"dry_run": {strconv.FormatBool(*dryRun)},
+		"bwlimit": {*bwlimit},
+	}
+	return c.printMoves(c.postMoves("/admin/paths/evacuate", query))
+}
+
+func cmdImport(c *controlClient, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	bwlimit := fs.String("bwlimit", "", "bandwidth limit for moves, such as 100MiB")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("import requires a directory")
+	}
+
+	// the daemon resolves the directory, so send it as an absolute path
+	dir, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	msg, err := c.post("/admin/import", url.Values{"dir": {dir}, "bwlimit": {*bwlimit}})
+	if err != nil {
+		return err
+	}
+	fmt.Println(msg)
+	return nil
+}
+
+func cmdJob(c *controlClient, args []string) error {
+	if len(args) == 1 && args[0] == "cancel" {
+		msg, err := c.post("/admin/jobs/cancel", nil)
+		if err != nil {
+			return err
+		}
+		fmt.Println(msg)
+		return nil
+	}
+
+	var st sink.StatusResponse
+	if err := c.get("/status", &st); err != nil {
+		return err
+	}
+	if st.Job == nil {
+		fmt.Println("No maintenance job has ran")
+		return nil
+	}
+	j := st.Job
+	state := "running"
+	switch {
+	case j.Finished && j.Canceled:
+		state = "canceled"
+	case j.Finished:
+		state = "finished"
+	}
+	fmt.Printf("%s job %s, started %s: %d of %d moved, %d failed\n",
+		j.Kind, state, humanize.Time(j.Started), j.Completed, j.Total, j.Failed)
+	return nil
+}
@@ -0,0 +1,204 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/krobertson/chia-plot-sink-multi/sink"
+	"golang.org/x/sys/unix"
+)
+
+// progressSample is how far a transfer was in its phase when last rendered,
+// used to compute its live rate.
+type progressSample struct {
+	phase string
+	done  int64
+	time  time.Time
+	rate  float64
+}
+
+// console renders a progress bar for each active transfer below the log
+// output while attended in a terminal. Log lines are written above the bars,
+// which are cleared and redrawn around each one, so the log scrolls as usual.
+// Logging only redraws the last rendered bars, as it may be called with the
+// transfers locked.
+type console struct {
+	sink    *sink.Sink
+	out     *os.File
+	lines   []string
+	drawn   int
+	samples map[uint64]*progressSample
+	mutex   sync.Mutex
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// newConsole returns a console writing to stderr, or nil when stderr isn't a
+// terminal, such as when ran as a service.
+func newConsole() *console {
+	if _, err := unix.IoctlGetWinsize(int(os.Stderr.Fd()), unix.TIOCGWINSZ); err != nil {
+		return nil
+	}
+	c := &console{
+		out:     os.Stderr,
+		samples: make(map[uint64]*progressSample),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	log.SetOutput(c)
+	return c
+}
+
+// Write prints log output above the progress bars.
+func (c *console) Write(p []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.clear()
+	n, err := c.out.Write(p)
+	c.draw()
+	return n, err
+}
+
+// start begins refreshing the progress bars twice a second.
+func (c *console) start(s *sink.Sink) {
+	c.mutex.Lock()
+	c.sink = s
+	c.mutex.Unlock()
+
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(500 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				transfers := s.Transfers()
+				c.mutex.Lock()
+				c.render(transfers)
+				c.clear()
+				c.draw()
+				c.mutex.Unlock()
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+// close stops refreshing, removes the progress bars, and restores the log
+// output.
+func (c *console) close() {
+	if c.sink != nil {
+		close(c.stop)
+		<-c.done
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.clear()
+	log.SetOutput(os.Stderr)
+}
+
+// clear erases the progress bars. This should be called with the mutex
+// locked.
+func (c *console) clear() {
+	if c.drawn > 0 {
+		fmt.Fprintf(c.out, "\x1b[%dF\x1b[J", c.drawn)
+		c.drawn = 0
+	}
+}
+
+// draw prints the rendered progress bars. This should be called with the
+// mutex locked.
+func (c *console) draw() {
+	var sb strings.Builder
+	for _, l := range c.lines {
+		sb.WriteString(l)
+		sb.WriteString("\n")
+	}
+	fmt.Fprint(c.out, sb.String())
+	c.drawn = len(c.lines)
+}
+
+// render builds a line per active transfer and a total, with the rate each
+// transfer has progressed at since the last render. This should be called with
+// the mutex locked.
+func (c *console) render(transfers []sink.TransferInfo) {
+	width := 80
+	if ws, err := unix.IoctlGetWinsize(int(c.out.Fd()), unix.TIOCGWINSZ); err == nil && ws.Col > 0 {
+		width = int(ws.Col)
+	}
+
+	c.lines = c.lines[:0]
+	if len(transfers) == 0 {
+		clear(c.samples)
+		return
+	}
+
+	now := time.Now()
+	active := make(map[uint64]bool, len(transfers))
+	var total float64
+	for _, ti := range transfers {
+		active[ti.ID] = true
+		done := ti.Received
+		if ti.Phase != sink.PhaseReceiving {
+			done = ti.Moved
+		}
+
+		ps := c.samples[ti.ID]
+		if ps == nil || ps.phase != ti.Phase {
+			ps = &progressSample{phase: ti.Phase, done: done, time: now}
+			c.samples[ti.ID] = ps
+		} else {
+			if secs := now.Sub(ps.time).Seconds(); secs > 0 {
+				ps.rate = float64(done-ps.done) / secs
+			}
+			ps.done, ps.time = done, now
+		}
+		total += ps.rate
+
+		name := ti.Filename
+		if name == "" {
+			name = ti.Source
+		}
+		if len(name) > 40 {
+			name = "…" + name[len(name)-39:]
+		}
+		status := fmt.Sprintf("%10s/s %s", humanize.IBytes(uint64(ps.rate)), progressETA(ti.Size, done, ps.rate))
+		if ti.Phase == sink.PhaseWaiting {
+			status = "waiting for the move window"
+		}
+		barWidth := width - 40 - 11 - 30
+		if barWidth < 10 {
+			barWidth = 10
+		}
+		c.lines = append(c.lines, truncateANSI(fmt.Sprintf("%-40s %-9s %s %s",
+			name, ti.Phase, fillBar(uint64(done), ti.Size, barWidth), status), width-1))
+	}
+	for id := range c.samples {
+		if !active[id] {
+			delete(c.samples, id)
+		}
+	}
+	noun := "transfers"
+	if len(transfers) == 1 {
+		noun = "transfer"
+	}
+	c.lines = append(c.lines, fmt.Sprintf("\x1b[1m%d %s, %s/s\x1b[0m", len(transfers), noun, humanize.IBytes(uint64(total))))
+}
+
+// progressETA estimates the time left at the rate.
+func progressETA(size uint64, done int64, rate float64) string {
+	if rate <= 0 || int64(size) <= done {
+		return ""
+	}
+	left := time.Duration(float64(int64(size)-done) / rate * float64(time.Second))
+	return "ETA " + left.Round(time.Second).String()
+}
@@ -0,0 +1,33 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+// startDebug starts an HTTP listener exposing the net/http/pprof handlers for
+// profiling a live sink. It is only enabled when an address is given, since
+// profiles can expose internal details and add overhead.
+func startDebug(addr string) {
+	// enable the block and mutex profiles so lock contention shows up
+	runtime.SetBlockProfileRate(int(1e6))
+	runtime.SetMutexProfileFraction(100)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	go func() {
+		log.Printf("Debug listener on %s...", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Debug listener stopped: %v", err)
+		}
+	}()
+}
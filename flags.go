@@ -0,0 +1,84 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/krobertson/chia-plot-sink-multi/sink"
+)
+
+// arrayFlags can be used with flags.Var to specify the a command line argument
+// multiple timmes.
+type arrayFlags []string
+
+// String returns a basic string concationation of all values.
+func (i *arrayFlags) String() string {
+	return strings.Join(*i, ", ")
+}
+
+// Set is used to append a new value to the array by flags.Var.
+func (i *arrayFlags) Set(value string) error {
+	*i = append(*i, value)
+	return nil
+}
+
+// flagSet returns true if the named flag was explicitly given on the command
+// line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// applyEnvFlags fills in command line flags which weren't given from the
+// environment, so the sink can be configured entirely through environment
+// variables in containers and templated service units.
+func applyEnvFlags() error {
+	if v := os.Getenv("PLOT_SINK_PORT"); v != "" && !flagSet("p") {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid PLOT_SINK_PORT %q", v)
+		}
+		port = n
+	}
+	if v := os.Getenv("PLOT_SINK_CONFIG"); v != "" && !flagSet("c") {
+		cfgFile = v
+	}
+	if v := os.Getenv("PLOT_SINK_CONCURRENCY"); v != "" && !flagSet("concurrency") {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid PLOT_SINK_CONCURRENCY %q", v)
+		}
+		concurrency = n
+	}
+	if v := os.Getenv("PLOT_SINK_CACHE"); v != "" && !flagSet("cache") {
+		cacheDirs = filepath.SplitList(v)
+	}
+	return nil
+}
+
+// overrideListen applies the listen flags to the config. The -listen flag
+// replaces the config's listen setting, and the -p flag replaces just its port.
+func overrideListen(cfg *sink.Config) {
+	if listenAddr != "" {
+		cfg.Listen = listenAddr
+	}
+	if port != 0 {
+		host, _, err := net.SplitHostPort(cfg.Listen)
+		if err != nil {
+			host = ""
+		}
+		cfg.Listen = net.JoinHostPort(host, strconv.Itoa(port))
+	}
+}
@@ -3,8 +3,9 @@ module github.com/krobertson/chia-plot-sink-multi
 go 1.21.7
 
 require (
-	github.com/brk0v/directio v0.0.0-20190225130936-69406e757cf7 // indirect
-	github.com/dustin/go-humanize v1.0.1 // indirect
-	golang.org/x/sys v0.18.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	github.com/BurntSushi/toml v1.3.2
+	github.com/brk0v/directio v0.0.0-20190225130936-69406e757cf7
+	github.com/dustin/go-humanize v1.0.1
+	golang.org/x/sys v0.18.0
+	gopkg.in/yaml.v3 v3.0.1
 )
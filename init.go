@@ -0,0 +1,44 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/krobertson/chia-plot-sink-multi/sink"
+)
+
+// cmdInit scans the mounted filesystems and writes a starter config, with
+// solid state disks proposed as the cache and spinning disks as destinations.
+func cmdInit(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	output := fs.String("o", cfgFile, "file to write the config to")
+	force := fs.Bool("force", false, "overwrite the file if it exists")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(*output); err == nil && !*force {
+		return fmt.Errorf("%s already exists, use -force to overwrite it", *output)
+	}
+
+	cfg, cache, dests, err := sink.StarterConfig()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*output, []byte(cfg), 0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("Wrote %s with %d cache and %d destination paths\n", *output, cache, dests)
+	if cache == 0 {
+		fmt.Println("No solid state disks were found for the cache, set one before starting the sink")
+	}
+	if dests == 0 {
+		fmt.Println("No disks were found for destinations, add them before starting the sink")
+	}
+	fmt.Printf("Review the file, then validate it with: %s -c %s -check\n", os.Args[0], *output)
+	return nil
+}
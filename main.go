@@ -7,57 +7,161 @@ import (
 	"os/signal"
 	"syscall"
 
-	"gopkg.in/yaml.v3"
+	"github.com/krobertson/chia-plot-sink-multi/sink"
 )
 
 var (
-	port    int
-	cfgFile string
+	port       int
+	listenAddr string
+	cfgFile    string
+	debugAddr  string
+	tuiMode    bool
+	checkMode  bool
+	progress   bool
+
+	controlAddr  string
+	controlToken string
+
+	destDirs    arrayFlags
+	cacheDirs   arrayFlags
+	concurrency int64
 )
 
 func main() {
-	flag.IntVar(&port, "p", 1337, "port to listen on")
+	flag.IntVar(&port, "p", 0, "port to listen on, overriding the port of listen from the config (default 1337)")
+	flag.StringVar(&listenAddr, "listen", "", "address to listen on, overriding listen from the config")
 	flag.StringVar(&cfgFile, "c", "config.yaml", "config file for locations")
+	flag.StringVar(&debugAddr, "pprof", "", "address to expose pprof debug endpoints on (disabled by default)")
+	flag.BoolVar(&checkMode, "check", false, "validate the config file, print a report, and exit")
+	flag.BoolVar(&tuiMode, "tui", false, "render a live dashboard to the terminal")
+	flag.BoolVar(&progress, "progress", true, "render transfer progress bars below the log when attached to a terminal")
+	flag.StringVar(&controlAddr, "control", "", "control interface address for subcommands (defaults to control_listen from the config)")
+	flag.StringVar(&controlToken, "token", "", "control token for subcommands (defaults to control_token from the config)")
+	flag.Var(&destDirs, "d", "destination directory, can be repeated (used instead of a config file)")
+	flag.Var(&cacheDirs, "cache", "cache directory for receiving plots, can be repeated (used with -d)")
+	flag.Int64Var(&concurrency, "concurrency", 0, "concurrent transfers when using -d (defaults to the number of directories)")
+	flag.Usage = usage
 	flag.Parse()
 
-	// read config file
-	b, err := os.ReadFile(cfgFile)
-	if err != nil {
-		log.Fatal("Failed to read config file", err)
+	// environment variables fill in for any flags not given
+	if err := applyEnvFlags(); err != nil {
+		log.Fatal("Invalid environment: ", err)
 	}
-	var cfg *config
-	err = yaml.Unmarshal(b, &cfg)
-	if err != nil {
-		log.Fatal("Failed to parse configuration", err)
+
+	// run a control subcommand against a running sink
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+
+	// validate the config and exit
+	if checkMode {
+		if sink.CheckConfig(cfgFile, os.Stdout) > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if debugAddr != "" {
+		startDebug(debugAddr)
+	}
+
+	// read config file, or build one from the flags when directories are
+	// given on the command line
+	var cfg *sink.Config
+	var err error
+	if len(destDirs) > 0 {
+		if flagSet("c") || os.Getenv("PLOT_SINK_CONFIG") != "" {
+			log.Fatal("The -d flag can't be combined with a config file")
+		}
+		cfgFile = ""
+		cfg, err = sink.FlagConfig(destDirs, cacheDirs, concurrency)
+		if err != nil {
+			log.Fatal("Invalid command line flags: ", err)
+		}
+	} else {
+		cfg, err = sink.LoadConfig(cfgFile)
+		if err != nil {
+			log.Fatal("Failed to load config file", err)
+		}
+	}
+
+	overrideListen(cfg)
+
+	if err := sink.ApplyCPU(cfg.CPU); err != nil {
+		log.Fatal("Failed to apply cpu settings: ", err)
+	}
+
+	// capture logs early so startup messages show up in the dashboard
+	var ui *tui
+	var con *console
+	if tuiMode {
+		ui = newTUI()
+	} else if progress {
+		con = newConsole()
 	}
 
 	// intialize server
-	s, err := newSink(cfg)
+	s, err := sink.New(cfg)
 	if err != nil {
+		if ui != nil {
+			ui.close()
+		}
 		log.Fatal("Failed to initialize sink", err)
 	}
 
+	// now that everything is bound, stop running as root before starting
+	if cfg.RunAs != nil {
+		owned := []string{cfg.ControlSocket}
+		if cfg.AuditLog != nil {
+			owned = append(owned, cfg.AuditLog.Path)
+		}
+		replaced := []string{cfg.StateFile}
+		if cfg.PlotDirectories != nil {
+			replaced = append(replaced, cfg.PlotDirectories.Path)
+		}
+		if err := sink.DropPrivileges(cfg.RunAs, owned, replaced); err != nil {
+			log.Fatal("Failed to drop privileges: ", err)
+		}
+	}
+	s.Start()
+	if ui != nil {
+		ui.start(s)
+	}
+	if con != nil {
+		con.start(s)
+	}
+
+	// add signal handler for reloading the config
+	go func() {
+		sighup := make(chan os.Signal, 1)
+		signal.Notify(sighup, syscall.SIGHUP)
+		for range sighup {
+			if _, err := s.Reload(cfgFile); err != nil {
+				log.Printf("Failed to reload configuration, keeping current: %v", err)
+			}
+		}
+	}()
+
 	// add signal handler for shutdown
 	go func() {
 		sigint := make(chan os.Signal, 1)
 		signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
 		<-sigint
 
-		// close the listener
-		s.listener.Close()
+		// close the listener to stop accepting new transfers
+		log.Print("Shutting down, no longer accepting transfers")
+		s.Close()
 	}()
 
-	// loop for connections
-	log.Print("Ready")
-	for {
-		conn, err := s.listener.Accept()
-		if err != nil {
-			log.Print("Failed to accept connection", conn)
-			break
-		}
-		go s.handleConnection(conn)
-	}
+	s.Serve()
 
 	// wait for existing transfers to finish
-	s.wg.Wait()
+	s.Shutdown(cfg.ShutdownTimeout)
+
+	if ui != nil {
+		ui.close()
+	}
+	if con != nil {
+		con.close()
+	}
 }
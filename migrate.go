@@ -0,0 +1,215 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/krobertson/chia-plot-sink-multi/protocol"
+	"github.com/krobertson/chia-plot-sink-multi/sink"
+)
+
+// migrateAttempts is how many times a plot is sent before the migration gives
+// up on it, as a busy sink refuses plots until a path frees up.
+const migrateAttempts = 3
+
+// migrateJournal records the plots a migration has sent, one absolute path per
+// line, so an interrupted migration resumes where it left off.
+type migrateJournal struct {
+	sent  map[string]bool
+	file  *os.File
+	mutex sync.Mutex
+}
+
+// openMigrateJournal reads the plots already sent from the journal, creating
+// it if it doesn't exist.
+func openMigrateJournal(path string) (*migrateJournal, error) {
+	j := &migrateJournal{sent: make(map[string]bool)}
+
+	f, err := os.Open(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				j.sent[line] = true
+			}
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	j.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// record adds the plot to the journal once it has been sent.
+func (j *migrateJournal) record(path string) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.sent[path] = true
+	_, err := fmt.Fprintln(j.file, path)
+	return err
+}
+
+// cmdMigrate sends the plots in local directories to another sink over the
+// sink protocol, such as to consolidate farms or move one to another machine.
+// Plots already sent are skipped when it is ran again.
+func cmdMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	parallel := fs.Int("parallel", 2, "plots to send at once")
+	journal := fs.String("journal", "migrate.journal", "file recording the plots sent, to resume an interrupted migration")
+	bwlimit := fs.String("bwlimit", "", "combined bandwidth limit, such as 100MiB")
+	remove := fs.Bool("remove", false, "remove each plot once it has been sent")
+	retry := fs.Duration("retry", 30*time.Second, "wait before resending a plot the sink refused")
+	priority := fs.String("priority", "", "priority of the plots, high or bulk, rather than the sink's default for this host")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 2 {
+		return errors.New("migrate requires the address of a sink, or a name publishing sinks, and at least one directory")
+	}
+	if *parallel < 1 {
+		return errors.New("parallel must be at least 1")
+	}
+
+	addr := fs.Arg(0)
+	store, err := sink.NewSinkStore(addr)
+	if err != nil {
+		return err
+	}
+	p, err := protocol.ParsePriority(*priority)
+	if err != nil {
+		return err
+	}
+	store.SetPriority(p)
+	limiter, err := sink.ParseBandwidthLimit(*bwlimit)
+	if err != nil {
+		return err
+	}
+	j, err := openMigrateJournal(*journal)
+	if err != nil {
+		return fmt.Errorf("failed to open journal: %v", err)
+	}
+	defer j.file.Close()
+
+	// gather the plots not yet sent
+	var pending []string
+	var total uint64
+	skipped := 0
+	for _, dir := range fs.Args()[1:] {
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		plots, err := sink.ListPlots(dir)
+		if err != nil {
+			return err
+		}
+		for _, p := range plots {
+			path := filepath.Join(dir, p.Name)
+			if j.sent[path] {
+				skipped++
+				continue
+			}
+			pending = append(pending, path)
+			total += p.Size
+		}
+	}
+	fmt.Printf("Migrating %d plots (%s) to %s, %d already sent\n", len(pending), humanize.IBytes(total), addr, skipped)
+
+	work := make(chan string)
+	var sent, failed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < *parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range work {
+				if err := migratePlot(store, path, limiter, *retry); err != nil {
+					fmt.Printf("Failed to send %s: %v\n", path, err)
+					failed.Add(1)
+					continue
+				}
+				if err := j.record(path); err != nil {
+					fmt.Printf("Failed to record %s in the journal: %v\n", path, err)
+				}
+				if *remove {
+					if err := os.Remove(path); err != nil {
+						fmt.Printf("Failed to remove %s: %v\n", path, err)
+					}
+				}
+				sent.Add(1)
+			}
+		}()
+	}
+	for _, path := range pending {
+		work <- path
+	}
+	close(work)
+	wg.Wait()
+
+	fmt.Printf("Sent %d plots, %d failed\n", sent.Load(), failed.Load())
+	if failed.Load() > 0 {
+		return errors.New("some plots weren't sent, run the migration again to retry them")
+	}
+	return nil
+}
+
+// migratePlot sends a single plot, retrying when the sink refuses it or the
+// send fails.
+func migratePlot(store *sink.SinkStore, path string, limiter *sink.RateLimiter, retry time.Duration) error {
+	var err error
+	for attempt := 1; attempt <= migrateAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(retry)
+		}
+
+		var f *os.File
+		f, err = os.Open(path)
+		if err != nil {
+			return err
+		}
+		var fi os.FileInfo
+		if fi, err = f.Stat(); err != nil {
+			f.Close()
+			return err
+		}
+
+		var r io.Reader = f
+		if limiter != nil {
+			r = limiter.Reader(f)
+		}
+
+		start := time.Now()
+		err = store.Upload(context.Background(), filepath.Base(path), uint64(fi.Size()), r)
+		f.Close()
+		if err == nil {
+			elapsed := time.Since(start)
+			fmt.Printf("Sent %s (%s) in %s, %s/s\n", filepath.Base(path), humanize.IBytes(uint64(fi.Size())),
+				elapsed.Round(time.Second), humanize.IBytes(uint64(float64(fi.Size())/elapsed.Seconds())))
+			return nil
+		}
+	}
+	return err
+}
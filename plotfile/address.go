@@ -0,0 +1,109 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package plotfile
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// bech32Charset is the alphabet of bech32 encoded addresses.
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// bech32mConst is xored into the checksum of bech32m, which Chia addresses
+// use, in place of the original bech32's 1.
+const bech32mConst = 0x2bc830a3
+
+// DecodeAddress decodes a bech32m xch address, such as a pool contract's, into
+// its puzzle hash.
+func DecodeAddress(addr string) ([]byte, error) {
+	addr = strings.ToLower(addr)
+	sep := strings.LastIndexByte(addr, '1')
+	if sep < 1 || len(addr)-sep < 7 {
+		return nil, errors.New("invalid address")
+	}
+
+	hrp := addr[:sep]
+	data := make([]byte, 0, len(addr)-sep-1)
+	for _, c := range addr[sep+1:] {
+		i := strings.IndexRune(bech32Charset, c)
+		if i < 0 {
+			return nil, fmt.Errorf("invalid address character %q", c)
+		}
+		data = append(data, byte(i))
+	}
+	if bech32Polymod(append(bech32ExpandHRP(hrp), data...)) != bech32mConst {
+		return nil, errors.New("invalid address checksum")
+	}
+	return convertBits(data[:len(data)-6], 5, 8, false)
+}
+
+// EncodeAddress encodes a puzzle hash as an xch address.
+func EncodeAddress(hash []byte) string {
+	data, _ := convertBits(hash, 8, 5, true)
+	values := append(bech32ExpandHRP("xch"), data...)
+	polymod := bech32Polymod(append(values, 0, 0, 0, 0, 0, 0)) ^ bech32mConst
+
+	var sb strings.Builder
+	sb.WriteString("xch1")
+	for _, b := range data {
+		sb.WriteByte(bech32Charset[b])
+	}
+	for i := 0; i < 6; i++ {
+		sb.WriteByte(bech32Charset[(polymod>>uint(5*(5-i)))&31])
+	}
+	return sb.String()
+}
+
+// bech32Polymod computes the bech32 checksum of the values.
+func bech32Polymod(values []byte) uint32 {
+	gen := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>uint(i))&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+// bech32ExpandHRP expands the human readable part for the checksum.
+func bech32ExpandHRP(hrp string) []byte {
+	out := make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		out = append(out, hrp[i]>>5)
+	}
+	out = append(out, 0)
+	for i := 0; i < len(hrp); i++ {
+		out = append(out, hrp[i]&31)
+	}
+	return out
+}
+
+// convertBits regroups the data from groups of from bits to groups of to bits.
+func convertBits(data []byte, from, to uint, pad bool) ([]byte, error) {
+	acc, bits := uint32(0), uint(0)
+	maxv := uint32(1)<<to - 1
+	out := make([]byte, 0, len(data)*int(from)/int(to)+1)
+	for _, v := range data {
+		acc = acc<<from | uint32(v)
+		bits += from
+		for bits >= to {
+			bits -= to
+			out = append(out, byte(acc>>bits&maxv))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			out = append(out, byte(acc<<(to-bits)&maxv))
+		}
+	} else if bits >= from || acc<<(to-bits)&maxv != 0 {
+		return nil, errors.New("invalid address padding")
+	}
+	return out, nil
+}
@@ -0,0 +1,240 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+// Package plotfile reads what identifies a Chia plot from its header and
+// filename, without reading the rest of the plot.
+package plotfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// magicV1 starts the header of plots in the original format.
+	magicV1 = "Proof of Space Plot"
+
+	// magicV2 starts the header of plots in the v2 format, which adds
+	// compression.
+	magicV2 = "PLOT"
+
+	// compressedFlag is set in the flags of compressed v2 plots.
+	compressedFlag = 1
+
+	// MinK and MaxK are the range of k sizes a valid plot can have.
+	MinK = 18
+	MaxK = 50
+)
+
+// Sizes of the keys in a plot's memo.
+const (
+	PublicKeySize  = 48
+	PuzzleHashSize = 32
+	MasterKeySize  = 32
+)
+
+// ErrNotPlot is returned when data doesn't start with a plot header.
+var ErrNotPlot = errors.New("not a plot file, the header is missing")
+
+// VersionError is returned by ReadHeader for plots in a format version it
+// doesn't know, such as one newer than this package. Only the magic and
+// version have been read, so the rest of the header is unknown.
+type VersionError struct {
+	Version int
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("unsupported plot format version %d", e.Version)
+}
+
+// Header is the part of a plot's header identifying the plot, who can farm
+// it, and how it is compressed. Plots in the v2 format, such as from Bladebit,
+// record their compression level in the header.
+type Header struct {
+	Version     int
+	ID          []byte
+	K           int
+	Compression int
+
+	// the memo holds either a pool public key, for plots farmed solo or
+	// with an OG pool, or the puzzle hash of a pool contract
+	PoolKey      []byte
+	PoolContract []byte
+	FarmerKey    []byte
+}
+
+// ReadHeader parses the plot header at the start of r, reading only as
+// much as the header takes.
+func ReadHeader(r io.Reader) (*Header, error) {
+	magic := make([]byte, len(magicV1))
+	if _, err := io.ReadFull(r, magic[:len(magicV2)]); err != nil {
+		return nil, err
+	}
+
+	h := &Header{Version: 1}
+	if string(magic[:len(magicV2)]) == magicV2 {
+		var version uint32
+		if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+			return nil, err
+		}
+		h.Version = int(version)
+	} else {
+		if _, err := io.ReadFull(r, magic[len(magicV2):]); err != nil {
+			return nil, err
+		}
+		if string(magic) != magicV1 {
+			return nil, ErrNotPlot
+		}
+	}
+
+	if h.Version != 1 && h.Version != 2 {
+		return nil, &VersionError{Version: h.Version}
+	}
+
+	var fixed [33]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return nil, err
+	}
+	h.ID = bytes.Clone(fixed[:32])
+	h.K = int(fixed[32])
+	if h.K < MinK || h.K > MaxK {
+		return nil, fmt.Errorf("invalid plot k size %d", h.K)
+	}
+
+	// v1 plots describe their format before the memo
+	if h.Version == 1 {
+		if _, err := readSized(r); err != nil {
+			return nil, err
+		}
+	}
+	memo, err := readSized(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.parseMemo(memo); err != nil {
+		return nil, err
+	}
+
+	if h.Version >= 2 {
+		var flags uint32
+		if err := binary.Read(r, binary.LittleEndian, &flags); err != nil {
+			return nil, err
+		}
+		if flags&compressedFlag != 0 {
+			var level [1]byte
+			if _, err := io.ReadFull(r, level[:]); err != nil {
+				return nil, err
+			}
+			h.Compression = int(level[0])
+		}
+	}
+	return h, nil
+}
+
+// readSized reads a field prefixed with its big endian uint16 length.
+func readSized(r io.Reader) ([]byte, error) {
+	var n uint16
+	if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+		return nil, err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// parseMemo splits the memo into its keys, which is either a pool public key
+// or pool contract puzzle hash, followed by the farmer public key and the
+// local master secret key.
+func (h *Header) parseMemo(memo []byte) error {
+	switch len(memo) {
+	case PublicKeySize + PublicKeySize + MasterKeySize:
+		h.PoolKey = memo[:PublicKeySize]
+	case PuzzleHashSize + PublicKeySize + MasterKeySize:
+		h.PoolContract = memo[:PuzzleHashSize]
+	default:
+		return fmt.Errorf("unexpected plot memo length %d", len(memo))
+	}
+	rest := memo[len(memo)-PublicKeySize-MasterKeySize:]
+	h.FarmerKey = rest[:PublicKeySize]
+	return nil
+}
+
+// PlotID returns the plot's id as hex.
+func (h *Header) PlotID() string {
+	return hex.EncodeToString(h.ID)
+}
+
+// ReadFileHeader parses the header of a stored plot.
+func ReadFileHeader(path string) (*Header, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadHeader(f)
+}
+
+// Compression returns the plot's compression level, zero when it isn't
+// compressed. Compressed plots in the v1 format, such as from Gigahorse, only
+// record it in their filename, as in plot-k32-c07-....plot.
+func Compression(h *Header, filename string) int {
+	if h != nil && h.Compression > 0 {
+		return h.Compression
+	}
+	parts := strings.Split(filename, "-")
+	if len(parts) < 3 || parts[0] != "plot" || !strings.HasPrefix(parts[2], "c") {
+		return 0
+	}
+	level, err := strconv.Atoi(parts[2][1:])
+	if err != nil || level < 0 {
+		return 0
+	}
+	return level
+}
+
+// Created returns when the plot was created from its filename, as in
+// plot-k32-2024-01-31-18-05-<id>.plot, where plotters use their local time. It
+// returns false for filenames without a timestamp.
+func Created(filename string) (time.Time, bool) {
+	parts := strings.Split(strings.TrimSuffix(filename, ".plot"), "-")
+	if len(parts) < 8 || parts[0] != "plot" {
+		return time.Time{}, false
+	}
+	// skip past the k size and any compression level
+	date := parts[2:]
+	if strings.HasPrefix(date[0], "c") {
+		date = date[1:]
+	}
+	if len(date) < 6 {
+		return time.Time{}, false
+	}
+
+	created, err := time.ParseInLocation("2006-01-02-15-04", strings.Join(date[:5], "-"), time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return created, true
+}
+
+// IDFromFilename returns the plot id at the end of a standard plot filename,
+// as in plot-k32-2024-01-01-00-00-<id>.plot, or an empty string.
+func IDFromFilename(filename string) string {
+	name := strings.TrimSuffix(filename, ".plot")
+	id := name[strings.LastIndex(name, "-")+1:]
+	if len(id) != 64 {
+		return ""
+	}
+	if _, err := hex.DecodeString(id); err != nil {
+		return ""
+	}
+	return strings.ToLower(id)
+}
@@ -0,0 +1,155 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package plotfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// buildHeader returns the header of a k32 plot in the format version, with a
+// memo for the pool key or contract.
+func buildHeader(version int, poolSize int, compression int) []byte {
+	var b bytes.Buffer
+	if version == 1 {
+		b.WriteString(magicV1)
+	} else {
+		b.WriteString(magicV2)
+		binary.Write(&b, binary.LittleEndian, uint32(version))
+	}
+	b.Write(bytes.Repeat([]byte{0xab}, 32))
+	b.WriteByte(32)
+	if version == 1 {
+		binary.Write(&b, binary.BigEndian, uint16(4))
+		b.WriteString("v1.0")
+	}
+
+	memo := append(bytes.Repeat([]byte{1}, poolSize), bytes.Repeat([]byte{2}, PublicKeySize)...)
+	memo = append(memo, bytes.Repeat([]byte{3}, MasterKeySize)...)
+	binary.Write(&b, binary.BigEndian, uint16(len(memo)))
+	b.Write(memo)
+
+	if version == 2 {
+		if compression > 0 {
+			binary.Write(&b, binary.LittleEndian, uint32(compressedFlag))
+			b.WriteByte(byte(compression))
+		} else {
+			binary.Write(&b, binary.LittleEndian, uint32(0))
+		}
+	}
+	return b.Bytes()
+}
+
+func TestReadHeader(t *testing.T) {
+	tests := []struct {
+		name        string
+		version     int
+		poolSize    int
+		compression int
+	}{
+		{"v1 pool key", 1, PublicKeySize, 0},
+		{"v1 pool contract", 1, PuzzleHashSize, 0},
+		{"v2 uncompressed", 2, PuzzleHashSize, 0},
+		{"v2 compressed", 2, PuzzleHashSize, 7},
+	}
+	for _, tt := range tests {
+		data := buildHeader(tt.version, tt.poolSize, tt.compression)
+
+		// one byte at a time, as the header arrives over the network
+		h, err := ReadHeader(iotest.OneByteReader(bytes.NewReader(data)))
+		if err != nil {
+			t.Fatalf("%s: ReadHeader: %v", tt.name, err)
+		}
+		if h.Version != tt.version || h.K != 32 || h.Compression != tt.compression {
+			t.Errorf("%s: got version %d, k %d, compression %d", tt.name, h.Version, h.K, h.Compression)
+		}
+		if h.PlotID() != strings.Repeat("ab", 32) {
+			t.Errorf("%s: PlotID = %s", tt.name, h.PlotID())
+		}
+		if !bytes.Equal(h.FarmerKey, bytes.Repeat([]byte{2}, PublicKeySize)) {
+			t.Errorf("%s: FarmerKey = %x", tt.name, h.FarmerKey)
+		}
+		if (tt.poolSize == PublicKeySize) != (h.PoolKey != nil) || (tt.poolSize == PuzzleHashSize) != (h.PoolContract != nil) {
+			t.Errorf("%s: PoolKey = %x, PoolContract = %x", tt.name, h.PoolKey, h.PoolContract)
+		}
+	}
+}
+
+func TestReadHeaderInvalid(t *testing.T) {
+	if _, err := ReadHeader(strings.NewReader("not a plot at all, just some bytes")); !errors.Is(err, ErrNotPlot) {
+		t.Errorf("ReadHeader of other data error = %v, want ErrNotPlot", err)
+	}
+
+	badK := buildHeader(1, PublicKeySize, 0)
+	badK[len(magicV1)+32] = 99
+	if _, err := ReadHeader(bytes.NewReader(badK)); err == nil {
+		t.Error("ReadHeader accepted k99")
+	}
+
+	badVersion := buildHeader(2, PuzzleHashSize, 0)
+	badVersion[len(magicV2)] = 9
+	var versionErr *VersionError
+	if _, err := ReadHeader(bytes.NewReader(badVersion)); !errors.As(err, &versionErr) || versionErr.Version != 9 {
+		t.Errorf("ReadHeader of format version 9 error = %v, want a VersionError", err)
+	}
+
+	short := buildHeader(1, PublicKeySize, 0)
+	if _, err := ReadHeader(bytes.NewReader(short[:len(short)-10])); err == nil {
+		t.Error("ReadHeader accepted a truncated header")
+	}
+}
+
+func TestFilenames(t *testing.T) {
+	id := strings.Repeat("0f", 32)
+	name := "plot-k32-c07-2024-01-31-18-05-" + id + ".plot"
+
+	if got := IDFromFilename(name); got != id {
+		t.Errorf("IDFromFilename = %q, want %q", got, id)
+	}
+	if got := IDFromFilename("something.plot"); got != "" {
+		t.Errorf("IDFromFilename of a non-standard name = %q", got)
+	}
+
+	if got := Compression(nil, name); got != 7 {
+		t.Errorf("Compression = %d, want 7", got)
+	}
+	if got := Compression(&Header{Compression: 3}, name); got != 3 {
+		t.Errorf("Compression with a header = %d, want 3", got)
+	}
+
+	created, ok := Created(name)
+	want := time.Date(2024, 1, 31, 18, 5, 0, 0, time.Local)
+	if !ok || !created.Equal(want) {
+		t.Errorf("Created = %v, %v, want %v", created, ok, want)
+	}
+	if _, ok := Created("something.plot"); ok {
+		t.Error("Created parsed a non-standard name")
+	}
+}
+
+func TestAddressRoundTrip(t *testing.T) {
+	hash := bytes.Repeat([]byte{0x5a}, PuzzleHashSize)
+	addr := EncodeAddress(hash)
+	if !strings.HasPrefix(addr, "xch1") {
+		t.Fatalf("EncodeAddress = %s", addr)
+	}
+	got, err := DecodeAddress(addr)
+	if err != nil {
+		t.Fatalf("DecodeAddress: %v", err)
+	}
+	if !bytes.Equal(got, hash) {
+		t.Errorf("DecodeAddress = %x, want %x", got, hash)
+	}
+
+	// a changed character breaks the checksum
+	bad := []byte(addr)
+	bad[10] = map[bool]byte{true: 'q', false: 'p'}[bad[10] != 'q']
+	if _, err := DecodeAddress(string(bad)); err == nil {
+		t.Error("DecodeAddress accepted a bad checksum")
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package protocol
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SRVService and SRVProto name the DNS SRV records sinks are published in, as
+// in _chia-plot-sink._tcp.example.com.
+const (
+	SRVService = "chia-plot-sink"
+	SRVProto   = "tcp"
+)
+
+// lookupSRV resolves SRV records, and is replaced in tests.
+var lookupSRV = net.LookupSRV
+
+// LookupSinks resolves the sinks published in DNS SRV records for name,
+// returning their addresses in the order to try them. The name is either the
+// full record name, starting with an underscore, or the domain the sink
+// service's records are under. Sinks are ordered by priority, and within a
+// priority shuffled by weight on every lookup, so senders spread plots across
+// sinks in proportion to their weights and only fail over to sinks of a lower
+// priority when none of the higher take the plot.
+func LookupSinks(name string) ([]string, error) {
+	service, proto := SRVService, SRVProto
+	if strings.HasPrefix(name, "_") {
+		service, proto = "", ""
+	}
+	_, records, err := lookupSRV(service, proto, name)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, 0, len(records))
+	for _, r := range records {
+		// a target of "." publishes that there is no service
+		target := strings.TrimSuffix(r.Target, ".")
+		if target == "" {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(target, strconv.Itoa(int(r.Port))))
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no sinks are published for %s", name)
+	}
+	return addrs, nil
+}
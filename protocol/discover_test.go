@@ -0,0 +1,67 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package protocol
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"testing"
+)
+
+// stubSRV replaces the resolver for the test, recording the names looked up.
+func stubSRV(t *testing.T, records []*net.SRV, err error) *[]string {
+	looked := new([]string)
+	orig := lookupSRV
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		*looked = append(*looked, service, proto, name)
+		return "", records, err
+	}
+	t.Cleanup(func() { lookupSRV = orig })
+	return looked
+}
+
+func TestLookupSinks(t *testing.T) {
+	looked := stubSRV(t, []*net.SRV{
+		{Target: "sink1.example.com.", Port: 1337, Priority: 10, Weight: 60},
+		{Target: "sink2.example.com.", Port: 1338, Priority: 10, Weight: 40},
+		{Target: "backup.example.com", Port: 1337, Priority: 20},
+	}, nil)
+
+	addrs, err := LookupSinks("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the resolver's order by priority and weight is kept
+	want := []string{"sink1.example.com:1337", "sink2.example.com:1338", "backup.example.com:1337"}
+	if !slices.Equal(addrs, want) {
+		t.Errorf("LookupSinks = %v, want %v", addrs, want)
+	}
+	if got := []string{SRVService, SRVProto, "example.com"}; !slices.Equal(*looked, got) {
+		t.Errorf("looked up %v, want %v", *looked, got)
+	}
+}
+
+func TestLookupSinksRecordName(t *testing.T) {
+	looked := stubSRV(t, []*net.SRV{{Target: "sink1.example.com.", Port: 1337}}, nil)
+	if _, err := LookupSinks("_plots._tcp.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if got := []string{"", "", "_plots._tcp.example.com"}; !slices.Equal(*looked, got) {
+		t.Errorf("looked up %v, want %v", *looked, got)
+	}
+}
+
+func TestLookupSinksNone(t *testing.T) {
+	// a target of "." publishes that there is no service
+	stubSRV(t, []*net.SRV{{Target: ".", Port: 0}}, nil)
+	if _, err := LookupSinks("example.com"); err == nil {
+		t.Error("LookupSinks with no service published succeeded")
+	}
+
+	dnsErr := &net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}
+	stubSRV(t, nil, dnsErr)
+	if _, err := LookupSinks("example.com"); !errors.Is(err, dnsErr) {
+		t.Errorf("LookupSinks error = %v, want %v", err, dnsErr)
+	}
+}
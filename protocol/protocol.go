@@ -0,0 +1,314 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+// Package protocol implements the framing used between a plot sender and the
+// sink.
+//
+// A transfer starts with the sender writing the plot's size as a little endian
+// uint64. Its top byte optionally carries the transfer's Priority, as plot
+// sizes never reach it, so senders which don't know of priorities send the
+// default without any change. The sink replies with a single Ack byte if it
+// can take the plot, or closes the connection if it can't. A sink without room
+// may instead reply with a Redirect byte and the address of another sink to
+// try, framed like a filename, before closing the connection. The sender then
+// writes the filename's length as a little endian uint16, the filename, and
+// the plot's contents, and closes its side of the connection for writing. Once
+// the plot is durably written, the sink replies with a Stored byte and closes
+// the connection. A sender may only discard its copy of the plot after reading
+// Stored, as the sink closing the connection without it means the plot may not
+// have been kept.
+//
+// Every header is read in full, so headers split across several packets, as
+// is common on WAN links, are decoded correctly.
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Ack is sent by the sink to accept a plot.
+const Ack byte = 1
+
+// Redirect is sent by the sink to refuse a plot while pointing the sender at
+// another sink which may take it. Senders which don't know it treat it as a
+// refusal.
+const Redirect byte = 2
+
+// Stored is sent by the sink once it has durably written the plot.
+const Stored byte = 3
+
+// Priority is how a sender ranks a transfer against others competing for the
+// sink's slots, such as a replot pipeline over a slow backfill.
+type Priority byte
+
+const (
+	// PriorityDefault leaves the priority to the sink's configuration.
+	PriorityDefault Priority = iota
+	PriorityHigh
+	PriorityBulk
+)
+
+// prioritySizeBits is how many bits of the size header hold the size when it
+// carries a priority.
+const prioritySizeBits = 56
+
+// MaxFilenameLength is the longest filename the header can carry.
+const MaxFilenameLength = math.MaxUint16
+
+// ErrNotAcknowledged is returned by ReadAck when the sink replied with
+// something other than Ack.
+var ErrNotAcknowledged = errors.New("transfer was not acknowledged")
+
+// ErrNotStored is returned by ReadStored when the sink closed the connection
+// without confirming it stored the plot.
+var ErrNotStored = errors.New("sink didn't confirm the plot was stored")
+
+// RedirectError is returned by ReadAck when the sink refused the plot and
+// redirected the sender to the sink at Addr. It matches ErrNotAcknowledged.
+type RedirectError struct {
+	Addr string
+}
+
+func (e *RedirectError) Error() string {
+	return "transfer was redirected to " + e.Addr
+}
+
+func (e *RedirectError) Is(target error) bool {
+	return target == ErrNotAcknowledged
+}
+
+// ReadSize reads the plot size header.
+func ReadSize(r io.Reader) (uint64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b[:]), nil
+}
+
+// WriteSize writes the plot size header.
+func WriteSize(w io.Writer, size uint64) error {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], size)
+	_, err := w.Write(b[:])
+	return err
+}
+
+// ParsePriority returns the priority named "high" or "bulk", or
+// PriorityDefault for an empty name.
+func ParsePriority(name string) (Priority, error) {
+	switch name {
+	case "":
+		return PriorityDefault, nil
+	case "high":
+		return PriorityHigh, nil
+	case "bulk":
+		return PriorityBulk, nil
+	}
+	return 0, fmt.Errorf("unknown priority %q, must be high or bulk", name)
+}
+
+// String returns the priority's name, or an empty string for the default.
+func (p Priority) String() string {
+	switch p {
+	case PriorityDefault:
+		return ""
+	case PriorityHigh:
+		return "high"
+	case PriorityBulk:
+		return "bulk"
+	}
+	return fmt.Sprintf("priority(%d)", byte(p))
+}
+
+// ReadSizePriority reads the plot size header, splitting the priority from
+// the size. Headers from senders which don't set a priority read as
+// PriorityDefault. Unknown priorities are returned for the caller to refuse.
+func ReadSizePriority(r io.Reader) (uint64, Priority, error) {
+	v, err := ReadSize(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	return v & (1<<prioritySizeBits - 1), Priority(v >> prioritySizeBits), nil
+}
+
+// WriteSizePriority writes the plot size header tagged with the priority.
+func WriteSizePriority(w io.Writer, size uint64, priority Priority) error {
+	if priority != PriorityDefault && size >= 1<<prioritySizeBits {
+		return fmt.Errorf("size %d is too large to send with a priority", size)
+	}
+	return WriteSize(w, size|uint64(priority)<<prioritySizeBits)
+}
+
+// ReadAck reads the sink's reply to the size header, returning
+// ErrNotAcknowledged if the plot was refused, or a *RedirectError if it was
+// refused with the address of another sink to try.
+func ReadAck(r io.Reader) error {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		if err == io.EOF {
+			return ErrNotAcknowledged
+		}
+		return err
+	}
+	switch b[0] {
+	case Ack:
+		return nil
+	case Redirect:
+		addr, err := ReadFilename(r)
+		if err != nil || addr == "" {
+			return ErrNotAcknowledged
+		}
+		return &RedirectError{Addr: addr}
+	}
+	return ErrNotAcknowledged
+}
+
+// WriteAck accepts the plot.
+func WriteAck(w io.Writer) error {
+	_, err := w.Write([]byte{Ack})
+	return err
+}
+
+// WriteStored confirms the plot was durably written.
+func WriteStored(w io.Writer) error {
+	_, err := w.Write([]byte{Stored})
+	return err
+}
+
+// ReadStored waits for the sink to confirm it stored the plot, returning
+// ErrNotStored if it closes the connection or replies with anything else.
+func ReadStored(r io.Reader) error {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		if err == io.EOF {
+			return ErrNotStored
+		}
+		return err
+	}
+	if b[0] != Stored {
+		return ErrNotStored
+	}
+	return nil
+}
+
+// WriteRedirect refuses the plot, redirecting the sender to the sink at addr.
+func WriteRedirect(w io.Writer, addr string) error {
+	if _, err := w.Write([]byte{Redirect}); err != nil {
+		return err
+	}
+	return WriteFilename(w, addr)
+}
+
+// ReadFilename reads the filename length and filename headers.
+func ReadFilename(r io.Reader) (string, error) {
+	var b [2]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return "", err
+	}
+
+	name := make([]byte, binary.LittleEndian.Uint16(b[:]))
+	if _, err := io.ReadFull(r, name); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return string(name), nil
+}
+
+// WriteFilename writes the filename length and filename headers.
+func WriteFilename(w io.Writer, name string) error {
+	if len(name) > MaxFilenameLength {
+		return fmt.Errorf("filename is %d bytes, longer than the maximum of %d", len(name), MaxFilenameLength)
+	}
+
+	b := make([]byte, 2+len(name))
+	binary.LittleEndian.PutUint16(b, uint16(len(name)))
+	copy(b[2:], name)
+	_, err := w.Write(b)
+	return err
+}
+
+// Send sends a plot over rw, the sender's side of a transfer. It writes the
+// size, waits for the sink's Ack, then writes the filename and size bytes of
+// the plot read from r. ErrNotAcknowledged is returned if the sink refused the
+// plot, or a *RedirectError when it named another sink to try, in which case
+// nothing was read from r. Send returns once the plot is written, without
+// waiting for the sink to store it. The caller then closes its side for
+// writing and calls ReadStored to wait for the Stored byte, which returns
+// ErrNotStored if the sink closes the connection without it, in which case the
+// plot may not have been kept.
+func Send(rw io.ReadWriter, filename string, size uint64, r io.Reader) error {
+	return SendPriority(rw, filename, size, PriorityDefault, r)
+}
+
+// SendPriority is like Send, but tags the transfer with the priority.
+func SendPriority(rw io.ReadWriter, filename string, size uint64, priority Priority, r io.Reader) error {
+	if err := WriteSizePriority(rw, size, priority); err != nil {
+		return err
+	}
+	if err := ReadAck(rw); err != nil {
+		return err
+	}
+	if err := WriteFilename(rw, filename); err != nil {
+		return err
+	}
+
+	n, err := io.Copy(rw, io.LimitReader(r, int64(size)))
+	if err != nil {
+		return err
+	}
+	if uint64(n) != size {
+		return fmt.Errorf("sent %d of %d bytes", n, size)
+	}
+	return nil
+}
+
+// CheckFilename returns an error if the filename isn't a plain file name, so
+// a sender can't write outside of the directory the plot is stored in. Names
+// with path separators, "." or "..", control characters, or invalid UTF-8
+// are rejected.
+func CheckFilename(name string) error {
+	switch {
+	case name == "":
+		return errors.New("filename is empty")
+	case name == "." || name == "..":
+		return fmt.Errorf("filename %q is a directory reference", name)
+	case strings.ContainsAny(name, `/\`):
+		return fmt.Errorf("filename %q contains a path separator", name)
+	case !utf8.ValidString(name):
+		return fmt.Errorf("filename %q is not valid UTF-8", name)
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("filename %q contains a control character", name)
+		}
+	}
+	return nil
+}
+
+// tempSuffixes are the suffixes plotters give plots while they are written.
+var tempSuffixes = []string{".tmp", ".part"}
+
+// FinalFilename returns the name a plot is stored under, stripping the suffix
+// plotters give plots while they are written, as in .plot.tmp or .plot.2.tmp,
+// so a plot sent under its in-progress name is still stored as a .plot. Other
+// names are returned unchanged.
+func FinalFilename(name string) string {
+	for _, suffix := range tempSuffixes {
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		if i := strings.LastIndex(name, ".plot."); i > 0 {
+			return name[:i+len(".plot")]
+		}
+	}
+	return name
+}
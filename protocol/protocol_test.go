@@ -0,0 +1,390 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestSizeRoundTrip(t *testing.T) {
+	for _, size := range []uint64{0, 1, 108_000_000_000, 1<<64 - 1} {
+		var buf bytes.Buffer
+		if err := WriteSize(&buf, size); err != nil {
+			t.Fatalf("WriteSize(%d): %v", size, err)
+		}
+		if buf.Len() != 8 {
+			t.Fatalf("WriteSize(%d) wrote %d bytes, want 8", size, buf.Len())
+		}
+
+		// one byte at a time, like a header split across packets
+		got, err := ReadSize(iotest.OneByteReader(&buf))
+		if err != nil {
+			t.Fatalf("ReadSize: %v", err)
+		}
+		if got != size {
+			t.Errorf("ReadSize = %d, want %d", got, size)
+		}
+	}
+}
+
+func TestSizeLittleEndian(t *testing.T) {
+	got, err := ReadSize(bytes.NewReader([]byte{0x01, 0x02, 0, 0, 0, 0, 0, 0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != 0x0201 {
+		t.Errorf("ReadSize = %#x, want 0x201", got)
+	}
+}
+
+func TestSizePriority(t *testing.T) {
+	for _, priority := range []Priority{PriorityDefault, PriorityHigh, PriorityBulk} {
+		var buf bytes.Buffer
+		if err := WriteSizePriority(&buf, 108_000_000_000, priority); err != nil {
+			t.Fatalf("WriteSizePriority(%s): %v", priority, err)
+		}
+		size, got, err := ReadSizePriority(&buf)
+		if err != nil {
+			t.Fatalf("ReadSizePriority: %v", err)
+		}
+		if size != 108_000_000_000 || got != priority {
+			t.Errorf("ReadSizePriority = %d, %s, want 108000000000, %s", size, got, priority)
+		}
+	}
+}
+
+func TestSizePriorityUntagged(t *testing.T) {
+	// senders which don't know of priorities write the bare size
+	var buf bytes.Buffer
+	if err := WriteSize(&buf, 108_000_000_000); err != nil {
+		t.Fatal(err)
+	}
+	size, priority, err := ReadSizePriority(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 108_000_000_000 || priority != PriorityDefault {
+		t.Errorf("ReadSizePriority = %d, %s, want 108000000000, the default", size, priority)
+	}
+}
+
+func TestWriteSizePriorityTooLarge(t *testing.T) {
+	if err := WriteSizePriority(io.Discard, 1<<56, PriorityBulk); err == nil {
+		t.Error("WriteSizePriority of a size overlapping the priority succeeded")
+	}
+	if err := WriteSizePriority(io.Discard, 1<<56, PriorityDefault); err != nil {
+		t.Errorf("WriteSizePriority without a priority: %v", err)
+	}
+}
+
+func TestParsePriority(t *testing.T) {
+	for _, p := range []Priority{PriorityDefault, PriorityHigh, PriorityBulk} {
+		got, err := ParsePriority(p.String())
+		if err != nil || got != p {
+			t.Errorf("ParsePriority(%q) = %v, %v, want %v", p.String(), got, err, p)
+		}
+	}
+	if _, err := ParsePriority("urgent"); err == nil {
+		t.Error("ParsePriority of an unknown name succeeded")
+	}
+}
+
+func TestReadSizeShort(t *testing.T) {
+	tests := []struct {
+		in   []byte
+		want error
+	}{
+		{nil, io.EOF},
+		{[]byte{1, 2, 3}, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		if _, err := ReadSize(bytes.NewReader(tt.in)); !errors.Is(err, tt.want) {
+			t.Errorf("ReadSize(%v) error = %v, want %v", tt.in, err, tt.want)
+		}
+	}
+}
+
+func TestAck(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteAck(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReadAck(&buf); err != nil {
+		t.Errorf("ReadAck: %v", err)
+	}
+
+	// a refusal is the connection closing, or anything other than an ack
+	for _, in := range [][]byte{nil, {0}, {2}} {
+		if err := ReadAck(bytes.NewReader(in)); !errors.Is(err, ErrNotAcknowledged) {
+			t.Errorf("ReadAck(%v) error = %v, want ErrNotAcknowledged", in, err)
+		}
+	}
+}
+
+func TestStored(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteStored(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReadStored(&buf); err != nil {
+		t.Errorf("ReadStored: %v", err)
+	}
+
+	// closing without confirming, or replying with anything else, isn't stored
+	for _, in := range [][]byte{nil, {Ack}, {0}} {
+		if err := ReadStored(bytes.NewReader(in)); err != ErrNotStored {
+			t.Errorf("ReadStored(%v) error = %v, want ErrNotStored", in, err)
+		}
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteRedirect(&buf, "sink2:1337"); err != nil {
+		t.Fatal(err)
+	}
+	err := ReadAck(iotest.HalfReader(&buf))
+	var re *RedirectError
+	if !errors.As(err, &re) || re.Addr != "sink2:1337" {
+		t.Fatalf("ReadAck error = %v, want redirect to sink2:1337", err)
+	}
+	if !errors.Is(err, ErrNotAcknowledged) {
+		t.Errorf("redirect doesn't match ErrNotAcknowledged")
+	}
+
+	// a redirect without an address is a plain refusal
+	buf.Reset()
+	WriteRedirect(&buf, "")
+	if err := ReadAck(&buf); err != ErrNotAcknowledged {
+		t.Errorf("ReadAck(empty redirect) error = %v, want ErrNotAcknowledged", err)
+	}
+}
+
+func TestFilenameRoundTrip(t *testing.T) {
+	names := []string{
+		"",
+		"plot-k32-2024-01-01-00-00-0123456789abcdef.plot",
+		strings.Repeat("a", MaxFilenameLength),
+	}
+	for _, name := range names {
+		var buf bytes.Buffer
+		if err := WriteFilename(&buf, name); err != nil {
+			t.Fatalf("WriteFilename(%d bytes): %v", len(name), err)
+		}
+		got, err := ReadFilename(iotest.HalfReader(&buf))
+		if err != nil {
+			t.Fatalf("ReadFilename(%d bytes): %v", len(name), err)
+		}
+		if got != name {
+			t.Errorf("ReadFilename = %q, want %q", got, name)
+		}
+	}
+}
+
+func TestWriteFilenameTooLong(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteFilename(&buf, strings.Repeat("a", MaxFilenameLength+1)); err == nil {
+		t.Error("WriteFilename accepted a name longer than the maximum")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("WriteFilename wrote %d bytes on error", buf.Len())
+	}
+}
+
+func TestReadFilenameShort(t *testing.T) {
+	tests := []struct {
+		in   []byte
+		want error
+	}{
+		{nil, io.EOF},
+		{[]byte{5}, io.ErrUnexpectedEOF},
+		{[]byte{5, 0}, io.ErrUnexpectedEOF},
+		{[]byte{5, 0, 'a', 'b'}, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		if _, err := ReadFilename(bytes.NewReader(tt.in)); !errors.Is(err, tt.want) {
+			t.Errorf("ReadFilename(%v) error = %v, want %v", tt.in, err, tt.want)
+		}
+	}
+}
+
+func TestHeadersStream(t *testing.T) {
+	// the filename header is followed by the plot, which must be left unread
+	var buf bytes.Buffer
+	WriteFilename(&buf, "a.plot")
+	buf.WriteString("plot data")
+
+	r := iotest.OneByteReader(&buf)
+	name, err := ReadFilename(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, _ := io.ReadAll(r)
+	if name != "a.plot" || string(rest) != "plot data" {
+		t.Errorf("got name %q and rest %q", name, rest)
+	}
+}
+
+func TestCheckFilename(t *testing.T) {
+	valid := []string{
+		"plot-k32-2024-01-01-00-00-0123456789abcdef.plot",
+		"plot..k32.plot",
+		".hidden.plot",
+		"plot k32 ü.plot",
+	}
+	for _, name := range valid {
+		if err := CheckFilename(name); err != nil {
+			t.Errorf("CheckFilename(%q) = %v, want nil", name, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		".",
+		"..",
+		"/etc/passwd",
+		"../plot.plot",
+		"dir/plot.plot",
+		`..\plot.plot`,
+		"plot\x00.plot",
+		"plot\n.plot",
+		"plot\x7f.plot",
+		"plot\xff.plot",
+	}
+	for _, name := range invalid {
+		if err := CheckFilename(name); err == nil {
+			t.Errorf("CheckFilename(%q) = nil, want an error", name)
+		}
+	}
+}
+
+func TestFinalFilename(t *testing.T) {
+	tests := map[string]string{
+		"plot-k32-abc.plot":         "plot-k32-abc.plot",
+		"plot-k32-abc.plot.tmp":     "plot-k32-abc.plot",
+		"plot-k32-abc.plot.2.tmp":   "plot-k32-abc.plot",
+		"plot-k32-abc.plot.part":    "plot-k32-abc.plot",
+		"plot-k32-abc.tmp":          "plot-k32-abc.tmp",
+		".plot.tmp":                 ".plot.tmp",
+		"plot-k32-abc.plot.tmp.bak": "plot-k32-abc.plot.tmp.bak",
+	}
+	for name, want := range tests {
+		if got := FinalFilename(name); got != want {
+			t.Errorf("FinalFilename(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func FuzzCheckFilename(f *testing.F) {
+	f.Add("plot.plot")
+	f.Add("../plot.plot")
+	f.Fuzz(func(t *testing.T, name string) {
+		if CheckFilename(name) != nil {
+			return
+		}
+
+		// an accepted name must stay within the directory it's joined to
+		joined := filepath.Join("/plots", name)
+		if filepath.Dir(joined) != "/plots" {
+			t.Errorf("CheckFilename accepted %q, which joins to %q", name, joined)
+		}
+	})
+}
+
+func FuzzReadFilename(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{3, 0, 'a', 'b', 'c'})
+	f.Add([]byte{0xff, 0xff, 'a'})
+	f.Fuzz(func(t *testing.T, in []byte) {
+		name, err := ReadFilename(bytes.NewReader(in))
+		if err != nil {
+			return
+		}
+
+		// anything decoded must encode back to the same header
+		var buf bytes.Buffer
+		if err := WriteFilename(&buf, name); err != nil {
+			t.Fatalf("WriteFilename: %v", err)
+		}
+		if !bytes.Equal(buf.Bytes(), in[:buf.Len()]) {
+			t.Errorf("re-encoded %x, want %x", buf.Bytes(), in[:buf.Len()])
+		}
+	})
+}
+
+func FuzzSizeRoundTrip(f *testing.F) {
+	f.Add(uint64(0))
+	f.Add(uint64(108_000_000_000))
+	f.Fuzz(func(t *testing.T, size uint64) {
+		var buf bytes.Buffer
+		WriteSize(&buf, size)
+		got, err := ReadSize(iotest.OneByteReader(&buf))
+		if err != nil || got != size {
+			t.Errorf("ReadSize = %d, %v, want %d", got, err, size)
+		}
+	})
+}
+
+// sinkConn is one side of a transfer, reading the sink's replies from in and
+// recording what was sent in out.
+type sinkConn struct {
+	in  io.Reader
+	out bytes.Buffer
+}
+
+func (c *sinkConn) Read(b []byte) (int, error)  { return c.in.Read(b) }
+func (c *sinkConn) Write(b []byte) (int, error) { return c.out.Write(b) }
+
+func TestSend(t *testing.T) {
+	conn := &sinkConn{in: bytes.NewReader([]byte{Ack})}
+	if err := Send(conn, "a.plot", 5, strings.NewReader("plotdata")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	size, err := ReadSize(&conn.out)
+	if err != nil || size != 5 {
+		t.Fatalf("ReadSize = %d, %v, want 5", size, err)
+	}
+	name, err := ReadFilename(&conn.out)
+	if err != nil || name != "a.plot" {
+		t.Fatalf("ReadFilename = %q, %v, want a.plot", name, err)
+	}
+	if got := conn.out.String(); got != "plotd" {
+		t.Errorf("sent data %q, want %q", got, "plotd")
+	}
+}
+
+func TestSendPriority(t *testing.T) {
+	conn := &sinkConn{in: bytes.NewReader([]byte{Ack})}
+	if err := SendPriority(conn, "a.plot", 5, PriorityBulk, strings.NewReader("plotdata")); err != nil {
+		t.Fatalf("SendPriority: %v", err)
+	}
+
+	size, priority, err := ReadSizePriority(&conn.out)
+	if err != nil || size != 5 || priority != PriorityBulk {
+		t.Fatalf("ReadSizePriority = %d, %s, %v, want 5, bulk", size, priority, err)
+	}
+}
+
+func TestSendRefused(t *testing.T) {
+	conn := &sinkConn{in: bytes.NewReader(nil)}
+	if err := Send(conn, "a.plot", 5, strings.NewReader("plotdata")); !errors.Is(err, ErrNotAcknowledged) {
+		t.Fatalf("Send error = %v, want ErrNotAcknowledged", err)
+	}
+	if conn.out.Len() != 8 {
+		t.Errorf("sent %d bytes after a refusal, want only the size", conn.out.Len())
+	}
+}
+
+func TestSendShort(t *testing.T) {
+	conn := &sinkConn{in: bytes.NewReader([]byte{Ack})}
+	if err := Send(conn, "a.plot", 10, strings.NewReader("plot")); err == nil {
+		t.Fatal("Send of a short plot succeeded")
+	}
+}
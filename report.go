@@ -0,0 +1,96 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/dustin/go-humanize"
+	"github.com/krobertson/chia-plot-sink-multi/sink"
+)
+
+// cmdReport prints the capacity of every configured path, like df limited to
+// the farm's disks. The running sink is queried when it can be reached,
+// otherwise the config is read and the disks are checked directly.
+func cmdReport(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ContinueOnError)
+	local := fs.Bool("local", false, "read the disks directly even if the sink is running")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var rows []sink.ReportRow
+	var err error
+	if !*local {
+		if c, cerr := newControlClient(); cerr == nil {
+			rows, err = sinkReport(c)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Sink not reachable (%v), reading disks directly\n", err)
+			}
+		}
+	}
+	if rows == nil {
+		if rows, err = sink.DiskReport(cfgFile); err != nil {
+			return err
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tPATH\tSIZE\tUSED\tFREE\tUSE%\tPLOTS\tSTATE")
+	var total, free uint64
+	var plots int
+	for _, r := range rows {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n", r.Group, r.Path, humanize.IBytes(r.Total),
+			humanize.IBytes(r.Total-r.Free), humanize.IBytes(r.Free), usePercent(r.Free, r.Total), r.Plots, r.State)
+		if r.Group != "cache" {
+			total += r.Total
+			free += r.Free
+			plots += r.Plots
+		}
+	}
+	fmt.Fprintf(w, "destinations\t\t%s\t%s\t%s\t%s\t%d\t\n", humanize.IBytes(total),
+		humanize.IBytes(total-free), humanize.IBytes(free), usePercent(free, total), plots)
+	return w.Flush()
+}
+
+// usePercent formats how full the space is, like df's Use% column.
+func usePercent(free, total uint64) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.0f%%", float64(total-free)/float64(total)*100)
+}
+
+// sinkReport builds the report from the running sink's status and plots.
+func sinkReport(c *controlClient) ([]sink.ReportRow, error) {
+	var st sink.StatusResponse
+	if err := c.get("/status", &st); err != nil {
+		return nil, err
+	}
+	var plots []sink.StoredPlot
+	if err := c.get("/plots", &plots); err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, p := range plots {
+		counts[p.Path]++
+	}
+
+	rows := make([]sink.ReportRow, 0)
+	for _, gs := range append([]*sink.GroupStatus{st.Cache}, st.Destinations...) {
+		for _, ps := range gs.Paths {
+			rows = append(rows, sink.ReportRow{
+				Group: gs.Name,
+				Path:  ps.Path,
+				Total: ps.TotalSpace,
+				Free:  ps.FreeSpace,
+				Plots: counts[ps.Path],
+				State: ps.State(),
+			})
+		}
+	}
+	return rows, nil
+}
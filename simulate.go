@@ -0,0 +1,84 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/krobertson/chia-plot-sink-multi/sink"
+)
+
+// cmdSimulate replays a workload against a described disk layout once for
+// each strategy, reporting how full the disks end up and how fast plots are
+// stored, so a strategy can be evaluated before it is deployed.
+func cmdSimulate(args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	plots := fs.Int("plots", 1000, "synthetic plots to send")
+	size := fs.String("size", "101.4GiB", "size of the synthetic plots")
+	interval := fs.Duration("interval", 5*time.Minute, "time between synthetic plots arriving")
+	audit := fs.String("audit", "", "replay the plot sizes and arrival times recorded in an audit log instead")
+	strategy := fs.String("strategy", "", "simulate only this strategy")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("simulate requires a layout file")
+	}
+
+	layout, err := sink.LoadSimLayout(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	var arrivals []sink.SimArrival
+	if *audit != "" {
+		if arrivals, err = sink.LoadAuditWorkload(*audit); err != nil {
+			return fmt.Errorf("failed to read audit log: %v", err)
+		}
+	} else {
+		plotSize, err := humanize.ParseBytes(*size)
+		if err != nil {
+			return fmt.Errorf("invalid plot size: %v", err)
+		}
+		for i := 0; i < *plots; i++ {
+			arrivals = append(arrivals, sink.SimArrival{At: time.Duration(i) * *interval, Size: plotSize})
+		}
+	}
+	if len(arrivals) == 0 {
+		return errors.New("the workload has no plots")
+	}
+
+	names := []string{sink.StrategyFreeSpace, sink.StrategySpeed, sink.StrategyBestFit}
+	if *strategy != "" {
+		if !slices.Contains(names, *strategy) {
+			return fmt.Errorf("unknown strategy %q", *strategy)
+		}
+		names = []string{*strategy}
+	}
+
+	fmt.Printf("Simulating %d plots onto %d disks\n\n", len(arrivals), layout.DiskCount())
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STRATEGY\tPLACED\tREFUSED\tELAPSED\tTHROUGHPUT\tAVG WAIT\tMAX WAIT\tFILL MIN/AVG/MAX\tSTDDEV\tFULL")
+	for _, name := range names {
+		r, err := sink.Simulate(layout, name, arrivals)
+		if err != nil {
+			return err
+		}
+		throughput := uint64(0)
+		if r.Elapsed > 0 {
+			throughput = uint64(float64(r.Bytes) / r.Elapsed.Seconds())
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s/s\t%s\t%s\t%.1f%%/%.1f%%/%.1f%%\t%.1f%%\t%d\n",
+			r.Strategy, r.Placed, r.Refused, r.Elapsed.Round(time.Minute), humanize.IBytes(throughput),
+			r.AvgWait.Round(time.Second), r.MaxWait.Round(time.Second),
+			r.MinFill, r.AvgFill, r.MaxFill, r.Stddev, r.Full)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,368 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// AdminResponse is returned by all of the admin endpoints.
+type AdminResponse struct {
+	Message string         `json:"message,omitempty"`
+	Error   string         `json:"error,omitempty"`
+	Moves   []*PlannedMove `json:"moves,omitempty"`
+}
+
+// registerAdmin adds the admin endpoints to the control interface's mux.
+func (s *Sink) registerAdmin(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/paths/pause", s.requireAdmin(s.handlePathAction))
+	mux.HandleFunc("/admin/paths/resume", s.requireAdmin(s.handlePathAction))
+	mux.HandleFunc("/admin/paths/disable", s.requireAdmin(s.handlePathAction))
+	mux.HandleFunc("/admin/groups/pause", s.requireAdmin(s.handleGroupAction))
+	mux.HandleFunc("/admin/groups/resume", s.requireAdmin(s.handleGroupAction))
+	mux.HandleFunc("/admin/groups/disable", s.requireAdmin(s.handleGroupAction))
+	mux.HandleFunc("/admin/groups/drain", s.requireAdmin(s.handleGroupAction))
+	mux.HandleFunc("/admin/reload", s.requireAdmin(s.handleReload))
+	mux.HandleFunc("/admin/transfers/cancel", s.requireAdmin(s.handleCancelTransfer))
+	mux.HandleFunc("/admin/rebalance", s.requireAdmin(s.handleRebalance))
+	mux.HandleFunc("/admin/jobs/cancel", s.requireAdmin(s.handleCancelJob))
+	mux.HandleFunc("/admin/paths/evacuate", s.requireAdmin(s.handleEvacuate))
+	mux.HandleFunc("/admin/import", s.requireAdmin(s.handleImport))
+	mux.HandleFunc("/admin/plotters/reset", s.requireAdmin(s.handleResetPlotter))
+}
+
+// requireAdmin wraps an admin handler, ensuring it is called with POST and the
+// configured bearer token. Over TCP, admin endpoints are unavailable when no
+// token has been configured. Requests over the unix socket are trusted.
+func (s *Sink) requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusMethodNotAllowed, &AdminResponse{Error: "method not allowed"})
+			return
+		}
+		if trusted, _ := r.Context().Value(trustedKey{}).(bool); trusted {
+			h(w, r)
+			return
+		}
+		if s.controlToken == "" {
+			writeJSON(w, http.StatusForbidden, &AdminResponse{Error: "admin api is disabled, no control_token configured"})
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.controlToken)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, &AdminResponse{Error: "unauthorized"})
+			return
+		}
+		h(w, r)
+	}
+}
+
+// handlePathAction pauses, resumes, or disables the path given in the "path"
+// query parameter.
+func (s *Sink) handlePathAction(w http.ResponseWriter, r *http.Request) {
+	action := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	path := r.URL.Query().Get("path")
+
+	_, pp := s.FindPath(path)
+	if pp == nil {
+		writeJSON(w, http.StatusNotFound, &AdminResponse{Error: fmt.Sprintf("path %q not found", path)})
+		return
+	}
+
+	switch action {
+	case "pause":
+		pp.adminPaused.Store(true)
+	case "resume":
+		pp.adminPaused.Store(false)
+		pp.disabled.Store(false)
+		pp.paused.Store(false)
+	case "disable":
+		pp.disabled.Store(true)
+	}
+
+	s.saveState()
+
+	msg := fmt.Sprintf("Path %s %s", pp.path, actionPastTense(action))
+	log.Printf("Admin: %s", msg)
+	writeJSON(w, http.StatusOK, &AdminResponse{Message: msg})
+}
+
+// handleGroupAction pauses, resumes, or disables the group given in the "group"
+// query parameter.
+func (s *Sink) handleGroupAction(w http.ResponseWriter, r *http.Request) {
+	action := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	name := r.URL.Query().Get("group")
+
+	groups := s.GroupsNamed(name)
+	if name == "" || len(groups) == 0 {
+		writeJSON(w, http.StatusNotFound, &AdminResponse{Error: fmt.Sprintf("group %q not found", name)})
+		return
+	}
+	pg := groups[0]
+
+	switch action {
+	case "pause":
+		pg.paused.Store(true)
+	case "resume":
+		pg.paused.Store(false)
+		pg.disabled.Store(false)
+		pg.draining.Store(false)
+	case "disable":
+		pg.disabled.Store(true)
+	case "drain":
+		if !pg.draining.Swap(true) {
+			go s.watchDrain(pg)
+		}
+	}
+
+	s.saveState()
+
+	msg := fmt.Sprintf("Group %q %s", pg.name, actionPastTense(action))
+	log.Printf("Admin: %s", msg)
+	writeJSON(w, http.StatusOK, &AdminResponse{Message: msg})
+}
+
+// handleReload re-reads the configuration file and applies it.
+func (s *Sink) handleReload(w http.ResponseWriter, r *http.Request) {
+	changes, err := s.Reload(s.configFile)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &AdminResponse{Error: err.Error()})
+		return
+	}
+	msg := "Reloaded configuration, no changes"
+	if len(changes) > 0 {
+		msg = "Reloaded configuration: " + strings.Join(changes, ", ")
+	}
+	writeJSON(w, http.StatusOK, &AdminResponse{Message: msg})
+}
+
+// handleCancelTransfer aborts the in-flight transfer given by the "id" or
+// "filename" query parameter.
+func (s *Sink) handleCancelTransfer(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	filename := r.URL.Query().Get("filename")
+
+	t := s.findTransfer(id, filename)
+	if t == nil {
+		writeJSON(w, http.StatusNotFound, &AdminResponse{Error: "transfer not found"})
+		return
+	}
+	t.cancel()
+
+	ti := t.info()
+	msg := fmt.Sprintf("Canceled transfer %d of %s from %s", ti.ID, ti.Filename, ti.Source)
+	log.Printf("Admin: %s", msg)
+	writeJSON(w, http.StatusOK, &AdminResponse{Message: msg})
+}
+
+// handleRebalance plans moves evening out the fill level of destination
+// paths and, unless "dry_run" is set, starts a job performing them. The plan
+// can be limited to a single "group", and "tolerance" is the allowed spread in
+// percent used. Moves are limited to "bwlimit" bytes per second if given.
+func (s *Sink) handleRebalance(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	group := q.Get("group")
+	if group == "cache" {
+		writeJSON(w, http.StatusBadRequest, &AdminResponse{Error: "the cache can't be rebalanced"})
+		return
+	}
+	if group != "" && len(s.GroupsNamed(group)) == 0 {
+		writeJSON(w, http.StatusNotFound, &AdminResponse{Error: fmt.Sprintf("group %q not found", group)})
+		return
+	}
+
+	tolerance := 2.0
+	if v := q.Get("tolerance"); v != "" {
+		t, err := strconv.ParseFloat(v, 64)
+		if err != nil || t < 0 {
+			writeJSON(w, http.StatusBadRequest, &AdminResponse{Error: "invalid tolerance"})
+			return
+		}
+		tolerance = t
+	}
+
+	limiter, err := ParseBandwidthLimit(q.Get("bwlimit"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &AdminResponse{Error: err.Error()})
+		return
+	}
+
+	moves := s.PlanRebalance(group, tolerance/100)
+	if len(moves) == 0 {
+		writeJSON(w, http.StatusOK, &AdminResponse{Message: "Paths are already balanced"})
+		return
+	}
+	if dryRun, _ := strconv.ParseBool(q.Get("dry_run")); dryRun {
+		writeJSON(w, http.StatusOK, &AdminResponse{Message: fmt.Sprintf("Rebalance would move %d plots", len(moves)), Moves: moves})
+		return
+	}
+
+	if err := s.StartJob(&MoveJob{Kind: "rebalance", Moves: moves, Limiter: limiter}); err != nil {
+		writeJSON(w, http.StatusConflict, &AdminResponse{Error: err.Error()})
+		return
+	}
+	msg := fmt.Sprintf("Started rebalance moving %d plots", len(moves))
+	log.Printf("Admin: %s", msg)
+	writeJSON(w, http.StatusOK, &AdminResponse{Message: msg, Moves: moves})
+}
+
+// handleEvacuate starts a job relocating every plot off the "path" onto other
+// destinations, such as ahead of removing a failing disk. The path is paused
+// for new placements when the job starts and stays paused afterwards.
+func (s *Sink) handleEvacuate(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	path := q.Get("path")
+
+	pg, pp := s.FindPath(path)
+	if pp == nil || pg == s.cacheGroup {
+		writeJSON(w, http.StatusNotFound, &AdminResponse{Error: fmt.Sprintf("destination path %q not found", path)})
+		return
+	}
+
+	limiter, err := ParseBandwidthLimit(q.Get("bwlimit"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &AdminResponse{Error: err.Error()})
+		return
+	}
+
+	moves, unplaced, err := s.PlanEvacuate(pp)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, &AdminResponse{Error: err.Error()})
+		return
+	}
+	msg := fmt.Sprintf("Evacuating %d plots from %s", len(moves), pp.path)
+	if len(unplaced) > 0 {
+		msg += fmt.Sprintf(", %d plots don't fit on any other path and will remain", len(unplaced))
+	}
+	if dryRun, _ := strconv.ParseBool(q.Get("dry_run")); dryRun {
+		writeJSON(w, http.StatusOK, &AdminResponse{Message: "Dry run: " + msg, Moves: moves})
+		return
+	}
+
+	wasPaused := pp.adminPaused.Swap(true)
+	err = s.StartJob(&MoveJob{
+		Kind:    "evacuate",
+		Moves:   moves,
+		Limiter: limiter,
+		OnDone: func() {
+			log.Printf("Evacuation of %s finished, it remains paused until resumed", pp.path)
+		},
+	})
+	if err != nil {
+		pp.adminPaused.Store(wasPaused)
+		writeJSON(w, http.StatusConflict, &AdminResponse{Error: err.Error()})
+		return
+	}
+	s.saveState()
+	log.Printf("Admin: %s", msg)
+	writeJSON(w, http.StatusOK, &AdminResponse{Message: msg, Moves: moves})
+}
+
+// handleImport starts a job ingesting the plots found in "dir" into the
+// destinations, recording them like received plots.
+func (s *Sink) handleImport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	moves, err := s.PlanImport(q.Get("dir"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &AdminResponse{Error: err.Error()})
+		return
+	}
+	if len(moves) == 0 {
+		writeJSON(w, http.StatusOK, &AdminResponse{Message: "No plots found to import"})
+		return
+	}
+
+	limiter, err := ParseBandwidthLimit(q.Get("bwlimit"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, &AdminResponse{Error: err.Error()})
+		return
+	}
+
+	if err := s.StartJob(&MoveJob{Kind: "import", Moves: moves, Limiter: limiter, Place: true}); err != nil {
+		writeJSON(w, http.StatusConflict, &AdminResponse{Error: err.Error()})
+		return
+	}
+	msg := fmt.Sprintf("Importing %d plots from %s", len(moves), moves[0].From)
+	log.Printf("Admin: %s", msg)
+	writeJSON(w, http.StatusOK, &AdminResponse{Message: msg})
+}
+
+// handleCancelJob stops the running maintenance job.
+func (s *Sink) handleCancelJob(w http.ResponseWriter, r *http.Request) {
+	j := s.CurrentJob()
+	if j == nil || j.finished.Load() {
+		writeJSON(w, http.StatusNotFound, &AdminResponse{Error: "no job is running"})
+		return
+	}
+	j.Cancel()
+
+	msg := fmt.Sprintf("Canceled %s job", j.Kind)
+	log.Printf("Admin: %s", msg)
+	writeJSON(w, http.StatusOK, &AdminResponse{Message: msg})
+}
+
+// ParseBandwidthLimit returns a limiter for a rate such as "100MiB", or nil if
+// the rate is empty.
+func ParseBandwidthLimit(rate string) (*RateLimiter, error) {
+	if rate == "" {
+		return nil, nil
+	}
+	b, err := humanize.ParseBytes(rate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bandwidth limit %q: %v", rate, err)
+	}
+	return NewRateLimiter(b), nil
+}
+
+// watchDrain waits for a draining group to finish its in-flight transfers and
+// logs once it is safe to perform maintenance on.
+func (s *Sink) watchDrain(pg *PlotGroup) {
+	for pg.draining.Load() {
+		if pg.quiesced() {
+			log.Printf("Group %q is drained, no transfers in progress", pg.name)
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// FindPath returns the group and PlotPath for the specified path, searching
+// both the cache and destination groups.
+func (s *Sink) FindPath(path string) (*PlotGroup, *PlotPath) {
+	if path == "" {
+		return nil, nil
+	}
+	for _, pg := range append(s.GroupsNamed("cache"), s.GroupsNamed("")...) {
+		pg.sortMutex.RLock()
+		for _, pp := range pg.sortedPlots {
+			if pp.path == path {
+				pg.sortMutex.RUnlock()
+				return pg, pp
+			}
+		}
+		pg.sortMutex.RUnlock()
+	}
+	return nil, nil
+}
+
+func actionPastTense(action string) string {
+	switch action {
+	case "pause":
+		return "paused"
+	case "resume":
+		return "resumed"
+	case "disable":
+		return "disabled"
+	case "drain":
+		return "draining"
+	}
+	return action
+}
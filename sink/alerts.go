@@ -0,0 +1,346 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// alertMetrics are the values which alert rules can be defined against. Each
+// is computed across the groups the rule is scoped to, which is either a single
+// named group (including "cache") or all of the destination groups.
+var alertMetrics = map[string]func(groups []*PlotGroup) float64{
+	"free_bytes": func(groups []*PlotGroup) float64 {
+		free, _ := groupsSpace(groups)
+		return float64(free)
+	},
+	"total_bytes": func(groups []*PlotGroup) float64 {
+		_, total := groupsSpace(groups)
+		return float64(total)
+	},
+	"used_percent": func(groups []*PlotGroup) float64 {
+		free, total := groupsSpace(groups)
+		if total == 0 {
+			return 0
+		}
+		return float64(total-free) / float64(total) * 100
+	},
+	"paused_paths": func(groups []*PlotGroup) float64 {
+		var n int
+		for _, pg := range groups {
+			pg.sortMutex.RLock()
+			for _, pp := range pg.sortedPlots {
+				if pp.unavailable() {
+					n++
+				}
+			}
+			pg.sortMutex.RUnlock()
+		}
+		return float64(n)
+	},
+	"unmounted_paths": func(groups []*PlotGroup) float64 {
+		var n int
+		for _, pg := range groups {
+			pg.sortMutex.RLock()
+			for _, pp := range pg.sortedPlots {
+				if pp.unmounted.Load() {
+					n++
+				}
+			}
+			pg.sortMutex.RUnlock()
+		}
+		return float64(n)
+	},
+	"cache_backlog": func(groups []*PlotGroup) float64 {
+		var n int64
+		for _, pg := range groups {
+			n += pg.backlog.plots.Load()
+		}
+		return float64(n)
+	},
+	"cache_backlog_bytes": func(groups []*PlotGroup) float64 {
+		var n int64
+		for _, pg := range groups {
+			n += pg.backlog.bytes.Load()
+		}
+		return float64(n)
+	},
+	"cache_backlog_growth": func(groups []*PlotGroup) float64 {
+		var n int64
+		for _, pg := range groups {
+			n += pg.backlog.growth()
+		}
+		return float64(n)
+	},
+	"transfers": func(groups []*PlotGroup) float64 {
+		var n int64
+		for _, pg := range groups {
+			n += pg.transfers.Load()
+		}
+		return float64(n)
+	},
+}
+
+// alertOperators are the comparisons supported between a metric value and a
+// rule's threshold.
+var alertOperators = map[string]func(a, b float64) bool{
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+}
+
+// alert is the payload delivered to notification channels when a rule starts
+// or stops firing.
+type alert struct {
+	Rule      string    `json:"rule"`
+	State     string    `json:"state"`
+	Metric    string    `json:"metric,omitempty"`
+	Group     string    `json:"group,omitempty"`
+	Value     float64   `json:"value"`
+	Threshold float64   `json:"threshold"`
+	Message   string    `json:"message"`
+	Time      time.Time `json:"time"`
+}
+
+// alertChannel is a destination notifications can be sent to.
+type alertChannel interface {
+	notify(a *alert) error
+}
+
+type alertRule struct {
+	cfg       *ConfigAlertRule
+	threshold float64
+	compare   func(a, b float64) bool
+	metric    func(groups []*PlotGroup) float64
+	since     time.Time
+	firing    bool
+}
+
+type alertManager struct {
+	sink     *Sink
+	interval time.Duration
+	channels map[string]alertChannel
+	rules    []*alertRule
+}
+
+// newAlertManager will validate the alert configuration and set up the
+// configured rules and notification channels. A "log" channel always exists
+// and is used for any rule that doesn't list its own channels.
+func newAlertManager(s *Sink, cfg *ConfigAlerts) (*alertManager, error) {
+	am := &alertManager{
+		sink:     s,
+		interval: cfg.Interval,
+		channels: map[string]alertChannel{"log": logChannel{}},
+		rules:    make([]*alertRule, 0, len(cfg.Rules)),
+	}
+	if am.interval <= 0 {
+		am.interval = time.Minute
+	}
+
+	for n, c := range cfg.Channels {
+		switch c.Type {
+		case "log":
+			am.channels[n] = logChannel{}
+		case "webhook":
+			if c.URL == "" {
+				return nil, fmt.Errorf("alert channel %q is missing a url", n)
+			}
+			am.channels[n] = webhookChannel{url: c.URL}
+		case "command":
+			if len(c.Command) == 0 {
+				return nil, fmt.Errorf("alert channel %q is missing a command", n)
+			}
+			am.channels[n] = commandChannel{args: c.Command}
+		default:
+			return nil, fmt.Errorf("alert channel %q has unknown type %q", n, c.Type)
+		}
+	}
+
+	for _, r := range cfg.Rules {
+		rule := &alertRule{cfg: r}
+		rule.metric = alertMetrics[r.Metric]
+		if rule.metric == nil {
+			return nil, fmt.Errorf("alert rule %q has unknown metric %q", r.Name, r.Metric)
+		}
+		rule.compare = alertOperators[r.Operator]
+		if rule.compare == nil {
+			return nil, fmt.Errorf("alert rule %q has unknown operator %q", r.Name, r.Operator)
+		}
+		threshold, err := parseThreshold(r.Threshold)
+		if err != nil {
+			return nil, fmt.Errorf("alert rule %q has invalid threshold: %v", r.Name, err)
+		}
+		rule.threshold = threshold
+		for _, c := range r.Channels {
+			if _, ok := am.channels[c]; !ok {
+				return nil, fmt.Errorf("alert rule %q references unknown channel %q", r.Name, c)
+			}
+		}
+		if len(r.Channels) == 0 {
+			r.Channels = []string{"log"}
+		}
+		am.rules = append(am.rules, rule)
+	}
+
+	return am, nil
+}
+
+// run evaluates the alert rules on the configured interval. It is intended to
+// be ran within its own goroutine.
+func (am *alertManager) run() {
+	for range time.Tick(am.interval) {
+		am.evaluate()
+	}
+}
+
+// evaluate checks each rule against the current state of the sink, tracking how
+// long its condition has held and notifying when it begins or stops firing.
+func (am *alertManager) evaluate() {
+	now := time.Now()
+	for _, r := range am.rules {
+		groups := am.sink.GroupsNamed(r.cfg.Group)
+		value := r.metric(groups)
+
+		if !r.compare(value, r.threshold) {
+			if r.firing {
+				r.firing = false
+				am.send(r.cfg.Channels, r.alert("resolved", value))
+			}
+			r.since = time.Time{}
+			continue
+		}
+
+		if r.since.IsZero() {
+			r.since = now
+		}
+		if !r.firing && now.Sub(r.since) >= r.cfg.For {
+			r.firing = true
+			am.send(r.cfg.Channels, r.alert("firing", value))
+		}
+	}
+}
+
+// notify can be used by other parts of the sink to deliver a one-off alert,
+// such as a failure event, through the named channels.
+func (am *alertManager) notify(channels []string, a *alert) {
+	if a.Time.IsZero() {
+		a.Time = time.Now()
+	}
+	if len(channels) == 0 {
+		channels = []string{"log"}
+	}
+	am.send(channels, a)
+}
+
+// send delivers the alert to the named channels in the background so a slow
+// webhook or command doesn't delay evaluating the other rules.
+func (am *alertManager) send(channels []string, a *alert) {
+	for _, n := range channels {
+		c := am.channels[n]
+		if c == nil {
+			continue
+		}
+		go func(n string, c alertChannel) {
+			if err := c.notify(a); err != nil {
+				log.Printf("Failed to send alert %q to channel %s: %v", a.Rule, n, err)
+			}
+		}(n, c)
+	}
+}
+
+// alert builds the notification payload for the rule's current state.
+func (r *alertRule) alert(state string, value float64) *alert {
+	scope := r.cfg.Group
+	if scope == "" {
+		scope = "destinations"
+	}
+	return &alert{
+		Rule:      r.cfg.Name,
+		State:     state,
+		Metric:    r.cfg.Metric,
+		Group:     r.cfg.Group,
+		Value:     value,
+		Threshold: r.threshold,
+		Message: fmt.Sprintf("%s: %s for %s is %s (%s %s)", r.cfg.Name, r.cfg.Metric,
+			scope, strconv.FormatFloat(value, 'f', -1, 64), r.cfg.Operator, r.cfg.Threshold),
+		Time: time.Now(),
+	}
+}
+
+// parseThreshold accepts either a plain number or a byte size such as "5 TiB".
+func parseThreshold(s string) (float64, error) {
+	if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+		return f, nil
+	}
+	b, err := humanize.ParseBytes(s)
+	if err != nil {
+		return 0, err
+	}
+	return float64(b), nil
+}
+
+// groupsSpace sums the free and total space across all paths in the groups,
+// counting pooled paths once.
+func groupsSpace(groups []*PlotGroup) (uint64, uint64) {
+	var free, total uint64
+	seen := make(map[*plotPool]bool)
+	for _, pg := range groups {
+		pg.sortMutex.RLock()
+		for _, pp := range pg.sortedPlots {
+			f, t := pp.countedSpace(seen)
+			free += f
+			total += t
+		}
+		pg.sortMutex.RUnlock()
+	}
+	return free, total
+}
+
+type logChannel struct{}
+
+func (logChannel) notify(a *alert) error {
+	log.Printf("ALERT [%s] %s", a.State, a.Message)
+	return nil
+}
+
+type webhookChannel struct {
+	url string
+}
+
+func (c webhookChannel) notify(a *alert) error {
+	return postJSON(c.url, a)
+}
+
+// commandChannel runs an external command for each alert, passing the details
+// in the environment.
+type commandChannel struct {
+	args []string
+}
+
+func (c commandChannel) notify(a *alert) error {
+	cmd := exec.Command(c.args[0], c.args[1:]...)
+	cmd.Env = append(os.Environ(),
+		"ALERT_RULE="+a.Rule,
+		"ALERT_STATE="+a.State,
+		"ALERT_METRIC="+a.Metric,
+		"ALERT_GROUP="+a.Group,
+		"ALERT_VALUE="+strconv.FormatFloat(a.Value, 'f', -1, 64),
+		"ALERT_MESSAGE="+a.Message,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestPausedPathsMetric checks paused_paths counts paths paused for any
+// reason, not only those paused after failures.
+func TestPausedPathsMetric(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for _, d := range []string{"cache", "d1", "d2", "d3", "d4", "d5"} {
+		p := filepath.Join(dir, d)
+		if err := os.Mkdir(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, p)
+	}
+
+	s, err := New(&Config{
+		Listen:       "127.0.0.1:0",
+		Cache:        &ConfigGroup{Paths: paths[:1], Concurrency: 1},
+		Destinations: map[string]*ConfigGroup{"a": {Paths: paths[1:], Concurrency: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	groups := s.GroupsNamed("")
+	if n := alertMetrics["paused_paths"](groups); n != 0 {
+		t.Fatalf("%v paths paused before any were", n)
+	}
+	pps := groups[0].sortedPlots
+	pps[0].paused.Store(true)
+	pps[1].adminPaused.Store(true)
+	pps[2].disabled.Store(true)
+	pps[3].faulted.Store(true)
+	if n := alertMetrics["paused_paths"](groups); n != 4 {
+		t.Errorf("%v paths paused, expected 4", n)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// placement describes a plot which has been successfully stored on its final
+// destination.
+type placement struct {
+	Time        time.Time `json:"time"`
+	Source      string    `json:"source"`
+	Filename    string    `json:"filename"`
+	Size        uint64    `json:"size"`
+	Group       string    `json:"group"`
+	Destination string    `json:"destination"`
+	Compression int       `json:"compression"`
+
+	// Replica is set for the extra copies of plots stored in groups with
+	// replicas
+	Replica bool `json:"replica,omitempty"`
+
+	// remote is set for plots uploaded to a remote store
+	remote bool
+}
+
+// auditLog is an append-only record of every plot stored by the sink, written
+// as either JSON lines or CSV.
+type auditLog struct {
+	format string
+	file   *os.File
+	csv    *csv.Writer
+	mutex  sync.Mutex
+}
+
+// auditColumns is the header row of CSV audit files. Columns are only added
+// at the end, so files started by older versions still read by position.
+var auditColumns = []string{"time", "source", "filename", "size", "group", "destination", "compression", "replica"}
+
+// newAuditLog will open the audit file for appending. When using CSV and the
+// file is new, the header row is written first.
+func newAuditLog(cfg *ConfigAuditLog) (*auditLog, error) {
+	a := &auditLog{format: cfg.Format}
+	if a.format == "" {
+		a.format = "jsonl"
+	}
+	if a.format != "jsonl" && a.format != "csv" {
+		return nil, fmt.Errorf("unknown audit log format %q", a.format)
+	}
+
+	f, err := os.OpenFile(cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	a.file = f
+
+	if a.format == "csv" {
+		a.csv = csv.NewWriter(f)
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if fi.Size() == 0 {
+			a.csv.Write(auditColumns)
+			a.csv.Flush()
+		}
+	}
+
+	return a, nil
+}
+
+// record appends the placement to the audit file.
+func (a *auditLog) record(p *placement) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.csv != nil {
+		a.csv.Write([]string{
+			p.Time.UTC().Format(time.RFC3339),
+			p.Source,
+			p.Filename,
+			strconv.FormatUint(p.Size, 10),
+			p.Group,
+			p.Destination,
+			strconv.Itoa(p.Compression),
+			strconv.FormatBool(p.Replica),
+		})
+		a.csv.Flush()
+		return a.csv.Error()
+	}
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	_, err = a.file.Write(append(b, '\n'))
+	return err
+}
+
+// recordPlacement is called once a plot has been moved to its final location,
+// and is responsible for informing anything tracking stored plots.
+func (s *Sink) recordPlacement(p *placement) {
+	if s.audit != nil {
+		if err := s.audit.record(p); err != nil {
+			log.Printf("Failed to write audit record for %s: %v", p.Filename, err)
+		}
+	}
+
+	s.stats.placed(p.Destination, p.Size, p.Compression, p.Replica)
+	s.sendHooks(p)
+	s.verifier.enqueue(p)
+
+	if s.harvester != nil && !p.remote {
+		go s.harvester.plotPlaced(p)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// backlogWindow is how far back the growth of a backlog is measured.
+const backlogWindow = 15 * time.Minute
+
+// backlogSample is the size of a backlog at a point in time.
+type backlogSample struct {
+	time  time.Time
+	plots int64
+}
+
+// backlogTracker counts the plots received into the cache which are waiting
+// for, or in the middle of, their move to a group's disks. A backlog growing
+// over the window means plots arrive faster than moves drain them, the early
+// sign of slow or misconfigured disks or routing.
+type backlogTracker struct {
+	plots atomic.Int64
+	bytes atomic.Int64
+
+	samples []backlogSample
+	mutex   sync.Mutex
+}
+
+// add records a plot entering the backlog.
+func (b *backlogTracker) add(size uint64) {
+	b.plots.Add(1)
+	b.bytes.Add(int64(size))
+}
+
+// done records a plot leaving the backlog, whether or not its move succeeded.
+func (b *backlogTracker) done(size uint64) {
+	b.plots.Add(-1)
+	b.bytes.Add(-int64(size))
+}
+
+// sample records the current backlog, dropping samples older than the window.
+func (b *backlogTracker) sample(now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.samples = append(b.samples, backlogSample{time: now, plots: b.plots.Load()})
+	for len(b.samples) > 1 && now.Sub(b.samples[1].time) >= backlogWindow {
+		b.samples = b.samples[1:]
+	}
+}
+
+// growth returns how many plots the backlog has grown by over the window, or
+// since sampling began if that is more recent. It is negative while moves are
+// draining the backlog.
+func (b *backlogTracker) growth() int64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if len(b.samples) == 0 {
+		return 0
+	}
+	return b.plots.Load() - b.samples[0].plots
+}
+
+// sampleBacklogs samples the backlog of each destination group every minute.
+// It is intended to be ran within its own goroutine.
+func (s *Sink) sampleBacklogs() {
+	for now := time.Now(); ; now = <-time.After(time.Minute) {
+		for _, pg := range s.GroupsNamed("") {
+			pg.backlog.sample(now)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// bandwidthWindow caps receiving at a rate during a time window.
+type bandwidthWindow struct {
+	window timeWindow
+	rate   uint64
+}
+
+// bandwidthSchedule caps the combined rate plots are received at, so a sink
+// sharing an uplink doesn't saturate it. The cap can change by time of day,
+// and the first window containing the current time applies, falling back to
+// the default limit. A rate of zero is unlimited.
+type bandwidthSchedule struct {
+	limiter *RateLimiter
+	limit   uint64
+	windows []bandwidthWindow
+	current uint64
+	mutex   sync.Mutex
+}
+
+// newBandwidthSchedule parses the bandwidth settings, which may be nil for no
+// limit.
+func newBandwidthSchedule(cfg *ConfigBandwidth) (*bandwidthSchedule, error) {
+	b := &bandwidthSchedule{limiter: NewRateLimiter(0)}
+	if cfg == nil {
+		return b, nil
+	}
+
+	if cfg.Limit != "" {
+		rate, err := humanize.ParseBytes(cfg.Limit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid limit %q: %v", cfg.Limit, err)
+		}
+		b.limit = rate
+	}
+	for _, sw := range cfg.Schedule {
+		w, err := parseWindow(sw.Window)
+		if err != nil {
+			return nil, err
+		}
+		rate, err := humanize.ParseBytes(sw.Limit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid limit %q for window %q: %v", sw.Limit, sw.Window, err)
+		}
+		b.windows = append(b.windows, bandwidthWindow{window: w, rate: rate})
+	}
+	return b, nil
+}
+
+// rateAt returns the cap at the time.
+func (b *bandwidthSchedule) rateAt(t time.Time) uint64 {
+	for _, w := range b.windows {
+		if w.window.contains(t) {
+			return w.rate
+		}
+	}
+	return b.limit
+}
+
+// apply sets the limiter to the cap at the time, logging when it changes.
+func (b *bandwidthSchedule) apply(t time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	rate := b.rateAt(t)
+	if rate == b.current {
+		return
+	}
+	b.current = rate
+	b.limiter.setRate(rate)
+	log.Printf("Receive bandwidth is now %s", formatRate(rate))
+}
+
+// formatRate describes a bandwidth limit, where zero is unlimited.
+func formatRate(rate uint64) string {
+	if rate == 0 {
+		return "unlimited"
+	}
+	return humanize.IBytes(rate) + "/s"
+}
+
+// update replaces the limit and windows with those of a reloaded config,
+// applying them right away.
+func (b *bandwidthSchedule) update(next *bandwidthSchedule) []string {
+	b.mutex.Lock()
+	changed := b.limit != next.limit || !slices.Equal(b.windows, next.windows)
+	b.limit, b.windows = next.limit, next.windows
+	b.mutex.Unlock()
+
+	b.apply(time.Now())
+	if changed {
+		return []string{"bandwidth schedule changed"}
+	}
+	return nil
+}
+
+// run keeps the limiter at the current window's cap. It is intended to be ran
+// within its own goroutine.
+func (b *bandwidthSchedule) run() {
+	b.apply(time.Now())
+
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		b.apply(now)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxBraceExpansion limits how many paths a single pattern can expand to, so a
+// typo can't exhaust memory.
+const maxBraceExpansion = 10000
+
+// expandBraces expands shell style braces in the pattern. Numeric ranges like
+// {1..4} and zero padded ones like {01..24} are supported, along with lists
+// like {a,b,c}. Multiple braces produce every combination, in order.
+func expandBraces(pattern string) ([]string, error) {
+	start := strings.IndexByte(pattern, '{')
+	if start < 0 {
+		return []string{pattern}, nil
+	}
+	end := strings.IndexByte(pattern[start:], '}')
+	if end < 0 {
+		return nil, fmt.Errorf("unmatched '{' in %q", pattern)
+	}
+	end += start
+
+	items, err := braceItems(pattern[start+1 : end])
+	if err != nil {
+		return nil, fmt.Errorf("invalid braces in %q: %v", pattern, err)
+	}
+
+	rest, err := expandBraces(pattern[end+1:])
+	if err != nil {
+		return nil, err
+	}
+	if len(items)*len(rest) > maxBraceExpansion {
+		return nil, fmt.Errorf("%q expands to more than %d paths", pattern, maxBraceExpansion)
+	}
+
+	prefix := pattern[:start]
+	expanded := make([]string, 0, len(items)*len(rest))
+	for _, item := range items {
+		for _, r := range rest {
+			expanded = append(expanded, prefix+item+r)
+		}
+	}
+	return expanded, nil
+}
+
+// braceItems returns the values for the contents of a single brace.
+func braceItems(body string) ([]string, error) {
+	from, to, ok := strings.Cut(body, "..")
+	if !ok {
+		if !strings.Contains(body, ",") {
+			return nil, fmt.Errorf("{%s} is not a range or list", body)
+		}
+		return strings.Split(body, ","), nil
+	}
+
+	first, err := strconv.Atoi(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid range start %q", from)
+	}
+	last, err := strconv.Atoi(to)
+	if err != nil {
+		return nil, fmt.Errorf("invalid range end %q", to)
+	}
+	if last-first >= maxBraceExpansion || first-last >= maxBraceExpansion {
+		return nil, fmt.Errorf("range {%s} is too large", body)
+	}
+
+	// pad to the width of the bounds when either has a leading zero
+	width := 0
+	if (len(from) > 1 && from[0] == '0') || (len(to) > 1 && to[0] == '0') {
+		width = max(len(from), len(to))
+	}
+
+	step := 1
+	if last < first {
+		step = -1
+	}
+	items := make([]string, 0)
+	for i := first; ; i += step {
+		items = append(items, fmt.Sprintf("%0*d", width, i))
+		if i == last {
+			break
+		}
+	}
+	return items, nil
+}
@@ -0,0 +1,132 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"unsafe"
+
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	// defaultBufferSize is the size of the buffers used to copy plots when
+	// one isn't configured.
+	defaultBufferSize = 1 << 20
+
+	// bufferAlignment satisfies the alignment direct I/O requires of buffers,
+	// including on disks with 4K sectors.
+	bufferAlignment = 4096
+)
+
+// flushWriter is a writer which holds back part of what's written until it's
+// flushed, such as the directio writer holding an unaligned tail.
+type flushWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// bufferPool holds copy buffers of a single size, so concurrent transfers
+// reuse buffers rather than allocating new ones for every copy.
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// newBufferPool returns a pool of aligned buffers. The size is rounded up to
+// a multiple of the alignment, so full buffers can be written with direct I/O.
+func newBufferPool(size int) *bufferPool {
+	if size <= 0 {
+		size = defaultBufferSize
+	}
+	size = (size + bufferAlignment - 1) &^ (bufferAlignment - 1)
+
+	bp := &bufferPool{size: size}
+	bp.pool.New = func() any {
+		b := alignedBuffer(size)
+		return &b
+	}
+	return bp
+}
+
+func (bp *bufferPool) get() *[]byte {
+	return bp.pool.Get().(*[]byte)
+}
+
+func (bp *bufferPool) put(b *[]byte) {
+	bp.pool.Put(b)
+}
+
+// alignedBuffer allocates a buffer of size bytes starting on an aligned
+// address, as required for direct I/O writes.
+func alignedBuffer(size int) []byte {
+	b := make([]byte, size+bufferAlignment)
+	offset := 0
+	if rem := int(uintptr(unsafe.Pointer(&b[0])) & (bufferAlignment - 1)); rem != 0 {
+		offset = bufferAlignment - rem
+	}
+	return b[offset : offset+size]
+}
+
+// writerOnly hides any ReadFrom method of the writer, so io.CopyBuffer uses
+// the supplied buffer rather than the writer's own copy.
+type writerOnly struct {
+	io.Writer
+}
+
+// copyBuffer copies from src to dst using a buffer from the pool.
+func (bp *bufferPool) copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	buf := bp.get()
+	defer bp.put(buf)
+
+	return io.CopyBuffer(writerOnly{dst}, src, *buf)
+}
+
+// copyFull copies from src to dst using a buffer from the pool, filling the
+// buffer completely before each write. Every write except the last is then a
+// full, aligned buffer, which a direct I/O writer passes straight to the disk
+// without copying it into its own buffer.
+func (bp *bufferPool) copyFull(dst io.Writer, src io.Reader) (int64, error) {
+	buf := bp.get()
+	defer bp.put(buf)
+
+	var written int64
+	for {
+		n, err := io.ReadFull(src, *buf)
+		if n > 0 {
+			nw, werr := dst.Write((*buf)[:n])
+			written += int64(nw)
+			if werr != nil {
+				return written, werr
+			}
+			if nw != n {
+				return written, io.ErrShortWrite
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// parseBufferSize parses a configured buffer size such as "4MiB". An empty
+// size returns zero, for the default.
+func parseBufferSize(s string) (uint64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := humanize.ParseBytes(s)
+	if err != nil {
+		return 0, err
+	}
+	if n > 1<<30 {
+		return 0, fmt.Errorf("%s is larger than 1GiB", s)
+	}
+	return n, nil
+}
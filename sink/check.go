@@ -0,0 +1,331 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// configCheck collects the results of validating a configuration.
+type configCheck struct {
+	out      io.Writer
+	errors   int
+	warnings int
+}
+
+func (c *configCheck) ok(format string, args ...any) {
+	fmt.Fprintf(c.out, "ok     %s\n", fmt.Sprintf(format, args...))
+}
+
+func (c *configCheck) warn(format string, args ...any) {
+	c.warnings++
+	fmt.Fprintf(c.out, "WARN   %s\n", fmt.Sprintf(format, args...))
+}
+
+func (c *configCheck) fail(format string, args ...any) {
+	c.errors++
+	fmt.Fprintf(c.out, "ERROR  %s\n", fmt.Sprintf(format, args...))
+}
+
+// CheckConfig fully validates the configuration without starting the sink and
+// writes a report of everything checked to out. It returns the number of errors
+// found.
+func CheckConfig(filename string, out io.Writer) int {
+	c := &configCheck{out: out}
+
+	cfg, err := LoadConfig(filename)
+	if err != nil {
+		c.fail("config %s failed to load: %v", filename, err)
+		return 1
+	}
+	c.ok("config %s parsed", filename)
+
+	// every path seen, to catch one being used more than once
+	seen := make(map[string]string)
+	rootDev := DeviceOf("/")
+
+	if cfg.Cache == nil || len(cfg.Cache.Paths) == 0 {
+		c.fail("cache has no paths")
+	} else {
+		c.checkGroup("cache", cfg.Cache, seen, rootDev)
+	}
+	if len(cfg.Destinations) == 0 {
+		c.fail("no destination groups are configured")
+	}
+	names := make([]string, 0, len(cfg.Destinations))
+	for n := range cfg.Destinations {
+		names = append(names, n)
+	}
+	slices.Sort(names)
+	for _, n := range names {
+		if n == "cache" {
+			c.fail("destination group can't be named %q, it is reserved", n)
+		}
+		if cfg.Destinations[n] == nil {
+			c.fail("group %q is empty", n)
+			continue
+		}
+		c.checkGroup(n, cfg.Destinations[n], seen, rootDev)
+	}
+	switch cfg.SharedDevices {
+	case "", "warn", "refuse":
+	default:
+		c.fail("shared_devices must be warn or refuse, not %q", cfg.SharedDevices)
+	}
+	for _, problem := range sharedDevices(seen) {
+		if cfg.SharedDevices == "refuse" {
+			c.fail("%s", problem)
+		} else {
+			c.warn("%s", problem)
+		}
+	}
+
+	// other sections which are validated when the sink starts
+	if cfg.Alerts != nil {
+		if _, err := newAlertManager(nil, cfg.Alerts); err != nil {
+			c.fail("alerts: %v", err)
+		} else {
+			c.ok("alerts: %d rules", len(cfg.Alerts.Rules))
+		}
+	}
+	if cfg.AuditLog != nil {
+		if cfg.AuditLog.Format != "" && cfg.AuditLog.Format != "jsonl" && cfg.AuditLog.Format != "csv" {
+			c.fail("audit_log: unknown format %q", cfg.AuditLog.Format)
+		} else if fi, err := os.Stat(filepath.Dir(cfg.AuditLog.Path)); err != nil || !fi.IsDir() {
+			c.fail("audit_log: directory for %s doesn't exist", cfg.AuditLog.Path)
+		} else {
+			c.ok("audit_log: %s", cfg.AuditLog.Path)
+		}
+	}
+	if cfg.Schedule != nil {
+		if _, err := parseWindows(cfg.Schedule.Ingest); err != nil {
+			c.fail("schedule: ingest: %v", err)
+		}
+		if _, err := parseWindows(cfg.Schedule.Moves); err != nil {
+			c.fail("schedule: moves: %v", err)
+		}
+	}
+	if cfg.PlotPermissions != nil {
+		if _, err := newFilePermissions(cfg.PlotPermissions); err != nil {
+			c.fail("plot_permissions: %v", err)
+		}
+	}
+	if _, err := newFilenamePattern(cfg.FilenamePattern); err != nil {
+		c.fail("filename_pattern: %v", err)
+	}
+	if _, err := newMoveRetryPolicy(cfg.MoveRetry); err != nil {
+		c.fail("move_retry: %v", err)
+	}
+	if _, err := newTempNaming(cfg.TempFiles); err != nil {
+		c.fail("temp_files: %v", err)
+	}
+	if _, err := newPeerRedirects(cfg.Redirect); err != nil {
+		c.fail("redirect: %v", err)
+	}
+	if _, err := newCluster(nil, cfg); err != nil {
+		c.fail("cluster: %v", err)
+	}
+	if cfg.RunAs != nil {
+		if cfg.RunAs.User == "" {
+			c.fail("run_as: a user is required")
+		} else if _, err := lookupUID(cfg.RunAs.User); err != nil {
+			c.fail("run_as: %v", err)
+		}
+		if cfg.RunAs.Group != "" {
+			if _, err := lookupGID(cfg.RunAs.Group); err != nil {
+				c.fail("run_as: %v", err)
+			}
+		}
+	}
+	if cfg.Buffers != nil {
+		if _, err := parseBufferSize(cfg.Buffers.Receive); err != nil {
+			c.fail("buffers: invalid receive size: %v", err)
+		}
+		if _, err := parseBufferSize(cfg.Buffers.Move); err != nil {
+			c.fail("buffers: invalid move size: %v", err)
+		}
+	}
+	if cfg.CPU != nil {
+		if cfg.CPU.GOMAXPROCS < 0 {
+			c.fail("cpu: gomaxprocs can't be negative")
+		}
+		if cfg.CPU.Affinity != "" {
+			if _, err := parseCPUList(cfg.CPU.Affinity); err != nil {
+				c.fail("cpu: affinity: %v", err)
+			}
+		}
+	}
+	if _, _, err := parsePlotSizes(cfg.PlotSize); err != nil {
+		c.fail("plot_size: %v", err)
+	}
+	if cfg.Keys != nil {
+		if _, err := newKeyFilter(cfg.Keys); err != nil {
+			c.fail("keys: %v", err)
+		}
+	}
+	if _, err := newPlotterSet(cfg.Plotters); err != nil {
+		c.fail("plotters: %v", err)
+	}
+	for name, pc := range cfg.Plotters {
+		for _, g := range pc.Groups {
+			if cfg.Destinations[g] == nil {
+				c.fail("plotters: plotter %q uses unknown group %q", name, g)
+			}
+		}
+	}
+	if _, err := newBandwidthSchedule(cfg.Bandwidth); err != nil {
+		c.fail("bandwidth: %v", err)
+	}
+	if m := newLoadMonitor(cfg.Load); m != nil {
+		if _, err := m.check(); err != nil {
+			c.fail("load: %v", err)
+		}
+	}
+	if t := cfg.Temperature; t != nil {
+		if t.Slow > 0 && t.Max > 0 && t.Slow >= t.Max {
+			c.fail("temperature: slow must be below max")
+		}
+		if t.Slow > 0 || t.Max > 0 {
+			smartctl := t.Smartctl
+			if smartctl == "" {
+				smartctl = "smartctl"
+			}
+			if _, err := exec.LookPath(smartctl); err != nil {
+				c.warn("temperature: %s not found, only disks with an hwmon sensor are monitored", smartctl)
+			}
+		}
+	}
+	if cfg.Verify != nil {
+		if v, err := newVerifier(nil, cfg.Verify); err != nil {
+			c.fail("verify: %v", err)
+		} else {
+			if _, err := exec.LookPath(v.command[0]); err != nil {
+				c.warn("verify: %s not found, plots won't be verified", v.command[0])
+			}
+			for _, ch := range v.channels {
+				if cfg.Alerts == nil || (ch != "log" && cfg.Alerts.Channels[ch] == nil) {
+					c.fail("verify: unknown alert channel %q", ch)
+				}
+			}
+		}
+	}
+	if cfg.Priority != nil && cfg.Priority.ReservedSlots < 0 {
+		c.fail("priority: reserved_slots can't be negative")
+	}
+	if cfg.ControlSocketMode != "" {
+		if _, err := strconv.ParseUint(cfg.ControlSocketMode, 8, 32); err != nil {
+			c.fail("control_socket_mode: invalid mode %q", cfg.ControlSocketMode)
+		}
+	}
+
+	fmt.Fprintf(c.out, "\n%d errors, %d warnings\n", c.errors, c.warnings)
+	return c.errors
+}
+
+// checkGroup validates a group's concurrency and each of its paths.
+func (c *configCheck) checkGroup(name string, cfg *ConfigGroup, seen map[string]string, rootDev uint64) {
+	if cfg.Concurrency <= 0 {
+		c.fail("group %q: concurrency must be at least 1, got %d", name, cfg.Concurrency)
+	}
+
+	if cfg.isRemote() {
+		stores, err := newRemoteStores(cfg)
+		if err != nil {
+			c.fail("group %q: %v", name, err)
+			return
+		}
+		for _, store := range stores {
+			c.ok("group %q: %s destination %s", name, cfg.Type, store)
+		}
+		return
+	}
+
+	// how many plots the paths can take at once, or -1 if unlimited
+	count, limit := 0, int64(0)
+	for _, p := range cfg.Paths {
+		if strings.HasPrefix(p, "!") {
+			continue
+		}
+
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			c.fail("group %q: path %s failed expansion: %v", name, p, err)
+			continue
+		}
+		matches, err := filepath.Glob(abs)
+		if err != nil {
+			c.fail("group %q: path %s failed globbing: %v", name, p, err)
+			continue
+		}
+		if len(matches) == 0 {
+			c.fail("group %q: path %s doesn't exist", name, p)
+			continue
+		}
+
+		for _, m := range matches {
+			if cfg.excluded(m) {
+				c.ok("group %q: path %s is excluded", name, m)
+				continue
+			}
+			if other, ok := seen[m]; ok {
+				c.fail("group %q: path %s is also used by group %q", name, m, other)
+				continue
+			}
+			seen[m] = name
+
+			fi, err := os.Stat(m)
+			if err != nil {
+				c.fail("group %q: path %s: %v", name, m, err)
+				continue
+			}
+			if !fi.IsDir() {
+				c.fail("group %q: path %s is not a directory", name, m)
+				continue
+			}
+			if cfg.skipFile != "" {
+				if _, err := os.Stat(filepath.Join(m, cfg.skipFile)); err == nil {
+					c.warn("group %q: path %s contains %s and will be skipped", name, m, cfg.skipFile)
+					continue
+				}
+			}
+			if rootDev != 0 && DeviceOf(m) == rootDev {
+				if cfg.mount {
+					c.fail("group %q: path %s is on the root filesystem and will be refused until its disk is mounted", name, m)
+					continue
+				} else {
+					c.warn("group %q: path %s is on the root filesystem, the disk may not be mounted", name, m)
+				}
+			}
+
+			free, total, err := DiskSpace(m)
+			if err != nil {
+				c.fail("group %q: path %s: %v", name, m, err)
+				continue
+			}
+			if fs := networkFilesystem(m); fs != "" {
+				c.warn("group %q: path %s is on a network filesystem (%s), direct I/O will be disabled for it", name, m, fs)
+			}
+			count++
+			if n := cfg.pathConcurrency(m); n == 0 || limit < 0 {
+				limit = -1
+			} else {
+				limit += n
+			}
+			c.ok("group %q: path %s [%s free / %s total]", name, m,
+				humanize.IBytes(free), humanize.IBytes(total))
+		}
+	}
+
+	if name != "cache" && count > 0 && limit >= 0 && cfg.Concurrency > limit {
+		c.warn("group %q: concurrency %d exceeds the %d its paths can take and will be lowered", name, cfg.Concurrency, limit)
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clusterMember is the capacity and load a sink shares with the rest of its
+// cluster.
+type clusterMember struct {
+	Name           string    `json:"name"`
+	Address        string    `json:"address"`
+	FreeSpace      uint64    `json:"free_space"`
+	TotalSpace     uint64    `json:"total_space"`
+	MaxFree        uint64    `json:"max_free"`
+	Connections    int64     `json:"connections"`
+	MaxConnections int64     `json:"max_connections,omitempty"`
+	Overloaded     bool      `json:"overloaded,omitempty"`
+	Updated        time.Time `json:"updated"`
+	Stale          bool      `json:"stale,omitempty"`
+
+	// when the member's state last changed, by the local clock, so hosts'
+	// clocks needn't agree
+	seen time.Time
+}
+
+// clusterGossip is exchanged between members, each sending the members it
+// knows of and replying with its own, so members learn of each other through
+// any peer they share.
+type clusterGossip struct {
+	Members []*clusterMember `json:"members"`
+}
+
+// clusterView is the aggregate status of the cluster.
+type clusterView struct {
+	Name        string           `json:"name"`
+	FreeSpace   uint64           `json:"free_space"`
+	TotalSpace  uint64           `json:"total_space"`
+	Connections int64            `json:"connections"`
+	Members     []*clusterMember `json:"members"`
+}
+
+// cluster shares the sink's capacity and load with its peers, and tracks
+// theirs, so refused plots can be redirected to the member with room for
+// them.
+type cluster struct {
+	sink     *Sink
+	name     string
+	address  string
+	token    string
+	peers    []string
+	interval time.Duration
+
+	members map[string]*clusterMember
+	mutex   sync.Mutex
+}
+
+// newCluster returns the cluster from the config, or nil when clustering
+// isn't configured. The name defaults to the hostname, and the address to the
+// hostname with the port plots are received on.
+func newCluster(s *Sink, cfg *Config) (*cluster, error) {
+	cc := cfg.Cluster
+	if cc == nil {
+		return nil, nil
+	}
+	if len(cc.Peers) == 0 {
+		return nil, errors.New("at least one peer is required")
+	}
+	if cfg.ControlListen == "" {
+		return nil, errors.New("control_listen is required for peers to reach the sink")
+	}
+
+	c := &cluster{
+		sink:     s,
+		name:     cc.Name,
+		address:  cc.Address,
+		token:    cc.Token,
+		peers:    make([]string, 0, len(cc.Peers)),
+		interval: cc.Interval,
+		members:  make(map[string]*clusterMember),
+	}
+	if c.token == "" {
+		c.token = cfg.ControlToken
+	}
+	if c.token == "" {
+		return nil, errors.New("a token is required, either its own or the control_token")
+	}
+	if c.interval <= 0 {
+		c.interval = 10 * time.Second
+	}
+
+	hostname, _ := os.Hostname()
+	if c.name == "" {
+		c.name = hostname
+	}
+	if c.address == "" {
+		_, port, err := net.SplitHostPort(cfg.listenAddress())
+		if err != nil || hostname == "" {
+			return nil, errors.New("address is required when the hostname and listen port are unknown")
+		}
+		c.address = net.JoinHostPort(hostname, port)
+	}
+	if _, _, err := net.SplitHostPort(c.address); err != nil {
+		return nil, fmt.Errorf("invalid address %q: %v", c.address, err)
+	}
+
+	for _, peer := range cc.Peers {
+		u, err := url.Parse(peer)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid peer %q, must be the http url of its control interface", peer)
+		}
+		c.peers = append(c.peers, strings.TrimSuffix(peer, "/"))
+	}
+	return c, nil
+}
+
+// self returns the sink's own state as shared with its peers.
+func (c *cluster) self() *clusterMember {
+	s := c.sink
+	m := &clusterMember{
+		Name:           c.name,
+		Address:        c.address,
+		Connections:    s.connections.Load(),
+		MaxConnections: s.maxConnections,
+		Overloaded:     s.load != nil && s.load.overloaded.Load(),
+		Updated:        time.Now(),
+		seen:           time.Now(),
+	}
+	for _, pg := range s.GroupsNamed("") {
+		gs := pg.Status()
+		m.FreeSpace += gs.FreeSpace
+		m.TotalSpace += gs.TotalSpace
+		if gs.Paused || gs.Disabled || gs.Draining {
+			continue
+		}
+		for _, ps := range gs.Paths {
+			if !ps.Paused && !ps.AdminPaused && !ps.Disabled && ps.Fault == "" {
+				m.MaxFree = max(m.MaxFree, ps.FreeSpace)
+			}
+		}
+	}
+	return m
+}
+
+// merge records the members' states which are newer than those known.
+func (c *cluster) merge(members []*clusterMember) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, m := range members {
+		if m == nil || m.Name == "" || m.Name == c.name {
+			continue
+		}
+		known := c.members[m.Name]
+		if known != nil && !m.Updated.After(known.Updated) {
+			continue
+		}
+		if known == nil {
+			log.Printf("Cluster member %s joined at %s", m.Name, m.Address)
+		}
+		m.Stale = false
+		m.seen = time.Now()
+		c.members[m.Name] = m
+	}
+}
+
+// snapshot returns the sink's own state followed by the other members', by
+// name, with those which haven't changed in three intervals marked stale.
+func (c *cluster) snapshot() []*clusterMember {
+	self := c.self()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	members := make([]*clusterMember, 0, len(c.members)+1)
+	for _, m := range c.members {
+		cp := *m
+		cp.Stale = time.Since(m.seen) > 3*c.interval
+		members = append(members, &cp)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return append([]*clusterMember{self}, members...)
+}
+
+// run exchanges states with each peer on the interval. It is intended to be
+// ran within its own goroutine.
+func (c *cluster) run() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	failing := make(map[string]bool)
+	for {
+		for _, peer := range c.peers {
+			err := c.gossip(peer)
+			switch {
+			case err != nil && !failing[peer]:
+				log.Printf("Failed to exchange cluster state with %s: %v", peer, err)
+			case err == nil && failing[peer]:
+				log.Printf("Exchanging cluster state with %s again", peer)
+			}
+			failing[peer] = err != nil
+		}
+		<-ticker.C
+	}
+}
+
+// gossip sends the known states to the peer and merges those it replies with.
+func (c *cluster) gossip(peer string) error {
+	b, err := json.Marshal(&clusterGossip{Members: c.snapshot()})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, peer+"/cluster/gossip", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+
+	var reply clusterGossip
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return err
+	}
+	c.merge(reply.Members)
+	return nil
+}
+
+// pick returns the address of the member with the most free space which can
+// take a plot of the size, or an empty string when none can. Members which
+// are stale, overloaded, or at their connection limit are passed over.
+func (c *cluster) pick(size uint64) string {
+	if c == nil {
+		return ""
+	}
+	var best *clusterMember
+	for _, m := range c.snapshot()[1:] {
+		switch {
+		case m.Stale || m.Overloaded || m.Address == "" || m.MaxFree < size:
+			continue
+		case m.MaxConnections > 0 && m.Connections >= m.MaxConnections:
+			continue
+		case best == nil || m.FreeSpace > best.FreeSpace:
+			best = m
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return best.Address
+}
+
+// view returns the aggregate status of the cluster, totalling the members
+// which aren't stale.
+func (c *cluster) view() *clusterView {
+	v := &clusterView{Name: c.name, Members: c.snapshot()}
+	for _, m := range v.Members {
+		if m.Stale {
+			continue
+		}
+		v.FreeSpace += m.FreeSpace
+		v.TotalSpace += m.TotalSpace
+		v.Connections += m.Connections
+	}
+	return v
+}
+
+// handleCluster returns the aggregate status of the cluster as JSON.
+func (s *Sink) handleCluster(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.cluster.view())
+}
+
+// handleClusterGossip merges the states sent by a peer, replying with those
+// known here. Peers authenticate with the cluster's token.
+func (s *Sink) handleClusterGossip(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, &AdminResponse{Error: "method not allowed"})
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.cluster.token)) != 1 {
+		writeJSON(w, http.StatusUnauthorized, &AdminResponse{Error: "unauthorized"})
+		return
+	}
+
+	var msg clusterGossip
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&msg); err != nil {
+		writeJSON(w, http.StatusBadRequest, &AdminResponse{Error: fmt.Sprintf("invalid gossip: %v", err)})
+		return
+	}
+	s.cluster.merge(msg.Members)
+	writeJSON(w, http.StatusOK, &clusterGossip{Members: s.cluster.snapshot()})
+}
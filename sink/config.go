@@ -0,0 +1,645 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/dustin/go-humanize"
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Listen              string                    `yaml:"listen"`
+	SkipDirectoryFile   string                    `yaml:"skip_directory_file"`
+	RequireMount        bool                      `yaml:"require_mount"`
+	SharedDevices       string                    `yaml:"shared_devices"`
+	ControlListen       string                    `yaml:"control_listen"`
+	ControlToken        string                    `yaml:"control_token"`
+	ControlSocket       string                    `yaml:"control_socket"`
+	ControlSocketMode   string                    `yaml:"control_socket_mode"`
+	StarvedPathInterval time.Duration             `yaml:"starved_path_interval"`
+	SummaryInterval     time.Duration             `yaml:"summary_interval"`
+	ShutdownTimeout     time.Duration             `yaml:"shutdown_timeout"`
+	StallTimeout        time.Duration             `yaml:"stall_timeout"`
+	FreeSpaceInterval   time.Duration             `yaml:"free_space_interval"`
+	WatchDestinations   bool                      `yaml:"watch_destinations"`
+	MaxConnections      int                       `yaml:"max_connections"`
+	Cache               *ConfigGroup              `yaml:"cache"`
+	Destinations        map[string]*ConfigGroup   `yaml:"destinations"`
+	Alerts              *ConfigAlerts             `yaml:"alerts"`
+	AuditLog            *ConfigAuditLog           `yaml:"audit_log"`
+	Webhooks            []string                  `yaml:"webhooks"`
+	Integrations        *ConfigIntegrations       `yaml:"integrations"`
+	Harvester           *ConfigHarvester          `yaml:"harvester"`
+	Schedule            *ConfigSchedule           `yaml:"schedule"`
+	PlotPermissions     *ConfigPermissions        `yaml:"plot_permissions"`
+	TempFiles           *ConfigTempFiles          `yaml:"temp_files"`
+	MoveRetry           *ConfigMoveRetry          `yaml:"move_retry"`
+	RunAs               *ConfigRunAs              `yaml:"run_as"`
+	StateFile           string                    `yaml:"state_file"`
+	PlotDirectories     *ConfigPlotDirectories    `yaml:"plot_directories"`
+	Buffers             *ConfigBuffers            `yaml:"buffers"`
+	SpeedProbe          string                    `yaml:"speed_probe"`
+	PlotSize            *ConfigPlotSize           `yaml:"plot_size"`
+	Keys                *ConfigKeys               `yaml:"keys"`
+	FilenamePattern     string                    `yaml:"filename_pattern"`
+	Sidecar             bool                      `yaml:"sidecar"`
+	ChecksumXattr       bool                      `yaml:"checksum_xattr"`
+	Dedupe              bool                      `yaml:"dedupe"`
+	MtimeFromFilename   bool                      `yaml:"mtime_from_filename"`
+	Relay               *ConfigRelay              `yaml:"relay"`
+	Redirect            ConfigStrings             `yaml:"redirect"`
+	Cluster             *ConfigCluster            `yaml:"cluster"`
+	Plotters            map[string]*ConfigPlotter `yaml:"plotters"`
+	Priority            *ConfigPriority           `yaml:"priority"`
+	Bandwidth           *ConfigBandwidth          `yaml:"bandwidth"`
+	Load                *ConfigLoad               `yaml:"load"`
+	Temperature         *ConfigTemperature        `yaml:"temperature"`
+	Verify              *ConfigVerify             `yaml:"verify"`
+	CPU                 *ConfigCPU                `yaml:"cpu"`
+	Include             ConfigStrings             `yaml:"include"`
+
+	// file is where the config was loaded from, and is re-read on reload
+	file string
+}
+
+// ConfigStrings is a list of strings which can also be given as a single
+// string in the config.
+type ConfigStrings []string
+
+func (cs *ConfigStrings) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*cs = ConfigStrings{value.Value}
+		return nil
+	}
+	var list []string
+	if err := value.Decode(&list); err != nil {
+		return err
+	}
+	*cs = list
+	return nil
+}
+
+// LoadConfig reads and parses the configuration file, merging in destination
+// groups from any included files, and applies environment overrides.
+func LoadConfig(filename string) (*Config, error) {
+	cfg, err := decodeConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.loadIncludes(filename); err != nil {
+		return nil, err
+	}
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	cfg.file = filename
+	if cfg.Relay != nil {
+		if err := cfg.relayConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	// expand each group's paths and resolve its skip file and mount
+	// requirement, which fall back to the global ones
+	groups := []*ConfigGroup{cfg.Cache}
+	for _, dst := range cfg.Destinations {
+		groups = append(groups, dst)
+	}
+	for _, g := range groups {
+		if g == nil {
+			continue
+		}
+
+		if g.ChiaConfig != "" {
+			dirs, err := chiaPlotDirectories(g.ChiaConfig)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read plot directories from %s: %v", g.ChiaConfig, err)
+			}
+			g.Paths = append(g.Paths, dirs...)
+		}
+
+		// expand any brace templates in the paths
+		paths := make([]string, 0, len(g.Paths))
+		for _, p := range g.Paths {
+			expanded, err := expandBraces(p)
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, expanded...)
+		}
+		g.Paths = paths
+
+		if g.Type != "" && !groupTypes[g.Type] {
+			return nil, fmt.Errorf("unknown group type %q", g.Type)
+		}
+		if g.Strategy != "" && !strategies[g.Strategy] {
+			return nil, fmt.Errorf("unknown strategy %q", g.Strategy)
+		}
+		if g.Reserve != "" {
+			if _, err := humanize.ParseBytes(g.Reserve); err != nil {
+				return nil, fmt.Errorf("invalid reserve %q: %v", g.Reserve, err)
+			}
+		}
+		if g.Bandwidth != "" {
+			if _, err := humanize.ParseBytes(g.Bandwidth); err != nil {
+				return nil, fmt.Errorf("invalid bandwidth %q: %v", g.Bandwidth, err)
+			}
+		}
+		if g.Replicas < 0 {
+			return nil, fmt.Errorf("invalid replicas %d", g.Replicas)
+		}
+
+		g.skipFile = cfg.SkipDirectoryFile
+		if g.SkipDirectoryFile != nil {
+			g.skipFile = *g.SkipDirectoryFile
+		}
+		g.mount = cfg.RequireMount
+		if g.RequireMount != nil {
+			g.mount = *g.RequireMount
+		}
+	}
+	for n, g := range cfg.Destinations {
+		if g == nil {
+			continue
+		}
+		for _, rg := range g.ReplicaGroups {
+			if cfg.Destinations[rg] == nil {
+				return nil, fmt.Errorf("group %q has unknown replica group %q", n, rg)
+			}
+		}
+	}
+	if cfg.Alerts != nil {
+		for _, r := range cfg.Alerts.Rules {
+			if !cfg.hasGroup(r.Group) {
+				return nil, fmt.Errorf("alert rule %q has unknown group %q", r.Name, r.Group)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// hasGroup returns true if name is a destination group, the cache, or empty
+// for all of the destination groups.
+func (cfg *Config) hasGroup(name string) bool {
+	return name == "" || name == "cache" || cfg.Destinations[name] != nil
+}
+
+// chiaPlotDirectories returns the harvester's plot_directories from a Chia
+// config file. A leading "~" in the filename is expanded to the home directory.
+func chiaPlotDirectories(filename string) ([]string, error) {
+	if rest, ok := strings.CutPrefix(filename, "~/"); ok {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		filename = filepath.Join(home, rest)
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var chia struct {
+		Harvester struct {
+			PlotDirectories []string `yaml:"plot_directories"`
+		} `yaml:"harvester"`
+	}
+	if err := yaml.Unmarshal(b, &chia); err != nil {
+		return nil, err
+	}
+	return chia.Harvester.PlotDirectories, nil
+}
+
+// decodeConfig reads and parses a single configuration file. The format is
+// detected from the extension: TOML and JSON files are converted to YAML so
+// that all of the formats share the same keys, and anything else is parsed as
+// YAML.
+func decodeConfig(filename string) (*Config, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc any
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".toml":
+		var m map[string]any
+		_, err = toml.Decode(string(b), &m)
+		doc = m
+	case ".json":
+		err = json.Unmarshal(b, &doc)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if doc != nil {
+		if b, err = yaml.Marshal(doc); err != nil {
+			return nil, err
+		}
+	}
+
+	var cfg *Config
+	if err := yaml.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	return cfg, nil
+}
+
+// loadIncludes merges the destination groups from the files matching the
+// include patterns. Relative patterns are resolved from the directory of the
+// main config file. Only destinations are read from included files, and a
+// group name may only be defined once across all of the files.
+func (cfg *Config) loadIncludes(filename string) error {
+	if cfg.Destinations == nil {
+		cfg.Destinations = make(map[string]*ConfigGroup)
+	}
+	defined := make(map[string]string)
+	for n := range cfg.Destinations {
+		defined[n] = filename
+	}
+
+	for _, pattern := range cfg.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(filename), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid include %q: %v", pattern, err)
+		}
+
+		for _, m := range matches {
+			inc, err := decodeConfig(m)
+			if err != nil {
+				return fmt.Errorf("failed to load included %s: %v", m, err)
+			}
+			for n, dst := range inc.Destinations {
+				if other, ok := defined[n]; ok {
+					return fmt.Errorf("destination group %q in %s is already defined in %s", n, m, other)
+				}
+				defined[n] = m
+				cfg.Destinations[n] = dst
+			}
+		}
+	}
+	return nil
+}
+
+// applyEnv overrides settings from the config file with any set in the
+// environment. PLOT_SINK_CONCURRENCY sets the concurrency of every destination
+// group, and PLOT_SINK_CACHE replaces the cache paths, separated like $PATH.
+func (cfg *Config) applyEnv() error {
+	if v := os.Getenv("PLOT_SINK_CONCURRENCY"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid PLOT_SINK_CONCURRENCY %q", v)
+		}
+		for _, dst := range cfg.Destinations {
+			if dst == nil {
+				continue
+			}
+			dst.Concurrency = n
+		}
+	}
+
+	if v := os.Getenv("PLOT_SINK_CACHE"); v != "" {
+		if cfg.Cache == nil {
+			cfg.Cache = &ConfigGroup{}
+		}
+		cfg.Cache.Paths = filepath.SplitList(v)
+		if cfg.Cache.Concurrency <= 0 {
+			cfg.Cache.Concurrency = int64(len(cfg.Cache.Paths))
+		}
+	}
+	return nil
+}
+
+// listenAddress returns the address to accept plots on.
+func (cfg *Config) listenAddress() string {
+	if cfg.Listen == "" {
+		return ":1337"
+	}
+	return cfg.Listen
+}
+
+// excluded returns true if the path matches one of the group's exclusion
+// patterns, which are paths prefixed with "!".
+func (g *ConfigGroup) excluded(path string) bool {
+	for _, p := range g.Paths {
+		if !strings.HasPrefix(p, "!") {
+			continue
+		}
+		pattern, err := filepath.Abs(p[1:])
+		if err != nil {
+			continue
+		}
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// FlagConfig builds a configuration from command line flags for running
+// without a config file, in the style of the original chia-plot-sink. All of
+// the destination paths are placed in a single group named "default". If the
+// concurrency is zero, it defaults to the number of destination paths.
+func FlagConfig(dests, cache []string, concurrency int64) (*Config, error) {
+	if len(cache) == 0 {
+		return nil, errors.New("at least one -cache directory is required with -d")
+	}
+	if concurrency <= 0 {
+		concurrency = int64(len(dests))
+	}
+
+	cfg := &Config{
+		Cache: &ConfigGroup{
+			Concurrency: concurrency,
+			Paths:       cache,
+		},
+		Destinations: map[string]*ConfigGroup{
+			"default": {
+				Concurrency: concurrency,
+				Paths:       dests,
+			},
+		},
+	}
+	return cfg, nil
+}
+
+type ConfigGroup struct {
+	name        string   `yaml:"-"`
+	skipFile    string   `yaml:"-"`
+	mount       bool     `yaml:"-"`
+	Concurrency int64    `yaml:"concurrency"`
+	Paths       []string `yaml:"paths"`
+
+	// Type is local for groups of directories, the default, s3 to upload to
+	// an object store configured under S3, sink to forward plots to the
+	// other plot sinks listed as the paths, or ssh to write them to the
+	// user@host:/path paths over SSH.
+	Type string     `yaml:"type"`
+	S3   *ConfigS3  `yaml:"s3"`
+	SSH  *ConfigSSH `yaml:"ssh"`
+
+	// Strategy chooses how paths are picked, by free_space, speed, or
+	// best_fit.
+	Strategy string `yaml:"strategy"`
+
+	// Reserve is free space always left on each of the group's paths.
+	Reserve string `yaml:"reserve"`
+
+	// Bandwidth caps the combined rate plots are written to the group's
+	// paths at, per second.
+	Bandwidth string `yaml:"bandwidth"`
+
+	// ChiaConfig adds the plot_directories from a harvester's Chia config
+	// file to the group's paths, keeping them in sync when reloaded.
+	ChiaConfig string `yaml:"chia_config"`
+
+	// Listen gives the group its own address to receive plots on. Plots sent
+	// to it only go to this group, and the group no longer takes plots sent
+	// to the main listener.
+	Listen string `yaml:"listen"`
+
+	// SkipDirectoryFile overrides the global skip file for the group. Setting
+	// it to an empty string disables skip files for the group.
+	SkipDirectoryFile *string `yaml:"skip_directory_file"`
+
+	// RequireMount overrides the global require_mount for the group.
+	RequireMount *bool `yaml:"require_mount"`
+
+	// PathConcurrency overrides how many plots can be written at once to the
+	// paths matching each pattern. Paths default to one, and zero means no
+	// limit.
+	PathConcurrency map[string]int64 `yaml:"path_concurrency"`
+
+	// Replicas is how many copies of each plot stored in the group are
+	// written, each to a path on a different filesystem. ReplicaGroups are
+	// the groups the extra copies are written to, defaulting to any group
+	// while preferring others than this one.
+	Replicas      int      `yaml:"replicas"`
+	ReplicaGroups []string `yaml:"replica_groups"`
+}
+
+// pathConcurrency returns the concurrency for a path in the group. An exact
+// match takes precedence over glob patterns.
+func (g *ConfigGroup) pathConcurrency(path string) int64 {
+	if n, ok := g.PathConcurrency[path]; ok {
+		return n
+	}
+	for pattern, n := range g.PathConcurrency {
+		pattern, err := filepath.Abs(pattern)
+		if err != nil {
+			continue
+		}
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return n
+		}
+	}
+	return 1
+}
+
+type ConfigAlerts struct {
+	Interval time.Duration                  `yaml:"interval"`
+	Channels map[string]*ConfigAlertChannel `yaml:"channels"`
+	Rules    []*ConfigAlertRule             `yaml:"rules"`
+}
+
+type ConfigAlertChannel struct {
+	Type    string   `yaml:"type"`
+	URL     string   `yaml:"url"`
+	Command []string `yaml:"command"`
+}
+
+type ConfigAlertRule struct {
+	Name      string        `yaml:"name"`
+	Metric    string        `yaml:"metric"`
+	Group     string        `yaml:"group"`
+	Operator  string        `yaml:"operator"`
+	Threshold string        `yaml:"threshold"`
+	For       time.Duration `yaml:"for"`
+	Channels  []string      `yaml:"channels"`
+}
+
+type ConfigAuditLog struct {
+	Path   string `yaml:"path"`
+	Format string `yaml:"format"`
+}
+
+type ConfigHarvester struct {
+	URL          string `yaml:"url"`
+	Cert         string `yaml:"cert"`
+	Key          string `yaml:"key"`
+	CA           string `yaml:"ca"`
+	AddDirectory bool   `yaml:"add_directory"`
+}
+
+type ConfigBuffers struct {
+	Receive string `yaml:"receive"`
+	Move    string `yaml:"move"`
+}
+
+type ConfigKeys struct {
+	Farmer       []string `yaml:"farmer"`
+	Pool         []string `yaml:"pool"`
+	PoolContract []string `yaml:"pool_contract"`
+}
+
+// ConfigPlotter limits the plots stored from the senders matching its sources,
+// which are addresses or networks in CIDR notation.
+type ConfigPlotter struct {
+	Sources  ConfigStrings `yaml:"sources"`
+	MaxPlots int64         `yaml:"max_plots"`
+	MaxSpace string        `yaml:"max_space"`
+
+	// Groups confines the plotter's plots to the named destination groups.
+	Groups []string `yaml:"groups"`
+
+	// Priority is high, the default, or bulk for plotters which should give
+	// way to the others.
+	Priority string `yaml:"priority"`
+}
+
+// ConfigPriority holds back slots in each destination group from bulk
+// plotters.
+type ConfigPriority struct {
+	ReservedSlots int64 `yaml:"reserved_slots"`
+}
+
+type ConfigIntegrations struct {
+	Push     []string      `yaml:"push"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+type ConfigCluster struct {
+	Name     string        `yaml:"name"`
+	Address  string        `yaml:"address"`
+	Peers    []string      `yaml:"peers"`
+	Token    string        `yaml:"token"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+type ConfigRelay struct {
+	Sinks         []string      `yaml:"sinks"`
+	Concurrency   int64         `yaml:"concurrency"`
+	RetryInterval time.Duration `yaml:"retry_interval"`
+}
+
+type ConfigSSH struct {
+	Command []string `yaml:"command"`
+}
+
+type ConfigS3 struct {
+	Endpoint  string `yaml:"endpoint"`
+	Region    string `yaml:"region"`
+	Bucket    string `yaml:"bucket"`
+	Prefix    string `yaml:"prefix"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	PartSize  string `yaml:"part_size"`
+	PathStyle bool   `yaml:"path_style"`
+}
+
+type ConfigPlotSize struct {
+	Min string `yaml:"min"`
+	Max string `yaml:"max"`
+}
+
+type ConfigCPU struct {
+	GOMAXPROCS int    `yaml:"gomaxprocs"`
+	Affinity   string `yaml:"affinity"`
+}
+
+type ConfigPlotDirectories struct {
+	Path    string   `yaml:"path"`
+	Format  string   `yaml:"format"`
+	Command []string `yaml:"command"`
+}
+
+// ConfigBandwidth caps the rate plots are received at, by default and during
+// time windows.
+type ConfigBandwidth struct {
+	Limit    string                  `yaml:"limit"`
+	Schedule []ConfigBandwidthWindow `yaml:"schedule"`
+}
+
+type ConfigBandwidthWindow struct {
+	Window string `yaml:"window"`
+	Limit  string `yaml:"limit"`
+}
+
+// ConfigLoad throttles receiving while the system is overloaded. Pressures
+// are the percent of time tasks stalled over the last 10 seconds.
+type ConfigLoad struct {
+	IOPressure  float64       `yaml:"io_pressure"`
+	CPUPressure float64       `yaml:"cpu_pressure"`
+	LoadAverage float64       `yaml:"load_average"`
+	Concurrency int64         `yaml:"concurrency"`
+	Interval    time.Duration `yaml:"interval"`
+	Recovery    time.Duration `yaml:"recovery"`
+}
+
+// ConfigTemperature slows or pauses writes to disks running hot. Limits are in
+// celsius.
+type ConfigTemperature struct {
+	Slow       int64         `yaml:"slow"`
+	Max        int64         `yaml:"max"`
+	Hysteresis int64         `yaml:"hysteresis"`
+	Interval   time.Duration `yaml:"interval"`
+	Smartctl   string        `yaml:"smartctl"`
+}
+
+// ConfigVerify checks newly placed plots in the background. The command has
+// {plot} replaced with the plot's path, and min_ratio is the fewest proofs per
+// challenge a plot must find. Channels are alert channels notified of failures.
+type ConfigVerify struct {
+	Command    []string `yaml:"command"`
+	Workers    int      `yaml:"workers"`
+	Queue      int      `yaml:"queue"`
+	MinRatio   float64  `yaml:"min_ratio"`
+	Quarantine string   `yaml:"quarantine"`
+	Channels   []string `yaml:"channels"`
+}
+
+type ConfigSchedule struct {
+	Ingest []string `yaml:"ingest"`
+	Moves  []string `yaml:"moves"`
+}
+
+type ConfigPermissions struct {
+	Mode  string `yaml:"mode"`
+	Owner string `yaml:"owner"`
+	Group string `yaml:"group"`
+}
+
+type ConfigTempFiles struct {
+	Prefix    string  `yaml:"prefix"`
+	Suffix    *string `yaml:"suffix"`
+	Directory string  `yaml:"directory"`
+}
+
+type ConfigMoveRetry struct {
+	Attempts int           `yaml:"attempts"`
+	Backoff  time.Duration `yaml:"backoff"`
+	Fallback bool          `yaml:"fallback"`
+	Pause    time.Duration `yaml:"pause"`
+}
+
+type ConfigRunAs struct {
+	User  string `yaml:"user"`
+	Group string `yaml:"group"`
+}
@@ -0,0 +1,68 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeConfigTOML(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "config.toml")
+	err := os.WriteFile(name, []byte(`
+listen = ":1337"
+
+[cache]
+paths = ["/mnt/cache1", "/mnt/cache2"]
+concurrency = 2
+
+[destinations.a]
+paths = ["/mnt/dst1"]
+concurrency = 4
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := decodeConfig(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != ":1337" {
+		t.Errorf("listen is %q", cfg.Listen)
+	}
+	if cfg.Cache == nil || !reflect.DeepEqual(cfg.Cache.Paths, []string{"/mnt/cache1", "/mnt/cache2"}) || cfg.Cache.Concurrency != 2 {
+		t.Errorf("cache is %+v", cfg.Cache)
+	}
+	if a := cfg.Destinations["a"]; a == nil || !reflect.DeepEqual(a.Paths, []string{"/mnt/dst1"}) || a.Concurrency != 4 {
+		t.Errorf("destination a is %+v", a)
+	}
+
+	if err := os.WriteFile(name, []byte("listen = \n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeConfig(name); err == nil {
+		t.Error("decoded a malformed TOML config")
+	}
+}
+
+// TestLoadConfigEnvEmptyGroup checks PLOT_SINK_CONCURRENCY skips empty group
+// entries rather than panicking on them.
+func TestLoadConfigEnvEmptyGroup(t *testing.T) {
+	t.Setenv("PLOT_SINK_CONCURRENCY", "3")
+	name := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(name, []byte("destinations:\n  foo:\n  bar:\n    paths: [/mnt/dst1]\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfig(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bar := cfg.Destinations["bar"]; bar == nil || bar.Concurrency != 3 {
+		t.Errorf("destination bar is %+v", bar)
+	}
+}
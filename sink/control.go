@@ -0,0 +1,198 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// trustedKey is set on the context of requests received over the unix socket,
+// where filesystem permissions are used for access control instead of the
+// control token.
+type trustedKey struct{}
+
+// startControl binds the control interface, which exposes the sink's status,
+// metrics, farm summary, and stored plots over HTTP. It may listen on TCP, a unix socket, or both.
+// It is served once the sink is started.
+func (s *Sink) startControl(cfg *Config) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+	mux.HandleFunc("/summary", s.handleSummary)
+	mux.HandleFunc("/plots", s.handlePlots)
+	mux.HandleFunc("/plots/lookup", s.handleLookup)
+	mux.HandleFunc("/plotters", s.handlePlotters)
+	if s.cluster != nil {
+		mux.HandleFunc("/cluster", s.handleCluster)
+		mux.HandleFunc("/cluster/gossip", s.handleClusterGossip)
+	}
+	s.registerAdmin(mux)
+
+	// the TCP listener isn't served until the sink starts, so close it if
+	// the socket can't be bound
+	var tcp net.Listener
+	if cfg.ControlListen != "" {
+		l, err := net.Listen("tcp", cfg.ControlListen)
+		if err != nil {
+			return err
+		}
+		log.Printf("Control interface listening on %s...", l.Addr().String())
+		s.background(func() { serveControl(l, mux) })
+		tcp = l
+	}
+	closeTCP := func() {
+		if tcp != nil {
+			tcp.Close()
+		}
+	}
+
+	if cfg.ControlSocket != "" {
+		mode := os.FileMode(0660)
+		if cfg.ControlSocketMode != "" {
+			m, err := strconv.ParseUint(cfg.ControlSocketMode, 8, 32)
+			if err != nil {
+				closeTCP()
+				return fmt.Errorf("invalid control_socket_mode %q: %v", cfg.ControlSocketMode, err)
+			}
+			mode = os.FileMode(m)
+		}
+
+		// remove a stale socket left from a previous run
+		os.Remove(cfg.ControlSocket)
+		l, err := net.Listen("unix", cfg.ControlSocket)
+		if err != nil {
+			closeTCP()
+			return err
+		}
+		if err := os.Chmod(cfg.ControlSocket, mode); err != nil {
+			l.Close()
+			closeTCP()
+			return err
+		}
+		log.Printf("Control interface listening on %s...", cfg.ControlSocket)
+		trusted := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mux.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), trustedKey{}, true)))
+		})
+		s.background(func() { serveControl(l, trusted) })
+	}
+
+	return nil
+}
+
+// serveControl serves the control interface on the listener.
+func serveControl(l net.Listener, h http.Handler) {
+	if err := http.Serve(l, h); err != nil {
+		log.Printf("Control interface on %s stopped: %v", l.Addr().String(), err)
+	}
+}
+
+// handleStatus returns the current status as JSON.
+func (s *Sink) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Status())
+}
+
+// handleMetrics returns the current status in the Prometheus text exposition
+// format.
+func (s *Sink) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	st := s.Status()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeMetric(w, "plot_sink_connections", "", float64(st.Connections))
+
+	groups := append([]*GroupStatus{st.Cache}, st.Destinations...)
+	for _, gs := range groups {
+		labels := fmt.Sprintf(`group=%q`, gs.Name)
+		writeMetric(w, "plot_sink_group_transfers", labels, float64(gs.Transfers))
+		writeMetric(w, "plot_sink_group_concurrency", labels, float64(gs.Concurrency))
+		writeMetric(w, "plot_sink_group_free_bytes", labels, float64(gs.FreeSpace))
+		writeMetric(w, "plot_sink_group_total_bytes", labels, float64(gs.TotalSpace))
+		writeMetric(w, "plot_sink_group_backlog", labels, float64(gs.Backlog))
+		writeMetric(w, "plot_sink_group_backlog_bytes", labels, float64(gs.BacklogBytes))
+		writeMetric(w, "plot_sink_group_backlog_growth", labels, float64(gs.BacklogGrowth))
+		for _, ps := range gs.Paths {
+			labels := fmt.Sprintf(`group=%q,path=%q`, gs.Name, ps.Path)
+			writeMetric(w, "plot_sink_path_transfers", labels, float64(ps.Transfers))
+			writeMetric(w, "plot_sink_path_busy", labels, boolMetric(ps.Busy))
+			writeMetric(w, "plot_sink_path_paused", labels, boolMetric(ps.Paused || ps.AdminPaused))
+			writeMetric(w, "plot_sink_path_disabled", labels, boolMetric(ps.Disabled))
+			writeMetric(w, "plot_sink_path_faulted", labels, boolMetric(ps.Fault != ""))
+			writeMetric(w, "plot_sink_path_free_bytes", labels, float64(ps.FreeSpace))
+			writeMetric(w, "plot_sink_path_total_bytes", labels, float64(ps.TotalSpace))
+			writeMetric(w, "plot_sink_path_considered_total", labels, float64(ps.Considered))
+			writeMetric(w, "plot_sink_path_selected_total", labels, float64(ps.Selected))
+			writeMetric(w, "plot_sink_path_placed_plots_total", labels, float64(ps.Plots))
+			writeMetric(w, "plot_sink_path_placed_bytes_total", labels, float64(ps.Bytes))
+		}
+	}
+
+	levels := make([]int, 0, len(st.Compression))
+	for level := range st.Compression {
+		levels = append(levels, level)
+	}
+	sort.Ints(levels)
+	for _, level := range levels {
+		writeMetric(w, "plot_sink_plots_placed_total", fmt.Sprintf(`compression="%d"`, level), float64(st.Compression[level]))
+	}
+
+	sources := make([]string, 0, len(st.Sources))
+	for k := range st.Sources {
+		sources = append(sources, k)
+	}
+	sort.Strings(sources)
+	for _, k := range sources {
+		ss := st.Sources[k]
+		labels := fmt.Sprintf(`source=%q`, k)
+		writeMetric(w, "plot_sink_source_plots_total", labels, float64(ss.Plots))
+		writeMetric(w, "plot_sink_source_bytes_total", labels, float64(ss.Bytes))
+		writeMetric(w, "plot_sink_source_failures_total", labels, float64(ss.Failures))
+		writeMetric(w, "plot_sink_source_avg_bytes_per_second", labels, ss.AvgBytesPerSec)
+	}
+
+	if s.cluster != nil {
+		for _, m := range s.cluster.snapshot() {
+			labels := fmt.Sprintf(`member=%q`, m.Name)
+			writeMetric(w, "plot_sink_cluster_member_stale", labels, boolMetric(m.Stale))
+			writeMetric(w, "plot_sink_cluster_member_free_bytes", labels, float64(m.FreeSpace))
+			writeMetric(w, "plot_sink_cluster_member_total_bytes", labels, float64(m.TotalSpace))
+			writeMetric(w, "plot_sink_cluster_member_connections", labels, float64(m.Connections))
+		}
+	}
+}
+
+// writeJSON encodes the value as the response body.
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// writeMetric writes a single sample in the Prometheus text format.
+func writeMetric(w http.ResponseWriter, name, labels string, value float64) {
+	var sb strings.Builder
+	sb.WriteString(name)
+	if labels != "" {
+		sb.WriteString("{" + labels + "}")
+	}
+	sb.WriteString(" ")
+	sb.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	sb.WriteString("\n")
+	w.Write([]byte(sb.String()))
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
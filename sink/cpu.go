@@ -0,0 +1,74 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// maxCPUs is the highest cpu number which can be given, matching the kernel's
+// default cpu set size.
+const maxCPUs = 1024
+
+// ApplyCPU restricts the process to the configured cores and sets GOMAXPROCS,
+// so heavy ingest doesn't take cycles from a harvester on the same box. It
+// should be called before the sink starts its goroutines.
+func ApplyCPU(cfg *ConfigCPU) error {
+	if cfg == nil {
+		return nil
+	}
+
+	procs := cfg.GOMAXPROCS
+	if cfg.Affinity != "" {
+		cpus, err := parseCPUList(cfg.Affinity)
+		if err != nil {
+			return err
+		}
+		if err := setAffinity(cpus); err != nil {
+			return err
+		}
+		log.Printf("Pinned to CPUs %s", cfg.Affinity)
+
+		// the runtime only sizes itself from the affinity at startup
+		if procs == 0 {
+			procs = len(cpus)
+		}
+	}
+
+	if procs > 0 {
+		runtime.GOMAXPROCS(procs)
+		log.Printf("Set GOMAXPROCS to %d", procs)
+	}
+	return nil
+}
+
+// parseCPUList parses a list of cpus in the kernel's format, such as "0-3,8".
+func parseCPUList(s string) ([]int, error) {
+	cpus := make([]int, 0)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("invalid cpu %q", part)
+		}
+		last := first
+		if isRange {
+			last, err = strconv.Atoi(hi)
+			if err != nil || last < first {
+				return nil, fmt.Errorf("invalid cpu range %q", part)
+			}
+		}
+		if last >= maxCPUs {
+			return nil, fmt.Errorf("cpu %d is out of range", last)
+		}
+		for c := first; c <= last; c++ {
+			cpus = append(cpus, c)
+		}
+	}
+	return cpus, nil
+}
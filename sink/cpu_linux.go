@@ -0,0 +1,35 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// setAffinity pins every thread of the process to the cpus. Affinity is per
+// thread on Linux, threads started afterwards inherit it from their creator.
+func setAffinity(cpus []int) error {
+	var set unix.CPUSet
+	for _, c := range cpus {
+		set.Set(c)
+	}
+
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return unix.SchedSetaffinity(0, &set)
+	}
+	for _, t := range tasks {
+		tid, err := strconv.Atoi(t.Name())
+		if err != nil {
+			continue
+		}
+		if err := unix.SchedSetaffinity(tid, &set); err != nil && err != unix.ESRCH {
+			return fmt.Errorf("failed to set affinity: %v", err)
+		}
+	}
+	return nil
+}
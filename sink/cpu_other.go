@@ -0,0 +1,14 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+//go:build !linux
+
+package sink
+
+import (
+	"errors"
+)
+
+// setAffinity is only supported on Linux.
+func setAffinity(cpus []int) error {
+	return errors.New("cpu affinity is only supported on Linux")
+}
@@ -0,0 +1,140 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/krobertson/chia-plot-sink-multi/plotfile"
+)
+
+// plotIndex maps the ids of the plots stored on the destinations to their
+// files, so a plot already stored under a different filename is caught.
+type plotIndex struct {
+	ids   map[string]string
+	mutex sync.Mutex
+}
+
+func newPlotIndex() *plotIndex {
+	return &plotIndex{ids: make(map[string]string)}
+}
+
+// add records the plot with the id as stored in the file.
+func (ix *plotIndex) add(id, file string) {
+	ix.mutex.Lock()
+	defer ix.mutex.Unlock()
+	ix.ids[id] = file
+}
+
+// remove drops the plot stored in the file.
+func (ix *plotIndex) remove(file string) {
+	ix.mutex.Lock()
+	defer ix.mutex.Unlock()
+	for id, f := range ix.ids {
+		if f == file {
+			delete(ix.ids, id)
+		}
+	}
+}
+
+// lookup returns the file the plot with the id is stored in, or an empty
+// string if it isn't stored. Plots removed since they were indexed, such as by
+// replotting, are dropped from the index.
+func (ix *plotIndex) lookup(id string) string {
+	ix.mutex.Lock()
+	file := ix.ids[id]
+	ix.mutex.Unlock()
+	if file == "" {
+		return ""
+	}
+
+	if _, err := os.Stat(file); err != nil {
+		ix.mutex.Lock()
+		if ix.ids[id] == file {
+			delete(ix.ids, id)
+		}
+		ix.mutex.Unlock()
+		return ""
+	}
+	return file
+}
+
+// indexPlots adds the plots stored on the destinations to the index. The id is
+// taken from standard plot filenames, and only other plots have their header
+// read, so disks aren't read through on startup. It is intended to be ran
+// within its own goroutine.
+func (s *Sink) indexPlots() {
+	count := 0
+	for _, pg := range s.GroupsNamed("") {
+		pg.sortMutex.RLock()
+		paths := append([]*PlotPath(nil), pg.sortedPlots...)
+		pg.sortMutex.RUnlock()
+
+		for _, pp := range paths {
+			if pp.isRemote() {
+				continue
+			}
+			plots, err := ListPlots(pp.path)
+			if err != nil {
+				continue
+			}
+			for _, p := range plots {
+				file := filepath.Join(pp.path, p.Name)
+				id := plotfile.IDFromFilename(p.Name)
+				if id == "" {
+					h, err := plotfile.ReadFileHeader(file)
+					if err != nil {
+						continue
+					}
+					id = h.PlotID()
+				}
+				s.index.add(id, file)
+				count++
+			}
+		}
+	}
+	log.Printf("Indexed %d stored plots by plot id", count)
+}
+
+// claimHeader records the transfer's plot header. With dedupe enabled, it
+// returns the plot already stored or in-flight with the same plot id, if there
+// is one, in which case the header isn't claimed.
+func (s *Sink) claimHeader(t *transfer, h *plotfile.Header) string {
+	if s.index == nil || h == nil {
+		s.setHeader(t, h)
+		return ""
+	}
+
+	id := h.PlotID()
+	if file := s.index.lookup(id); file != "" {
+		return file
+	}
+
+	s.transfersMutex.Lock()
+	defer s.transfersMutex.Unlock()
+	for _, other := range s.transfers {
+		if other != t && other.header != nil && other.header.PlotID() == id {
+			return other.info().Filename + " (in-flight)"
+		}
+	}
+	t.header = h
+	return ""
+}
+
+// setHeader records the transfer's plot header. It is set with the transfers
+// locked, since claimHeader reads the headers of every transfer.
+func (s *Sink) setHeader(t *transfer, h *plotfile.Header) {
+	s.transfersMutex.Lock()
+	defer s.transfersMutex.Unlock()
+	t.header = h
+}
+
+// indexPlot records a plot moved to a local destination.
+func (s *Sink) indexPlot(t *transfer, plot *PlotPath, filename string) {
+	if s.index != nil && t.header != nil && !plot.isRemote() {
+		s.index.add(t.header.PlotID(), filepath.Join(plot.path, filename))
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// sharedDevices returns a description of each device backing paths the sink
+// treats as independent, given the group of each path. A device shared by the
+// cache and destinations, or by several destination groups, breaks the
+// capacity and concurrency assumptions, as does a disk partitioned into
+// several paths of one group. Paths of one group on the same filesystem are
+// pooled, so aren't reported. Devices are whole disks on Linux, and otherwise
+// filesystems.
+func sharedDevices(groups map[string]string) []string {
+	paths := make([]string, 0, len(groups))
+	for p := range groups {
+		paths = append(paths, p)
+	}
+	slices.Sort(paths)
+	filesystems := filesystemIDs(paths)
+	disks := pathDisks(paths)
+
+	// paths are sorted, so devices are in the order of their first path
+	devices := make([]string, 0)
+	byDevice := make(map[string][]string)
+	for _, p := range paths {
+		device := filesystems[p]
+		if d := disks[p]; d != nil {
+			device = d.device
+		}
+		if device == "" {
+			continue
+		}
+		if _, ok := byDevice[device]; !ok {
+			devices = append(devices, device)
+		}
+		byDevice[device] = append(byDevice[device], p)
+	}
+
+	problems := make([]string, 0)
+	for _, device := range devices {
+		shared := byDevice[device]
+		if len(shared) < 2 {
+			continue
+		}
+
+		names := make(map[string]bool)
+		fs := make(map[string]bool)
+		destinations := make([]string, 0)
+		for _, p := range shared {
+			if !names[groups[p]] && groups[p] != "cache" {
+				destinations = append(destinations, groups[p])
+			}
+			names[groups[p]] = true
+			fs[filesystems[p]] = true
+		}
+		slices.Sort(destinations)
+		list := strings.Join(shared, ", ")
+		switch {
+		case names["cache"] && len(names) > 1:
+			problems = append(problems, fmt.Sprintf("cache and destination paths %s are on the same device %s", list, device))
+		case len(names) > 1:
+			problems = append(problems, fmt.Sprintf("paths %s of groups %s are on the same device %s",
+				list, strings.Join(destinations, ", "), device))
+		case len(fs) > 1:
+			problems = append(problems, fmt.Sprintf("paths %s are separate filesystems on the same device %s, so their writes aren't pooled", list, device))
+		}
+	}
+	return problems
+}
+
+// pathGroups returns the group of each local path of the cache and
+// destinations.
+func (s *Sink) pathGroups() map[string]string {
+	groups := make(map[string]string)
+	for _, pg := range append(s.GroupsNamed("cache"), s.GroupsNamed("")...) {
+		pg.sortMutex.RLock()
+		for _, pp := range pg.sortedPlots {
+			if !pp.isRemote() {
+				groups[pp.path] = pg.name
+			}
+		}
+		pg.sortMutex.RUnlock()
+	}
+	return groups
+}
@@ -0,0 +1,23 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// openDirect opens the file for writing with caching disabled. macOS has no
+// O_DIRECT, F_NOCACHE is its equivalent and is set once the file is open.
+func openDirect(name string, flag int, perm os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := unix.FcntlInt(f.Fd(), unix.F_NOCACHE, 1); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,16 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+//go:build linux || freebsd
+
+package sink
+
+import (
+	"os"
+	"syscall"
+)
+
+// openDirect opens the file for writing with direct I/O, bypassing the page
+// cache so moving plots doesn't evict everything else from memory.
+func openDirect(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(name, flag|syscall.O_DIRECT, perm)
+}
@@ -0,0 +1,63 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"cmp"
+	"slices"
+)
+
+// PlanEvacuate computes moves relocating every plot off of the path onto the
+// other available destination paths, favoring those with the most free space.
+// Plots which can't fit anywhere are returned separately.
+func (s *Sink) PlanEvacuate(src *PlotPath) ([]*PlannedMove, []PlotFile, error) {
+	plots, err := ListPlots(src.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	slices.SortFunc(plots, func(a, b PlotFile) int {
+		return cmp.Compare(b.Size, a.Size)
+	})
+
+	targets := make([]*pathUsage, 0)
+	for _, pg := range s.GroupsNamed("") {
+		pg.sortMutex.RLock()
+		for _, pp := range pg.sortedPlots {
+			if pp == src || pp.isRemote() || pp.unavailable() || pg.disabled.Load() || pg.draining.Load() {
+				continue
+			}
+			if err := pp.updateFreeSpace(); err != nil {
+				continue
+			}
+			targets = append(targets, &pathUsage{pp: pp, group: pg, free: pp.freeSpace.Load(), total: pp.totalSpace.Load()})
+		}
+		pg.sortMutex.RUnlock()
+	}
+
+	moves := make([]*PlannedMove, 0, len(plots))
+	unplaced := make([]PlotFile, 0)
+	for _, p := range plots {
+		slices.SortFunc(targets, func(a, b *pathUsage) int {
+			return cmp.Compare(b.free, a.free)
+		})
+		if len(targets) == 0 || targets[0].free < p.Size {
+			unplaced = append(unplaced, p)
+			continue
+		}
+
+		dst := targets[0]
+		dst.free -= p.Size
+		moves = append(moves, &PlannedMove{
+			Filename: p.Name,
+			Size:     p.Size,
+			From:     src.path,
+			To:       dst.pp.path,
+			Group:    dst.group.name,
+			src:      src,
+			dst:      dst.pp,
+			dstGroup: dst.group,
+		})
+	}
+
+	return moves, unplaced, nil
+}
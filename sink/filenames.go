@@ -0,0 +1,20 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"regexp"
+)
+
+// standardFilename matches chia's plot naming, along with the compression level
+// some plotters add, as in plot-k32-c07-2024-01-31-18-05-<id>.plot.
+const standardFilename = `^plot-k\d+(-c\d+)?-\d{4}-\d{2}-\d{2}-\d{2}-\d{2}-[0-9a-fA-F]{64}\.plot$`
+
+// newFilenamePattern compiles the pattern incoming filenames must match,
+// defaulting to the standard plot naming.
+func newFilenamePattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		pattern = standardFilename
+	}
+	return regexp.Compile(pattern)
+}
@@ -0,0 +1,144 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/krobertson/chia-plot-sink-multi/protocol"
+)
+
+// sinkDialTimeout limits how long connecting to a downstream sink can take.
+const sinkDialTimeout = 30 * time.Second
+
+// sinkStoredTimeout limits how long a downstream sink can take to confirm it
+// stored a plot once all of it was sent, which includes syncing it to disk.
+const sinkStoredTimeout = 10 * time.Minute
+
+// SinkStore forwards plots to another plot sink over the sink protocol, so a
+// fast front-end sink can fan plots out to several storage servers. A store
+// for a name without a port sends to the sinks published for it in DNS SRV
+// records.
+type SinkStore struct {
+	addr     string
+	discover bool
+	priority protocol.Priority
+}
+
+// NewSinkStore returns a store for the sink at the host:port address, or for
+// the sinks discovered through the DNS name.
+func NewSinkStore(addr string) (*SinkStore, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		if addr == "" || strings.ContainsAny(addr, ":/") {
+			return nil, fmt.Errorf("invalid sink address %q: %v", addr, err)
+		}
+		return &SinkStore{addr: addr, discover: true}, nil
+	}
+	return &SinkStore{addr: addr}, nil
+}
+
+// newSinkStores creates a store for each of the group's paths, which are the
+// host:port addresses of the downstream sinks, or DNS names publishing them.
+func newSinkStores(cfg *ConfigGroup) ([]RemoteStore, error) {
+	if len(cfg.Paths) == 0 {
+		return nil, errors.New("sink groups require the addresses of the sinks as paths")
+	}
+
+	stores := make([]RemoteStore, 0, len(cfg.Paths))
+	for _, addr := range cfg.Paths {
+		store, err := NewSinkStore(addr)
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, store)
+	}
+	return stores, nil
+}
+
+// SetPriority tags the plots sent to the sink with the priority, rather than
+// leaving it to the sink's configuration for this host.
+func (s *SinkStore) SetPriority(priority protocol.Priority) {
+	s.priority = priority
+}
+
+func (s *SinkStore) String() string {
+	return s.addr
+}
+
+// Upload sends the plot to the downstream sink. The sink closes the
+// connection once it has stored the plot, which is waited for before
+// returning. When discovering sinks, they are looked up for every plot and
+// tried in turn until one takes it.
+func (s *SinkStore) Upload(ctx context.Context, filename string, size uint64, r io.Reader) error {
+	addrs := []string{s.addr}
+	if s.discover {
+		var err error
+		if addrs, err = protocol.LookupSinks(s.addr); err != nil {
+			return fmt.Errorf("failed to discover sinks: %v", err)
+		}
+	}
+
+	var err error
+	for i, addr := range addrs {
+		err = sendFollowingRedirect(ctx, addr, filename, size, s.priority, r)
+		if !unsent(err) || i == len(addrs)-1 {
+			break
+		}
+		log.Printf("Sink %s didn't take %s, trying %s: %v", addr, filename, addrs[i+1], err)
+	}
+	if errors.Is(err, protocol.ErrNotAcknowledged) {
+		return errors.New("refused by the sink, it may have no eligible paths")
+	}
+	return err
+}
+
+// sendFollowingRedirect sends the plot to the sink at addr. A sink without
+// room may redirect the plot to a peer, which is followed once.
+func sendFollowingRedirect(ctx context.Context, addr, filename string, size uint64, priority protocol.Priority, r io.Reader) error {
+	err := sendToSink(ctx, addr, filename, size, priority, r)
+	var redirect *protocol.RedirectError
+	if errors.As(err, &redirect) {
+		log.Printf("Sink %s redirected %s to %s", addr, filename, redirect.Addr)
+		err = sendToSink(ctx, redirect.Addr, filename, size, priority, r)
+	}
+	return err
+}
+
+// unsent returns true if the error left the plot unread, as when the sink
+// couldn't be reached or refused it, so it can be sent to another sink.
+func unsent(err error) bool {
+	var opErr *net.OpError
+	return errors.Is(err, protocol.ErrNotAcknowledged) || errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// sendToSink sends the plot to the sink at addr, returning once the sink has
+// confirmed it stored it. The plot only counts as delivered on that
+// confirmation, as the connection closing may be the sink failing to store it.
+func sendToSink(ctx context.Context, addr, filename string, size uint64, priority protocol.Priority, r io.Reader) error {
+	d := net.Dialer{Timeout: sinkDialTimeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := protocol.SendPriority(conn, filename, size, priority, r); err != nil {
+		return err
+	}
+
+	// signal the end of the plot and wait for the sink to confirm it
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.CloseWrite()
+	}
+	conn.SetReadDeadline(time.Now().Add(sinkStoredTimeout))
+	return protocol.ReadStored(conn)
+}
@@ -0,0 +1,86 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/krobertson/chia-plot-sink-multi/protocol"
+)
+
+// fakeSink accepts a single transfer, handing the connection to receive once
+// the plot has been acknowledged, and returns its address.
+func fakeSink(t *testing.T, receive func(conn net.Conn, size uint64)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		size, err := protocol.ReadSize(conn)
+		if err != nil {
+			return
+		}
+		if err := protocol.WriteAck(conn); err != nil {
+			return
+		}
+		if _, err := protocol.ReadFilename(conn); err != nil {
+			return
+		}
+		receive(conn, size)
+	}()
+	return l.Addr().String()
+}
+
+func TestSinkStoreUpload(t *testing.T) {
+	plot := bytes.Repeat([]byte("plot"), 64*1024)
+
+	tests := []struct {
+		name    string
+		receive func(conn net.Conn, size uint64)
+		stored  bool
+	}{{
+		name: "stored",
+		receive: func(conn net.Conn, size uint64) {
+			io.Copy(io.Discard, conn)
+			protocol.WriteStored(conn)
+		},
+		stored: true,
+	}, {
+		// the whole plot arrives, but the sink fails to store it
+		name: "not stored",
+		receive: func(conn net.Conn, size uint64) {
+			io.Copy(io.Discard, conn)
+		},
+	}, {
+		name: "closed early",
+		receive: func(conn net.Conn, size uint64) {
+			io.CopyN(io.Discard, conn, int64(size/2))
+		},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := NewSinkStore(fakeSink(t, tt.receive))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.Upload(context.Background(), "a.plot", uint64(len(plot)), bytes.NewReader(plot))
+			if tt.stored && err != nil {
+				t.Errorf("upload error = %v, want stored", err)
+			}
+			if !tt.stored && err == nil {
+				t.Error("upload succeeded without the sink confirming the plot was stored")
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"log"
+	"slices"
+	"time"
+)
+
+// invalidateFreeSpace marks the paths' free space as changed, such as after a
+// plot is written to or removed from them. They are refreshed in the
+// background, so statfs never sits on the path of a transfer.
+func (s *Sink) invalidateFreeSpace(paths ...*PlotPath) {
+	s.staleMutex.Lock()
+	for _, pp := range paths {
+		if pp != nil {
+			s.stale[pp] = true
+		}
+	}
+	s.staleMutex.Unlock()
+
+	select {
+	case s.staleNotify <- struct{}{}:
+	default:
+	}
+}
+
+// refreshFreeSpace keeps the free space of the paths current. Invalidated paths
+// are refreshed right away, and every path is refreshed on the interval so the
+// numbers stay accurate when other processes use or free space. A negative
+// interval disables the periodic refresh. It is intended to be ran within its
+// own goroutine.
+func (s *Sink) refreshFreeSpace(interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		var paths []*PlotPath
+		select {
+		case <-tick:
+			for _, pg := range append(s.GroupsNamed("cache"), s.GroupsNamed("")...) {
+				pg.sortMutex.RLock()
+				paths = append(paths, pg.sortedPlots...)
+				pg.sortMutex.RUnlock()
+			}
+		case <-s.staleNotify:
+			s.staleMutex.Lock()
+			for pp := range s.stale {
+				paths = append(paths, pp)
+			}
+			clear(s.stale)
+			s.staleMutex.Unlock()
+		}
+
+		for _, pp := range paths {
+			pp.updateFreeSpace()
+		}
+
+		// resort now that the free space has changed
+		s.cacheGroup.sortCachePaths()
+		for _, pg := range s.GroupsNamed("") {
+			pg.sortPaths()
+		}
+	}
+}
+
+// availableSpace returns the space currently available on the path's
+// filesystem, bypassing the periodically refreshed numbers.
+func availableSpace(path string) (uint64, error) {
+	free, _, err := DiskSpace(path)
+	return free, err
+}
+
+// pendingBytes returns how much the in-flight transfers headed to the path, or
+// to other paths in its pool, other than except, have yet to write to it.
+func (s *Sink) pendingBytes(pp *PlotPath, except *transfer) uint64 {
+	pool := pp.plotPool()
+
+	s.transfersMutex.Lock()
+	defer s.transfersMutex.Unlock()
+
+	total := uint64(0)
+	for _, t := range s.transfers {
+		if t == except {
+			continue
+		}
+		if _, dst := t.destination(); dst != pp && (pool == nil || dst == nil || dst.plotPool() != pool) {
+			continue
+		}
+		if moved := uint64(t.moved.Load()); moved < t.size {
+			total += t.size - moved
+		}
+	}
+	return total
+}
+
+// hasRoom returns true if the path can take the transfer's plot on top of what
+// the other in-flight transfers to it will still write, leaving the group's
+// reserve free.
+func (s *Sink) hasRoom(t *transfer, pg *PlotGroup, pp *PlotPath) bool {
+	if pp.isRemote() {
+		return true
+	}
+
+	free, err := availableSpace(pp.path)
+	if err != nil {
+		log.Printf("Failed to check free space on %s: %v", pp.path, err)
+		return false
+	}
+	return free >= t.size+pg.reserve+s.pendingBytes(pp, t)
+}
+
+// ensureRoom re-checks the transfer's destination still has room right before
+// the plot is written to it, since other transfers may have filled it while
+// the plot was received, or its disk may have been lost. A received plot is
+// rerouted to another path in its group when it no longer fits. It returns
+// false if there is nowhere to put it.
+func (s *Sink) ensureRoom(t *transfer) bool {
+	pg, plot := t.destination()
+	reason := "no longer has room"
+	if !plot.isRemote() && plot.mounted.Load() && onRootFilesystem(plot.path) {
+		// fault it now rather than at the next refresh
+		plot.updateFreeSpace()
+		reason = "is no longer mounted"
+	} else if s.hasRoom(t, pg, plot) {
+		return true
+	}
+	return s.reroute(t, reason, nil)
+}
+
+// reroute moves the transfer to another path in its group with room for the
+// plot, in the group's order, other than those excluded. The reason its
+// destination can't be used is logged. It returns false if there is no other
+// path.
+func (s *Sink) reroute(t *transfer, reason string, exclude map[*PlotPath]bool) bool {
+	pg, plot := t.destination()
+	r := t.reservation
+	if r == nil {
+		log.Printf("Destination %s %s, can't store %s", plot.path, reason, t.filename)
+		return false
+	}
+
+	// try the group's other paths, in the group's order
+	pg.sortMutex.RLock()
+	paths := slices.Clone(pg.sortedPlots)
+	pg.sortMutex.RUnlock()
+
+	for _, pp := range paths {
+		if pp == plot || exclude[pp] || pp.unavailable() || !s.hasRoom(t, pg, pp) {
+			continue
+		}
+		nr := s.Reserve(&ReserveRequest{Size: t.size, dst: pp, dstGroup: pg, replace: r})
+		if nr == nil {
+			continue
+		}
+
+		r.Group, r.Plot = nr.Group, nr.Plot
+		t.setDestination(nr.Group, nr.Plot)
+		s.invalidateFreeSpace(plot)
+		log.Printf("Destination %s %s, rerouting %s to %s", plot.path, reason, t.filename, pp.path)
+		return true
+	}
+
+	log.Printf("Destination %s %s, and no other path in group %q can take %s", plot.path, reason, pg.name, t.filename)
+	return false
+}
@@ -0,0 +1,60 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// TestFreeSpaceRefresh refreshes the paths' free space while plots are picked
+// and the status read, as the background refresh does, for go test -race.
+func TestFreeSpaceRefresh(t *testing.T) {
+	dir := t.TempDir()
+	cache := filepath.Join(dir, "cache")
+	dst := filepath.Join(dir, "dst")
+	for _, d := range []string{cache, dst} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := New(&Config{
+		Listen:       "127.0.0.1:0",
+		Cache:        &ConfigGroup{Paths: []string{cache}, Concurrency: 1},
+		Destinations: map[string]*ConfigGroup{"a": {Paths: []string{dst}, Concurrency: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	pp := s.GroupsNamed("a")[0].sortedPlots[0]
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			pp.updateFreeSpace()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			s.PickPlot(1, 0)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			s.Status()
+		}
+	}()
+	wg.Wait()
+
+	if pp.totalSpace.Load() == 0 {
+		t.Error("total space wasn't read")
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// harvesterClient calls the local Chia harvester's RPC interface so newly
+// placed plots are picked up immediately rather than on the next rescan.
+type harvesterClient struct {
+	url          string
+	addDirectory bool
+	client       *http.Client
+	directories  map[string]bool
+	mutex        sync.Mutex
+}
+
+// newHarvesterClient will load the harvester's TLS client certificate and
+// prepare the RPC client. When a CA is given, the harvester's certificate is
+// verified against it. Chia's certificates are not issued for a hostname, so
+// only the chain is checked.
+func newHarvesterClient(cfg *ConfigHarvester) (*harvesterClient, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load harvester certificate: %v", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+	}
+	if cfg.CA != "" {
+		b, err := os.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read harvester CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in harvester CA %s", cfg.CA)
+		}
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("harvester presented no certificate")
+			}
+			c, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			_, err = c.Verify(x509.VerifyOptions{Roots: pool})
+			return err
+		}
+	}
+
+	url := cfg.URL
+	if url == "" {
+		url = "https://localhost:8560"
+	}
+
+	return &harvesterClient{
+		url:          strings.TrimSuffix(url, "/"),
+		addDirectory: cfg.AddDirectory,
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+// call performs an RPC request against the harvester and decodes the response
+// into resp if given.
+func (h *harvesterClient) call(endpoint string, req, resp any) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	r, err := h.client.Post(h.url+"/"+endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	var result struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error"`
+	}
+	body := new(bytes.Buffer)
+	body.ReadFrom(r.Body)
+	if err := json.Unmarshal(body.Bytes(), &result); err != nil {
+		return fmt.Errorf("invalid response from %s: %v", endpoint, err)
+	}
+	if !result.Success {
+		return fmt.Errorf("%s failed: %s", endpoint, result.Error)
+	}
+	if resp != nil {
+		return json.Unmarshal(body.Bytes(), resp)
+	}
+	return nil
+}
+
+// ensureDirectory adds the directory to the harvester if it isn't already one
+// of its plot directories. The harvester's list is loaded on first use.
+func (h *harvesterClient) ensureDirectory(dir string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.directories == nil {
+		var resp struct {
+			Directories []string `json:"directories"`
+		}
+		if err := h.call("get_plot_directories", struct{}{}, &resp); err != nil {
+			return err
+		}
+		h.directories = make(map[string]bool)
+		for _, d := range resp.Directories {
+			h.directories[d] = true
+		}
+	}
+
+	if h.directories[dir] {
+		return nil
+	}
+	if err := h.call("add_plot_directory", map[string]string{"dirname": dir}, nil); err != nil {
+		return err
+	}
+	h.directories[dir] = true
+	log.Printf("Added plot directory %s to the harvester", dir)
+	return nil
+}
+
+// plotPlaced is called after a plot is moved to its destination. It ensures the
+// harvester knows of the directory if configured, and then triggers a refresh.
+func (h *harvesterClient) plotPlaced(p *placement) {
+	if h.addDirectory {
+		if err := h.ensureDirectory(p.Destination); err != nil {
+			log.Printf("Failed to add plot directory %s to harvester: %v", p.Destination, err)
+		}
+	}
+
+	if err := h.call("refresh_plots", struct{}{}, nil); err != nil {
+		log.Printf("Failed to refresh harvester plots after %s: %v", p.Filename, err)
+	}
+}
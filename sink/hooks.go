@@ -0,0 +1,40 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"log"
+	"time"
+)
+
+// hookEvent is the JSON payload POSTed to the completion webhooks.
+type hookEvent struct {
+	Event string     `json:"event"`
+	Plot  *placement `json:"plot"`
+}
+
+// hookAttempts is how many times delivery to a webhook is tried before giving
+// up on the event.
+const hookAttempts = 3
+
+// sendHooks will deliver the placement event to all of the configured
+// webhooks. Each is delivered in the background and retried with a backoff so
+// a slow or unavailable endpoint never holds up transfers.
+func (s *Sink) sendHooks(p *placement) {
+	ev := &hookEvent{Event: "plot.placed", Plot: p}
+
+	for _, url := range s.webhooks {
+		go func(url string) {
+			var err error
+			for i := 0; i < hookAttempts; i++ {
+				if i > 0 {
+					time.Sleep(time.Duration(i) * 5 * time.Second)
+				}
+				if err = postJSON(url, ev); err == nil {
+					return
+				}
+			}
+			log.Printf("Failed to deliver webhook for %s to %s: %v", p.Filename, url, err)
+		}(url)
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// PlanImport lists the plots in the directory to be ingested into the
+// destinations. Their destinations are picked as each is moved, so they're
+// distributed exactly like received plots, and held to the same filename,
+// key, and dedupe checks.
+func (s *Sink) PlanImport(dir string) ([]*PlannedMove, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if _, pp := s.FindPath(dir); pp != nil {
+		return nil, fmt.Errorf("%s is already one of the sink's paths", dir)
+	}
+
+	plots, err := ListPlots(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	moves := make([]*PlannedMove, 0, len(plots))
+	for _, p := range plots {
+		moves = append(moves, &PlannedMove{
+			Filename: p.Name,
+			Size:     p.Size,
+			From:     dir,
+		})
+	}
+	return moves, nil
+}
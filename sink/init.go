@@ -0,0 +1,129 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"cmp"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// cacheMaxSize is the largest non-rotational disk proposed as a cache. Larger
+// solid state disks are more likely intended to store plots.
+const cacheMaxSize = 4 << 40
+
+// initFilesystems are the filesystem types considered for plot storage.
+var initFilesystems = map[string]bool{
+	"ext4": true, "xfs": true, "btrfs": true, "zfs": true, "f2fs": true,
+	"ntfs": true, "ntfs3": true, "fuseblk": true, "exfat": true,
+	"ufs": true, "apfs": true, "hfs": true,
+}
+
+// mountedDisk describes a mounted filesystem found by init.
+type mountedDisk struct {
+	mountpoint string
+	device     string
+	fstype     string
+	size       uint64
+	rotational bool
+}
+
+// StarterConfig scans the mounted filesystems and renders a starter config,
+// with solid state disks proposed as the cache and spinning disks as
+// destinations. It also returns how many of each were found.
+func StarterConfig() (string, int, int, error) {
+	disks, err := scanMounts()
+	if err != nil {
+		return "", 0, 0, err
+	}
+	slices.SortFunc(disks, func(a, b *mountedDisk) int {
+		return cmp.Compare(a.mountpoint, b.mountpoint)
+	})
+
+	var cache, dests []*mountedDisk
+	for _, d := range disks {
+		if !d.rotational && d.size <= cacheMaxSize {
+			cache = append(cache, d)
+		} else {
+			dests = append(dests, d)
+		}
+	}
+	return initConfig(cache, dests), len(cache), len(dests), nil
+}
+
+// systemMount returns true for mountpoints used by the operating system.
+func systemMount(mountpoint string) bool {
+	switch mountpoint {
+	case "/", "/home", "/usr", "/var", "/tmp", "/opt", "/srv", "/root":
+		return true
+	}
+	for _, prefix := range []string{"/boot", "/snap/", "/var/", "/usr/", "/nix/", "/etc/", "/System/", "/private/"} {
+		if strings.HasPrefix(mountpoint, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *mountedDisk) describe() string {
+	kind := "rotational"
+	if !d.rotational {
+		kind = "solid state"
+	}
+	return fmt.Sprintf("%s, %s, %s, %s", filepath.Base(d.device), d.fstype, humanize.IBytes(d.size), kind)
+}
+
+// initConfig renders the starter config for the disks.
+func initConfig(cache, dests []*mountedDisk) string {
+	var sb strings.Builder
+	fmt.Fprintln(&sb, "# Generated by init from the mounted filesystems. Review the cache and")
+	fmt.Fprintln(&sb, "# destinations before starting the sink, see sample-config.yaml for all of the")
+	fmt.Fprintln(&sb, "# available settings.")
+	fmt.Fprintln(&sb, "#")
+	fmt.Fprintln(&sb, "# Create the skip file in each disk's mountpoint directory while it is")
+	fmt.Fprintln(&sb, "# unmounted, so the path is skipped if the disk fails to mount.")
+	fmt.Fprintln(&sb, `skip_directory_file: ".not_mounted"`)
+	fmt.Fprintln(&sb, `listen: ":1337"`)
+
+	fmt.Fprintln(&sb, "cache:")
+	fmt.Fprintln(&sb, "  # Fast solid state storage plots are received onto before being moved to")
+	fmt.Fprintln(&sb, "  # their destination. Keep this at or below the sum of the destinations'")
+	fmt.Fprintln(&sb, "  # concurrency.")
+	fmt.Fprintf(&sb, "  concurrency: %d\n", max(len(dests), 1))
+	fmt.Fprintln(&sb, "  paths:")
+	if len(cache) == 0 {
+		fmt.Fprintln(&sb, "    # no solid state disks were found, set the cache path")
+		fmt.Fprintln(&sb, "    - /mnt/cache")
+	}
+	for _, d := range cache {
+		fmt.Fprintf(&sb, "    - %s # %s\n", yamlPath(d.mountpoint), d.describe())
+	}
+
+	fmt.Fprintln(&sb, "destinations:")
+	fmt.Fprintln(&sb, "  # Split destinations into groups of disks sharing a controller channel, with")
+	fmt.Fprintln(&sb, "  # concurrency matching what the channel can sustain.")
+	fmt.Fprintln(&sb, "  local:")
+	fmt.Fprintf(&sb, "    concurrency: %d\n", max(len(dests), 1))
+	fmt.Fprintln(&sb, "    paths:")
+	if len(dests) == 0 {
+		fmt.Fprintln(&sb, "      # no disks were found, add the destination paths")
+		fmt.Fprintln(&sb, "      - /mnt/plots*")
+	}
+	for _, d := range dests {
+		fmt.Fprintf(&sb, "      - %s # %s\n", yamlPath(d.mountpoint), d.describe())
+	}
+	return sb.String()
+}
+
+// yamlPath quotes the path if it contains characters YAML would misread.
+func yamlPath(path string) string {
+	if strings.ContainsAny(path, "#:'\"{}[],&*!|>%@`") || strings.HasPrefix(path, " ") {
+		return strconv.Quote(path)
+	}
+	return path
+}
@@ -0,0 +1,54 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+//go:build darwin || freebsd
+
+package sink
+
+import (
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// scanMounts returns the mounted filesystems which could hold plots, skipping
+// pseudo filesystems and the ones the operating system lives on. Whether a
+// disk is solid state isn't detected, so every disk is treated as rotational.
+func scanMounts() ([]*mountedDisk, error) {
+	n, err := unix.Getfsstat(nil, unix.MNT_NOWAIT)
+	if err != nil {
+		return nil, err
+	}
+	stats := make([]unix.Statfs_t, n)
+	n, err = unix.Getfsstat(stats, unix.MNT_NOWAIT)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	disks := make([]*mountedDisk, 0)
+	for _, st := range stats[:n] {
+		mountpoint := unix.ByteSliceToString(st.Mntonname[:])
+		device := unix.ByteSliceToString(st.Mntfromname[:])
+		fstype := unix.ByteSliceToString(st.Fstypename[:])
+
+		if !initFilesystems[fstype] || systemMount(mountpoint) {
+			continue
+		}
+		if fstype != "zfs" && !strings.HasPrefix(device, "/dev/") {
+			continue
+		}
+		if seen[device] {
+			continue
+		}
+		seen[device] = true
+
+		disks = append(disks, &mountedDisk{
+			mountpoint: mountpoint,
+			device:     device,
+			fstype:     fstype,
+			size:       uint64(st.Blocks) * uint64(st.Bsize),
+			rotational: true,
+		})
+	}
+	return disks, nil
+}
@@ -0,0 +1,105 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// scanMounts returns the mounted filesystems which could hold plots, skipping
+// pseudo filesystems and the ones the operating system lives on.
+func scanMounts() ([]*mountedDisk, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	seen := make(map[string]bool)
+	disks := make([]*mountedDisk, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// the fields before the separator vary, the mountpoint is the 5th
+		pre, post, ok := strings.Cut(scanner.Text(), " - ")
+		if !ok {
+			continue
+		}
+		fields, postFields := strings.Fields(pre), strings.Fields(post)
+		if len(fields) < 5 || len(postFields) < 2 {
+			continue
+		}
+		mountpoint := unescapeMount(fields[4])
+		fstype, device := postFields[0], postFields[1]
+
+		if !initFilesystems[fstype] || systemMount(mountpoint) {
+			continue
+		}
+		if fstype != "zfs" && !strings.HasPrefix(device, "/dev/") {
+			continue
+		}
+		// a device mounted more than once, such as with bind mounts, is only
+		// listed for its first mountpoint
+		if seen[device] {
+			continue
+		}
+		seen[device] = true
+
+		_, size, err := DiskSpace(mountpoint)
+		if err != nil {
+			continue
+		}
+		disks = append(disks, &mountedDisk{
+			mountpoint: mountpoint,
+			device:     device,
+			fstype:     fstype,
+			size:       size,
+			rotational: rotational(device),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return disks, nil
+}
+
+// unescapeMount decodes the octal escapes used for spaces and other special
+// characters in mountinfo.
+func unescapeMount(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			var c byte
+			if _, err := fmt.Sscanf(s[i+1:i+4], "%03o", &c); err == nil {
+				sb.WriteByte(c)
+				i += 3
+				continue
+			}
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+// rotational returns true if the block device is a spinning disk. Devices which
+// can't be determined, such as pools, are assumed to be.
+func rotational(device string) bool {
+	var st unix.Stat_t
+	if err := unix.Stat(device, &st); err != nil {
+		return true
+	}
+
+	// partitions don't have a queue, so check the parent disk as well
+	sys := fmt.Sprintf("/sys/dev/block/%d:%d", unix.Major(st.Rdev), unix.Minor(st.Rdev))
+	for _, p := range []string{sys + "/queue/rotational", sys + "/../queue/rotational"} {
+		b, err := os.ReadFile(p)
+		if err == nil {
+			return strings.TrimSpace(string(b)) != "0"
+		}
+	}
+	return true
+}
@@ -0,0 +1,292 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/krobertson/chia-plot-sink-multi/plotfile"
+)
+
+// PlannedMove is a single relocation of a stored plot from one path to another
+// performed by a maintenance job.
+type PlannedMove struct {
+	Filename string `json:"filename"`
+	Size     uint64 `json:"size"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Group    string `json:"group"`
+
+	src      *PlotPath
+	dst      *PlotPath
+	dstGroup *PlotGroup
+
+	// source is the sender of a received plot moved by the scheduled mover,
+	// recorded as its source in place of the job's kind
+	source string
+}
+
+// MoveJob is a background maintenance operation which relocates stored plots
+// using the same move pipeline as received plots. Only one runs at a time.
+type MoveJob struct {
+	Kind    string
+	started time.Time
+	Moves   []*PlannedMove
+	Limiter *RateLimiter
+
+	// Place picks destinations as moves run, the same as for received plots,
+	// and records each as a placement
+	Place bool
+
+	// OnDone is called after the last move, successful or not
+	OnDone func()
+
+	completed atomic.Int64
+	failed    atomic.Int64
+	canceled  atomic.Bool
+	finished  atomic.Bool
+
+	// transfers are the job's moves in progress, which may run concurrently
+	transfersMutex sync.Mutex
+	transfers      map[*transfer]struct{}
+}
+
+// JobInfo is the state of a maintenance job as reported in the status.
+type JobInfo struct {
+	Kind      string    `json:"kind"`
+	Started   time.Time `json:"started"`
+	Total     int       `json:"total"`
+	Completed int64     `json:"completed"`
+	Failed    int64     `json:"failed"`
+	Canceled  bool      `json:"canceled"`
+	Finished  bool      `json:"finished"`
+}
+
+func (j *MoveJob) Info() *JobInfo {
+	return &JobInfo{
+		Kind:      j.Kind,
+		Started:   j.started,
+		Total:     len(j.Moves),
+		Completed: j.completed.Load(),
+		Failed:    j.failed.Load(),
+		Canceled:  j.canceled.Load(),
+		Finished:  j.finished.Load(),
+	}
+}
+
+// Cancel stops the job after aborting the moves in progress.
+func (j *MoveJob) Cancel() {
+	j.canceled.Store(true)
+	j.transfersMutex.Lock()
+	defer j.transfersMutex.Unlock()
+	for t := range j.transfers {
+		t.cancel()
+	}
+}
+
+// track records a move in progress so it is aborted if the job is canceled.
+func (j *MoveJob) track(t *transfer) {
+	j.transfersMutex.Lock()
+	defer j.transfersMutex.Unlock()
+	if j.transfers == nil {
+		j.transfers = make(map[*transfer]struct{})
+	}
+	j.transfers[t] = struct{}{}
+	if j.canceled.Load() {
+		t.cancel()
+	}
+}
+
+// untrack removes a finished move from those in progress.
+func (j *MoveJob) untrack(t *transfer) {
+	j.transfersMutex.Lock()
+	defer j.transfersMutex.Unlock()
+	delete(j.transfers, t)
+}
+
+// StartJob begins running the job in the background. It fails if another job is
+// still running.
+func (s *Sink) StartJob(j *MoveJob) error {
+	if err := s.registerJob(j); err != nil {
+		return err
+	}
+	s.wg.Add(1)
+	go s.runJob(j)
+	return nil
+}
+
+// registerJob makes the job the current one, reported in the status and
+// canceled through the admin API. It fails if another job is still running.
+func (s *Sink) registerJob(j *MoveJob) error {
+	s.jobMutex.Lock()
+	defer s.jobMutex.Unlock()
+
+	if s.job != nil && !s.job.finished.Load() {
+		return fmt.Errorf("a %s job is already running", s.job.Kind)
+	}
+	j.started = time.Now()
+	s.job = j
+	return nil
+}
+
+// CurrentJob returns the most recent job, or nil if none has ran.
+func (s *Sink) CurrentJob() *MoveJob {
+	s.jobMutex.Lock()
+	defer s.jobMutex.Unlock()
+	return s.job
+}
+
+// runJob performs each of the job's moves in order.
+func (s *Sink) runJob(j *MoveJob) {
+	defer s.wg.Done()
+	log.Printf("Starting %s job with %d moves", j.Kind, len(j.Moves))
+
+	for _, m := range j.Moves {
+		if j.canceled.Load() {
+			break
+		}
+		if err := s.relocate(j, m); err != nil {
+			log.Printf("Failed to move %s from %s to %s: %v", m.Filename, m.From, m.To, err)
+			j.failed.Add(1)
+			continue
+		}
+		j.completed.Add(1)
+	}
+
+	if j.OnDone != nil {
+		j.OnDone()
+	}
+	j.finished.Store(true)
+	log.Printf("Finished %s job: %d moved, %d failed, %d skipped",
+		j.Kind, j.completed.Load(), j.failed.Load(), int64(len(j.Moves))-j.completed.Load()-j.failed.Load())
+}
+
+// relocate moves a single stored plot. The destination is reserved the same
+// way as for a received plot, so the two never write to a disk at once.
+func (s *Sink) relocate(j *MoveJob, m *PlannedMove) error {
+	r, err := s.reserveMove(j, m)
+	if err != nil {
+		return err
+	}
+	defer s.Release(r)
+
+	if !m.dst.isRemote() && m.Size > m.dst.freeSpace.Load() {
+		return errors.New("not enough free space on destination")
+	}
+
+	source := j.Kind
+	if m.source != "" {
+		source = m.source
+	}
+	t := s.startTransfer(nil, source, m.Size, m.dstGroup, m.dst)
+	defer s.finishTransfer(t)
+	t.cachePlot = m.src
+	t.limiter = j.Limiter
+	t.setFilename(m.Filename)
+	t.setPhase(PhaseMoving)
+	j.track(t)
+	defer j.untrack(t)
+
+	// plots being placed are held to the same checks as received ones
+	srcfile := filepath.Join(m.From, m.Filename)
+	if j.Place {
+		h, err := plotfile.ReadFileHeader(srcfile)
+		if err := s.admitPlot(t, m.Filename, h, err); err != nil {
+			return err
+		}
+	} else if s.index != nil {
+		h, _ := plotfile.ReadFileHeader(srcfile)
+		s.setHeader(t, h)
+	}
+	if s.xattrs {
+		t.checksum = checksumFromXattr(srcfile)
+	}
+	if !s.handleMove(t, srcfile) {
+		return errors.New("move failed")
+	}
+	if j.Place {
+		s.storeReplicas(t, m.dstGroup, m.dst, srcfile)
+	}
+	if err := os.Remove(srcfile); err != nil {
+		log.Printf("Failed to remove %s after moving it: %v", srcfile, err)
+	}
+	s.indexPlot(t, m.dst, m.Filename)
+	if !m.dst.isRemote() {
+		if err := moveSidecar(m.Filename, m.From, m.dst.path); err != nil {
+			log.Printf("Failed to move the sidecar of %s: %v", m.Filename, err)
+		}
+	}
+
+	if j.Place {
+		s.recordPlacement(&placement{
+			Time:        time.Now(),
+			Source:      source,
+			Filename:    m.Filename,
+			Size:        m.Size,
+			Group:       m.dstGroup.name,
+			Destination: m.dst.path,
+			Compression: plotfile.Compression(t.header, m.Filename),
+		})
+	}
+
+	s.invalidateFreeSpace(m.src, m.dst)
+	return nil
+}
+
+// reserveMove waits until a write slot on the move's destination is reserved.
+// When the move has no destination, one is picked the same way as for a
+// received plot, from its group when it has one.
+func (s *Sink) reserveMove(j *MoveJob, m *PlannedMove) (*Reservation, error) {
+	for {
+		if j.canceled.Load() {
+			return nil, errTransferCanceled
+		}
+
+		req := &ReserveRequest{Size: m.Size, dst: m.dst, dstGroup: m.dstGroup}
+		if m.dst == nil {
+			req.Group = m.Group
+		}
+		r := s.Reserve(req)
+		if r != nil {
+			m.dst, m.dstGroup = r.Plot, r.Group
+			m.To, m.Group = r.Plot.path, r.Group.name
+			return r, nil
+		}
+
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// ListPlots returns the completed plot files stored directly in the path.
+func ListPlots(path string) ([]PlotFile, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	plots := make([]PlotFile, 0)
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".plot" {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		plots = append(plots, PlotFile{Name: e.Name(), Size: uint64(fi.Size()), Modified: fi.ModTime()})
+	}
+	return plots, nil
+}
+
+type PlotFile struct {
+	Name     string
+	Size     uint64
+	Modified time.Time
+}
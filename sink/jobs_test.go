@@ -0,0 +1,24 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import "testing"
+
+// TestMoveJobCancel checks canceling a job aborts all of its moves in
+// progress, as the scheduled job runs them concurrently, and any started after.
+func TestMoveJobCancel(t *testing.T) {
+	j := &MoveJob{Kind: "scheduled"}
+	a, b := &transfer{}, &transfer{}
+	j.track(a)
+	j.track(b)
+	j.Cancel()
+	if !a.canceled.Load() || !b.canceled.Load() {
+		t.Error("moves in progress weren't canceled")
+	}
+
+	c := &transfer{}
+	j.track(c)
+	if !c.canceled.Load() {
+		t.Error("move started after canceling wasn't canceled")
+	}
+}
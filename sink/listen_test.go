@@ -0,0 +1,52 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestNewClosesListeners checks New returns an error when a group's port is
+// taken, and releases the ports it had already bound.
+func TestNewClosesListeners(t *testing.T) {
+	dir := t.TempDir()
+	cache := filepath.Join(dir, "cache")
+	dst := filepath.Join(dir, "dst")
+	for _, d := range []string{cache, dst} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	// find a free port for the main listener
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	_, err = New(&Config{
+		Listen:       addr,
+		Cache:        &ConfigGroup{Paths: []string{cache}, Concurrency: 1},
+		Destinations: map[string]*ConfigGroup{"a": {Paths: []string{dst}, Concurrency: 1, Listen: taken.Addr().String()}},
+	})
+	if err == nil {
+		t.Fatal("New succeeded with the group's port taken")
+	}
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("main listener wasn't closed: %v", err)
+	}
+	l.Close()
+}
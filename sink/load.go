@@ -0,0 +1,128 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// loadMonitor watches the system's pressure and load, and throttles how many
+// plots are received at once while it is overloaded, so a harvester on the
+// same box doesn't miss signage points during an ingest storm.
+type loadMonitor struct {
+	ioPressure  float64
+	cpuPressure float64
+	loadAverage float64
+	concurrency int64
+	interval    time.Duration
+	recovery    time.Duration
+
+	overloaded atomic.Bool
+}
+
+// newLoadMonitor returns a monitor for the configured limits, or nil when
+// none are set.
+func newLoadMonitor(cfg *ConfigLoad) *loadMonitor {
+	if cfg == nil || (cfg.IOPressure <= 0 && cfg.CPUPressure <= 0 && cfg.LoadAverage <= 0) {
+		return nil
+	}
+	m := &loadMonitor{
+		ioPressure:  cfg.IOPressure,
+		cpuPressure: cfg.CPUPressure,
+		loadAverage: cfg.LoadAverage,
+		concurrency: cfg.Concurrency,
+		interval:    cfg.Interval,
+		recovery:    cfg.Recovery,
+	}
+	if m.concurrency <= 0 {
+		m.concurrency = 1
+	}
+	if m.interval <= 0 {
+		m.interval = 5 * time.Second
+	}
+	if m.recovery <= 0 {
+		m.recovery = time.Minute
+	}
+	return m
+}
+
+// check returns a description of the first limit exceeded, or an empty string
+// when the system isn't overloaded.
+func (m *loadMonitor) check() (string, error) {
+	if m.ioPressure > 0 {
+		p, err := readPressure("io")
+		if err != nil {
+			return "", err
+		}
+		if p >= m.ioPressure {
+			return formatLoad("io pressure", p, m.ioPressure), nil
+		}
+	}
+	if m.cpuPressure > 0 {
+		p, err := readPressure("cpu")
+		if err != nil {
+			return "", err
+		}
+		if p >= m.cpuPressure {
+			return formatLoad("cpu pressure", p, m.cpuPressure), nil
+		}
+	}
+	if m.loadAverage > 0 {
+		l, err := readLoadAverage()
+		if err != nil {
+			return "", err
+		}
+		if l >= m.loadAverage {
+			return formatLoad("load average", l, m.loadAverage), nil
+		}
+	}
+	return "", nil
+}
+
+// run polls the system's load, throttling as soon as a limit is exceeded and
+// lifting it once the load has stayed under the limits for the recovery time.
+// It is intended to be ran within its own goroutine.
+func (m *loadMonitor) run() {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	var calm time.Time
+	for range ticker.C {
+		reason, err := m.check()
+		if err != nil {
+			log.Printf("Failed to read the system load, no longer throttling on it: %v", err)
+			m.overloaded.Store(false)
+			return
+		}
+
+		switch {
+		case reason != "":
+			calm = time.Time{}
+			if !m.overloaded.Swap(true) {
+				log.Printf("System is overloaded (%s), accepting %d transfers at once", reason, m.concurrency)
+			}
+		case m.overloaded.Load():
+			if calm.IsZero() {
+				calm = time.Now()
+			}
+			if time.Since(calm) >= m.recovery {
+				m.overloaded.Store(false)
+				log.Print("System load has recovered, no longer throttling transfers")
+			}
+		}
+	}
+}
+
+// throttled returns true if the sink is receiving as many plots as it accepts
+// while overloaded.
+func (m *loadMonitor) throttled(connections int64) bool {
+	return m != nil && m.overloaded.Load() && connections > m.concurrency
+}
+
+// formatLoad describes a load limit which was exceeded.
+func formatLoad(name string, value, limit float64) string {
+	return fmt.Sprintf("%s %.2f over %.2f", name, value, limit)
+}
@@ -0,0 +1,45 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// readPressure returns the share of the last 10 seconds, as a percent, some
+// tasks were stalled waiting on the resource, from the kernel's pressure stall
+// information.
+func readPressure(resource string) (float64, error) {
+	b, err := os.ReadFile("/proc/pressure/" + resource)
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "some" {
+			continue
+		}
+		value, ok := strings.CutPrefix(fields[1], "avg10=")
+		if !ok {
+			break
+		}
+		return strconv.ParseFloat(value, 64)
+	}
+	return 0, fmt.Errorf("unexpected format of /proc/pressure/%s", resource)
+}
+
+// readLoadAverage returns the one minute load average.
+func readLoadAverage() (float64, error) {
+	b, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected format of /proc/loadavg")
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
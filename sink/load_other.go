@@ -0,0 +1,19 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+//go:build !linux
+
+package sink
+
+import (
+	"errors"
+)
+
+// readPressure is only supported on Linux.
+func readPressure(resource string) (float64, error) {
+	return 0, errors.New("pressure stall information is only available on Linux")
+}
+
+// readLoadAverage is only supported on Linux.
+func readLoadAverage() (float64, error) {
+	return 0, errors.New("load average is only supported on Linux")
+}
@@ -0,0 +1,76 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"errors"
+	"time"
+)
+
+// moveRetryPolicy decides how a failed move is handled: how many times it is
+// tried on the same path, how long to wait between tries, whether the plot
+// then falls back to another path in its group, and how long a path the plot
+// couldn't be moved to is paused.
+type moveRetryPolicy struct {
+	attempts int
+	backoff  time.Duration
+	fallback bool
+	pause    time.Duration
+}
+
+// newMoveRetryPolicy returns the policy from the config. By default a move is
+// tried once, and the path paused for 5 minutes when it fails.
+func newMoveRetryPolicy(cfg *ConfigMoveRetry) (*moveRetryPolicy, error) {
+	p := &moveRetryPolicy{attempts: 1, backoff: 30 * time.Second, pause: 5 * time.Minute}
+	if cfg == nil {
+		return p, nil
+	}
+	if cfg.Attempts < 0 {
+		return nil, errors.New("attempts can't be negative")
+	}
+	if cfg.Backoff < 0 {
+		return nil, errors.New("backoff can't be negative")
+	}
+	if cfg.Attempts > 0 {
+		p.attempts = cfg.Attempts
+	}
+	if cfg.Backoff > 0 {
+		p.backoff = cfg.Backoff
+	}
+	if cfg.Pause != 0 {
+		p.pause = cfg.Pause
+	}
+	p.fallback = cfg.Fallback
+	return p, nil
+}
+
+// delay returns how long to wait before the next try after the attempt,
+// doubling with each one.
+func (p *moveRetryPolicy) delay(attempt int) time.Duration {
+	d := p.backoff
+	for i := 1; i < attempt && d < time.Hour; i++ {
+		d *= 2
+	}
+	return min(d, time.Hour)
+}
+
+// wait sleeps for the delay after the attempt, returning false if the
+// transfer is canceled meanwhile.
+func (p *moveRetryPolicy) wait(t *transfer, attempt int) bool {
+	deadline := time.Now().Add(p.delay(attempt))
+	for time.Now().Before(deadline) {
+		if t.canceled.Load() {
+			return false
+		}
+		time.Sleep(min(time.Second, time.Until(deadline)))
+	}
+	return !t.canceled.Load()
+}
+
+// failed pauses the path after the plot couldn't be moved to it. A negative
+// pause leaves it in use.
+func (p *moveRetryPolicy) failed(pp *PlotPath) {
+	if p.pause > 0 {
+		pp.pauseFor(p.pause)
+	}
+}
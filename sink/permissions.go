@@ -0,0 +1,91 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// filePermissions are applied to plots once they are in their final location,
+// so harvesters running as a different user can read them.
+type filePermissions struct {
+	mode    os.FileMode
+	setMode bool
+	uid     int
+	gid     int
+}
+
+// newFilePermissions resolves the configured mode, owner, and group. Owner and
+// group can be given as names or numeric ids.
+func newFilePermissions(cfg *ConfigPermissions) (*filePermissions, error) {
+	p := &filePermissions{uid: -1, gid: -1}
+
+	if cfg.Mode != "" {
+		m, err := strconv.ParseUint(cfg.Mode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mode %q: %v", cfg.Mode, err)
+		}
+		p.mode = os.FileMode(m)
+		p.setMode = true
+	}
+
+	if cfg.Owner != "" {
+		uid, err := lookupUID(cfg.Owner)
+		if err != nil {
+			return nil, err
+		}
+		p.uid = uid
+	}
+
+	if cfg.Group != "" {
+		gid, err := lookupGID(cfg.Group)
+		if err != nil {
+			return nil, err
+		}
+		p.gid = gid
+	}
+
+	return p, nil
+}
+
+// apply sets the mode and ownership on the file.
+func (p *filePermissions) apply(path string) error {
+	if p.setMode {
+		if err := os.Chmod(path, p.mode); err != nil {
+			return err
+		}
+	}
+	if p.uid >= 0 || p.gid >= 0 {
+		if err := os.Chown(path, p.uid, p.gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupUID returns the uid for a user name or numeric id.
+func lookupUID(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// lookupGID returns the gid for a group name or numeric id.
+func lookupGID(name string) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
@@ -0,0 +1,116 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// plotDirectories writes the destination paths out for the harvester, and can
+// run a command such as "chia plots add -d" for each path it hasn't seen
+// before, so new disks are farmed without manual steps.
+type plotDirectories struct {
+	path    string
+	format  string
+	command []string
+	known   map[string]bool
+	mutex   sync.Mutex
+}
+
+func newPlotDirectories(cfg *ConfigPlotDirectories) (*plotDirectories, error) {
+	pd := &plotDirectories{
+		path:    cfg.Path,
+		format:  cfg.Format,
+		command: cfg.Command,
+		known:   make(map[string]bool),
+	}
+	if pd.format == "" {
+		pd.format = "yaml"
+	}
+	if pd.format != "yaml" && pd.format != "lines" {
+		return nil, fmt.Errorf("unknown plot_directories format %q", pd.format)
+	}
+	if pd.path == "" && len(pd.command) == 0 {
+		return nil, fmt.Errorf("plot_directories requires a path or command")
+	}
+	return pd, nil
+}
+
+// update writes out the paths, and runs the command for any which are new.
+func (pd *plotDirectories) update(paths []string) {
+	pd.mutex.Lock()
+	defer pd.mutex.Unlock()
+
+	slices.Sort(paths)
+	if pd.path != "" {
+		if err := pd.write(paths); err != nil {
+			log.Printf("Failed to write plot directories to %s: %v", pd.path, err)
+		}
+	}
+
+	for _, p := range paths {
+		if pd.known[p] {
+			continue
+		}
+		if len(pd.command) > 0 {
+			args := append(slices.Clone(pd.command[1:]), p)
+			out, err := exec.Command(pd.command[0], args...).CombinedOutput()
+			if err != nil {
+				log.Printf("Failed to add plot directory %s: %v: %s", p, err, strings.TrimSpace(string(out)))
+				continue
+			}
+			log.Printf("Added plot directory %s", p)
+		}
+		pd.known[p] = true
+	}
+}
+
+// write replaces the file with the paths, as either a plot_directories YAML
+// list matching the Chia config, or one path per line.
+func (pd *plotDirectories) write(paths []string) error {
+	var b bytes.Buffer
+	if pd.format == "lines" {
+		b.WriteString(strings.Join(paths, "\n") + "\n")
+	} else {
+		enc := yaml.NewEncoder(&b)
+		enc.SetIndent(2)
+		if err := enc.Encode(map[string][]string{"plot_directories": paths}); err != nil {
+			return err
+		}
+	}
+
+	tmpfile := filepath.Join(filepath.Dir(pd.path), "."+filepath.Base(pd.path)+".tmp")
+	if err := os.WriteFile(tmpfile, b.Bytes(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpfile, pd.path)
+}
+
+// updatePlotDirectories emits the current destination paths, if configured.
+func (s *Sink) updatePlotDirectories() {
+	if s.plotDirs == nil {
+		return
+	}
+
+	paths := make([]string, 0)
+	for _, pg := range s.GroupsNamed("") {
+		pg.sortMutex.RLock()
+		for _, pp := range pg.sortedPlots {
+			if !pp.isRemote() {
+				paths = append(paths, pp.path)
+			}
+		}
+		pg.sortMutex.RUnlock()
+	}
+	s.plotDirs.update(paths)
+}
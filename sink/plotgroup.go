@@ -0,0 +1,424 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"cmp"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Strategies for choosing between a group's paths.
+const (
+	// StrategyFreeSpace picks the path with the most free space.
+	StrategyFreeSpace = "free_space"
+
+	// StrategySpeed picks the fastest path measured by the speed probe,
+	// falling back to free space for paths with the same speed.
+	StrategySpeed = "speed"
+
+	// StrategyBestFit picks the path with the least free space that still
+	// fits the plot, topping off nearly full disks first.
+	StrategyBestFit = "best_fit"
+)
+
+// strategies are the valid values for a group's strategy.
+var strategies = map[string]bool{
+	StrategyFreeSpace: true,
+	StrategySpeed:     true,
+	StrategyBestFit:   true,
+}
+
+// PlotGroup is a set of paths sharing a concurrency limit, which plots are
+// placed across by the group's strategy.
+type PlotGroup struct {
+	name        string
+	concurrency int64
+	transfers   atomic.Int64
+	paused      atomic.Bool
+	disabled    atomic.Bool
+	draining    atomic.Bool
+	listen      string
+	strategy    string
+	reserve     uint64
+
+	// caps the combined rate plots are moved to the group at
+	limiter   *RateLimiter
+	bandwidth uint64
+
+	// plots in the cache waiting to be moved to the group
+	backlog backlogTracker
+
+	// copies written of each plot stored in the group, and the groups the
+	// extra copies go to
+	replicas      int
+	replicaGroups []string
+
+	sortedPlots []*PlotPath
+	sortMutex   sync.RWMutex
+
+	allowExcessConcurrency bool
+}
+
+// Name returns the group's name, which is "cache" for the cache.
+func (pg *PlotGroup) Name() string {
+	return pg.name
+}
+
+func newPlotGroup(cfg *ConfigGroup, allowExcessConcurrency bool) (*PlotGroup, error) {
+	pg := &PlotGroup{
+		name:                   cfg.name,
+		listen:                 cfg.Listen,
+		allowExcessConcurrency: allowExcessConcurrency,
+		sortedPlots:            make([]*PlotPath, 0),
+	}
+
+	// validate the plots exist and add them in
+	pg.update(cfg, resolvePaths(cfg, nil))
+
+	log.Printf("Plot Group %q ready with concurrency %d.", pg.name, pg.concurrency)
+
+	return pg, nil
+}
+
+// pathValidateWorkers bounds how many paths are validated at once, and
+// pathValidateTimeout is how long a path, such as a spun down disk, has to
+// respond before it is skipped.
+const (
+	pathValidateWorkers = 16
+	pathValidateTimeout = 30 * time.Second
+)
+
+// resolvePaths expands the group's configured paths and validates each is a
+// directory. Paths matching an exclusion pattern are left out, as are paths
+// containing the group's skip file, which is typically left in the mount point
+// directory of an unmounted disk. Paths found in existing are reused rather
+// than recreated, so their state is carried over when the configuration is
+// reloaded. Paths are validated concurrently, so many slow disks don't hold
+// up startup.
+func resolvePaths(cfg *ConfigGroup, existing map[string]*PlotPath) []*PlotPath {
+	if cfg.isRemote() {
+		return resolveRemote(cfg, existing)
+	}
+
+	matched := make([]string, 0)
+
+	for _, p := range cfg.Paths {
+		if strings.HasPrefix(p, "!") {
+			continue
+		}
+
+		p, err := filepath.Abs(p)
+		if err != nil {
+			log.Printf("Path %s failed expansion, skipping: %v", p, err)
+			continue
+		}
+
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			log.Printf("Path %s failed globbing, skipping: %v", p, err)
+			continue
+		}
+
+		for _, m := range matches {
+			if !cfg.excluded(m) {
+				matched = append(matched, m)
+			}
+		}
+	}
+
+	// validate with a bounded number of workers, keeping the configured order
+	results := make([]*PlotPath, len(matched))
+	sem := make(chan struct{}, pathValidateWorkers)
+	var wg sync.WaitGroup
+	for i, m := range matched {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, m string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = validatePathTimeout(cfg, m, existing[m])
+		}(i, m)
+	}
+	wg.Wait()
+
+	paths := make([]*PlotPath, 0, len(results))
+	for _, pp := range results {
+		if pp != nil {
+			paths = append(paths, pp)
+		}
+	}
+	return paths
+}
+
+// validatePathTimeout runs validatePath, giving up on the path if it doesn't
+// respond within pathValidateTimeout. A stuck stat is left to finish in the
+// background.
+func validatePathTimeout(cfg *ConfigGroup, path string, pp *PlotPath) *PlotPath {
+	done := make(chan *PlotPath, 1)
+	go func() {
+		done <- validatePath(cfg, path, pp)
+	}()
+
+	select {
+	case pp := <-done:
+		return pp
+	case <-time.After(pathValidateTimeout):
+		log.Printf("Path %s didn't respond within %s, skipping", path, pathValidateTimeout)
+		return nil
+	}
+}
+
+// validatePath checks a single matched path, returning nil if it should be
+// skipped. An existing PlotPath is reused with its concurrency updated.
+func validatePath(cfg *ConfigGroup, path string, pp *PlotPath) *PlotPath {
+	if cfg.skipFile != "" {
+		if _, err := os.Stat(filepath.Join(path, cfg.skipFile)); err == nil {
+			log.Printf("Path %s contains %s, skipping", path, cfg.skipFile)
+			return nil
+		}
+	}
+
+	if pp != nil {
+		pp.setConcurrency(cfg.pathConcurrency(path))
+		pp.requireMount.Store(cfg.mount)
+		return pp
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		log.Printf("Path %s failed validation, skipping: %v", path, err)
+		return nil
+	}
+
+	if !fi.IsDir() {
+		log.Printf("Path %s is not a directory, skipping", path)
+		return nil
+	}
+
+	// an unmounted path is still registered, so it is used once mounted
+	pp = &PlotPath{path: path, concurrency: cfg.pathConcurrency(path)}
+	pp.requireMount.Store(cfg.mount)
+	if err := pp.updateFreeSpace(); err != nil && err != errNotMounted {
+		return nil
+	}
+
+	log.Printf("Registred plot path: %s [%s free / %s total]",
+		path, humanize.IBytes(pp.freeSpace.Load()), humanize.IBytes(pp.totalSpace.Load()))
+	return pp
+}
+
+// update replaces the group's concurrency and paths. In-flight transfers keep
+// their references to any paths which were removed.
+func (pg *PlotGroup) update(cfg *ConfigGroup, paths []*PlotPath) {
+	pg.sortMutex.Lock()
+	pg.concurrency = cfg.Concurrency
+	pg.sortedPlots = paths
+	pg.replicas = max(cfg.Replicas, 1)
+	pg.replicaGroups = cfg.ReplicaGroups
+	pg.strategy = cfg.Strategy
+	if pg.strategy == "" {
+		pg.strategy = StrategyFreeSpace
+	}
+	pg.reserve, _ = humanize.ParseBytes(cfg.Reserve)
+	pg.bandwidth, _ = humanize.ParseBytes(cfg.Bandwidth)
+	if pg.limiter == nil {
+		pg.limiter = NewRateLimiter(0)
+	}
+	pg.limiter.setRate(pg.bandwidth)
+
+	// ensure concurrency doesn't exceed what the paths can take
+	if !pg.allowExcessConcurrency {
+		pg.concurrency = min(pg.concurrency, pathsConcurrency(paths, pg.concurrency))
+	}
+	pg.sortMutex.Unlock()
+
+	// sort the paths
+	pg.sortPaths()
+}
+
+// pathsConcurrency returns how many plots can be written to the paths at once
+// in total. If any path has no limit, unlimited is returned instead.
+func pathsConcurrency(paths []*PlotPath, unlimited int64) int64 {
+	total := int64(0)
+	for _, pp := range paths {
+		if pp.concurrency == 0 {
+			return unlimited
+		}
+		total += pp.concurrency
+	}
+	return total
+}
+
+// sortPaths will update the order of the plotPaths inside the sink's
+// sortedPaths slice according to the group's strategy. This should be done
+// after every file transfer when the free space is updated.
+func (pg *PlotGroup) sortPaths() {
+	pg.sortMutex.Lock()
+	defer pg.sortMutex.Unlock()
+
+	slices.SortStableFunc(pg.sortedPlots, func(a, b *PlotPath) int {
+		switch pg.strategy {
+		case StrategySpeed:
+			if c := cmp.Compare(b.speed.Load(), a.speed.Load()); c != 0 {
+				return c
+			}
+		case StrategyBestFit:
+			return cmp.Compare(a.freeSpace.Load(), b.freeSpace.Load())
+		}
+		return cmp.Compare(b.freeSpace.Load(), a.freeSpace.Load())
+	})
+}
+
+// sortCachePaths will update the order of the plotPaths inside the group's
+// sortedPaths slice according to the number of transfers. This is used with
+// cache plotPaths rather than final destination ones.
+func (pg *PlotGroup) sortCachePaths() {
+	pg.sortMutex.Lock()
+	defer pg.sortMutex.Unlock()
+
+	slices.SortStableFunc(pg.sortedPlots, func(a, b *PlotPath) int {
+		return cmp.Compare(a.transfers.Load(), b.transfers.Load())
+	})
+}
+
+// PickPlot will return which plot path would be most ideal for the current
+// request. It will order the one with the most free space that doesn't already
+// have an active transfer.
+func (pg *PlotGroup) PickPlot(size uint64) *PlotPath {
+	return pg.pickPlotExcept(size, nil)
+}
+
+// pickPlotExcept is like pickPlot, but passes over the paths skip returns true
+// for.
+func (pg *PlotGroup) pickPlotExcept(size uint64, skip func(*PlotPath) bool) *PlotPath {
+	pg.sortMutex.RLock()
+	defer pg.sortMutex.RUnlock()
+
+	if pg.transfers.Load() >= pg.concurrency {
+		return nil
+	}
+	if pg.paused.Load() || pg.disabled.Load() || pg.draining.Load() {
+		return nil
+	}
+
+	for _, v := range pg.sortedPlots {
+		if skip != nil && skip(v) {
+			continue
+		}
+		v.considered.Add(1)
+		if v.full() {
+			v.skipBusy.Add(1)
+			continue
+		}
+		if v.unavailable() {
+			v.skipPaused.Add(1)
+			continue
+		}
+		// when sorted by free space, if this one doesn't have enough space,
+		// no point to continue. The group's reserve is always left free.
+		if !v.isRemote() && size+pg.reserve > v.freeSpace.Load() {
+			v.skipNoSpace.Add(1)
+			if pg.strategy == StrategyFreeSpace {
+				return nil
+			}
+			continue
+		}
+		v.selected.Add(1)
+		return v
+	}
+	return nil
+}
+
+// hasRoom returns true if the group can take another transfer while leaving
+// headroom of its slots free.
+func (pg *PlotGroup) hasRoom(headroom int64) bool {
+	return headroom == 0 || pg.transfers.Load()+headroom < pg.concurrency
+}
+
+// quiesced returns true when the group is draining and all of its in-flight
+// transfers and moves have finished.
+func (pg *PlotGroup) quiesced() bool {
+	return pg.draining.Load() && pg.transfers.Load() == 0
+}
+
+// sortGroups will update the order of the plotGroups inside the sink's
+// sortedGrups slice. This should be done after every file transfer when the
+// number of transfers is updated.
+func (s *Sink) sortGroups() {
+	s.sortMutex.Lock()
+	defer s.sortMutex.Unlock()
+
+	slices.SortStableFunc(s.sortedGroups, func(a, b *PlotGroup) int {
+		return cmp.Compare(a.transfers.Load(), b.transfers.Load())
+	})
+}
+
+// GroupsNamed returns the groups matching the name. The cache group can be
+// referenced as "cache", and an empty name will return all of the destination
+// groups.
+func (s *Sink) GroupsNamed(name string) []*PlotGroup {
+	if name == "cache" {
+		return []*PlotGroup{s.cacheGroup}
+	}
+
+	s.sortMutex.RLock()
+	defer s.sortMutex.RUnlock()
+
+	if name == "" {
+		return slices.Clone(s.sortedGroups)
+	}
+	for _, pg := range s.sortedGroups {
+		if pg.name == name {
+			return []*PlotGroup{pg}
+		}
+	}
+	return nil
+}
+
+// PickPlot will return which plot path would be most ideal for the current
+// request. It will loop over the available groups, sorted by the number of
+// transfers they already have, and return an available PlotPath to use. Groups
+// with their own listener are skipped, as are groups without headroom free
+// slots beyond the plot.
+func (s *Sink) PickPlot(size uint64, headroom int64) (*PlotGroup, *PlotPath) {
+	s.sortMutex.RLock()
+	defer s.sortMutex.RUnlock()
+
+	for _, pg := range s.sortedGroups {
+		if pg.listen != "" || !pg.hasRoom(headroom) {
+			continue
+		}
+		pp := pg.PickPlot(size)
+		if pp != nil {
+			return pg, pp
+		}
+	}
+	return nil, nil
+}
+
+// pickPlotFrom is like pickPlot, but only picks from the named groups, which
+// may include groups with their own listener.
+func (s *Sink) pickPlotFrom(size uint64, names []string, headroom int64) (*PlotGroup, *PlotPath) {
+	s.sortMutex.RLock()
+	defer s.sortMutex.RUnlock()
+
+	for _, pg := range s.sortedGroups {
+		if !slices.Contains(names, pg.name) || !pg.hasRoom(headroom) {
+			continue
+		}
+		pp := pg.PickPlot(size)
+		if pp != nil {
+			return pg, pp
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,82 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/krobertson/chia-plot-sink-multi/plotfile"
+)
+
+// keyFilter only accepts plots created with the farm's keys, so a shared sink
+// doesn't store plots the farm can never farm.
+type keyFilter struct {
+	farmer       map[string]bool
+	pool         map[string]bool
+	poolContract map[string]bool
+}
+
+// newKeyFilter parses the allowed keys. Keys are hex, and pool contracts may
+// also be given as their xch address.
+func newKeyFilter(cfg *ConfigKeys) (*keyFilter, error) {
+	kf := &keyFilter{}
+	var err error
+	if kf.farmer, err = parseKeys(cfg.Farmer, plotfile.PublicKeySize); err != nil {
+		return nil, fmt.Errorf("invalid farmer key: %v", err)
+	}
+	if kf.pool, err = parseKeys(cfg.Pool, plotfile.PublicKeySize); err != nil {
+		return nil, fmt.Errorf("invalid pool key: %v", err)
+	}
+	if kf.poolContract, err = parseKeys(cfg.PoolContract, plotfile.PuzzleHashSize); err != nil {
+		return nil, fmt.Errorf("invalid pool contract: %v", err)
+	}
+	return kf, nil
+}
+
+// parseKeys decodes the keys into a set of their hex encoding, returning nil
+// when there are none.
+func parseKeys(keys []string, size int) (map[string]bool, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	set := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		var b []byte
+		var err error
+		if strings.HasPrefix(k, "xch1") || strings.HasPrefix(k, "txch1") {
+			b, err = plotfile.DecodeAddress(k)
+		} else {
+			b, err = hex.DecodeString(strings.TrimPrefix(k, "0x"))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", k, err)
+		}
+		if len(b) != size {
+			return nil, fmt.Errorf("%q is %d bytes, expected %d", k, len(b), size)
+		}
+		set[hex.EncodeToString(b)] = true
+	}
+	return set, nil
+}
+
+// check returns an error if the plot wasn't created with allowed keys. When
+// either pool keys or pool contracts are configured, the plot must use one of
+// them.
+func (kf *keyFilter) check(h *plotfile.Header) error {
+	if kf.farmer != nil && !kf.farmer[hex.EncodeToString(h.FarmerKey)] {
+		return fmt.Errorf("farmer key %x is not allowed", h.FarmerKey)
+	}
+	if kf.pool == nil && kf.poolContract == nil {
+		return nil
+	}
+	if h.PoolKey != nil && !kf.pool[hex.EncodeToString(h.PoolKey)] {
+		return fmt.Errorf("pool key %x is not allowed", h.PoolKey)
+	}
+	if h.PoolContract != nil && !kf.poolContract[hex.EncodeToString(h.PoolContract)] {
+		return fmt.Errorf("pool contract %s is not allowed", plotfile.EncodeAddress(h.PoolContract))
+	}
+	return nil
+}
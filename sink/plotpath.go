@@ -0,0 +1,280 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// PlotPath is a directory or remote store plots are written to, tracking its
+// free space and the transfers writing to it.
+type PlotPath struct {
+	path       string
+	transfers  atomic.Int64
+	busy       atomic.Bool
+	paused     atomic.Bool
+	freeSpace  atomic.Uint64
+	totalSpace atomic.Uint64
+	mutex      sync.Mutex
+
+	// concurrency is how many plots can be written to the path at once. Zero
+	// means the path is never busy.
+	concurrency int64
+
+	// write speed in bytes per second measured by the speed probe
+	speed atomic.Uint64
+
+	// requireMount refuses the path while it is on the root filesystem, such
+	// as when its disk failed to mount
+	requireMount atomic.Bool
+
+	// mounted is set once the path is seen on its own filesystem, after which
+	// it is refused should it drop to the root filesystem, such as when its
+	// disk is lost, rather than filling the OS drive. unmounted is set while
+	// it is refused for either reason.
+	mounted   atomic.Bool
+	unmounted atomic.Bool
+
+	// buffered is set for paths on network filesystems, where direct I/O
+	// either fails or is slow, so they're written through the page cache
+	buffered atomic.Bool
+
+	// pool is set when the path shares its filesystem with other paths
+	pool *plotPool
+
+	// remote is set for paths uploading to a remote store rather than
+	// writing to a directory
+	remote RemoteStore
+
+	// set while the path's filesystem can't be read, such as when the disk
+	// has died or been unmounted, along with the error
+	faulted atomic.Bool
+	fault   string
+
+	// set by the temperature monitor while the path's disk is running hot,
+	// warm limiting it to one plot at a time and hot pausing it, along with
+	// the last temperature read
+	warm        atomic.Bool
+	hot         atomic.Bool
+	temperature atomic.Int64
+
+	// set by an operator through the admin api
+	adminPaused atomic.Bool
+	disabled    atomic.Bool
+
+	// selection counters used to diagnose paths which never receive plots
+	considered  atomic.Int64
+	selected    atomic.Int64
+	skipBusy    atomic.Int64
+	skipPaused  atomic.Int64
+	skipNoSpace atomic.Int64
+}
+
+// errNotMounted faults a path requiring a mount which is on the root
+// filesystem.
+var errNotMounted = errors.New("not mounted, the path is on the root filesystem")
+
+// Path returns the directory, or for a remote store its address.
+func (p *PlotPath) Path() string {
+	return p.path
+}
+
+// updateFreeSpace will get the filesystem stats and update the free and total
+// space on the PlotPath. If they can't be read, or the path requires a mount
+// and isn't on one, the path is faulted and no longer selected until they can
+// be again.
+func (p *PlotPath) updateFreeSpace() error {
+	// remote stores don't report their free space
+	if p.isRemote() {
+		return nil
+	}
+
+	free, total, err := DiskSpace(p.path)
+	if err == nil {
+		onRoot := onRootFilesystem(p.path)
+		if onRoot && (p.requireMount.Load() || p.mounted.Load()) {
+			err = errNotMounted
+		} else if !onRoot {
+			p.mounted.Store(true)
+		}
+	}
+	p.unmounted.Store(err == errNotMounted)
+	if err != nil {
+		p.setFault(err)
+		return err
+	}
+	p.setFault(nil)
+	p.detectNetworkFilesystem()
+
+	p.freeSpace.Store(free)
+	p.totalSpace.Store(total)
+	return nil
+}
+
+// setFault records the path's filesystem error, or clears it when err is nil,
+// logging when the path becomes faulted or recovers.
+func (p *PlotPath) setFault(err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	switch {
+	case err != nil && !p.faulted.Load():
+		log.Printf("Path %s faulted, no longer selecting it: %v", p.path, err)
+	case err == nil && p.faulted.Load():
+		log.Printf("Path %s recovered from fault: %s", p.path, p.fault)
+	}
+
+	p.faulted.Store(err != nil)
+	p.fault = ""
+	if err != nil {
+		p.fault = err.Error()
+	}
+}
+
+// detectNetworkFilesystem switches the path to buffered writes while it is on
+// a network filesystem, which is checked on every refresh since one may be
+// mounted at the path after it was registered.
+func (p *PlotPath) detectNetworkFilesystem() {
+	fs := networkFilesystem(p.path)
+	if buffered := fs != ""; buffered != p.buffered.Swap(buffered) {
+		if buffered {
+			log.Printf("Path %s is on a network filesystem (%s), writing to it without direct I/O", p.path, fs)
+		} else {
+			log.Printf("Path %s is no longer on a network filesystem, writing to it with direct I/O", p.path)
+		}
+	}
+}
+
+// openWrite opens a file in the path for writing, with direct I/O unless the
+// path is on a network filesystem.
+func (p *PlotPath) openWrite(name string, flag int, perm os.FileMode) (*os.File, error) {
+	if p.buffered.Load() {
+		return os.OpenFile(name, flag, perm)
+	}
+	return openDirect(name, flag, perm)
+}
+
+// setRemote sets the store the path uploads to.
+func (p *PlotPath) setRemote(store RemoteStore) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.remote = store
+}
+
+// remoteStore returns the store the path uploads to, or nil for a directory.
+func (p *PlotPath) remoteStore() RemoteStore {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.remote
+}
+
+// isRemote returns true if the path uploads to a remote store.
+func (p *PlotPath) isRemote() bool {
+	return p.remoteStore() != nil
+}
+
+// faultReason returns the error the path is faulted with, or an empty string.
+func (p *PlotPath) faultReason() string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.fault
+}
+
+// acquire reserves one of the path's write slots, returning false if the path
+// is already writing as many plots as its concurrency allows, or any while its
+// disk is warm. The path is marked busy while all of its slots are in use.
+func (p *PlotPath) acquire() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.concurrency > 0 && p.transfers.Load() >= p.concurrency {
+		return false
+	}
+	if p.warm.Load() && p.transfers.Load() > 0 {
+		return false
+	}
+	if p.pool != nil && !p.pool.acquire() {
+		return false
+	}
+	n := p.transfers.Add(1)
+	p.busy.Store(p.concurrency > 0 && n >= p.concurrency)
+	return true
+}
+
+// release frees a write slot reserved by acquire.
+func (p *PlotPath) release() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.pool != nil {
+		p.pool.release()
+	}
+	n := p.transfers.Add(-1)
+	p.busy.Store(p.concurrency > 0 && n >= p.concurrency)
+}
+
+// full returns true if the path, or the pool it is part of, is already writing
+// as many plots as it can.
+func (p *PlotPath) full() bool {
+	if p.busy.Load() {
+		return true
+	}
+	pool := p.plotPool()
+	return pool != nil && pool.full()
+}
+
+// pathConcurrency returns how many plots can be written to the path at once.
+func (p *PlotPath) pathConcurrency() int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.concurrency
+}
+
+// setPool sets the pool the path shares its filesystem with, or nil.
+func (p *PlotPath) setPool(pool *plotPool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.pool = pool
+}
+
+// plotPool returns the pool the path is part of, or nil.
+func (p *PlotPath) plotPool() *plotPool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.pool
+}
+
+// setConcurrency changes how many plots can be written to the path at once.
+func (p *PlotPath) setConcurrency(n int64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.concurrency = n
+	p.busy.Store(n > 0 && p.transfers.Load() >= n)
+}
+
+// pause is used to temporarily pause selecting the specified path as an option
+// for storing plots. This is primarily used if storing a plot fails. It may be
+// an intermittiend issue, but this allows retrying it later.
+func (p *PlotPath) pause() {
+	p.pauseFor(5 * time.Minute)
+}
+
+// pauseFor pauses selecting the path for the duration.
+func (p *PlotPath) pauseFor(d time.Duration) {
+	p.paused.Store(true)
+	time.AfterFunc(d, func() {
+		p.paused.Store(false)
+	})
+}
+
+// unavailable returns true if the path is paused for any reason, faulted, too
+// hot, or has been disabled, and shouldn't be selected for new plots.
+func (p *PlotPath) unavailable() bool {
+	return p.paused.Load() || p.faulted.Load() || p.hot.Load() || p.adminPaused.Load() || p.disabled.Load()
+}
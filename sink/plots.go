@@ -0,0 +1,131 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/krobertson/chia-plot-sink-multi/plotfile"
+)
+
+// minLookupID is the shortest plot id prefix a lookup accepts, so a few
+// characters don't match half the farm.
+const minLookupID = 8
+
+// StoredPlot is a plot found on one of the sink's paths.
+type StoredPlot struct {
+	Filename string    `json:"filename"`
+	Group    string    `json:"group"`
+	Path     string    `json:"path"`
+	Size     uint64    `json:"size"`
+	Time     time.Time `json:"time"`
+}
+
+// storedPlots lists the plots on the paths of the groups, or only the path
+// when one is given. Paths are read in parallel, so a slow disk doesn't hold
+// up the others. Remote destinations can't be listed and are skipped.
+func (s *Sink) storedPlots(groups []*PlotGroup, path string) []StoredPlot {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	list := make([]StoredPlot, 0)
+
+	for _, pg := range groups {
+		pg.sortMutex.RLock()
+		for _, pp := range pg.sortedPlots {
+			if pp.isRemote() || (path != "" && pp.path != path) {
+				continue
+			}
+
+			wg.Add(1)
+			go func(group, path string) {
+				defer wg.Done()
+				plots, err := ListPlots(path)
+				if err != nil {
+					return
+				}
+
+				mutex.Lock()
+				defer mutex.Unlock()
+				for _, p := range plots {
+					list = append(list, StoredPlot{
+						Filename: p.Name,
+						Group:    group,
+						Path:     path,
+						Size:     p.Size,
+						Time:     p.Modified,
+					})
+				}
+			}(pg.name, pp.path)
+		}
+		pg.sortMutex.RUnlock()
+	}
+	wg.Wait()
+
+	slices.SortFunc(list, func(a, b StoredPlot) int {
+		if c := cmp.Compare(a.Path, b.Path); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Filename, b.Filename)
+	})
+	return list
+}
+
+// handlePlots returns the plots stored on the destinations and waiting in the
+// cache, optionally limited to the "group" or "path" query parameters. The
+// time of each plot is when it was written to the path.
+func (s *Sink) handlePlots(w http.ResponseWriter, r *http.Request) {
+	group := r.URL.Query().Get("group")
+	path := r.URL.Query().Get("path")
+
+	groups := append(s.GroupsNamed("cache"), s.GroupsNamed("")...)
+	if group != "" {
+		groups = s.GroupsNamed(group)
+		if len(groups) == 0 {
+			writeJSON(w, http.StatusNotFound, &AdminResponse{Error: fmt.Sprintf("group %q not found", group)})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, s.storedPlots(groups, path))
+}
+
+// matchesPlot returns true if the plot is the one being looked up, by its
+// filename or by its plot id or a prefix of it.
+func matchesPlot(filename, query string) bool {
+	if filename == query || strings.TrimSuffix(filename, ".plot") == query {
+		return true
+	}
+	id := plotfile.IDFromFilename(filename)
+	query = strings.ToLower(query)
+	return id != "" && len(query) >= minLookupID && strings.HasPrefix(id, query)
+}
+
+// handleLookup finds which path holds the plot given by filename or plot id in
+// the "plot" query parameter, such as when the harvester reports a bad plot.
+// Every copy found is returned.
+func (s *Sink) handleLookup(w http.ResponseWriter, r *http.Request) {
+	query := filepath.Base(strings.TrimSpace(r.URL.Query().Get("plot")))
+	if query == "" || query == "." || query == "/" {
+		writeJSON(w, http.StatusBadRequest, &AdminResponse{Error: "a plot filename or id is required"})
+		return
+	}
+
+	groups := append(s.GroupsNamed("cache"), s.GroupsNamed("")...)
+	found := make([]StoredPlot, 0)
+	for _, p := range s.storedPlots(groups, "") {
+		if matchesPlot(p.Filename, query) {
+			found = append(found, p)
+		}
+	}
+	if len(found) == 0 {
+		writeJSON(w, http.StatusNotFound, &AdminResponse{Error: fmt.Sprintf("plot %q not found", query)})
+		return
+	}
+	writeJSON(w, http.StatusOK, found)
+}
@@ -0,0 +1,47 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"fmt"
+
+	"github.com/dustin/go-humanize"
+)
+
+// The default range of accepted plot sizes, from heavily compressed k32 plots
+// up to uncompressed k34 plots.
+const (
+	defaultMinPlotSize = 32 << 30
+	defaultMaxPlotSize = 450 << 30
+)
+
+// parsePlotSizes returns the range of plot sizes to accept. Unset limits use
+// the defaults, and a limit of 0 disables it.
+func parsePlotSizes(cfg *ConfigPlotSize) (uint64, uint64, error) {
+	minSize, maxSize := uint64(defaultMinPlotSize), uint64(defaultMaxPlotSize)
+	if cfg == nil {
+		return minSize, maxSize, nil
+	}
+
+	var err error
+	if cfg.Min != "" {
+		if minSize, err = humanize.ParseBytes(cfg.Min); err != nil {
+			return 0, 0, fmt.Errorf("invalid min: %v", err)
+		}
+	}
+	if cfg.Max != "" {
+		if maxSize, err = humanize.ParseBytes(cfg.Max); err != nil {
+			return 0, 0, fmt.Errorf("invalid max: %v", err)
+		}
+	}
+	if maxSize > 0 && minSize > maxSize {
+		return 0, 0, fmt.Errorf("min %s is larger than max %s", cfg.Min, cfg.Max)
+	}
+	return minSize, maxSize, nil
+}
+
+// acceptableSize returns true if a plot of the size is within the accepted
+// range, so bogus size headers are refused before anything is reserved.
+func (s *Sink) acceptableSize(size uint64) bool {
+	return size >= s.minPlotSize && (s.maxPlotSize == 0 || size <= s.maxPlotSize)
+}
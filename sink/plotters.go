@@ -0,0 +1,286 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"cmp"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+)
+
+// plotter is a named set of senders sharing a quota, so one plotter can't fill
+// storage meant for others. Senders are matched by their address, since the
+// protocol doesn't carry any identity of its own.
+type plotter struct {
+	name     string
+	sources  []netip.Prefix
+	maxPlots int64
+	maxSpace uint64
+	groups   []string
+
+	// bulk plotters can't take the slots held back for the others
+	bulk bool
+
+	// plots stored from the plotter, and those being received
+	usage   plotterUsage
+	pending plotterUsage
+}
+
+// Priorities a plotter can be given.
+const (
+	priorityHigh = "high"
+	priorityBulk = "bulk"
+)
+
+// plotterUsage is how much of a plotter's quota is used, and is persisted in
+// the state file.
+type plotterUsage struct {
+	Plots int64  `json:"plots"`
+	Bytes uint64 `json:"bytes"`
+}
+
+// plotterSet holds the configured plotters. A nil set has no plotters, so no
+// sender is limited.
+type plotterSet struct {
+	plotters []*plotter
+	mutex    sync.Mutex
+}
+
+// newPlotterSet parses the configured plotters, returning nil when there are
+// none.
+func newPlotterSet(cfg map[string]*ConfigPlotter) (*plotterSet, error) {
+	if len(cfg) == 0 {
+		return nil, nil
+	}
+
+	ps := &plotterSet{}
+	for name, pc := range cfg {
+		p := &plotter{name: name, maxPlots: pc.MaxPlots, groups: pc.Groups}
+		if len(pc.Sources) == 0 {
+			return nil, fmt.Errorf("plotter %q has no sources", name)
+		}
+		for _, src := range pc.Sources {
+			prefix, err := parseSource(src)
+			if err != nil {
+				return nil, fmt.Errorf("plotter %q: %v", name, err)
+			}
+			p.sources = append(p.sources, prefix)
+		}
+		switch pc.Priority {
+		case "", priorityHigh:
+		case priorityBulk:
+			p.bulk = true
+		default:
+			return nil, fmt.Errorf("plotter %q: unknown priority %q", name, pc.Priority)
+		}
+		if pc.MaxPlots < 0 {
+			return nil, fmt.Errorf("plotter %q: max_plots can't be negative", name)
+		}
+		if pc.MaxSpace != "" {
+			size, err := humanize.ParseBytes(pc.MaxSpace)
+			if err != nil {
+				return nil, fmt.Errorf("plotter %q: invalid max_space: %v", name, err)
+			}
+			p.maxSpace = size
+		}
+		ps.plotters = append(ps.plotters, p)
+	}
+
+	// match in a stable order when sources overlap
+	slices.SortFunc(ps.plotters, func(a, b *plotter) int {
+		return cmp.Compare(a.name, b.name)
+	})
+	return ps, nil
+}
+
+// parseSource parses a sender's address or network in CIDR notation.
+func parseSource(src string) (netip.Prefix, error) {
+	if strings.Contains(src, "/") {
+		prefix, err := netip.ParsePrefix(src)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid source %q: %v", src, err)
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(src)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid source %q: %v", src, err)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// match returns the plotter the sending host belongs to, or nil if it isn't
+// one of the plotters.
+func (ps *plotterSet) match(host string) *plotter {
+	if ps == nil {
+		return nil
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil
+	}
+	addr = addr.Unmap()
+	for _, p := range ps.plotters {
+		for _, prefix := range p.sources {
+			if prefix.Contains(addr) {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// priority returns the plotter's priority.
+func (p *plotter) priority() string {
+	if p.bulk {
+		return priorityBulk
+	}
+	return priorityHigh
+}
+
+// allowsGroup returns true if the plotter's plots may be stored in the group.
+func (p *plotter) allowsGroup(group string) bool {
+	return len(p.groups) == 0 || slices.Contains(p.groups, group)
+}
+
+// admit counts a plot of the size against the plotter's quota, returning an
+// error if it would exceed it. Plots being received count towards the quota
+// until they are stored or fail.
+func (ps *plotterSet) admit(p *plotter, size uint64) error {
+	if p == nil {
+		return nil
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	if p.maxPlots > 0 && p.usage.Plots+p.pending.Plots+1 > p.maxPlots {
+		return fmt.Errorf("plotter %q has reached its quota of %d plots", p.name, p.maxPlots)
+	}
+	if p.maxSpace > 0 && p.usage.Bytes+p.pending.Bytes+size > p.maxSpace {
+		return fmt.Errorf("plotter %q has reached its quota of %s", p.name, humanize.IBytes(p.maxSpace))
+	}
+	p.pending.Plots++
+	p.pending.Bytes += size
+	return nil
+}
+
+// done removes a plot admitted with admit from the pending plots, counting it
+// as used when it was stored.
+func (ps *plotterSet) done(p *plotter, size uint64, stored bool) {
+	if p == nil {
+		return
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	p.pending.Plots--
+	p.pending.Bytes -= size
+	if stored {
+		p.usage.Plots++
+		p.usage.Bytes += size
+	}
+}
+
+// reset clears the quota used by the named plotter, such as after its plots
+// were replotted or removed. It returns false if there is no such plotter.
+func (ps *plotterSet) reset(name string) bool {
+	if ps == nil {
+		return false
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	for _, p := range ps.plotters {
+		if p.name == name {
+			p.usage = plotterUsage{}
+			return true
+		}
+	}
+	return false
+}
+
+// usages returns a copy of the quota used by each plotter.
+func (ps *plotterSet) usages() map[string]*plotterUsage {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	m := make(map[string]*plotterUsage, len(ps.plotters))
+	for _, p := range ps.plotters {
+		u := p.usage
+		m[p.name] = &u
+	}
+	return m
+}
+
+// restore sets the quota used by each plotter from the saved state.
+func (ps *plotterSet) restore(usage map[string]*plotterUsage) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+
+	for _, p := range ps.plotters {
+		if u := usage[p.name]; u != nil {
+			p.usage = *u
+		}
+	}
+}
+
+// plotterStatus is a plotter's quota and how much of it is used.
+type plotterStatus struct {
+	Name     string   `json:"name"`
+	Sources  []string `json:"sources"`
+	Groups   []string `json:"groups,omitempty"`
+	Priority string   `json:"priority"`
+	MaxPlots int64    `json:"max_plots,omitempty"`
+	MaxSpace uint64   `json:"max_space,omitempty"`
+	Plots    int64    `json:"plots"`
+	Bytes    uint64   `json:"bytes"`
+	Pending  int64    `json:"pending"`
+}
+
+// handlePlotters returns the configured plotters and their usage.
+func (s *Sink) handlePlotters(w http.ResponseWriter, r *http.Request) {
+	list := make([]*plotterStatus, 0)
+	if s.plotters != nil {
+		s.plotters.mutex.Lock()
+		for _, p := range s.plotters.plotters {
+			ps := &plotterStatus{
+				Name:     p.name,
+				Groups:   p.groups,
+				Priority: p.priority(),
+				MaxPlots: p.maxPlots,
+				MaxSpace: p.maxSpace,
+				Plots:    p.usage.Plots,
+				Bytes:    p.usage.Bytes,
+				Pending:  p.pending.Plots,
+			}
+			for _, prefix := range p.sources {
+				ps.Sources = append(ps.Sources, prefix.String())
+			}
+			list = append(list, ps)
+		}
+		s.plotters.mutex.Unlock()
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+// handleResetPlotter clears the quota used by the plotter given in the
+// "plotter" query parameter.
+func (s *Sink) handleResetPlotter(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("plotter")
+	if !s.plotters.reset(name) {
+		writeJSON(w, http.StatusNotFound, &AdminResponse{Error: fmt.Sprintf("plotter %q not found", name)})
+		return
+	}
+	s.saveState()
+
+	msg := fmt.Sprintf("Quota usage of plotter %s reset", name)
+	log.Printf("Admin: %s", msg)
+	writeJSON(w, http.StatusOK, &AdminResponse{Message: msg})
+}
@@ -0,0 +1,144 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"log"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// plotPool is a set of destination paths on one underlying filesystem, such as
+// directories of a mergerfs pool, subvolumes of a btrfs filesystem, or several
+// directories on the same disk. Its paths report the same free space and
+// share the write slots of a single path, so the space isn't counted once for
+// each of them and parallel writes don't thrash the pool.
+type plotPool struct {
+	paths       []string
+	transfers   int64
+	concurrency int64
+	mutex       sync.Mutex
+}
+
+// acquire reserves one of the pool's write slots, returning false if the pool
+// is already writing as many plots as its concurrency allows.
+func (p *plotPool) acquire() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.concurrency > 0 && p.transfers >= p.concurrency {
+		return false
+	}
+	p.transfers++
+	return true
+}
+
+// release frees a write slot reserved by acquire.
+func (p *plotPool) release() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.transfers > 0 {
+		p.transfers--
+	}
+}
+
+// full returns true if all of the pool's write slots are in use.
+func (p *plotPool) full() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.concurrency > 0 && p.transfers >= p.concurrency
+}
+
+// assignPools groups the destination paths sharing a filesystem into pools.
+// Pools are kept by their filesystem across reloads, so write slots held by
+// in-flight transfers carry over.
+func (s *Sink) assignPools(groups []*PlotGroup) {
+	paths := make(map[string]*PlotPath)
+	for _, pg := range groups {
+		pg.sortMutex.RLock()
+		for _, pp := range pg.sortedPlots {
+			if !pp.isRemote() {
+				paths[pp.path] = pp
+			}
+		}
+		pg.sortMutex.RUnlock()
+	}
+
+	// group the paths by their filesystem
+	names := make([]string, 0, len(paths))
+	for name := range paths {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	ids := filesystemIDs(names)
+	members := make(map[string][]*PlotPath)
+	for _, name := range names {
+		if id := ids[name]; id != "" {
+			members[id] = append(members[id], paths[name])
+		}
+	}
+
+	if s.pools == nil {
+		s.pools = make(map[string]*plotPool)
+	}
+	assigned := make(map[*PlotPath]*plotPool)
+	for id, list := range members {
+		if len(list) < 2 {
+			continue
+		}
+
+		pool := s.pools[id]
+		if pool == nil {
+			pool = &plotPool{}
+			s.pools[id] = pool
+		}
+
+		// the pool can take as many plots at once as its widest path
+		pool.mutex.Lock()
+		names := make([]string, 0, len(list))
+		concurrency := int64(-1)
+		for _, pp := range list {
+			names = append(names, pp.path)
+			n := pp.pathConcurrency()
+			if n == 0 || concurrency == 0 {
+				concurrency = 0
+			} else {
+				concurrency = max(concurrency, n)
+			}
+		}
+		changed := !slices.Equal(names, pool.paths)
+		pool.paths = names
+		pool.concurrency = concurrency
+		pool.mutex.Unlock()
+
+		for _, pp := range list {
+			assigned[pp] = pool
+		}
+		if changed {
+			log.Printf("Paths %s share a filesystem, pooling their free space and writes", strings.Join(names, ", "))
+		}
+	}
+	for id := range s.pools {
+		if len(members[id]) < 2 {
+			delete(s.pools, id)
+		}
+	}
+	for _, pp := range paths {
+		pp.setPool(assigned[pp])
+	}
+}
+
+// countedSpace returns the path's free and total space, or zeros if another
+// path of its pool was already counted in seen, so pooled space is summed
+// only once.
+func (p *PlotPath) countedSpace(seen map[*plotPool]bool) (uint64, uint64) {
+	if pool := p.plotPool(); pool != nil {
+		if seen[pool] {
+			return 0, 0
+		}
+		seen[pool] = true
+	}
+	return p.freeSpace.Load(), p.totalSpace.Load()
+}
@@ -0,0 +1,93 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// DropPrivileges switches the process to the configured user and group. It is
+// called after New binds the listeners and before the sink is started, so the
+// sink can be started as root to use a privileged port and then do everything
+// else as an unprivileged user. Any files the sink needs to keep managing, such
+// as the control socket and state file, are given to the new user first, and
+// those which don't exist yet are skipped. The replaced files are rewritten by
+// renaming a new copy over them, so their directories must also be writable by
+// the new user, which is checked once it has been switched to.
+func DropPrivileges(cfg *ConfigRunAs, owned, replaced []string) error {
+	if cfg.User == "" {
+		return errors.New("run_as requires a user")
+	}
+
+	uid, err := lookupUID(cfg.User)
+	if err != nil {
+		return fmt.Errorf("failed to find user %q: %v", cfg.User, err)
+	}
+
+	// default to the user's primary group
+	gid := -1
+	if cfg.Group != "" {
+		if gid, err = lookupGID(cfg.Group); err != nil {
+			return fmt.Errorf("failed to find group %q: %v", cfg.Group, err)
+		}
+	} else if u, err := user.LookupId(strconv.Itoa(uid)); err == nil {
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if gid < 0 {
+		return fmt.Errorf("unable to determine the group for user %q, set run_as.group", cfg.User)
+	}
+
+	if os.Getuid() == uid && os.Getgid() == gid {
+		return nil
+	}
+
+	for _, p := range append(owned, replaced...) {
+		if p == "" {
+			continue
+		}
+		if err := os.Chown(p, uid, gid); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to chown %s: %v", p, err)
+		}
+	}
+
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("failed to set groups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("failed to set gid: %v", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("failed to set uid: %v", err)
+	}
+
+	log.Printf("Dropped privileges to uid %d, gid %d", uid, gid)
+
+	for _, p := range replaced {
+		if p == "" {
+			continue
+		}
+		if err := checkWritable(filepath.Dir(p)); err != nil {
+			return fmt.Errorf("directory of %s isn't writable by uid %d: %v", p, uid, err)
+		}
+	}
+	return nil
+}
+
+// checkWritable checks a file can be created in dir by creating and removing
+// one.
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".plot-sink-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,112 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// TestSaveStateAfterDropPrivileges checks the state is still saved once the
+// sink has switched to run_as, and that it refuses to switch when the state
+// file's directory isn't writable by the user. Privileges can't be regained,
+// so the sink runs in a child process.
+func TestSaveStateAfterDropPrivileges(t *testing.T) {
+	if dir := os.Getenv("SINK_TEST_STATE_DIR"); dir != "" {
+		dropAndSaveState(dir)
+		return
+	}
+	if os.Getuid() != 0 {
+		t.Skip("requires root")
+	}
+	u, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skip("no nobody user")
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+
+	dir := t.TempDir()
+	for d := dir; d != os.TempDir(); d = filepath.Dir(d) {
+		if err := os.Chmod(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range []string{"cache", "dst", "state"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stateFile := filepath.Join(dir, "state", "state.json")
+	if err := os.WriteFile(stateFile, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func() error {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestSaveStateAfterDropPrivileges$")
+		cmd.Env = append(os.Environ(), "SINK_TEST_STATE_DIR="+dir)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Logf("%s", out)
+		}
+		return err
+	}
+
+	if err := run(); err == nil {
+		t.Fatal("dropped privileges with a state directory the user can't write to")
+	}
+
+	if err := os.Chown(filepath.Join(dir, "state"), uid, gid); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st sinkState
+	if err := json.Unmarshal(b, &st); err != nil {
+		t.Fatal(err)
+	}
+	if gs := st.Groups["a"]; gs == nil || !gs.Paused {
+		t.Errorf("paused group wasn't saved: %s", b)
+	}
+	fi, err := os.Stat(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Sys().(*syscall.Stat_t).Uid != uint32(uid) {
+		t.Error("state file isn't owned by the user")
+	}
+}
+
+// dropAndSaveState is the child side of TestSaveStateAfterDropPrivileges.
+func dropAndSaveState(dir string) {
+	s, err := New(&Config{
+		Listen:       "127.0.0.1:0",
+		StateFile:    filepath.Join(dir, "state", "state.json"),
+		Cache:        &ConfigGroup{Paths: []string{filepath.Join(dir, "cache")}, Concurrency: 1},
+		Destinations: map[string]*ConfigGroup{"a": {Paths: []string{filepath.Join(dir, "dst")}, Concurrency: 1}},
+	})
+	if err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		os.Exit(1)
+	}
+	defer s.Close()
+
+	if err := DropPrivileges(&ConfigRunAs{User: "nobody"}, nil, []string{s.stateFile}); err != nil {
+		os.Stderr.WriteString(err.Error() + "\n")
+		os.Exit(1)
+	}
+	s.GroupsNamed("a")[0].paused.Store(true)
+	s.saveState()
+}
@@ -0,0 +1,76 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// probeFile is the name of the temporary file written by the speed probe.
+const probeFile = ".plot-sink-probe"
+
+// probe measures the path's write speed by writing size bytes the same way
+// plots are written and syncing them to disk. The result is stored in bytes per second.
+func (p *PlotPath) probe(size int) error {
+	name := filepath.Join(p.path, probeFile)
+	f, err := p.openWrite(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(name)
+	defer f.Close()
+
+	buf := alignedBuffer(defaultBufferSize)
+	start := time.Now()
+	for written := 0; written < size; written += len(buf) {
+		if _, err := f.Write(buf); err != nil {
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	elapsed := time.Since(start).Seconds()
+	p.speed.Store(uint64(float64(size) / elapsed))
+	return nil
+}
+
+// probePaths measures the write speed of any paths which haven't been probed.
+// Groups are probed in parallel, but the paths within a group one at a time,
+// since they typically share a controller and would skew each other.
+func (s *Sink) probePaths(groups []*PlotGroup) {
+	if s.probeSize <= 0 {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, pg := range groups {
+		pg.sortMutex.RLock()
+		paths := append([]*PlotPath{}, pg.sortedPlots...)
+		pg.sortMutex.RUnlock()
+
+		wg.Add(1)
+		go func(pg *PlotGroup) {
+			defer wg.Done()
+			for _, pp := range paths {
+				if pp.speed.Load() > 0 || pp.isRemote() {
+					continue
+				}
+				if err := pp.probe(s.probeSize); err != nil {
+					log.Printf("Speed probe of %s failed: %v", pp.path, err)
+					continue
+				}
+				log.Printf("Speed probe of %s: %s/sec", pp.path, humanize.IBytes(pp.speed.Load()))
+			}
+			pg.sortPaths()
+		}(pg)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,66 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter paces reads to a maximum number of bytes per second. A single
+// limiter may be shared by multiple copies to cap their combined bandwidth.
+type RateLimiter struct {
+	rate  float64
+	next  time.Time
+	mutex sync.Mutex
+}
+
+// NewRateLimiter returns a limiter for the rate in bytes per second.
+func NewRateLimiter(rate uint64) *RateLimiter {
+	return &RateLimiter{rate: float64(rate)}
+}
+
+// setRate changes the limit, where zero is unlimited.
+func (l *RateLimiter) setRate(rate uint64) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.rate = float64(rate)
+}
+
+// wait reserves n bytes against the limit and sleeps until they are allowed.
+func (l *RateLimiter) wait(n int) {
+	l.mutex.Lock()
+	if l.rate <= 0 {
+		l.mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / l.rate * float64(time.Second)))
+	d := l.next.Sub(now)
+	l.mutex.Unlock()
+
+	time.Sleep(d)
+}
+
+// Reader returns a reader reading from r no faster than the limit.
+func (l *RateLimiter) Reader(r io.Reader) io.Reader {
+	return &limitedReader{r: r, l: l}
+}
+
+// limitedReader applies a RateLimiter to an io.Reader.
+type limitedReader struct {
+	r io.Reader
+	l *RateLimiter
+}
+
+func (r *limitedReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.l.wait(n)
+	}
+	return n, err
+}
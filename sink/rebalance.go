@@ -0,0 +1,107 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"cmp"
+	"slices"
+)
+
+// rebalanceMaxMoves bounds the size of a single rebalance plan.
+const rebalanceMaxMoves = 10000
+
+// pathUsage is the simulated state of a path while planning a rebalance.
+type pathUsage struct {
+	pp    *PlotPath
+	group *PlotGroup
+	free  uint64
+	total uint64
+	plots []PlotFile
+}
+
+func (u *pathUsage) used() float64 {
+	if u.total == 0 {
+		return 1
+	}
+	return float64(u.total-u.free) / float64(u.total)
+}
+
+// PlanRebalance computes the moves needed to even out the fill level of the
+// destination paths, within the tolerance given as a fraction of capacity. It
+// can be limited to a single group, otherwise plots may move between groups.
+// Paused or disabled paths are left alone.
+func (s *Sink) PlanRebalance(group string, tolerance float64) []*PlannedMove {
+	usages := make([]*pathUsage, 0)
+	for _, pg := range s.GroupsNamed(group) {
+		pg.sortMutex.RLock()
+		for _, pp := range pg.sortedPlots {
+			if pp.unavailable() {
+				continue
+			}
+			plots, err := ListPlots(pp.path)
+			if err != nil {
+				continue
+			}
+			if err := pp.updateFreeSpace(); err != nil {
+				continue
+			}
+			// move the largest plots first so fewer moves are needed
+			slices.SortFunc(plots, func(a, b PlotFile) int {
+				return cmp.Compare(b.Size, a.Size)
+			})
+			usages = append(usages, &pathUsage{
+				pp:    pp,
+				group: pg,
+				free:  pp.freeSpace.Load(),
+				total: pp.totalSpace.Load(),
+				plots: plots,
+			})
+		}
+		pg.sortMutex.RUnlock()
+	}
+	if len(usages) < 2 {
+		return nil
+	}
+
+	moves := make([]*PlannedMove, 0)
+	for len(moves) < rebalanceMaxMoves {
+		slices.SortFunc(usages, func(a, b *pathUsage) int {
+			return cmp.Compare(b.used(), a.used())
+		})
+		src, dst := usages[0], usages[len(usages)-1]
+		if src.used()-dst.used() <= tolerance {
+			break
+		}
+
+		// find a plot which fits and doesn't overshoot, leaving the
+		// destination fuller than the source
+		idx := slices.IndexFunc(src.plots, func(p PlotFile) bool {
+			if p.Size > dst.free {
+				return false
+			}
+			srcUsed := float64(src.total-src.free-p.Size) / float64(src.total)
+			dstUsed := float64(dst.total-dst.free+p.Size) / float64(dst.total)
+			return dstUsed <= srcUsed
+		})
+		if idx < 0 {
+			break
+		}
+
+		p := src.plots[idx]
+		src.plots = slices.Delete(src.plots, idx, idx+1)
+		src.free += p.Size
+		dst.free -= p.Size
+		moves = append(moves, &PlannedMove{
+			Filename: p.Name,
+			Size:     p.Size,
+			From:     src.pp.path,
+			To:       dst.pp.path,
+			Group:    dst.group.name,
+			src:      src.pp,
+			dst:      dst.pp,
+			dstGroup: dst.group,
+		})
+	}
+
+	return moves
+}
@@ -0,0 +1,49 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// peerRedirects are the other sinks a sender is pointed at when this one has
+// no room for its plot, so independent sinks can share the plotters' load.
+type peerRedirects struct {
+	peers []string
+	next  atomic.Uint64
+}
+
+// newPeerRedirects returns the redirects to the host:port addresses of the
+// peers, or nil when there are none.
+func newPeerRedirects(peers []string) (*peerRedirects, error) {
+	if len(peers) == 0 {
+		return nil, nil
+	}
+	for _, addr := range peers {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid peer address %q: %v", addr, err)
+		}
+	}
+	return &peerRedirects{peers: peers}, nil
+}
+
+// redirectPeer returns the sink to point a refused plot of the size at,
+// preferring the cluster member with the most room for it over the next
+// configured peer.
+func (s *Sink) redirectPeer(size uint64) string {
+	if addr := s.cluster.pick(size); addr != "" {
+		return addr
+	}
+	return s.redirects.pick()
+}
+
+// pick returns the peer to redirect the next refused plot to, taking each in
+// turn, or an empty string when there are no peers.
+func (p *peerRedirects) pick() string {
+	if p == nil {
+		return ""
+	}
+	return p.peers[(p.next.Add(1)-1)%uint64(len(p.peers))]
+}
@@ -0,0 +1,75 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// relayGroup is the name of the destination group created in relay mode.
+const relayGroup = "relay"
+
+// relayConfig turns the relay settings into a sink group forwarding to the
+// downstream sinks, which becomes the only destination.
+func (cfg *Config) relayConfig() error {
+	if len(cfg.Destinations) > 0 {
+		return errors.New("relay mode can't be combined with destinations")
+	}
+	if len(cfg.Relay.Sinks) == 0 {
+		return errors.New("relay mode requires at least one sink")
+	}
+
+	concurrency := cfg.Relay.Concurrency
+	if concurrency == 0 {
+		concurrency = int64(len(cfg.Relay.Sinks))
+	}
+	cfg.Destinations = map[string]*ConfigGroup{
+		relayGroup: {
+			Type:        groupTypeSink,
+			Concurrency: concurrency,
+			Paths:       cfg.Relay.Sinks,
+		},
+	}
+	return nil
+}
+
+// retryRelay forwards plots left in the cache, such as after a downstream sink
+// refused or failed to store them, or the sink was restarted. Each is kept
+// until a downstream sink confirms it stored it. It is intended to be ran
+// within its own goroutine.
+func (s *Sink) retryRelay(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !s.moveWindows.open(time.Now()) {
+			continue
+		}
+
+		s.cacheGroup.sortMutex.RLock()
+		paths := append([]*PlotPath(nil), s.cacheGroup.sortedPlots...)
+		s.cacheGroup.sortMutex.RUnlock()
+
+		j := &MoveJob{Kind: relayGroup, Place: true}
+		for _, pp := range paths {
+			plots, err := ListPlots(pp.path)
+			if err != nil {
+				continue
+			}
+			for _, p := range plots {
+				// skip plots still being received or forwarded
+				if s.findTransfer(0, p.Name) != nil {
+					continue
+				}
+				m := &PlannedMove{Filename: p.Name, Size: p.Size, From: pp.path, src: pp}
+				if err := s.relocate(j, m); err != nil {
+					log.Printf("Failed to relay %s from the cache, will retry: %v", p.Name, err)
+					continue
+				}
+				log.Printf("Relayed %s from the cache to %s", p.Name, m.To)
+			}
+		}
+	}
+}
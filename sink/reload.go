@@ -0,0 +1,166 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Reload re-reads the configuration file and applies changes to the cache and
+// destination groups. Existing groups and paths are updated in place so that
+// in-flight transfers are unaffected. If the new configuration is invalid, an
+// error is returned and the current configuration remains active. Other
+// settings require a restart to take effect.
+func (s *Sink) Reload(filename string) ([]string, error) {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	if filename == "" {
+		return nil, errors.New("no config file to reload, running from command line flags")
+	}
+
+	cfg, err := LoadConfig(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %v", err)
+	}
+	if cfg.Cache == nil || len(cfg.Cache.Paths) == 0 {
+		return nil, errors.New("config has no cache paths")
+	}
+	if len(cfg.Destinations) == 0 {
+		return nil, errors.New("config has no destinations")
+	}
+
+	// alert rules aren't reloaded, so the groups they watch must remain
+	if s.alerts != nil {
+		for _, r := range s.alerts.rules {
+			if !cfg.hasGroup(r.cfg.Group) {
+				return nil, fmt.Errorf("alert rule %q watches group %q, which the config removes", r.cfg.Name, r.cfg.Group)
+			}
+		}
+	}
+
+	// index the current paths so they can be reused
+	existing := make(map[string]*PlotPath)
+	current := make(map[string]*PlotGroup)
+	for _, pg := range append(s.GroupsNamed("cache"), s.GroupsNamed("")...) {
+		pg.sortMutex.RLock()
+		for _, pp := range pg.sortedPlots {
+			existing[pp.path] = pp
+		}
+		pg.sortMutex.RUnlock()
+		current[pg.name] = pg
+	}
+
+	// resolve all of the new paths before changing anything, so a group left
+	// with no usable paths rejects the whole reload
+	cfg.Cache.name = "cache"
+	resolved := map[string][]*PlotPath{"cache": resolvePaths(cfg.Cache, existing)}
+	if len(resolved["cache"]) == 0 {
+		return nil, errors.New("none of the cache paths are usable")
+	}
+	for n, dst := range cfg.Destinations {
+		dst.name = n
+		resolved[n] = resolvePaths(dst, existing)
+		if len(resolved[n]) == 0 {
+			return nil, fmt.Errorf("none of the paths for group %q are usable", n)
+		}
+	}
+
+	bandwidth, err := newBandwidthSchedule(cfg.Bandwidth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bandwidth: %v", err)
+	}
+
+	// apply the changes
+	changes := make([]string, 0)
+	changes = append(changes, s.bandwidth.update(bandwidth)...)
+	changes = append(changes, s.cacheGroup.diff(cfg.Cache, resolved["cache"])...)
+	s.cacheGroup.update(cfg.Cache, resolved["cache"])
+	s.cacheGroup.sortCachePaths()
+
+	groups := make([]*PlotGroup, 0, len(cfg.Destinations))
+	for n, dst := range cfg.Destinations {
+		pg := current[n]
+		if pg == nil {
+			pg = &PlotGroup{name: n, listen: dst.Listen}
+			changes = append(changes, fmt.Sprintf("added group %q", n))
+			if dst.Listen != "" {
+				changes = append(changes, fmt.Sprintf("group %q listening on %s requires a restart", n, dst.Listen))
+			}
+		} else {
+			changes = append(changes, pg.diff(dst, resolved[n])...)
+		}
+		pg.update(dst, resolved[n])
+		groups = append(groups, pg)
+	}
+	for n := range current {
+		if _, ok := cfg.Destinations[n]; !ok && n != "cache" {
+			changes = append(changes, fmt.Sprintf("removed group %q", n))
+		}
+	}
+
+	s.sortMutex.Lock()
+	s.sortedGroups = groups
+	s.sortMutex.Unlock()
+	s.sortGroups()
+	s.assignPools(groups)
+	if s.watcher != nil {
+		s.watcher.sync(s.watchedPaths())
+	}
+
+	// probe the speed of any new paths
+	s.probePaths(groups)
+
+	// apply any saved state to paths and groups which were added
+	s.applyState()
+	if s.index != nil {
+		go s.indexPlots()
+	}
+	go s.updatePlotDirectories()
+
+	if len(changes) == 0 {
+		log.Print("Reloaded configuration, no changes")
+	}
+	for _, c := range changes {
+		log.Printf("Reloaded configuration: %s", c)
+	}
+	return changes, nil
+}
+
+// diff describes how the group will change when updated with the config and
+// paths.
+func (pg *PlotGroup) diff(cfg *ConfigGroup, paths []*PlotPath) []string {
+	pg.sortMutex.RLock()
+	defer pg.sortMutex.RUnlock()
+
+	changes := make([]string, 0)
+	if cfg.Listen != pg.listen && pg.name != "cache" {
+		changes = append(changes, fmt.Sprintf("group %q listen change to %q requires a restart", pg.name, cfg.Listen))
+	}
+	concurrency := cfg.Concurrency
+	if !pg.allowExcessConcurrency {
+		concurrency = min(concurrency, pathsConcurrency(paths, concurrency))
+	}
+	if bandwidth, _ := humanize.ParseBytes(cfg.Bandwidth); bandwidth != pg.bandwidth {
+		changes = append(changes, fmt.Sprintf("group %q bandwidth changed from %s to %s", pg.name, formatRate(pg.bandwidth), formatRate(bandwidth)))
+	}
+	if concurrency != pg.concurrency {
+		changes = append(changes, fmt.Sprintf("group %q concurrency changed from %d to %d", pg.name, pg.concurrency, concurrency))
+	}
+	for _, pp := range paths {
+		if !slices.Contains(pg.sortedPlots, pp) {
+			changes = append(changes, fmt.Sprintf("group %q added path %s", pg.name, pp.path))
+		}
+	}
+	for _, pp := range pg.sortedPlots {
+		if !slices.Contains(paths, pp) {
+			changes = append(changes, fmt.Sprintf("group %q removed path %s", pg.name, pp.path))
+		}
+	}
+	return changes
+}
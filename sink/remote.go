@@ -0,0 +1,113 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Destination group types. Local groups write plots to directories, the others
+// upload them from the cache to a remote store.
+const (
+	groupTypeLocal = "local"
+	groupTypeS3    = "s3"
+	groupTypeSink  = "sink"
+	groupTypeSSH   = "ssh"
+)
+
+// groupTypes are the valid group types.
+var groupTypes = map[string]bool{
+	groupTypeLocal: true,
+	groupTypeS3:    true,
+	groupTypeSink:  true,
+	groupTypeSSH:   true,
+}
+
+// RemoteStore is a destination plots are uploaded to rather than written to a
+// local disk. Remote stores don't report free space, so they are limited only
+// by their group's concurrency.
+type RemoteStore interface {
+	// Upload stores size bytes read from r as the named plot, giving up once
+	// ctx is done.
+	Upload(ctx context.Context, filename string, size uint64, r io.Reader) error
+
+	// String identifies the store, and is used as its path.
+	String() string
+}
+
+// newRemoteStores creates the stores for a remote group.
+func newRemoteStores(cfg *ConfigGroup) ([]RemoteStore, error) {
+	switch cfg.Type {
+	case groupTypeS3:
+		store, err := newS3Store(cfg.S3)
+		if err != nil {
+			return nil, err
+		}
+		return []RemoteStore{store}, nil
+	case groupTypeSink:
+		return newSinkStores(cfg)
+	case groupTypeSSH:
+		return newSSHStores(cfg)
+	}
+	return nil, fmt.Errorf("unknown group type %q", cfg.Type)
+}
+
+// resolveRemote returns the paths for a remote group, one for each of its
+// stores. Paths found in existing are reused so their state is carried over
+// when the configuration is reloaded.
+func resolveRemote(cfg *ConfigGroup, existing map[string]*PlotPath) []*PlotPath {
+	stores, err := newRemoteStores(cfg)
+	if err != nil {
+		log.Printf("Group %q failed to set up its %s destination, skipping: %v", cfg.name, cfg.Type, err)
+		return make([]*PlotPath, 0)
+	}
+
+	paths := make([]*PlotPath, 0, len(stores))
+	for _, store := range stores {
+		pp := existing[store.String()]
+		if pp == nil {
+			pp = &PlotPath{path: store.String()}
+			log.Printf("Registred %s destination: %s", cfg.Type, pp.path)
+		}
+		pp.setRemote(store)
+		paths = append(paths, pp)
+	}
+	return paths
+}
+
+// isRemote returns true if the group uploads to remote stores.
+func (g *ConfigGroup) isRemote() bool {
+	return g.Type != "" && g.Type != groupTypeLocal
+}
+
+// handleUpload is the counterpart of movePlot for remote destinations,
+// uploading the plot from its temp file to the store.
+func (s *Sink) handleUpload(t *transfer, plot *PlotPath, store RemoteStore, tf *os.File) error {
+	fi, err := tf.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat tmpfile: %v", err)
+	}
+
+	// apply any bandwidth limits
+	src := t.moveReader(tf)
+
+	s.uploads.Add(1)
+	defer s.uploads.Add(-1)
+	start := time.Now()
+	err = store.Upload(s.uploadCtx, t.filename, uint64(fi.Size()), &progressReader{r: src, n: &t.moved, canceled: &t.canceled})
+	if err != nil {
+		return fmt.Errorf("failed to upload: %v", err)
+	}
+
+	seconds := time.Since(start).Seconds()
+	log.Printf("Uploaded plot %s to %s (%s, %f secs, %s/sec)",
+		t.filename, plot.path, humanize.IBytes(uint64(fi.Size())), seconds, humanize.Bytes(uint64(float64(fi.Size())/seconds)))
+	return nil
+}
@@ -0,0 +1,121 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/krobertson/chia-plot-sink-multi/plotfile"
+)
+
+// sameFilesystem returns true if the paths are the same or pooled together on
+// one filesystem, so a copy on each wouldn't survive losing the disk.
+func sameFilesystem(a, b *PlotPath) bool {
+	if a == b {
+		return true
+	}
+	pool := a.plotPool()
+	return pool != nil && pool == b.plotPool()
+}
+
+// pickReplica picks a path for another copy of a plot already on the avoided
+// paths, on a filesystem none of them are on. It picks from the named groups,
+// or otherwise from any group without its own listener, trying groups without
+// a copy first so copies are spread across groups, and their disks' HBAs, when
+// they can be.
+func (s *Sink) pickReplica(size uint64, names []string, avoid []*PlotPath) (*PlotGroup, *PlotPath) {
+	s.sortMutex.RLock()
+	defer s.sortMutex.RUnlock()
+
+	skip := func(pp *PlotPath) bool {
+		return slices.ContainsFunc(avoid, func(a *PlotPath) bool { return sameFilesystem(a, pp) })
+	}
+	holding := func(pg *PlotGroup) bool {
+		pg.sortMutex.RLock()
+		defer pg.sortMutex.RUnlock()
+		return slices.ContainsFunc(pg.sortedPlots, func(pp *PlotPath) bool { return slices.Contains(avoid, pp) })
+	}
+
+	groups := make([]*PlotGroup, 0, len(s.sortedGroups))
+	for _, pg := range s.sortedGroups {
+		if len(names) > 0 && !slices.Contains(names, pg.name) || len(names) == 0 && pg.listen != "" {
+			continue
+		}
+		groups = append(groups, pg)
+	}
+	slices.SortStableFunc(groups, func(a, b *PlotGroup) int {
+		switch ha, hb := holding(a), holding(b); {
+		case ha == hb:
+			return 0
+		case hb:
+			return -1
+		}
+		return 1
+	})
+
+	for _, pg := range groups {
+		if pp := pg.pickPlotExcept(size, skip); pp != nil {
+			return pg, pp
+		}
+	}
+	return nil, nil
+}
+
+// storeReplicas writes the extra copies of the plot its group asks for, once
+// it has been moved to its first destination. A path a copy fails on is
+// paused as by the move retry policy and another picked. When no path is left,
+// the plot is kept with the copies which were written.
+func (s *Sink) storeReplicas(t *transfer, pg *PlotGroup, plot *PlotPath, tmpfile string) {
+	if pg.replicas < 2 {
+		return
+	}
+
+	tf, err := os.Open(tmpfile)
+	if err != nil {
+		log.Printf("Failed to open tmpfile for copies of %s: %v", t.filename, err)
+		return
+	}
+	defer tf.Close()
+
+	placed := []*PlotPath{plot}
+	avoid := []*PlotPath{plot}
+	for len(placed) < pg.replicas {
+		r := s.Reserve(&ReserveRequest{Size: t.size, Groups: pg.replicaGroups, avoid: avoid})
+		if r == nil {
+			log.Printf("No path available for copy %d of %s, it is stored %d times", len(placed)+1, t.filename, len(placed))
+			return
+		}
+
+		err := s.movePlot(t, r.Plot, tf)
+		s.Release(r)
+		if t.canceled.Load() {
+			return
+		}
+		avoid = append(avoid, r.Plot)
+		if err != nil {
+			log.Printf("Failed to write copy %d of %s to %s: %v", len(placed)+1, t.filename, r.Plot.path, err)
+			s.moveRetry.failed(r.Plot)
+			continue
+		}
+		placed = append(placed, r.Plot)
+
+		if s.sidecars && !r.Plot.isRemote() {
+			s.writePlotSidecar(t, r.Plot)
+		}
+		s.recordPlacement(&placement{
+			Time:        time.Now(),
+			Source:      t.source,
+			Filename:    t.filename,
+			Size:        t.size,
+			Group:       r.Group.name,
+			Destination: r.Plot.path,
+			Compression: plotfile.Compression(t.header, t.filename),
+			Replica:     true,
+			remote:      r.Plot.isRemote(),
+		})
+		s.invalidateFreeSpace(r.Plot)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreReplicasAudit(t *testing.T) {
+	dir := t.TempDir()
+	cache := filepath.Join(dir, "cache")
+	dst1 := filepath.Join(dir, "dst1")
+	dst2 := filepath.Join(dir, "dst2")
+	for _, d := range []string{cache, dst1, dst2} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	auditFile := filepath.Join(dir, "audit.csv")
+
+	s, err := New(&Config{
+		Listen:       "127.0.0.1:0",
+		Cache:        &ConfigGroup{Paths: []string{cache}, Concurrency: 1},
+		Destinations: map[string]*ConfigGroup{"a": {Paths: []string{dst1, dst2}, Concurrency: 2, Replicas: 2}},
+		AuditLog:     &ConfigAuditLog{Path: auditFile, Format: "csv"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	pg := s.GroupsNamed("a")[0]
+	for _, pp := range pg.sortedPlots {
+		// the temp directories share a filesystem, which may not support
+		// direct I/O, so treat them as separate disks written through the
+		// page cache
+		pp.setPool(nil)
+		pp.buffered.Store(true)
+	}
+	plot := pg.sortedPlots[0]
+
+	const filename = "plot-k32-2024-01-01-00-00-abcdef.plot"
+	tmpfile := filepath.Join(cache, filename)
+	if err := os.WriteFile(tmpfile, []byte("plotdata"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tr := &transfer{source: "10.0.0.1", size: 8, filename: filename}
+
+	// the first copy is recorded by the move, the others by storeReplicas
+	s.recordPlacement(&placement{
+		Time:        time.Now(),
+		Source:      tr.source,
+		Filename:    filename,
+		Size:        tr.size,
+		Group:       pg.name,
+		Destination: plot.path,
+	})
+	s.storeReplicas(tr, pg, plot, tmpfile)
+
+	f, err := os.Open(auditFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("audit log has %d rows, want a header and two copies: %v", len(rows), rows)
+	}
+	if got := rows[0][len(rows[0])-1]; got != "replica" {
+		t.Errorf("last column is %q, want replica", got)
+	}
+	primary, replica := rows[1], rows[2]
+	if primary[2] != filename || replica[2] != filename {
+		t.Errorf("rows are for %q and %q, want %q", primary[2], replica[2], filename)
+	}
+	if primary[5] == replica[5] {
+		t.Errorf("both copies recorded on %s", primary[5])
+	}
+	if primary[7] != "false" || replica[7] != "true" {
+		t.Errorf("replica columns are %q and %q, want false and true", primary[7], replica[7])
+	}
+	if _, err := os.Stat(filepath.Join(replica[5], filename)); err != nil {
+		t.Errorf("replica not written: %v", err)
+	}
+}
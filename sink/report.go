@@ -0,0 +1,113 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ReportRow is a line of the capacity report.
+type ReportRow struct {
+	Group string
+	Path  string
+	Total uint64
+	Free  uint64
+	Plots int
+	State string
+}
+
+// DiskReport builds the report from the config, reading each path's space and
+// plots from disk. Paths paused or disabled through the admin api are read from
+// the state file.
+func DiskReport(filename string) ([]ReportRow, error) {
+	cfg, err := LoadConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &sinkState{}
+	if cfg.StateFile != "" {
+		b, err := os.ReadFile(cfg.StateFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read state file: %v", err)
+		}
+		if err == nil {
+			if err := json.Unmarshal(b, state); err != nil {
+				return nil, fmt.Errorf("failed to read state file: %v", err)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(cfg.Destinations))
+	for n := range cfg.Destinations {
+		names = append(names, n)
+	}
+	slices.Sort(names)
+
+	rootDev := DeviceOf("/")
+	rows := make([]ReportRow, 0)
+	groups := append([]string{"cache"}, names...)
+	for _, name := range groups {
+		gc := cfg.Cache
+		if name != "cache" {
+			gc = cfg.Destinations[name]
+		}
+		if gc == nil || gc.isRemote() {
+			continue
+		}
+		for _, path := range configuredPaths(gc) {
+			row := ReportRow{Group: name, Path: path, State: "active"}
+			switch ps := state.Paths[path]; {
+			case gc.skipFile != "" && fileExists(filepath.Join(path, gc.skipFile)):
+				row.State = "skipped"
+			case rootDev != 0 && DeviceOf(path) == rootDev && gc.mount:
+				row.State = "unmounted"
+			case ps != nil && (ps.Paused || ps.Disabled):
+				row.State = ps.describe()
+			}
+
+			if row.Free, row.Total, err = DiskSpace(path); err != nil {
+				row.State = "faulted"
+			}
+			if plots, err := ListPlots(path); err == nil {
+				row.Plots = len(plots)
+			}
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+// configuredPaths expands the group's paths, leaving out those excluded and
+// those which aren't directories.
+func configuredPaths(cfg *ConfigGroup) []string {
+	paths := make([]string, 0)
+	for _, p := range cfg.Paths {
+		if strings.HasPrefix(p, "!") {
+			continue
+		}
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			continue
+		}
+		matches, _ := filepath.Glob(abs)
+		for _, m := range matches {
+			if fi, err := os.Stat(m); err == nil && fi.IsDir() && !cfg.excluded(m) {
+				paths = append(paths, m)
+			}
+		}
+	}
+	return paths
+}
+
+// fileExists returns true if the file exists.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,408 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	// defaultS3PartSize is the size of each part of a multipart upload.
+	defaultS3PartSize = 128 << 20
+
+	// s3MaxParts is the most parts a multipart upload can have. The part size
+	// is raised for plots which would need more.
+	s3MaxParts = 10000
+
+	// unsignedPayload is signed in place of the payload's hash, so parts can
+	// be streamed from the cache without reading them twice.
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+
+	// s3DialTimeout limits connecting to the endpoint and the TLS handshake,
+	// and s3ResponseTimeout waiting for the response once a request is sent.
+	s3DialTimeout     = 30 * time.Second
+	s3ResponseTimeout = 2 * time.Minute
+
+	// s3IdleTimeout aborts a request, such as uploading a part, which makes
+	// no progress sending its body or reading the response for this long.
+	s3IdleTimeout = 2 * time.Minute
+
+	// s3AbortTimeout limits aborting a failed multipart upload, which is
+	// still attempted when the upload was canceled.
+	s3AbortTimeout = 30 * time.Second
+)
+
+// errS3Idle is the cause of requests aborted for making no progress.
+var errS3Idle = fmt.Errorf("no progress for %s", s3IdleTimeout)
+
+// s3Store uploads plots to an S3 compatible object store, such as AWS or
+// MinIO, signing requests with AWS Signature Version 4.
+type s3Store struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	prefix    string
+	accessKey string
+	secretKey string
+	partSize  uint64
+	pathStyle bool
+	client    *http.Client
+}
+
+// newS3Store creates the store from the group's s3 settings. The credentials
+// fall back to the standard AWS environment variables.
+func newS3Store(cfg *ConfigS3) (*s3Store, error) {
+	if cfg == nil || cfg.Bucket == "" {
+		return nil, errors.New("s3 groups require a bucket")
+	}
+
+	s := &s3Store{
+		region:    cfg.Region,
+		bucket:    cfg.Bucket,
+		prefix:    cfg.Prefix,
+		accessKey: cfg.AccessKey,
+		secretKey: cfg.SecretKey,
+		partSize:  defaultS3PartSize,
+		pathStyle: cfg.PathStyle,
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: s3DialTimeout, KeepAlive: 30 * time.Second}).DialContext,
+			TLSHandshakeTimeout:   s3DialTimeout,
+			ResponseHeaderTimeout: s3ResponseTimeout,
+			IdleConnTimeout:       90 * time.Second,
+		}},
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	if s.accessKey == "" {
+		s.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if s.secretKey == "" {
+		s.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("s3 credentials are not set")
+	}
+
+	endpoint := cfg.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", s.region)
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+	s.endpoint = u
+
+	if cfg.PartSize != "" {
+		n, err := humanize.ParseBytes(cfg.PartSize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid part_size: %v", err)
+		}
+		if n < 5<<20 || n > 5<<30 {
+			return nil, fmt.Errorf("part_size must be between 5MiB and 5GiB")
+		}
+		s.partSize = n
+	}
+	return s, nil
+}
+
+func (s *s3Store) String() string {
+	return "s3://" + s.bucket + "/" + s.prefix
+}
+
+// Upload stores the plot in a single request if it fits in one part,
+// otherwise as a multipart upload which is aborted if any part fails or ctx is
+// done.
+func (s *s3Store) Upload(ctx context.Context, filename string, size uint64, r io.Reader) error {
+	key := s.prefix + filename
+	if size <= s.partSize {
+		_, err := s.do(ctx, http.MethodPut, key, nil, r, int64(size), unsignedPayload)
+		return err
+	}
+
+	uploadID, err := s.createMultipart(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	partSize := max(s.partSize, (size+s3MaxParts-1)/s3MaxParts)
+	etags := make([]string, 0, (size+partSize-1)/partSize)
+	for remaining := size; remaining > 0; {
+		n := min(partSize, remaining)
+		query := url.Values{
+			"partNumber": {fmt.Sprint(len(etags) + 1)},
+			"uploadId":   {uploadID},
+		}
+		resp, err := s.do(ctx, http.MethodPut, key, query, r, int64(n), unsignedPayload)
+		if err != nil {
+			s.abortMultipart(ctx, key, uploadID)
+			return fmt.Errorf("part %d: %v", len(etags)+1, err)
+		}
+		etags = append(etags, resp.Header.Get("ETag"))
+		remaining -= n
+	}
+
+	if err := s.completeMultipart(ctx, key, uploadID, etags); err != nil {
+		s.abortMultipart(ctx, key, uploadID)
+		return err
+	}
+	return nil
+}
+
+func (s *s3Store) createMultipart(ctx context.Context, key string) (string, error) {
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return "", err
+	}
+
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(resp.body, &result); err != nil || result.UploadID == "" {
+		return "", fmt.Errorf("failed to start multipart upload: %s", resp.body)
+	}
+	return result.UploadID, nil
+}
+
+func (s *s3Store) completeMultipart(ctx context.Context, key, uploadID string, etags []string) error {
+	type part struct {
+		PartNumber int
+		ETag       string
+	}
+	complete := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{}
+	for i, etag := range etags {
+		complete.Parts = append(complete.Parts, part{PartNumber: i + 1, ETag: etag})
+	}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+
+	// the request can fail after the status has been sent, with the error in
+	// the body instead
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, bytes.NewReader(body), int64(len(body)), payloadHash(body))
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(resp.body, []byte("<Error>")) {
+		return s3Error(resp.body)
+	}
+	return nil
+}
+
+// abortMultipart discards the parts uploaded so far. It is attempted even once
+// ctx is done, so a canceled upload doesn't leave its parts stored.
+func (s *s3Store) abortMultipart(ctx context.Context, key, uploadID string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s3AbortTimeout)
+	defer cancel()
+	s.do(ctx, http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, 0, emptyPayloadHash)
+}
+
+// s3Response is a successful response, with its body read.
+type s3Response struct {
+	Header http.Header
+	body   []byte
+}
+
+// do sends a signed request for the object, returning an error for any
+// unsuccessful status. The request is aborted once ctx is done, or when it
+// makes no progress for s3IdleTimeout.
+func (s *s3Store) do(ctx context.Context, method, key string, query url.Values, body io.Reader, length int64, hash string) (*s3Response, error) {
+	u := *s.endpoint
+	path := "/" + key
+	if s.pathStyle {
+		path = "/" + s.bucket + path
+	} else {
+		u.Host = s.bucket + "." + u.Host
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	idle := time.AfterFunc(s3IdleTimeout, func() { cancel(errS3Idle) })
+	defer idle.Stop()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Body = io.NopCloser(&idleReader{r: io.LimitReader(body, length), idle: idle})
+		req.ContentLength = length
+	}
+	signV4(req, hash, s.accessKey, s.secretKey, s.region, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, s3RequestError(ctx, err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(io.LimitReader(&idleReader{r: resp.Body, idle: idle}, 1<<20))
+	if err != nil {
+		return nil, s3RequestError(ctx, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if len(b) == 0 {
+			return nil, fmt.Errorf("%s", resp.Status)
+		}
+		return nil, s3Error(b)
+	}
+	return &s3Response{Header: resp.Header, body: b}, nil
+}
+
+// idleReader restarts the idle timer whenever data is read.
+type idleReader struct {
+	r    io.Reader
+	idle *time.Timer
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.idle.Reset(s3IdleTimeout)
+	}
+	return n, err
+}
+
+// s3RequestError returns why the request's context was canceled, when it was,
+// rather than the less helpful error from the client.
+func s3RequestError(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); cause != nil {
+		return cause
+	}
+	return err
+}
+
+// s3Error decodes an S3 error response.
+func s3Error(body []byte) error {
+	var e struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := xml.Unmarshal(body, &e); err != nil || e.Code == "" {
+		return fmt.Errorf("unexpected response: %.200s", body)
+	}
+	return fmt.Errorf("%s: %s", e.Code, e.Message)
+}
+
+// emptyPayloadHash is the hash of a request without a body.
+var emptyPayloadHash = payloadHash(nil)
+
+func payloadHash(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// signV4 signs the request with AWS Signature Version 4, covering the host and
+// every header already set on the request.
+func signV4(req *http.Request, hash, accessKey, secretKey, region string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	slices.Sort(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + payloadHash([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes the query sorted by key, as required for signing.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent encodes everything other than unreserved characters. The
+// slash is left as is in paths.
+func s3Escape(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			sb.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,57 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestS3UploadCanceled(t *testing.T) {
+	aborted := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Query().Has("uploads"):
+			w.Write([]byte("<InitiateMultipartUploadResult><UploadId>u1</UploadId></InitiateMultipartUploadResult>"))
+		case r.Method == http.MethodPut:
+			// hang on the part until the client gives up
+			io.Copy(io.Discard, r.Body)
+			<-r.Context().Done()
+		case r.Method == http.MethodDelete && r.URL.Query().Get("uploadId") == "u1":
+			close(aborted)
+		}
+	}))
+	defer srv.Close()
+
+	store, err := newS3Store(&ConfigS3{Endpoint: srv.URL, Bucket: "plots", AccessKey: "a", SecretKey: "s", PathStyle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.partSize = 4
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- store.Upload(ctx, "a.plot", 8, strings.NewReader("plotdata"))
+	}()
+
+	select {
+	case err := <-errc:
+		if err == nil {
+			t.Error("Upload succeeded once canceled")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Upload didn't return once canceled")
+	}
+	select {
+	case <-aborted:
+	default:
+		t.Error("multipart upload wasn't aborted")
+	}
+}
@@ -0,0 +1,317 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// timeWindow is a daily span of time, optionally limited to certain days of the
+// week. A window whose end is before its start runs past midnight, and belongs
+// to the day it starts on.
+type timeWindow struct {
+	days  [7]bool
+	start int
+	end   int
+}
+
+// windowSet is a list of windows, where a time is allowed if it falls within
+// any of them. An empty set always allows.
+type windowSet []timeWindow
+
+// parseWindows parses each of the window specifications.
+func parseWindows(specs []string) (windowSet, error) {
+	ws := make(windowSet, 0, len(specs))
+	for _, spec := range specs {
+		w, err := parseWindow(spec)
+		if err != nil {
+			return nil, err
+		}
+		ws = append(ws, w)
+	}
+	return ws, nil
+}
+
+// parseWindow parses a window in the form "[days] HH:MM-HH:MM", where days are
+// a comma separated list of names or ranges such as "Mon-Fri" or "Sat,Sun".
+func parseWindow(spec string) (timeWindow, error) {
+	var w timeWindow
+	fields := strings.Fields(spec)
+
+	switch len(fields) {
+	case 1:
+		for i := range w.days {
+			w.days[i] = true
+		}
+	case 2:
+		for _, part := range strings.Split(strings.ToLower(fields[0]), ",") {
+			first, last, isRange := strings.Cut(part, "-")
+			from, ok := weekdays[first]
+			if !ok {
+				return w, fmt.Errorf("invalid day %q in window %q", first, spec)
+			}
+			to := from
+			if isRange {
+				if to, ok = weekdays[last]; !ok {
+					return w, fmt.Errorf("invalid day %q in window %q", last, spec)
+				}
+			}
+			for d := from; ; d = (d + 1) % 7 {
+				w.days[d] = true
+				if d == to {
+					break
+				}
+			}
+		}
+	default:
+		return w, fmt.Errorf("invalid window %q", spec)
+	}
+
+	start, end, ok := strings.Cut(fields[len(fields)-1], "-")
+	if !ok {
+		return w, fmt.Errorf("invalid time range in window %q", spec)
+	}
+	var err error
+	if w.start, err = parseClock(start); err != nil {
+		return w, fmt.Errorf("invalid start in window %q: %v", spec, err)
+	}
+	if w.end, err = parseClock(end); err != nil {
+		return w, fmt.Errorf("invalid end in window %q: %v", spec, err)
+	}
+	return w, nil
+}
+
+// parseClock returns the minutes since midnight for a time such as "22:30".
+// "24:00" is accepted as the end of the day.
+func parseClock(s string) (int, error) {
+	hs, ms, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, fmt.Errorf("expected HH:MM, got %q", s)
+	}
+	h, err := strconv.Atoi(hs)
+	if err != nil {
+		return 0, err
+	}
+	m, err := strconv.Atoi(ms)
+	if err != nil {
+		return 0, err
+	}
+	if h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("time %q out of range", s)
+	}
+	return h*60 + m, nil
+}
+
+// contains returns true if the time falls within the window.
+func (w timeWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+
+	if w.start <= w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+
+	// overnight windows belong to the day they started on
+	if minute >= w.start {
+		return w.days[day]
+	}
+	return minute < w.end && w.days[(day+6)%7]
+}
+
+// open returns true if the time is within any of the windows.
+func (ws windowSet) open(t time.Time) bool {
+	if len(ws) == 0 {
+		return true
+	}
+	for _, w := range ws {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForMoveWindow blocks until moves are allowed by the schedule, returning
+// false if the transfer is canceled while waiting. Received plots don't wait
+// here, they are left in the cache for the scheduled mover instead.
+func (s *Sink) waitForMoveWindow(t *transfer) bool {
+	if s.moveWindows.open(time.Now()) {
+		return true
+	}
+
+	log.Printf("Waiting for the move window to open before moving %s", t.name())
+	t.setPhase(PhaseWaiting)
+	defer t.setPhase(PhaseMoving)
+	for !s.moveWindows.open(time.Now()) {
+		if t.canceled.Load() {
+			return false
+		}
+		time.Sleep(30 * time.Second)
+	}
+	return true
+}
+
+// scheduledMoves are the plots left in the cache while the move window is
+// closed, to be moved once it opens.
+type scheduledMoves struct {
+	moves []*PlannedMove
+	mutex sync.Mutex
+}
+
+func (q *scheduledMoves) add(m *PlannedMove) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.moves = append(q.moves, m)
+}
+
+// take removes and returns all of the queued moves.
+func (q *scheduledMoves) take() []*PlannedMove {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	moves := q.moves
+	q.moves = nil
+	return moves
+}
+
+// scheduleMove leaves a received plot in the cache until the move window
+// opens, so the transfer can finish and free its connection and reservations
+// rather than holding them while it waits. The plot's sidecar and checksum are
+// kept with it in the cache, and it is moved to the group it was received for.
+func (s *Sink) scheduleMove(t *transfer, pg *PlotGroup, cachePlot *PlotPath, filename, tmpfile string) {
+	if s.sidecars {
+		s.writePlotSidecar(t, cachePlot)
+	}
+	if s.xattrs && t.checksum != "" {
+		if err := setChecksumXattr(tmpfile, t.checksum); err != nil {
+			log.Printf("Failed to store the checksum of %s: %v", filename, err)
+		}
+	}
+	if s.relaying {
+		log.Printf("Move window is closed, leaving %s in the cache to be relayed once it opens", filename)
+		return
+	}
+	s.scheduled.add(&PlannedMove{
+		Filename: filename,
+		Size:     t.size,
+		From:     cachePlot.path,
+		Group:    pg.name,
+		src:      cachePlot,
+		source:   t.source,
+	})
+	log.Printf("Move window is closed, leaving %s in the cache until it opens", filename)
+}
+
+// runScheduledMoves moves the plots left in the cache once the move window
+// opens, starting with any left there before a restart. Each window's moves run
+// as a scheduled job, waiting for any other job to finish first. Moves still
+// waiting for a destination when the window closes are kept for the next one,
+// as are those of a canceled job, which resume in the next window. It is
+// intended to be ran within its own goroutine.
+func (s *Sink) runScheduledMoves() {
+	s.scheduleCachedPlots()
+
+	for ; ; time.Sleep(30 * time.Second) {
+		if !s.moveWindows.open(time.Now()) {
+			continue
+		}
+		moves := s.scheduled.take()
+		if len(moves) == 0 {
+			continue
+		}
+		j := &MoveJob{Kind: "scheduled", Moves: moves, Place: true}
+		if err := s.registerJob(j); err != nil {
+			for _, m := range moves {
+				s.scheduled.add(m)
+			}
+			continue
+		}
+		log.Printf("Move window is open, moving %d plots from the cache", len(moves))
+
+		// stop reserving destinations once the window closes
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !j.finished.Load() && s.moveWindows.open(time.Now()) {
+				time.Sleep(time.Second)
+			}
+			j.canceled.Store(true)
+		}()
+
+		var moving sync.WaitGroup
+		for _, m := range moves {
+			moving.Add(1)
+			go func(m *PlannedMove) {
+				defer moving.Done()
+				err := s.relocate(j, m)
+				if err == nil {
+					j.completed.Add(1)
+					return
+				}
+				if _, serr := os.Stat(filepath.Join(m.From, m.Filename)); serr != nil {
+					log.Printf("Failed to move %s from the cache, it is no longer there: %v", m.Filename, serr)
+					j.failed.Add(1)
+					return
+				}
+				if !errors.Is(err, errTransferCanceled) {
+					log.Printf("Failed to move %s from the cache, will retry: %v", m.Filename, err)
+					j.failed.Add(1)
+				}
+				s.scheduled.add(m)
+			}(m)
+		}
+		moving.Wait()
+		canceled := j.canceled.Load()
+		j.finished.Store(true)
+		wg.Wait()
+		log.Printf("Finished %s job: %d moved, %d failed, %d skipped",
+			j.Kind, j.completed.Load(), j.failed.Load(), int64(len(j.Moves))-j.completed.Load()-j.failed.Load())
+
+		// a job canceled while the window is open waits for the next one
+		if canceled && s.moveWindows.open(time.Now()) {
+			log.Printf("Scheduled moves were canceled, waiting for the next move window")
+			for s.moveWindows.open(time.Now()) {
+				time.Sleep(30 * time.Second)
+			}
+		}
+	}
+}
+
+// scheduleCachedPlots queues the plots left in the cache paths, such as those
+// waiting for the move window when the sink was restarted.
+func (s *Sink) scheduleCachedPlots() {
+	s.cacheGroup.sortMutex.RLock()
+	paths := append([]*PlotPath(nil), s.cacheGroup.sortedPlots...)
+	s.cacheGroup.sortMutex.RUnlock()
+
+	for _, pp := range paths {
+		plots, err := ListPlots(pp.path)
+		if err != nil {
+			continue
+		}
+		for _, p := range plots {
+			s.scheduled.add(&PlannedMove{Filename: p.Name, Size: p.Size, From: pp.path, src: pp})
+		}
+		if len(plots) > 0 {
+			log.Printf("Found %d plots left in the cache at %s, moving them once the move window opens", len(plots), pp.path)
+		}
+	}
+}
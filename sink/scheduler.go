@@ -0,0 +1,130 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+// Reservation holds the paths a transfer or move may use until it is
+// released. The cache path is only reserved for received plots.
+type Reservation struct {
+	Group *PlotGroup
+	Plot  *PlotPath
+	Cache *PlotPath
+}
+
+// ReserveRequest asks the scheduler for a destination. When dst is set, only
+// that path is reserved, otherwise one is picked from the named group or, if
+// no group is named, from any group without its own listener, or only from
+// groups when they are given. When replace is
+// set, its destination is handed back once the new one is reserved, while its
+// cache path is kept. Headroom is how many of a group's slots must be left
+// free for other transfers, such as for bulk plotters. When avoid is set, the
+// destination is for another copy of a plot already on those paths.
+type ReserveRequest struct {
+	Size     uint64
+	Group    string
+	Groups   []string
+	Headroom int64
+	dst      *PlotPath
+	dstGroup *PlotGroup
+	Cache    bool
+	replace  *Reservation
+	avoid    []*PlotPath
+	reply    chan *Reservation
+}
+
+// scheduler hands out reservations from a single goroutine, so picking a path
+// and reserving it happen together and two transfers can never be given the
+// same slot. Groups and cache paths are only resorted when a reservation has
+// been released since the last pick, rather than after every change.
+type scheduler struct {
+	sink     *Sink
+	requests chan *ReserveRequest
+	releases chan *Reservation
+	dirty    bool
+}
+
+func newScheduler(s *Sink) *scheduler {
+	return &scheduler{
+		sink:     s,
+		requests: make(chan *ReserveRequest),
+		releases: make(chan *Reservation),
+	}
+}
+
+// run handles reservation requests and releases. It is intended to be ran
+// within its own goroutine.
+func (sc *scheduler) run() {
+	for {
+		select {
+		case req := <-sc.requests:
+			if sc.dirty {
+				sc.sink.sortGroups()
+				sc.sink.cacheGroup.sortCachePaths()
+				sc.dirty = false
+			}
+			req.reply <- sc.reserve(req)
+
+		case r := <-sc.releases:
+			r.Plot.release()
+			r.Group.transfers.Add(-1)
+			if r.Cache != nil {
+				r.Cache.transfers.Add(-1)
+				sc.sink.cacheGroup.transfers.Add(-1)
+			}
+			sc.dirty = true
+		}
+	}
+}
+
+func (sc *scheduler) reserve(req *ReserveRequest) *Reservation {
+	s := sc.sink
+	r := &Reservation{Group: req.dstGroup, Plot: req.dst}
+
+	switch {
+	case r.Plot != nil:
+	case len(req.avoid) > 0:
+		r.Group, r.Plot = s.pickReplica(req.Size, req.Groups, req.avoid)
+	case req.Group == "" && len(req.Groups) > 0:
+		r.Group, r.Plot = s.pickPlotFrom(req.Size, req.Groups, req.Headroom)
+	case req.Group == "":
+		r.Group, r.Plot = s.PickPlot(req.Size, req.Headroom)
+	default:
+		if groups := s.GroupsNamed(req.Group); len(groups) > 0 && groups[0].hasRoom(req.Headroom) {
+			r.Group, r.Plot = groups[0], groups[0].PickPlot(req.Size)
+		}
+	}
+	if r.Plot == nil || !r.Plot.acquire() {
+		return nil
+	}
+
+	if req.Cache {
+		r.Cache = s.cacheGroup.PickPlot(req.Size)
+		if r.Cache == nil {
+			r.Plot.release()
+			return nil
+		}
+		r.Cache.transfers.Add(1)
+		s.cacheGroup.transfers.Add(1)
+		sc.dirty = true
+	}
+	r.Group.transfers.Add(1)
+
+	if req.replace != nil {
+		req.replace.Plot.release()
+		req.replace.Group.transfers.Add(-1)
+		sc.dirty = true
+	}
+	return r
+}
+
+// Reserve asks the scheduler for a destination, returning nil if none is
+// available.
+func (s *Sink) Reserve(req *ReserveRequest) *Reservation {
+	req.reply = make(chan *Reservation, 1)
+	s.scheduler.requests <- req
+	return <-req.reply
+}
+
+// Release returns the reservation's slots to the scheduler.
+func (s *Sink) Release(r *Reservation) {
+	s.scheduler.releases <- r
+}
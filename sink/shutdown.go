@@ -0,0 +1,84 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// uploadCancelTimeout limits waiting for canceled uploads to clean up.
+const uploadCancelTimeout = 30 * time.Second
+
+// Shutdown waits for in-flight transfers, including their moves from the cache
+// to the final disk, to finish. A positive timeout limits how long to wait and
+// a negative one skips waiting entirely. Anything still in progress when giving
+// up is reported so it can be cleaned up or re-sent, after canceling uploads to
+// remote stores. The state is saved last.
+func (s *Sink) Shutdown(timeout time.Duration) {
+	defer s.saveState()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	if active := s.Transfers(); len(active) > 0 && timeout >= 0 {
+		if timeout > 0 {
+			log.Printf("Waiting up to %s for %d transfers to finish...", timeout, len(active))
+		} else {
+			log.Printf("Waiting for %d transfers to finish...", len(active))
+		}
+	}
+
+	var expired <-chan time.Time
+	switch {
+	case timeout > 0:
+		expired = time.After(timeout)
+	case timeout < 0:
+		c := make(chan time.Time)
+		close(c)
+		expired = c
+	}
+
+	select {
+	case <-done:
+		log.Print("All transfers finished")
+		return
+	case <-expired:
+	}
+
+	// cancel uploads to remote stores, giving them a moment to clean up what
+	// they stored, such as the parts of S3 multipart uploads
+	s.cancelUploads()
+	if s.uploads.Load() > 0 {
+		select {
+		case <-done:
+			log.Print("Canceled the remaining uploads, all transfers finished")
+			return
+		case <-time.After(uploadCancelTimeout):
+		}
+	}
+
+	// report what is being abandoned
+	active := s.Transfers()
+	log.Printf("Shutting down with %d transfers still in progress", len(active))
+	for _, ti := range active {
+		switch ti.Phase {
+		case PhaseReceiving:
+			log.Printf("Abandoned receive of %s from %s (%s of %s), partial file left in %s",
+				ti.Filename, ti.Source, humanize.IBytes(uint64(ti.Received)), humanize.IBytes(ti.Size), ti.Cache)
+		case PhaseMoving:
+			log.Printf("Abandoned move of %s to %s (%s of %s), plot remains at %s",
+				ti.Filename, ti.Destination, humanize.IBytes(uint64(ti.Moved)), humanize.IBytes(ti.Size),
+				filepath.Join(ti.Cache, ti.Filename))
+		case PhaseWaiting:
+			log.Printf("Abandoned move of %s to %s waiting for the move window, plot remains at %s",
+				ti.Filename, ti.Destination, filepath.Join(ti.Cache, ti.Filename))
+		}
+	}
+}
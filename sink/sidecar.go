@@ -0,0 +1,71 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// sidecarExt is appended to a plot's filename to name its sidecar.
+const sidecarExt = ".json"
+
+// sidecar is the provenance of a stored plot, written next to it so it
+// survives without the sink's own records.
+type sidecar struct {
+	Filename       string    `json:"filename"`
+	PlotID         string    `json:"plot_id,omitempty"`
+	Source         string    `json:"source"`
+	Size           uint64    `json:"size"`
+	Compression    int       `json:"compression"`
+	Received       time.Time `json:"received"`
+	ReceiveSeconds float64   `json:"receive_seconds"`
+	MoveSeconds    float64   `json:"move_seconds"`
+	SHA256         string    `json:"sha256"`
+}
+
+// writeSidecar writes the sidecar for the plot stored in dir. It is written to
+// a temp file and renamed, so a partial sidecar is never left behind.
+func writeSidecar(dir string, sc *sidecar) error {
+	b, err := json.MarshalIndent(sc, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Join(dir, sc.Filename+sidecarExt)
+	tmpfile := name + ".tmp"
+	if err := os.WriteFile(tmpfile, append(b, '\n'), 0644); err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+	if err := os.Rename(tmpfile, name); err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+	return nil
+}
+
+// moveSidecar moves the sidecar of a plot which was moved from srcDir to
+// dstDir, if it has one. It is copied since the directories are usually on
+// different disks.
+func moveSidecar(filename, srcDir, dstDir string) error {
+	src := filepath.Join(srcDir, filename+sidecarExt)
+	b, err := os.ReadFile(src)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var sc sidecar
+	if err := json.Unmarshal(b, &sc); err != nil {
+		return err
+	}
+	if err := writeSidecar(dstDir, &sc); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
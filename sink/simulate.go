@@ -0,0 +1,344 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"gopkg.in/yaml.v3"
+)
+
+// SimLayout describes the disks of a destination group to simulate.
+type SimLayout struct {
+	Concurrency int64     `yaml:"concurrency"`
+	Reserve     string    `yaml:"reserve"`
+	Disks       []simDisk `yaml:"disks"`
+}
+
+// simDisk is one or more identical disks. Used is how much of each is already
+// filled, and Speed is how fast each writes a plot per second.
+type simDisk struct {
+	Count       int    `yaml:"count"`
+	Size        string `yaml:"size"`
+	Used        string `yaml:"used"`
+	Speed       string `yaml:"speed"`
+	Concurrency int64  `yaml:"concurrency"`
+}
+
+// SimArrival is a plot arriving at the sink.
+type SimArrival struct {
+	At   time.Duration
+	Size uint64
+}
+
+// simWrite is a plot being written to a disk.
+type simWrite struct {
+	path *PlotPath
+	size uint64
+	done time.Duration
+}
+
+// SimResult is the outcome of simulating the workload with one strategy.
+type SimResult struct {
+	Strategy string
+	Placed   int
+	Refused  int
+	Bytes    uint64
+	Elapsed  time.Duration
+	AvgWait  time.Duration
+	MaxWait  time.Duration
+	MinFill  float64
+	AvgFill  float64
+	MaxFill  float64
+	Stddev   float64
+	Full     int
+}
+
+// LoadSimLayout reads the disk layout to simulate.
+func LoadSimLayout(filename string) (*SimLayout, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var layout SimLayout
+	if err := yaml.Unmarshal(b, &layout); err != nil {
+		return nil, err
+	}
+	if len(layout.Disks) == 0 {
+		return nil, errors.New("the layout has no disks")
+	}
+	return &layout, nil
+}
+
+func (l *SimLayout) DiskCount() int {
+	n := 0
+	for _, d := range l.Disks {
+		n += max(d.Count, 1)
+	}
+	return n
+}
+
+// group builds a destination group of the layout's disks using the strategy.
+// Paths default to one plot at a time and the group to one per disk.
+func (l *SimLayout) group(strategy string) (*PlotGroup, error) {
+	cfg := &ConfigGroup{name: "simulated", Concurrency: l.Concurrency, Strategy: strategy, Reserve: l.Reserve}
+	if _, err := humanize.ParseBytes(orZero(l.Reserve)); err != nil {
+		return nil, fmt.Errorf("invalid reserve: %v", err)
+	}
+
+	var paths []*PlotPath
+	for i, d := range l.Disks {
+		size, err := humanize.ParseBytes(d.Size)
+		if err != nil {
+			return nil, fmt.Errorf("disk %d: invalid size: %v", i+1, err)
+		}
+		used, err := humanize.ParseBytes(orZero(d.Used))
+		if err != nil || used > size {
+			return nil, fmt.Errorf("disk %d: invalid used space %q", i+1, d.Used)
+		}
+		speed, err := humanize.ParseBytes(d.Speed)
+		if err != nil || speed == 0 {
+			return nil, fmt.Errorf("disk %d: invalid speed %q", i+1, d.Speed)
+		}
+		concurrency := d.Concurrency
+		if concurrency == 0 {
+			concurrency = 1
+		}
+
+		for j := 0; j < max(d.Count, 1); j++ {
+			pp := &PlotPath{
+				path:        fmt.Sprintf("disk%d", len(paths)+1),
+				concurrency: concurrency,
+			}
+			pp.freeSpace.Store(size - used)
+			pp.totalSpace.Store(size)
+			pp.speed.Store(speed)
+			paths = append(paths, pp)
+		}
+	}
+
+	if cfg.Concurrency == 0 {
+		cfg.Concurrency = int64(len(paths))
+	}
+	pg := &PlotGroup{name: cfg.name}
+	pg.update(cfg, paths)
+	return pg, nil
+}
+
+// orZero returns "0" for an empty size, so an unset size parses as none.
+func orZero(size string) string {
+	if size == "" {
+		return "0"
+	}
+	return size
+}
+
+// Simulate places the plots as they arrive using the group's own path
+// selection. Plots wait in order for a path to free up, and are refused once
+// no disk has room for them. Free space is taken when a write starts, as the
+// sink counts reserved space, and each write runs at its disk's speed.
+func Simulate(layout *SimLayout, strategy string, arrivals []SimArrival) (*SimResult, error) {
+	pg, err := layout.group(strategy)
+	if err != nil {
+		return nil, err
+	}
+	r := &SimResult{Strategy: strategy}
+
+	var waiting []SimArrival
+	var writing []*simWrite
+	var now, totalWait time.Duration
+	next := 0
+
+	for next < len(arrivals) || len(waiting) > 0 || len(writing) > 0 {
+		// advance to the next arrival or finished write
+		now = time.Duration(math.MaxInt64)
+		if next < len(arrivals) {
+			now = arrivals[next].At
+		}
+		for _, w := range writing {
+			now = min(now, w.done)
+		}
+
+		writing = slices.DeleteFunc(writing, func(w *simWrite) bool {
+			if w.done > now {
+				return false
+			}
+			w.path.release()
+			pg.transfers.Add(-1)
+			r.Elapsed = w.done
+			return true
+		})
+		for next < len(arrivals) && arrivals[next].At <= now {
+			waiting = append(waiting, arrivals[next])
+			next++
+		}
+
+		// start as many of the waiting plots as the disks can take
+		for len(waiting) > 0 {
+			a := waiting[0]
+			if !pg.fits(a.Size) {
+				r.Refused++
+				waiting = waiting[1:]
+				continue
+			}
+			pp := pg.PickPlot(a.Size)
+			if pp == nil || !pp.acquire() {
+				if len(writing) == 0 {
+					// nothing will free up, so the plot can't be placed
+					r.Refused++
+					waiting = waiting[1:]
+					continue
+				}
+				break
+			}
+			waiting = waiting[1:]
+			pg.transfers.Add(1)
+			pp.freeSpace.Add(-a.Size)
+
+			wait := now - a.At
+			totalWait += wait
+			r.MaxWait = max(r.MaxWait, wait)
+			r.Placed++
+			r.Bytes += a.Size
+			d := time.Duration(float64(a.Size) / float64(pp.speed.Load()) * float64(time.Second))
+			writing = append(writing, &simWrite{path: pp, size: a.Size, done: now + d})
+			pg.sortPaths()
+		}
+	}
+
+	if r.Placed > 0 {
+		r.AvgWait = totalWait / time.Duration(r.Placed)
+	}
+	r.Elapsed -= arrivals[0].At
+	r.fillStats(pg, arrivals)
+	return r, nil
+}
+
+// fits returns true if any of the group's disks has room for the plot.
+func (pg *PlotGroup) fits(size uint64) bool {
+	for _, pp := range pg.sortedPlots {
+		if size+pg.reserve <= pp.freeSpace.Load() {
+			return true
+		}
+	}
+	return false
+}
+
+// fillStats records how full the disks ended up, counting those without room
+// for another plot of the average size as full.
+func (r *SimResult) fillStats(pg *PlotGroup, arrivals []SimArrival) {
+	var total uint64
+	for _, a := range arrivals {
+		total += a.Size
+	}
+	avgSize := total / uint64(len(arrivals))
+
+	r.MinFill = 100
+	fills := make([]float64, 0, len(pg.sortedPlots))
+	for _, pp := range pg.sortedPlots {
+		fill := 100 * float64(pp.totalSpace.Load()-pp.freeSpace.Load()) / float64(pp.totalSpace.Load())
+		fills = append(fills, fill)
+		r.MinFill = min(r.MinFill, fill)
+		r.MaxFill = max(r.MaxFill, fill)
+		r.AvgFill += fill / float64(len(pg.sortedPlots))
+		if pp.freeSpace.Load() < avgSize+pg.reserve {
+			r.Full++
+		}
+	}
+	for _, fill := range fills {
+		r.Stddev += (fill - r.AvgFill) * (fill - r.AvgFill) / float64(len(fills))
+	}
+	r.Stddev = math.Sqrt(r.Stddev)
+}
+
+// LoadAuditWorkload reads the sizes and times of the plots recorded in an
+// audit log, in either of its formats, as arrivals relative to the first.
+// Replica rows are skipped, as they are copies of plots already arrived.
+func LoadAuditWorkload(filename string) ([]SimArrival, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	type record struct {
+		time time.Time
+		size uint64
+	}
+	var records []record
+
+	br := bufio.NewReader(f)
+	first, err := br.Peek(1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(first) > 0 && first[0] == '{' {
+		scanner := bufio.NewScanner(br)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" {
+				continue
+			}
+			var p placement
+			if err := json.Unmarshal([]byte(line), &p); err != nil {
+				return nil, err
+			}
+			if p.Replica {
+				continue
+			}
+			records = append(records, record{p.Time, p.Size})
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else {
+		// files started by older versions have fewer columns in earlier rows
+		cr := csv.NewReader(br)
+		cr.FieldsPerRecord = -1
+		rows, err := cr.ReadAll()
+		if err != nil {
+			return nil, err
+		}
+		for i, row := range rows {
+			if i == 0 && len(row) > 0 && row[0] == "time" {
+				continue
+			}
+			if len(row) < 4 {
+				return nil, fmt.Errorf("line %d has %d columns", i+1, len(row))
+			}
+			if len(row) > 7 && row[7] == "true" {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339, row[0])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+			size, err := strconv.ParseUint(row[3], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+			records = append(records, record{t, size})
+		}
+	}
+
+	slices.SortStableFunc(records, func(a, b record) int {
+		return a.time.Compare(b.time)
+	})
+	arrivals := make([]SimArrival, 0, len(records))
+	for _, rec := range records {
+		arrivals = append(arrivals, SimArrival{At: rec.time.Sub(records[0].time), Size: rec.size})
+	}
+	return arrivals, nil
+}
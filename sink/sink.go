@@ -0,0 +1,1099 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+// Package sink receives plots from plotters over the sink protocol and places
+// them across groups of destination paths, receiving each onto a cache first.
+// The chia-plot-sink-multi command is a thin wrapper around it, and other tools
+// can embed a sink the same way:
+//
+//	cfg, err := sink.LoadConfig("config.yaml")
+//	...
+//	s, err := sink.New(cfg)
+//	...
+//	go func() {
+//		<-stop
+//		s.Close()
+//	}()
+//	s.Serve()
+//	s.Shutdown(cfg.ShutdownTimeout)
+//
+// New binds the listeners without starting anything, so a sink started as root
+// can call DropPrivileges before Serve, or Start, runs the rest.
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/brk0v/directio"
+	"github.com/dustin/go-humanize"
+	"github.com/krobertson/chia-plot-sink-multi/plotfile"
+	"github.com/krobertson/chia-plot-sink-multi/protocol"
+)
+
+// Sink receives plots on its listeners, reserves a destination for each
+// through its scheduler, and moves them there from the cache.
+type Sink struct {
+	sortedGroups  []*PlotGroup
+	sortMutex     sync.RWMutex
+	cacheGroup    *PlotGroup
+	alerts        *alertManager
+	audit         *auditLog
+	stats         *statsTracker
+	webhooks      []string
+	controlToken  string
+	configFile    string
+	ingestWindows windowSet
+	moveWindows   windowSet
+	scheduled     scheduledMoves
+	relaying      bool
+	permissions   *filePermissions
+	tempFiles     *tempNaming
+	redirects     *peerRedirects
+	cluster       *cluster
+	filenames     *regexp.Regexp
+	moveRetry     *moveRetryPolicy
+
+	maxConnections int64
+	connections    atomic.Int64
+	stallTimeout   time.Duration
+
+	// range of plot sizes accepted, a max of zero means no limit
+	minPlotSize uint64
+	maxPlotSize uint64
+
+	// keys plots must be created with, or nil to accept any
+	keys *keyFilter
+
+	// quotas of the plotters sending plots, or nil when there are none
+	plotters *plotterSet
+
+	// slots in each group bulk plotters leave free for the others
+	reservedSlots int64
+
+	// caps the combined rate plots are received at
+	bandwidth *bandwidthSchedule
+
+	// throttles receiving while the system is overloaded, or nil
+	load *loadMonitor
+
+	// slows or pauses writes to paths whose disks are running hot, or nil
+	temperature *temperatureMonitor
+
+	// checks newly placed plots in the background, or nil
+	verifier *verifier
+
+	// background work queued by New, ran once by Start
+	starters  []func()
+	startOnce sync.Once
+
+	// uploads to remote stores in progress, and the context Shutdown cancels
+	// to abort them once it stops waiting for transfers
+	uploads       atomic.Int64
+	uploadCtx     context.Context
+	cancelUploads context.CancelFunc
+
+	// watches the destination paths for changes made by other processes, or
+	// nil
+	watcher *dirWatcher
+
+	// ids of the stored plots when refusing duplicates, or nil
+	index *plotIndex
+
+	// write a sidecar with each stored plot's provenance and checksum, and
+	// store the checksum in an extended attribute on the plot
+	sidecars bool
+	xattrs   bool
+
+	// set the modification time of stored plots to when they were created
+	plotTimes bool
+
+	harvester *harvesterClient
+	plotDirs  *plotDirectories
+
+	// copy buffers for receiving plots onto the cache and moving them to
+	// their destination
+	receiveBuffers *bufferPool
+	moveBuffers    *bufferPool
+
+	// paths whose free space needs to be refreshed
+	stale       map[*PlotPath]bool
+	staleMutex  sync.Mutex
+	staleNotify chan struct{}
+
+	// bytes written to each destination to measure its speed, or zero when
+	// the speed probe is disabled
+	probeSize      int
+	listener       net.Listener
+	groupListeners map[string]net.Listener
+	wg             sync.WaitGroup
+
+	reloadMutex sync.Mutex
+
+	job      *MoveJob
+	jobMutex sync.Mutex
+
+	scheduler *scheduler
+
+	// destination paths sharing a filesystem, by its id
+	pools map[string]*plotPool
+
+	stateFile  string
+	state      *sinkState
+	stateMutex sync.Mutex
+
+	transfers      map[uint64]*transfer
+	transfersMutex sync.Mutex
+	transferID     atomic.Uint64
+}
+
+// New will create a the sink server process and validate all of
+// the provided plot paths. It will return an error if any of the paths do not
+// exist, or are not a directory.
+func New(cfg *Config) (*Sink, error) {
+	s := &Sink{
+		sortedGroups: make([]*PlotGroup, 0),
+		stats:        newStatsTracker(),
+		webhooks:     cfg.Webhooks,
+		sidecars:     cfg.Sidecar,
+		xattrs:       cfg.ChecksumXattr,
+		plotTimes:    cfg.MtimeFromFilename,
+		controlToken: cfg.ControlToken,
+		configFile:   cfg.file,
+		transfers:    make(map[uint64]*transfer),
+		stale:        make(map[*PlotPath]bool),
+		staleNotify:  make(chan struct{}, 1),
+
+		maxConnections: int64(cfg.MaxConnections),
+		stallTimeout:   cfg.StallTimeout,
+		stateFile:      cfg.StateFile,
+	}
+	s.uploadCtx, s.cancelUploads = context.WithCancel(context.Background())
+
+	// set up the copy buffers
+	var receiveSize, moveSize uint64
+	if cfg.Buffers != nil {
+		var err error
+		if receiveSize, err = parseBufferSize(cfg.Buffers.Receive); err != nil {
+			return nil, fmt.Errorf("invalid receive buffer size: %v", err)
+		}
+		if moveSize, err = parseBufferSize(cfg.Buffers.Move); err != nil {
+			return nil, fmt.Errorf("invalid move buffer size: %v", err)
+		}
+	}
+	s.receiveBuffers = newBufferPool(int(receiveSize))
+	s.moveBuffers = newBufferPool(int(moveSize))
+
+	var err error
+	if s.minPlotSize, s.maxPlotSize, err = parsePlotSizes(cfg.PlotSize); err != nil {
+		return nil, fmt.Errorf("invalid plot_size: %v", err)
+	}
+
+	if cfg.Keys != nil {
+		if s.keys, err = newKeyFilter(cfg.Keys); err != nil {
+			return nil, fmt.Errorf("invalid keys: %v", err)
+		}
+	}
+
+	if s.plotters, err = newPlotterSet(cfg.Plotters); err != nil {
+		return nil, fmt.Errorf("invalid plotters: %v", err)
+	}
+	if cfg.Priority != nil {
+		s.reservedSlots = cfg.Priority.ReservedSlots
+	}
+	if s.bandwidth, err = newBandwidthSchedule(cfg.Bandwidth); err != nil {
+		return nil, fmt.Errorf("invalid bandwidth: %v", err)
+	}
+	s.background(s.bandwidth.run)
+	if s.load = newLoadMonitor(cfg.Load); s.load != nil {
+		s.background(s.load.run)
+	}
+	s.temperature = newTemperatureMonitor(cfg.Temperature)
+
+	// populate cache settings
+	cfg.Cache.name = "cache"
+	cacheGroup, err := newPlotGroup(cfg.Cache, true)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize cache group: %v", err)
+	}
+	s.cacheGroup = cacheGroup
+	s.cacheGroup.sortCachePaths()
+
+	// populage destination groups
+	for n, dst := range cfg.Destinations {
+		dst.name = n
+		pg, err := newPlotGroup(dst, false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize destination group: %v", err)
+		}
+		s.sortedGroups = append(s.sortedGroups, pg)
+	}
+	s.assignPools(s.sortedGroups)
+	if cfg.SharedDevices != "" && cfg.SharedDevices != "warn" && cfg.SharedDevices != "refuse" {
+		return nil, fmt.Errorf("invalid shared_devices %q, must be warn or refuse", cfg.SharedDevices)
+	}
+	for _, problem := range sharedDevices(s.pathGroups()) {
+		if cfg.SharedDevices == "refuse" {
+			return nil, fmt.Errorf("shared device: %s", problem)
+		}
+		log.Printf("WARNING: %s", problem)
+	}
+
+	// start handing out reservations. The scheduler only works in memory, so
+	// unlike the other background work it runs right away.
+	s.scheduler = newScheduler(s)
+	go s.scheduler.run()
+
+	// measure the speed of the destinations
+	if cfg.SpeedProbe != "" {
+		size, err := humanize.ParseBytes(cfg.SpeedProbe)
+		if err != nil {
+			return nil, fmt.Errorf("invalid speed_probe size: %v", err)
+		}
+		s.probeSize = int(size)
+		s.probePaths(s.sortedGroups)
+	}
+	if s.temperature != nil {
+		s.background(s.watchTemperatures)
+	}
+
+	// restore paused and disabled paths and groups
+	if err := s.loadState(); err != nil {
+		return nil, fmt.Errorf("failed to load state file: %v", err)
+	}
+
+	// parse the schedule
+	if cfg.Schedule != nil {
+		var err error
+		if s.ingestWindows, err = parseWindows(cfg.Schedule.Ingest); err != nil {
+			return nil, fmt.Errorf("failed to parse ingest schedule: %v", err)
+		}
+		if s.moveWindows, err = parseWindows(cfg.Schedule.Moves); err != nil {
+			return nil, fmt.Errorf("failed to parse move schedule: %v", err)
+		}
+	}
+
+	// resolve permissions for stored plots
+	if cfg.PlotPermissions != nil {
+		perms, err := newFilePermissions(cfg.PlotPermissions)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse plot permissions: %v", err)
+		}
+		s.permissions = perms
+	}
+
+	// how failed moves are retried
+	if s.moveRetry, err = newMoveRetryPolicy(cfg.MoveRetry); err != nil {
+		return nil, fmt.Errorf("invalid move_retry: %v", err)
+	}
+
+	// only accept plots named as configured
+	if s.filenames, err = newFilenamePattern(cfg.FilenamePattern); err != nil {
+		return nil, fmt.Errorf("invalid filename_pattern: %v", err)
+	}
+
+	// point senders at peer sinks when there is no room for their plots
+	if s.redirects, err = newPeerRedirects(cfg.Redirect); err != nil {
+		return nil, fmt.Errorf("invalid redirect: %v", err)
+	}
+
+	// share capacity with the other sinks in the cluster
+	if s.cluster, err = newCluster(s, cfg); err != nil {
+		return nil, fmt.Errorf("invalid cluster: %v", err)
+	}
+
+	// name in-progress files so harvesters and scanners pass over them
+	if s.tempFiles, err = newTempNaming(cfg.TempFiles); err != nil {
+		return nil, fmt.Errorf("invalid temp_files: %v", err)
+	}
+
+	// setup alerting
+	if cfg.Alerts != nil {
+		am, err := newAlertManager(s, cfg.Alerts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize alerts: %v", err)
+		}
+		s.alerts = am
+		s.background(am.run)
+	}
+	s.background(s.sampleBacklogs)
+	if cfg.Verify != nil {
+		if s.verifier, err = newVerifier(s, cfg.Verify); err != nil {
+			return nil, fmt.Errorf("invalid verify: %v", err)
+		}
+		s.background(s.verifier.start)
+	}
+
+	// push the farm summary to dashboards
+	if cfg.Integrations != nil && len(cfg.Integrations.Push) > 0 {
+		s.background(func() { s.pushSummary(cfg.Integrations) })
+	}
+
+	// open the audit log
+	if cfg.AuditLog != nil && cfg.AuditLog.Path != "" {
+		audit, err := newAuditLog(cfg.AuditLog)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %v", err)
+		}
+		s.audit = audit
+	}
+
+	// setup the harvester rpc client
+	if cfg.Harvester != nil {
+		hc, err := newHarvesterClient(cfg.Harvester)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize harvester client: %v", err)
+		}
+		s.harvester = hc
+	}
+
+	// write out the plot directories for the harvester
+	if cfg.PlotDirectories != nil {
+		pd, err := newPlotDirectories(cfg.PlotDirectories)
+		if err != nil {
+			return nil, err
+		}
+		s.plotDirs = pd
+		s.updatePlotDirectories()
+	}
+
+	// bind to the port
+	addr := cfg.listenAddress()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen %s: %w", addr, err)
+	}
+	log.Printf("Listening on %s...", addr)
+	s.listener = l
+
+	// bind the ports for groups with their own listener
+	s.groupListeners = make(map[string]net.Listener)
+	for _, pg := range s.sortedGroups {
+		if pg.listen == "" {
+			continue
+		}
+		l, err := net.Listen("tcp", pg.listen)
+		if err != nil {
+			s.closeListeners()
+			return nil, fmt.Errorf("failed to bind to %s for group %q: %v", pg.listen, pg.name, err)
+		}
+		log.Printf("Listening on %s for group %q...", pg.listen, pg.name)
+		s.groupListeners[pg.name] = l
+	}
+
+	if s.stallTimeout == 0 {
+		s.stallTimeout = 10 * time.Minute
+	}
+
+	// keep the free space of the paths current
+	refresh := cfg.FreeSpaceInterval
+	if refresh == 0 {
+		refresh = time.Minute
+	}
+	s.background(func() { s.refreshFreeSpace(refresh) })
+
+	// index the stored plots to refuse duplicates
+	if cfg.Dedupe {
+		s.index = newPlotIndex()
+		s.background(s.indexPlots)
+	}
+
+	// react to plots removed or added by other processes right away
+	if cfg.WatchDestinations {
+		if s.watcher, err = newDirWatcher(); err != nil {
+			log.Printf("Unable to watch destinations for changes: %v", err)
+		} else {
+			s.background(s.watchDestinations)
+		}
+	}
+
+	// move plots left in the cache once the move window opens. When relaying,
+	// they are forwarded along with any others left in the cache.
+	s.relaying = cfg.Relay != nil
+	if len(s.moveWindows) > 0 && !s.relaying {
+		s.background(s.runScheduledMoves)
+	}
+
+	// forward plots left in the cache when relaying
+	if s.relaying {
+		retry := cfg.Relay.RetryInterval
+		if retry <= 0 {
+			retry = time.Minute
+		}
+		log.Printf("Relaying plots to %d downstream sinks", len(cfg.Relay.Sinks))
+		s.background(func() { s.retryRelay(retry) })
+	}
+
+	// report on paths which are never selected
+	interval := cfg.StarvedPathInterval
+	if interval == 0 {
+		interval = time.Hour
+	}
+	if interval > 0 {
+		s.background(func() { s.reportStarvedPaths(interval) })
+	}
+	if cfg.SummaryInterval > 0 {
+		s.background(func() { s.logSummaries(cfg.SummaryInterval) })
+	}
+
+	// bind the control interface
+	if cfg.ControlListen != "" || cfg.ControlSocket != "" {
+		if err := s.startControl(cfg); err != nil {
+			s.closeListeners()
+			return nil, fmt.Errorf("failed to bind control interface: %v", err)
+		}
+	}
+	if s.cluster != nil {
+		log.Printf("Clustering as %s with %d peers", s.cluster.name, len(s.cluster.peers))
+		s.background(s.cluster.run)
+	}
+
+	return s, nil
+}
+
+// background queues fn to run in its own goroutine once the sink is started, so
+// New only binds the listeners and nothing runs before privileges are dropped.
+func (s *Sink) background(fn func()) {
+	s.starters = append(s.starters, fn)
+}
+
+// Start runs the sink's background work, such as serving the control interface
+// and keeping free space current. It is separate from New so the sink can bind
+// its listeners as root and drop privileges before starting, and is called by
+// Serve if it hasn't been already.
+func (s *Sink) Start() {
+	s.startOnce.Do(func() {
+		for _, fn := range s.starters {
+			go fn()
+		}
+		s.starters = nil
+	})
+}
+
+// acquireConnection reserves one of the connection slots, returning false if
+// the sink is already handling the maximum number of connections.
+func (s *Sink) acquireConnection() bool {
+	if s.connections.Add(1) > s.maxConnections && s.maxConnections > 0 {
+		s.connections.Add(-1)
+		return false
+	}
+	return true
+}
+
+// releaseConnection frees the connection's slot.
+func (s *Sink) releaseConnection() {
+	s.connections.Add(-1)
+}
+
+// serveGroup accepts connections on a group's own listener, placing the plots
+// only within that group. It returns once the listener is closed.
+func (s *Sink) serveGroup(name string, l net.Listener) {
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !acceptRetry(err, &delay) {
+				return
+			}
+			continue
+		}
+		delay = 0
+		if !s.acquireConnection() {
+			log.Printf("Refusing connection from %s, already at the maximum of %d connections",
+				conn.RemoteAddr().String(), s.maxConnections)
+			conn.Close()
+			continue
+		}
+		s.wg.Add(1)
+		go s.handleConnection(conn, name)
+	}
+}
+
+// Serve accepts plots on the sink's listeners until Close is called. When the
+// systemd watchdog is enabled, the accept wakes up periodically to ping it, so
+// a hung loop gets the sink restarted.
+func (s *Sink) Serve() {
+	s.Start()
+	log.Print("Ready")
+	sdNotify("READY=1")
+	for name, l := range s.groupListeners {
+		go s.serveGroup(name, l)
+	}
+
+	watchdog := newWatchdog()
+	var delay time.Duration
+	for {
+		if watchdog != nil {
+			watchdog.ping()
+			if tl, ok := s.listener.(*net.TCPListener); ok {
+				tl.SetDeadline(watchdog.deadline())
+			}
+		}
+
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			if !acceptRetry(err, &delay) {
+				return
+			}
+			continue
+		}
+		delay = 0
+		if !s.acquireConnection() {
+			log.Printf("Refusing connection from %s, already at the maximum of %d connections",
+				conn.RemoteAddr().String(), s.maxConnections)
+			conn.Close()
+			continue
+		}
+		s.wg.Add(1)
+		go s.handleConnection(conn, "")
+	}
+}
+
+// acceptRetry handles a failed Accept. It returns false once the listener has
+// been closed for shutdown. Other errors, such as running out of file
+// descriptors, are logged and retried after a backoff which doubles with each
+// consecutive failure, up to a second.
+func acceptRetry(err error, delay *time.Duration) bool {
+	if errors.Is(err, net.ErrClosed) {
+		return false
+	}
+
+	if *delay == 0 {
+		*delay = 5 * time.Millisecond
+	} else {
+		*delay = min(*delay*2, time.Second)
+	}
+	log.Printf("Failed to accept connection, retrying in %s: %v", *delay, err)
+	time.Sleep(*delay)
+	return true
+}
+
+// Close stops accepting new connections on all of the listeners, so Serve
+// returns. Transfers already in progress continue until Shutdown.
+func (s *Sink) Close() {
+	sdNotify("STOPPING=1")
+	s.closeListeners()
+}
+
+// closeListeners closes the main listener and those of the groups.
+func (s *Sink) closeListeners() {
+	s.listener.Close()
+	for _, l := range s.groupListeners {
+		l.Close()
+	}
+}
+
+// handleConnection faciliates the transfer of plot files from the plotters to
+// the sink. It encapculates a single request and is ran within its own
+// goroutine. The caller must add to the sink's WaitGroup and acquire a
+// connection slot before starting it.
+func (s *Sink) handleConnection(conn net.Conn, group string) {
+	defer s.wg.Done()
+	defer s.releaseConnection()
+
+	// refuse transfers outside of the ingest schedule
+	if !s.ingestWindows.open(time.Now()) {
+		log.Printf("Refusing transfer from %s outside of the ingest schedule", conn.RemoteAddr().String())
+		conn.Close()
+		return
+	}
+
+	// refuse transfers beyond the few accepted while the system is overloaded
+	if s.load.throttled(s.connections.Load()) {
+		log.Printf("Refusing transfer from %s, the system is overloaded", conn.RemoteAddr().String())
+		conn.Close()
+		return
+	}
+
+	// receive the file size
+	size, priority, err := protocol.ReadSizePriority(s.connReader(conn))
+	if err != nil {
+		log.Printf("Failed to receive file size: %v", err)
+		conn.Close()
+		return
+	}
+	source := remoteHost(conn)
+	if priority > protocol.PriorityBulk {
+		log.Printf("Refusing plot from %s, it has an unknown %s", source, priority)
+		conn.Close()
+		return
+	}
+
+	if !s.acceptableSize(size) {
+		log.Printf("Refusing plot from %s, its size of %s is outside of the accepted range", source, humanize.IBytes(size))
+		conn.Close()
+		return
+	}
+
+	// hold the plotter to its quota and groups
+	plotter := s.plotters.match(source)
+	if plotter != nil && group != "" && !plotter.allowsGroup(group) {
+		log.Printf("Refusing plot from %s, plotter %q can't store plots in group %q", source, plotter.name, group)
+		conn.Close()
+		return
+	}
+	if err := s.plotters.admit(plotter, size); err != nil {
+		log.Printf("Refusing plot from %s: %v", source, err)
+		conn.Close()
+		return
+	}
+	// the sender's priority overrides the plotter's default
+	bulk := plotter != nil && plotter.bulk
+	if priority != protocol.PriorityDefault {
+		bulk = priority == protocol.PriorityBulk
+	}
+	stored := false
+	defer func() {
+		if plotter != nil {
+			s.plotters.done(plotter, size, stored)
+		}
+		// persist the plotter's usage and the lifetime counters
+		s.saveState()
+	}()
+
+	// reserve a destination and cache path. This should return the one with
+	// the most free space that isn't busy.
+	req := &ReserveRequest{Size: size, Group: group, Cache: true}
+	if plotter != nil && group == "" {
+		req.Groups = plotter.groups
+	}
+	if bulk {
+		req.Headroom = s.reservedSlots
+	}
+	r := s.Reserve(req)
+	if r == nil {
+		// point the sender at a peer which may have room
+		if peer := s.redirectPeer(size); peer != "" {
+			if err := protocol.WriteRedirect(conn, peer); err != nil {
+				log.Printf("Failed to redirect %s to %s: %v", source, peer, err)
+			} else {
+				conn.Close()
+				log.Printf("Request to store plot, but no eligible plot found (%s), redirected %s to %s", humanize.Bytes(size), source, peer)
+				return
+			}
+		}
+		conn.Close()
+		log.Printf("Request to store plot, but no eligible plot found (%s)", humanize.Bytes(size))
+		return
+	}
+	defer s.Release(r)
+	pg, plot, cachePlot := r.Group, r.Plot, r.Cache
+
+	t := s.startTransfer(conn, source, size, pg, plot)
+	defer s.finishTransfer(t)
+	t.cachePlot = cachePlot
+	t.reservation = r
+	if bulk {
+		t.priority = priorityBulk
+	}
+
+	// transfer the file to fast local storage
+	filename, tmpfile, ok := s.handleTransfer(conn, t)
+	if !ok {
+		// conn already closed
+		return
+	}
+
+	// leave it in the cache for the scheduled mover while moves aren't
+	// allowed, rather than holding the connection slot and reservations
+	if !s.moveWindows.open(time.Now()) {
+		s.scheduleMove(t, pg, cachePlot, filename, tmpfile)
+		stored = true
+		s.invalidateFreeSpace(cachePlot)
+		return
+	}
+
+	// move it to final disk, counting it in the group's backlog until then
+	pg.backlog.add(size)
+	t.setPhase(PhaseMoving)
+	ok = s.handleMove(t, tmpfile)
+	pg.backlog.done(size)
+	pg, plot = r.Group, r.Plot
+	if !ok && t.canceled.Load() {
+		log.Printf("Transfer of %s was canceled, removing cached copy", filename)
+		os.Remove(tmpfile)
+	}
+	if ok {
+		stored = true
+		if s.sidecars && !plot.isRemote() {
+			s.writePlotSidecar(t, plot)
+		}
+		s.indexPlot(t, plot, filename)
+		s.recordPlacement(&placement{
+			Time:        time.Now(),
+			Source:      source,
+			Filename:    filename,
+			Size:        size,
+			Group:       pg.name,
+			Destination: plot.path,
+			Compression: plotfile.Compression(t.header, filename),
+			remote:      plot.isRemote(),
+		})
+		s.storeReplicas(t, pg, plot, tmpfile)
+		os.Remove(tmpfile)
+	}
+
+	// update free space
+	s.invalidateFreeSpace(plot, cachePlot)
+}
+
+// writePlotSidecar writes the sidecar for a plot received and moved to the
+// path. The move time is taken from the start of the move phase, so it doesn't
+// include waiting for the move schedule.
+func (s *Sink) writePlotSidecar(t *transfer, plot *PlotPath) {
+	info := t.info()
+	sc := &sidecar{
+		Filename:       info.Filename,
+		Source:         info.Source,
+		Size:           info.Size,
+		Compression:    plotfile.Compression(t.header, info.Filename),
+		Received:       info.Started.Add(t.receiveTime).UTC(),
+		ReceiveSeconds: t.receiveTime.Seconds(),
+		MoveSeconds:    time.Since(info.PhaseStart).Seconds(),
+		SHA256:         t.checksum,
+	}
+	if t.header != nil {
+		sc.PlotID = t.header.PlotID()
+	}
+	if err := writeSidecar(plot.path, sc); err != nil {
+		log.Printf("Failed to write sidecar for %s: %v", info.Filename, err)
+	}
+}
+
+// admitPlot checks a plot about to be stored against the filename pattern, the
+// allowed keys, and with dedupe the plots already stored or in-flight, claiming
+// its header for the transfer. hdrErr is the error reading the header, as data
+// without a plot header, or with one in a format version that isn't known, is
+// only refused when checking keys.
+func (s *Sink) admitPlot(t *transfer, filename string, hdr *plotfile.Header, hdrErr error) error {
+	if !s.filenames.MatchString(filename) {
+		return fmt.Errorf("its name doesn't match %s", s.filenames)
+	}
+	var versionErr *plotfile.VersionError
+	switch {
+	case s.keys != nil:
+		if hdrErr == nil {
+			hdrErr = s.keys.check(hdr)
+		}
+	case errors.Is(hdrErr, plotfile.ErrNotPlot):
+		hdrErr = nil
+	case errors.As(hdrErr, &versionErr):
+		log.Printf("Plot %s is in unknown format version %d, accepting it without reading the rest of its header", filename, versionErr.Version)
+		hdrErr = nil
+	}
+	if hdrErr != nil {
+		return hdrErr
+	}
+	if existing := s.claimHeader(t, hdr); existing != "" {
+		return fmt.Errorf("plot id %s is already stored as %s", hdr.PlotID(), existing)
+	}
+	return nil
+}
+
+// handleTransfer takes care of receiving the plot from the remote host and
+// storing on the temporary NVME/SSDs. It returns the filename of the plot, the
+// path to the temp storage location, and a bool indicating success. At the end,
+// it closes the remote connection regardless of success.
+func (s *Sink) handleTransfer(conn net.Conn, t *transfer) (string, string, bool) {
+	defer conn.Close()
+	cachePlot, plot := t.cachePlot, t.plot
+	source := remoteHost(conn)
+	in := s.connReader(conn)
+
+	// send response acknowledging to continue
+	if err := protocol.WriteAck(conn); err != nil {
+		log.Printf("Failed to acknowledge transfer: %v", err)
+		s.stats.failure(source)
+		return "", "", false
+	}
+
+	// receive filename
+	filename, err := protocol.ReadFilename(in)
+	if err != nil {
+		log.Printf("Failed to receive filename: %v", err)
+		s.stats.failure(source)
+		return "", "", false
+	}
+	if err := protocol.CheckFilename(filename); err != nil {
+		log.Printf("Refusing plot from %s: %v", source, err)
+		s.stats.failure(source)
+		return "", "", false
+	}
+	if final := protocol.FinalFilename(filename); final != filename {
+		log.Printf("Plot %s from %s has an in-progress name, storing it as %s", filename, source, final)
+		filename = final
+	}
+	if !s.claimFilename(t, filename) {
+		log.Printf("Refusing plot %s from %s, it is already being transferred", filename, source)
+		s.stats.failure(source)
+		return "", "", false
+	}
+
+	// read the plot's header, which is kept to be written ahead of the rest
+	// of the plot
+	var header bytes.Buffer
+	hdr, hdrErr := plotfile.ReadHeader(io.TeeReader(in, &header))
+	if err := s.admitPlot(t, filename, hdr, hdrErr); err != nil {
+		log.Printf("Refusing plot %s from %s: %v", filename, source, err)
+		s.stats.failure(source)
+		return "", "", false
+	}
+
+	// open the file and transfer
+	tmpfile, err := s.tempFiles.path(cachePlot.path, filename)
+	if err != nil {
+		log.Printf("Failed to create temp directory in %s: %v", cachePlot.path, err)
+		return "", "", false
+	}
+	os.Remove(tmpfile)
+	f, err := os.Create(tmpfile)
+	if err != nil {
+		log.Printf("Failed to open file at %s: %v", tmpfile, err)
+		return "", "", false
+	}
+	defer f.Close()
+
+	// perform the copy
+	log.Printf("Receiving plot %s from %s", filename, conn.RemoteAddr().String())
+	start := time.Now()
+	// read at most one byte more than announced, so overlong transfers are caught
+	body := io.LimitReader(io.MultiReader(&header, in), int64(t.size)+1)
+	body = &limitedReader{r: body, l: s.bandwidth.limiter}
+	var hasher hash.Hash
+	if s.sidecars || s.xattrs {
+		hasher = sha256.New()
+		body = io.TeeReader(body, hasher)
+	}
+	bytes, err := s.receiveBuffers.copyBuffer(f, &progressReader{r: body, n: &t.received, canceled: &t.canceled})
+	if err != nil {
+		f.Close()
+		os.Remove(tmpfile)
+		if t.canceled.Load() {
+			log.Printf("Receive of plot %s was canceled", filename)
+			return "", "", false
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			log.Printf("Receive of plot %s from %s stalled for %s, aborting", filename, source, s.stallTimeout)
+			s.stats.failure(source)
+			return "", "", false
+		}
+		log.Printf("Failure while writing plot %s: %v", tmpfile, err)
+		s.stats.failure(source)
+		plot.pause()
+		return "", "", false
+	}
+
+	// ensure the whole plot arrived, and nothing more, before handing it on
+	if uint64(bytes) != t.size {
+		f.Close()
+		os.Remove(tmpfile)
+		if uint64(bytes) < t.size {
+			log.Printf("Plot %s from %s was truncated, received %d of %d bytes", filename, source, bytes, t.size)
+		} else {
+			log.Printf("Plot %s from %s was longer than the announced %d bytes", filename, source, t.size)
+		}
+		s.stats.failure(source)
+		return "", "", false
+	}
+
+	// sync and rename it so we know it was completed
+	if err := f.Sync(); err != nil {
+		log.Printf("Failed to sync temp plot %s: %v", tmpfile, err)
+		f.Close()
+		os.Remove(tmpfile)
+		plot.pause()
+		return "", "", false
+	}
+	dstfile := filepath.Join(cachePlot.path, filename)
+	err = commitFile(tmpfile, dstfile)
+	if err != nil {
+		log.Printf("Failed to rename temp plot %s: %v", tmpfile, err)
+		f.Close()
+		os.Remove(tmpfile)
+		plot.pause()
+		return "", "", false
+	}
+
+	// confirm the plot is stored, so the sender can discard its copy. Senders
+	// which don't wait for it may have already closed the connection.
+	protocol.WriteStored(conn)
+
+	// log successful and some metrics
+	elapsed := time.Since(start)
+	t.receiveTime = elapsed
+	if hasher != nil {
+		t.checksum = hex.EncodeToString(hasher.Sum(nil))
+	}
+	s.stats.success(source, uint64(bytes), elapsed)
+	seconds := elapsed.Seconds()
+	log.Printf("Successfully stored %s:%s (%s, %f secs, %s/sec)",
+		conn.RemoteAddr().String(), filename, humanize.IBytes(uint64(bytes)), seconds, humanize.Bytes(uint64(float64(bytes)/seconds)))
+
+	s.invalidateFreeSpace(cachePlot)
+
+	return filename, dstfile, true
+}
+
+// handleMove is responsible for moving the plot from the temp location to the
+// final hard disk. It returns a bool to indicate success. A failed move is
+// retried as the move retry policy allows, on the same path and then on
+// others in the group, and otherwise the plot is left in the cache.
+func (s *Sink) handleMove(t *transfer, tmpfile string) bool {
+	// wait until moves are allowed by the schedule
+	if !s.waitForMoveWindow(t) {
+		return false
+	}
+
+	// make sure the plot still fits, which may pick a new destination
+	if !s.ensureRoom(t) {
+		return false
+	}
+
+	tf, err := os.Open(tmpfile)
+	if err != nil {
+		log.Printf("Failed to open tmpfile: %v", err)
+		return false
+	}
+	defer tf.Close()
+
+	policy := s.moveRetry
+	tried := make(map[*PlotPath]bool)
+	for {
+		_, plot := t.destination()
+		tried[plot] = true
+		for attempt := 1; ; attempt++ {
+			err := s.movePlot(t, plot, tf)
+			if err == nil {
+				return true
+			}
+			if t.canceled.Load() {
+				return false
+			}
+			log.Printf("Failed to move plot %s to %s (attempt %d of %d): %v", t.filename, plot.path, attempt, policy.attempts, err)
+			if attempt >= policy.attempts {
+				break
+			}
+			log.Printf("Retrying move of %s to %s in %s", t.filename, plot.path, policy.delay(attempt))
+			if !policy.wait(t, attempt) {
+				return false
+			}
+		}
+
+		policy.failed(plot)
+		if !policy.fallback || !s.reroute(t, "failed", tried) {
+			return false
+		}
+	}
+}
+
+// movePlot makes a single attempt at moving the plot from the temp file to the
+// path, removing anything partially written when it fails.
+func (s *Sink) movePlot(t *transfer, plot *PlotPath, tf *os.File) error {
+	t.moved.Store(0)
+	if _, err := tf.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if store := plot.remoteStore(); store != nil {
+		return s.handleUpload(t, plot, store, tf)
+	}
+	filename := t.filename
+
+	dstfile := filepath.Join(plot.path, filename)
+	tmpdstfile, err := s.tempFiles.path(plot.path, filename)
+	if err != nil {
+		return fmt.Errorf("failed to create temp directory: %v", err)
+	}
+
+	flags := os.O_WRONLY | os.O_EXCL | os.O_CREATE
+	f, err := plot.openWrite(tmpdstfile, flags, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open dest file: %v", err)
+	}
+
+	// open directio writter. Its buffer only holds the unaligned tail, since
+	// whole aligned buffers are written. Paths on network filesystems are
+	// written directly, as they aren't opened for direct I/O.
+	var dio flushWriter = bufio.NewWriterSize(f, 0)
+	if !plot.buffered.Load() {
+		dio, err = directio.New(f)
+		if err != nil {
+			f.Close()
+			os.Remove(tmpdstfile)
+			return fmt.Errorf("failed to create directio writter: %v", err)
+		}
+	}
+
+	// apply any bandwidth limits
+	src := t.moveReader(tf)
+
+	// perform the copy
+	start := time.Now()
+	bytes, err := s.moveBuffers.copyFull(dio, &progressReader{r: src, n: &t.moved, canceled: &t.canceled})
+	if err != nil {
+		dio.Flush()
+		f.Close()
+		os.Remove(tmpdstfile)
+		return err
+	}
+
+	// flush, sync, and close before rename
+	dio.Flush()
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpdstfile)
+		return fmt.Errorf("failed to sync: %v", err)
+	}
+	f.Close()
+
+	// store the checksum with the plot, when it was computed
+	if s.xattrs && t.checksum != "" {
+		if err := setChecksumXattr(tmpdstfile, t.checksum); err != nil {
+			log.Printf("Failed to store the checksum of %s: %v", filename, err)
+		}
+	}
+
+	// rename it so it can be used by the chia harvester
+	if err := commitFile(tmpdstfile, dstfile); err != nil {
+		os.Remove(tmpdstfile)
+		return fmt.Errorf("failed to rename final plot: %v", err)
+	}
+
+	// apply the configured ownership and permissions
+	if s.permissions != nil {
+		if err := s.permissions.apply(dstfile); err != nil {
+			log.Printf("Failed to set permissions on %s: %v", dstfile, err)
+		}
+	}
+
+	// date the plot by when it was created rather than received
+	if s.plotTimes {
+		if created, ok := plotfile.Created(filename); ok {
+			if err := os.Chtimes(dstfile, created, created); err != nil {
+				log.Printf("Failed to set the time of %s: %v", dstfile, err)
+			}
+		}
+	}
+
+	// success
+	seconds := time.Since(start).Seconds()
+	log.Printf("Moved plot %s (%s, %f secs, %s/sec)",
+		dstfile, humanize.IBytes(uint64(bytes)), seconds, humanize.Bytes(uint64(float64(bytes)/seconds)))
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+// sshStore writes plots to a directory on another machine over SSH, for
+// storage boxes which can't run the sink but accept SSH. It runs the system's
+// ssh client, so keys, ports, and jump hosts come from the user's ssh config.
+type sshStore struct {
+	dest    string
+	host    string
+	dir     string
+	command []string
+}
+
+// newSSHStores creates a store for each of the group's paths, which are of the
+// form user@host:/path.
+func newSSHStores(cfg *ConfigGroup) ([]RemoteStore, error) {
+	if len(cfg.Paths) == 0 {
+		return nil, errors.New("ssh groups require user@host:/path destinations as paths")
+	}
+
+	command := []string{"ssh"}
+	if cfg.SSH != nil && len(cfg.SSH.Command) > 0 {
+		command = cfg.SSH.Command
+	}
+	if _, err := exec.LookPath(command[0]); err != nil {
+		return nil, fmt.Errorf("ssh command not found: %v", err)
+	}
+
+	stores := make([]RemoteStore, 0, len(cfg.Paths))
+	for _, dest := range cfg.Paths {
+		host, dir, ok := strings.Cut(dest, ":")
+		if !ok || host == "" || !path.IsAbs(dir) {
+			return nil, fmt.Errorf("invalid ssh destination %q, expected user@host:/path", dest)
+		}
+		stores = append(stores, &sshStore{dest: dest, host: host, dir: path.Clean(dir), command: command})
+	}
+	return stores, nil
+}
+
+func (s *sshStore) String() string {
+	return s.dest
+}
+
+// Upload streams the plot to a temp file on the remote host, which is renamed
+// into place only once all of it has arrived, so an interrupted upload never
+// leaves a partial plot for the harvester to find.
+func (s *sshStore) Upload(ctx context.Context, filename string, size uint64, r io.Reader) error {
+	dst := path.Join(s.dir, filename)
+	tmp := dst + ".tmp"
+	script := fmt.Sprintf(
+		`mkdir -p %[1]s && cat > %[2]s && n=$(wc -c < %[2]s) && if [ "$n" -ne %[4]d ]; then rm -f %[2]s; echo "received $n of %[4]d bytes" >&2; exit 1; fi && mv %[2]s %[3]s`,
+		shellQuote(s.dir), shellQuote(tmp), shellQuote(dst), size)
+
+	args := append(s.command[1:len(s.command):len(s.command)], "-o", "BatchMode=yes", s.host, script)
+	cmd := exec.CommandContext(ctx, s.command[0], args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	n, err := io.Copy(stdin, io.LimitReader(r, int64(size)))
+	if err != nil {
+		// kill the session rather than closing stdin, which the remote end
+		// would take as the end of the plot
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	stdin.Close()
+
+	if err := cmd.Wait(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%v: %s", err, msg)
+		}
+		return err
+	}
+	if uint64(n) != size {
+		return fmt.Errorf("sent %d of %d bytes", n, size)
+	}
+	return nil
+}
+
+// shellQuote quotes s for use as a single word in a POSIX shell command.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
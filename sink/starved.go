@@ -0,0 +1,93 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"log"
+	"time"
+)
+
+// pathCounters is a snapshot of a PlotPath's selection counters.
+type pathCounters struct {
+	considered  int64
+	selected    int64
+	skipBusy    int64
+	skipPaused  int64
+	skipNoSpace int64
+}
+
+func (p *PlotPath) counters() pathCounters {
+	return pathCounters{
+		considered:  p.considered.Load(),
+		selected:    p.selected.Load(),
+		skipBusy:    p.skipBusy.Load(),
+		skipPaused:  p.skipPaused.Load(),
+		skipNoSpace: p.skipNoSpace.Load(),
+	}
+}
+
+func (c pathCounters) sub(o pathCounters) pathCounters {
+	return pathCounters{
+		considered:  c.considered - o.considered,
+		selected:    c.selected - o.selected,
+		skipBusy:    c.skipBusy - o.skipBusy,
+		skipPaused:  c.skipPaused - o.skipPaused,
+		skipNoSpace: c.skipNoSpace - o.skipNoSpace,
+	}
+}
+
+// reportStarvedPaths periodically logs paths which received no plots during
+// the interval while other paths in their group did. These would otherwise go
+// unnoticed, such as a path always sorted behind others, one which is always
+// busy, or a glob matching an unintended directory.
+func (s *Sink) reportStarvedPaths(interval time.Duration) {
+	last := make(map[*PlotPath]pathCounters)
+
+	for range time.Tick(interval) {
+		for _, pg := range append(s.GroupsNamed("cache"), s.GroupsNamed("")...) {
+			pg.sortMutex.RLock()
+			paths := append([]*PlotPath(nil), pg.sortedPlots...)
+			pg.sortMutex.RUnlock()
+
+			deltas := make(map[*PlotPath]pathCounters, len(paths))
+			var groupSelected int64
+			for _, pp := range paths {
+				c := pp.counters()
+				d := c.sub(last[pp])
+				last[pp] = c
+				deltas[pp] = d
+				groupSelected += d.selected
+			}
+
+			// an idle group isn't starving anything
+			if groupSelected == 0 {
+				continue
+			}
+
+			for _, pp := range paths {
+				d := deltas[pp]
+				if d.selected > 0 {
+					continue
+				}
+				log.Printf("Path %s in group %q received no plots in the last %s while the group received %d: %s",
+					pp.path, pg.name, interval, groupSelected, d.reason())
+			}
+		}
+	}
+}
+
+// reason gives the likely cause for a path not being selected.
+func (c pathCounters) reason() string {
+	switch {
+	case c.considered == 0:
+		return "never considered, other paths are always sorted ahead of it"
+	case c.skipPaused > 0 && c.skipPaused >= c.skipBusy:
+		return "paused or faulted, likely after write failures"
+	case c.skipNoSpace > 0:
+		return "not enough free space"
+	case c.skipBusy > 0:
+		return "always busy with another transfer"
+	default:
+		return "considered but never chosen"
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// sinkState is persisted to the state file so operator changes survive a
+// restart.
+type sinkState struct {
+	Paths  map[string]*pathState  `json:"paths,omitempty"`
+	Groups map[string]*groupState `json:"groups,omitempty"`
+
+	// quota used by each plotter
+	Plotters map[string]*plotterUsage `json:"plotters,omitempty"`
+
+	// lifetime transfer counters
+	Stats *lifetimeStats `json:"stats,omitempty"`
+}
+
+type pathState struct {
+	Paused   bool `json:"paused,omitempty"`
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+type groupState struct {
+	Paused   bool `json:"paused,omitempty"`
+	Disabled bool `json:"disabled,omitempty"`
+	Draining bool `json:"draining,omitempty"`
+}
+
+// loadState reads the state file, if one is configured, and applies it to the
+// current paths and groups. A missing file is not an error.
+func (s *Sink) loadState() error {
+	s.state = &sinkState{
+		Paths:  make(map[string]*pathState),
+		Groups: make(map[string]*groupState),
+	}
+	if s.stateFile == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(s.stateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, s.state); err != nil {
+		return err
+	}
+	if s.state.Paths == nil {
+		s.state.Paths = make(map[string]*pathState)
+	}
+	if s.state.Groups == nil {
+		s.state.Groups = make(map[string]*groupState)
+	}
+
+	s.applyState()
+	if s.plotters != nil {
+		s.plotters.restore(s.state.Plotters)
+	}
+	s.stats.restore(s.state.Stats)
+	return nil
+}
+
+// applyState sets the persisted flags on the current paths and groups. This is
+// used at startup and after a reload adds paths or groups.
+func (s *Sink) applyState() {
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+
+	for _, pg := range append(s.GroupsNamed("cache"), s.GroupsNamed("")...) {
+		if gs := s.state.Groups[pg.name]; gs != nil {
+			pg.paused.Store(gs.Paused)
+			pg.disabled.Store(gs.Disabled)
+			if gs.Draining && !pg.draining.Swap(true) {
+				go s.watchDrain(pg)
+			}
+		}
+
+		pg.sortMutex.RLock()
+		for _, pp := range pg.sortedPlots {
+			if ps := s.state.Paths[pp.path]; ps != nil {
+				pp.adminPaused.Store(ps.Paused)
+				pp.disabled.Store(ps.Disabled)
+				if ps.Paused || ps.Disabled {
+					log.Printf("Path %s is %s from the saved state", pp.path, ps.describe())
+				}
+			}
+		}
+		pg.sortMutex.RUnlock()
+	}
+}
+
+// saveState records the current flags of all paths and groups, along with the
+// plotters' usage and lifetime counters, in the state file. Entries for paths
+// or groups no longer configured are kept, so their state returns if they are
+// added back.
+func (s *Sink) saveState() {
+	if s.stateFile == "" {
+		return
+	}
+
+	s.stateMutex.Lock()
+	defer s.stateMutex.Unlock()
+
+	for _, pg := range append(s.GroupsNamed("cache"), s.GroupsNamed("")...) {
+		s.state.Groups[pg.name] = &groupState{
+			Paused:   pg.paused.Load(),
+			Disabled: pg.disabled.Load(),
+			Draining: pg.draining.Load(),
+		}
+
+		pg.sortMutex.RLock()
+		for _, pp := range pg.sortedPlots {
+			s.state.Paths[pp.path] = &pathState{
+				Paused:   pp.adminPaused.Load(),
+				Disabled: pp.disabled.Load(),
+			}
+		}
+		pg.sortMutex.RUnlock()
+	}
+
+	if s.plotters != nil {
+		if s.state.Plotters == nil {
+			s.state.Plotters = make(map[string]*plotterUsage)
+		}
+		for name, u := range s.plotters.usages() {
+			s.state.Plotters[name] = u
+		}
+	}
+	s.state.Stats = s.stats.lifetime()
+
+	// omit entries with nothing set
+	for k, v := range s.state.Groups {
+		if *v == (groupState{}) {
+			delete(s.state.Groups, k)
+		}
+	}
+	for k, v := range s.state.Paths {
+		if *v == (pathState{}) {
+			delete(s.state.Paths, k)
+		}
+	}
+	for k, v := range s.state.Plotters {
+		if *v == (plotterUsage{}) {
+			delete(s.state.Plotters, k)
+		}
+	}
+
+	b, err := json.MarshalIndent(s.state, "", "  ")
+	if err != nil {
+		log.Printf("Failed to encode state: %v", err)
+		return
+	}
+
+	// write to a temp file and rename so a crash can't leave it truncated
+	tmpfile := filepath.Join(filepath.Dir(s.stateFile), "."+filepath.Base(s.stateFile)+".tmp")
+	if err := os.WriteFile(tmpfile, b, 0644); err != nil {
+		log.Printf("Failed to write state file: %v", err)
+		return
+	}
+	if err := os.Rename(tmpfile, s.stateFile); err != nil {
+		log.Printf("Failed to write state file: %v", err)
+	}
+}
+
+func (ps *pathState) describe() string {
+	if ps.Disabled {
+		return "disabled"
+	}
+	return "paused"
+}
@@ -0,0 +1,48 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// DiskSpace returns the space available to write and the total size of the
+// filesystem containing the path. The field types of the filesystem stats
+// differ between platforms, so they are converted here. ZFS datasets are
+// asked for their own numbers, falling back to statfs if that fails.
+func DiskSpace(path string) (free, total uint64, err error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	if isZFS(&stat) {
+		if free, total, err := zfsSpace(path); err == nil {
+			return free, total, nil
+		}
+	}
+	bsize := uint64(stat.Bsize)
+	return uint64(stat.Bavail) * bsize, uint64(stat.Blocks) * bsize, nil
+}
+
+// onRootFilesystem returns true if the path is on the same filesystem as "/",
+// meaning no disk is mounted at or above it.
+func onRootFilesystem(path string) bool {
+	dev := DeviceOf(path)
+	return dev != 0 && dev == DeviceOf("/")
+}
+
+// DeviceOf returns the device id of the filesystem containing the path, or 0
+// if it can't be determined.
+func DeviceOf(path string) uint64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev)
+	}
+	return 0
+}
@@ -0,0 +1,51 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+//go:build darwin || freebsd
+
+package sink
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// networkFilesystems are the names of network and FUSE filesystems.
+var networkFilesystems = map[string]bool{
+	"nfs": true, "smbfs": true, "afpfs": true, "webdav": true,
+	"fusefs": true, "macfuse": true, "osxfuse": true,
+}
+
+// networkFilesystem returns the name of the network filesystem the path is
+// on, or an empty string if it's on a local one.
+func networkFilesystem(path string) string {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return ""
+	}
+	name := unix.ByteSliceToString(stat.Fstypename[:])
+	if networkFilesystems[name] || strings.HasPrefix(name, "fusefs.") {
+		return name
+	}
+	return ""
+}
+
+// isZFS returns true if the filesystem stats are for a ZFS dataset.
+func isZFS(stat *unix.Statfs_t) bool {
+	return unix.ByteSliceToString(stat.Fstypename[:]) == "zfs"
+}
+
+// filesystemIDs returns an id for the filesystem each path is on, which is the
+// same for paths on one filesystem, or an empty string if it can't be found.
+func filesystemIDs(paths []string) map[string]string {
+	ids := make(map[string]string, len(paths))
+	for _, p := range paths {
+		var stat unix.Statfs_t
+		if err := unix.Statfs(p, &stat); err != nil {
+			continue
+		}
+		ids[p] = fmt.Sprintf("%x:%x", stat.Fsid.Val[0], stat.Fsid.Val[1])
+	}
+	return ids
+}
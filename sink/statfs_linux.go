@@ -0,0 +1,87 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// cifsMagic, smb2Magic, and zfsMagic identify CIFS, SMB3, and ZFS mounts,
+// which x/sys doesn't define.
+const (
+	cifsMagic = 0xff534d42
+	smb2Magic = 0xfe534d42
+	zfsMagic  = 0x2fc12fc1
+)
+
+// networkFilesystems maps the statfs magic numbers of network and FUSE
+// filesystems to their names.
+var networkFilesystems = map[int64]string{
+	unix.NFS_SUPER_MAGIC:  "nfs",
+	unix.SMB_SUPER_MAGIC:  "smb",
+	cifsMagic:             "cifs",
+	smb2Magic:             "smb3",
+	unix.FUSE_SUPER_MAGIC: "fuse",
+	unix.CEPH_SUPER_MAGIC: "ceph",
+	unix.V9FS_MAGIC:       "9p",
+}
+
+// networkFilesystem returns the name of the network filesystem the path is
+// on, or an empty string if it's on a local one.
+func networkFilesystem(path string) string {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return ""
+	}
+	return networkFilesystems[int64(uint32(stat.Type))]
+}
+
+// isZFS returns true if the filesystem stats are for a ZFS dataset.
+func isZFS(stat *unix.Statfs_t) bool {
+	return uint32(stat.Type) == zfsMagic
+}
+
+// filesystemIDs returns an id for the filesystem each path is on, which is the
+// same for paths on one filesystem, or an empty string if it can't be found.
+// The device of the mount is used rather than of the path itself, since each
+// btrfs subvolume reports a device of its own.
+func filesystemIDs(paths []string) map[string]string {
+	ids := make(map[string]string, len(paths))
+	b, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return ids
+	}
+
+	// the mountpoint and device of each mount, later mounts hiding earlier
+	// ones at the same mountpoint
+	devices := make(map[string]string)
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		devices[unescapeMount(fields[4])] = fields[2]
+	}
+
+	for _, p := range paths {
+		resolved, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			continue
+		}
+		// walk up to the mountpoint the path is under
+		for dir := resolved; ; dir = filepath.Dir(dir) {
+			if dev, ok := devices[dir]; ok {
+				ids[p] = dev
+				break
+			}
+			if dir == "/" {
+				break
+			}
+		}
+	}
+	return ids
+}
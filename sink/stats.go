@@ -0,0 +1,202 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"maps"
+	"sync"
+	"time"
+)
+
+// sourceStats are the aggregated transfer counters for a single plotter,
+// keyed by its source address.
+type sourceStats struct {
+	Plots    int64         `json:"plots"`
+	Bytes    uint64        `json:"bytes"`
+	Failures int64         `json:"failures"`
+	Duration time.Duration `json:"duration"`
+	LastSeen time.Time     `json:"last_seen"`
+}
+
+// pathTotals count the plots placed on a single path.
+type pathTotals struct {
+	Plots int64  `json:"plots"`
+	Bytes uint64 `json:"bytes"`
+}
+
+// statsTracker collects the per-source statistics, and counts the plots placed
+// at each compression level and on each path. The counters cover the farm's
+// lifetime, persisted in the state file when one is configured.
+type statsTracker struct {
+	sources     map[string]*sourceStats
+	compression map[int]int64
+	paths       map[string]*pathTotals
+	mutex       sync.Mutex
+}
+
+// lifetimeStats are the counters persisted in the state file.
+type lifetimeStats struct {
+	Sources     map[string]*sourceStats `json:"sources,omitempty"`
+	Compression map[int]int64           `json:"compression,omitempty"`
+	Paths       map[string]*pathTotals  `json:"paths,omitempty"`
+}
+
+func newStatsTracker() *statsTracker {
+	return &statsTracker{
+		sources:     make(map[string]*sourceStats),
+		compression: make(map[int]int64),
+		paths:       make(map[string]*pathTotals),
+	}
+}
+
+// restore adds the counters from the state file to those counted so far.
+func (t *statsTracker) restore(ls *lifetimeStats) {
+	if ls == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for k, v := range ls.Sources {
+		ss := t.get(k)
+		ss.Plots += v.Plots
+		ss.Bytes += v.Bytes
+		ss.Failures += v.Failures
+		ss.Duration += v.Duration
+		if v.LastSeen.After(ss.LastSeen) {
+			ss.LastSeen = v.LastSeen
+		}
+	}
+	for k, v := range ls.Compression {
+		t.compression[k] += v
+	}
+	for k, v := range ls.Paths {
+		pt := t.paths[k]
+		if pt == nil {
+			pt = &pathTotals{}
+			t.paths[k] = pt
+		}
+		pt.Plots += v.Plots
+		pt.Bytes += v.Bytes
+	}
+}
+
+// lifetime returns a copy of the counters to persist.
+func (t *statsTracker) lifetime() *lifetimeStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	ls := &lifetimeStats{
+		Sources:     make(map[string]*sourceStats, len(t.sources)),
+		Compression: maps.Clone(t.compression),
+		Paths:       make(map[string]*pathTotals, len(t.paths)),
+	}
+	for k, v := range t.sources {
+		ss := *v
+		ls.Sources[k] = &ss
+	}
+	for k, v := range t.paths {
+		pt := *v
+		ls.Paths[k] = &pt
+	}
+	return ls
+}
+
+// get returns the stats for the source, creating them if needed. This should be
+// called with the mutex locked.
+func (t *statsTracker) get(source string) *sourceStats {
+	ss := t.sources[source]
+	if ss == nil {
+		ss = &sourceStats{}
+		t.sources[source] = ss
+	}
+	return ss
+}
+
+// success records a plot fully received from the source.
+func (t *statsTracker) success(source string, bytes uint64, d time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	ss := t.get(source)
+	ss.Plots++
+	ss.Bytes += bytes
+	ss.Duration += d
+	ss.LastSeen = time.Now()
+}
+
+// failure records a transfer from the source which failed to be received.
+func (t *statsTracker) failure(source string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	ss := t.get(source)
+	ss.Failures++
+	ss.LastSeen = time.Now()
+}
+
+// placed records a plot placed on its destination path with the compression
+// level, which is only counted once for plots with replicas.
+func (t *statsTracker) placed(path string, size uint64, compression int, replica bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !replica {
+		t.compression[compression]++
+	}
+
+	pt := t.paths[path]
+	if pt == nil {
+		pt = &pathTotals{}
+		t.paths[path] = pt
+	}
+	pt.Plots++
+	pt.Bytes += size
+}
+
+// pathTotal returns the plots placed on the path.
+func (t *statsTracker) pathTotal(path string) pathTotals {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if pt := t.paths[path]; pt != nil {
+		return *pt
+	}
+	return pathTotals{}
+}
+
+// compressionCounts returns a copy of the plots placed at each compression
+// level.
+func (t *statsTracker) compressionCounts() map[int]int64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return maps.Clone(t.compression)
+}
+
+// snapshot returns a copy of the current stats for all sources.
+func (t *statsTracker) snapshot() map[string]sourceStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	m := make(map[string]sourceStats, len(t.sources))
+	for k, v := range t.sources {
+		m[k] = *v
+	}
+	return m
+}
+
+// throughput returns the average receive rate in bytes per second.
+func (ss sourceStats) throughput() float64 {
+	if ss.Duration <= 0 {
+		return 0
+	}
+	return float64(ss.Bytes) / ss.Duration.Seconds()
+}
+
+// failureRate returns the fraction of transfers from the source which failed.
+func (ss sourceStats) failureRate() float64 {
+	total := ss.Plots + ss.Failures
+	if total == 0 {
+		return 0
+	}
+	return float64(ss.Failures) / float64(total)
+}
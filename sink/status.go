@@ -0,0 +1,180 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"time"
+)
+
+type StatusResponse struct {
+	Connections  int64                    `json:"connections"`
+	Cache        *GroupStatus             `json:"cache"`
+	Destinations []*GroupStatus           `json:"destinations"`
+	Sources      map[string]*SourceStatus `json:"sources"`
+	Transfers    []TransferInfo           `json:"transfers"`
+	Compression  map[int]int64            `json:"compression"`
+	Job          *JobInfo                 `json:"job,omitempty"`
+	Overloaded   bool                     `json:"overloaded,omitempty"`
+	Verify       *verifyStatus            `json:"verify,omitempty"`
+}
+
+type GroupStatus struct {
+	Name          string        `json:"name"`
+	Concurrency   int64         `json:"concurrency"`
+	Transfers     int64         `json:"transfers"`
+	Paused        bool          `json:"paused"`
+	Disabled      bool          `json:"disabled"`
+	Draining      bool          `json:"draining"`
+	Quiesced      bool          `json:"quiesced"`
+	Bandwidth     uint64        `json:"bandwidth,omitempty"`
+	Backlog       int64         `json:"backlog"`
+	BacklogBytes  int64         `json:"backlog_bytes"`
+	BacklogGrowth int64         `json:"backlog_growth"`
+	FreeSpace     uint64        `json:"free_space"`
+	TotalSpace    uint64        `json:"total_space"`
+	Paths         []*PathStatus `json:"paths"`
+}
+
+type PathStatus struct {
+	Path        string `json:"path"`
+	Transfers   int64  `json:"transfers"`
+	Busy        bool   `json:"busy"`
+	Paused      bool   `json:"paused"`
+	AdminPaused bool   `json:"admin_paused"`
+	Disabled    bool   `json:"disabled"`
+	Fault       string `json:"fault,omitempty"`
+	Temperature int64  `json:"temperature,omitempty"`
+	Hot         bool   `json:"hot,omitempty"`
+	FreeSpace   uint64 `json:"free_space"`
+	TotalSpace  uint64 `json:"total_space"`
+	Speed       uint64 `json:"speed,omitempty"`
+	Considered  int64  `json:"considered"`
+	Selected    int64  `json:"selected"`
+	Plots       int64  `json:"plots"`
+	Bytes       uint64 `json:"bytes"`
+}
+
+type SourceStatus struct {
+	Plots          int64     `json:"plots"`
+	Bytes          uint64    `json:"bytes"`
+	Failures       int64     `json:"failures"`
+	FailureRate    float64   `json:"failure_rate"`
+	AvgBytesPerSec float64   `json:"avg_bytes_per_sec"`
+	LastSeen       time.Time `json:"last_seen"`
+}
+
+// Status builds a point in time view of the sink's groups, paths, and sources.
+func (s *Sink) Status() *StatusResponse {
+	resp := &StatusResponse{
+		Connections:  s.connections.Load(),
+		Cache:        s.cacheGroup.Status(),
+		Destinations: make([]*GroupStatus, 0),
+		Sources:      make(map[string]*SourceStatus),
+		Transfers:    s.Transfers(),
+		Compression:  s.stats.compressionCounts(),
+		Overloaded:   s.load != nil && s.load.overloaded.Load(),
+		Verify:       s.verifier.status(),
+	}
+
+	if j := s.CurrentJob(); j != nil {
+		resp.Job = j.Info()
+	}
+
+	for _, pg := range s.GroupsNamed("") {
+		gs := pg.Status()
+		for _, ps := range gs.Paths {
+			pt := s.stats.pathTotal(ps.Path)
+			ps.Plots, ps.Bytes = pt.Plots, pt.Bytes
+		}
+		resp.Destinations = append(resp.Destinations, gs)
+	}
+
+	for k, ss := range s.stats.snapshot() {
+		resp.Sources[k] = &SourceStatus{
+			Plots:          ss.Plots,
+			Bytes:          ss.Bytes,
+			Failures:       ss.Failures,
+			FailureRate:    ss.failureRate(),
+			AvgBytesPerSec: ss.throughput(),
+			LastSeen:       ss.LastSeen,
+		}
+	}
+
+	return resp
+}
+
+// Status returns the current state of the group and its paths.
+func (pg *PlotGroup) Status() *GroupStatus {
+	pg.sortMutex.RLock()
+	defer pg.sortMutex.RUnlock()
+
+	gs := &GroupStatus{
+		Name:          pg.name,
+		Concurrency:   pg.concurrency,
+		Transfers:     pg.transfers.Load(),
+		Paused:        pg.paused.Load(),
+		Disabled:      pg.disabled.Load(),
+		Draining:      pg.draining.Load(),
+		Quiesced:      pg.quiesced(),
+		Bandwidth:     pg.bandwidth,
+		Backlog:       pg.backlog.plots.Load(),
+		BacklogBytes:  pg.backlog.bytes.Load(),
+		BacklogGrowth: pg.backlog.growth(),
+		Paths:         make([]*PathStatus, 0, len(pg.sortedPlots)),
+	}
+	seen := make(map[*plotPool]bool)
+	for _, pp := range pg.sortedPlots {
+		free, total := pp.countedSpace(seen)
+		gs.FreeSpace += free
+		gs.TotalSpace += total
+		gs.Paths = append(gs.Paths, &PathStatus{
+			Path:        pp.path,
+			Transfers:   pp.transfers.Load(),
+			Busy:        pp.busy.Load(),
+			Paused:      pp.paused.Load(),
+			AdminPaused: pp.adminPaused.Load(),
+			Disabled:    pp.disabled.Load(),
+			Fault:       pp.faultReason(),
+			Temperature: pp.temperature.Load(),
+			Hot:         pp.hot.Load(),
+			FreeSpace:   pp.freeSpace.Load(),
+			TotalSpace:  pp.totalSpace.Load(),
+			Speed:       pp.speed.Load(),
+			Considered:  pp.considered.Load(),
+			Selected:    pp.selected.Load(),
+		})
+	}
+	return gs
+}
+
+// State summarizes the group's flags for display.
+func (gs *GroupStatus) State() string {
+	switch {
+	case gs.Disabled:
+		return "disabled"
+	case gs.Quiesced:
+		return "drained"
+	case gs.Draining:
+		return "draining"
+	case gs.Paused:
+		return "paused"
+	}
+	return "active"
+}
+
+// State summarizes the path's flags for display.
+func (ps *PathStatus) State() string {
+	switch {
+	case ps.Disabled:
+		return "disabled"
+	case ps.Fault != "":
+		return "faulted"
+	case ps.AdminPaused:
+		return "paused"
+	case ps.Paused:
+		return "paused (failure)"
+	case ps.Busy:
+		return "busy"
+	}
+	return "active"
+}
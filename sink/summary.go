@@ -0,0 +1,154 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// farmSummary is a flat summary of the sink for farm dashboards such as
+// Machinaris and farmr, which show it alongside their harvester and farmer
+// stats. It is served on /summary and pushed to the integration urls.
+type farmSummary struct {
+	Hostname       string    `json:"hostname"`
+	Time           time.Time `json:"time"`
+	Plots          int64     `json:"plots"`
+	Bytes          uint64    `json:"bytes"`
+	Failures       int64     `json:"failures"`
+	Plotters       int       `json:"plotters"`
+	Transfers      int       `json:"transfers"`
+	CacheFree      uint64    `json:"cache_free"`
+	CacheTotal     uint64    `json:"cache_total"`
+	FreeSpace      uint64    `json:"free_space"`
+	TotalSpace     uint64    `json:"total_space"`
+	Paths          int       `json:"paths"`
+	PausedPaths    int       `json:"paused_paths"`
+	FaultedPaths   int       `json:"faulted_paths"`
+	PlotsRemaining uint64    `json:"plots_remaining"`
+}
+
+// summary builds the current farm summary. The plots remaining is estimated
+// from the average size of the plots received so far.
+func (s *Sink) summary() *farmSummary {
+	fs := &farmSummary{
+		Time:      time.Now().UTC(),
+		Transfers: len(s.Transfers()),
+	}
+	fs.Hostname, _ = os.Hostname()
+
+	for _, ss := range s.stats.snapshot() {
+		fs.Plots += ss.Plots
+		fs.Bytes += ss.Bytes
+		fs.Failures += ss.Failures
+		fs.Plotters++
+	}
+
+	fs.CacheFree, fs.CacheTotal = groupsSpace(s.GroupsNamed("cache"))
+	groups := s.GroupsNamed("")
+	fs.FreeSpace, fs.TotalSpace = groupsSpace(groups)
+	for _, pg := range groups {
+		pg.sortMutex.RLock()
+		for _, pp := range pg.sortedPlots {
+			fs.Paths++
+			if pp.faulted.Load() {
+				fs.FaultedPaths++
+			} else if pp.unavailable() {
+				fs.PausedPaths++
+			}
+		}
+		pg.sortMutex.RUnlock()
+	}
+
+	if fs.Plots > 0 {
+		fs.PlotsRemaining = fs.FreeSpace / (fs.Bytes / uint64(fs.Plots))
+	}
+	return fs
+}
+
+// handleSummary returns the farm summary as JSON.
+func (s *Sink) handleSummary(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.summary())
+}
+
+// pushSummary posts the farm summary to the integration urls on the interval.
+// It is intended to be ran within its own goroutine.
+func (s *Sink) pushSummary(cfg *ConfigIntegrations) {
+	interval := cfg.Interval
+	if interval <= 0 {
+		interval = 5 * time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		fs := s.summary()
+		for _, url := range cfg.Push {
+			if err := postJSON(url, fs); err != nil {
+				log.Printf("Failed to push the summary to %s: %v", url, err)
+			}
+		}
+	}
+}
+
+// logSummaries logs a compact summary of the farm on the interval, giving
+// unattended logs a heartbeat: the plots stored, those added and the average
+// receive rate over the interval, and each group's free and total space. It
+// is intended to be ran within its own goroutine.
+func (s *Sink) logSummaries(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	lastPlots, lastBytes := s.placedTotals()
+	for range ticker.C {
+		plots, bytes := s.placedTotals()
+		log.Print(s.summaryLine(interval, plots-lastPlots, bytes-lastBytes))
+		lastPlots, lastBytes = plots, bytes
+	}
+}
+
+// placedTotals returns the plots placed and bytes received since the sink's
+// lifetime counters began.
+func (s *Sink) placedTotals() (int64, uint64) {
+	var plots int64
+	for _, n := range s.stats.compressionCounts() {
+		plots += n
+	}
+	var bytes uint64
+	for _, ss := range s.stats.snapshot() {
+		bytes += ss.Bytes
+	}
+	return plots, bytes
+}
+
+// summaryLine formats the summary for the plots added and bytes received over
+// the interval.
+func (s *Sink) summaryLine(interval time.Duration, added int64, received uint64) string {
+	groups := s.GroupsNamed("")
+	stored := s.storedPlots(groups, "")
+	counts := make(map[string]int, len(groups))
+	for _, p := range stored {
+		counts[p.Group]++
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Summary: %d plots stored, %d added in the last %s, receiving %s/s, %d transfers",
+		len(stored), added, interval, humanize.IBytes(uint64(float64(received)/interval.Seconds())),
+		len(s.Transfers()))
+	for _, pg := range groups {
+		free, total := groupsSpace([]*PlotGroup{pg})
+		fmt.Fprintf(&sb, "; %s: %d plots, %s/%s TiB free", pg.name, counts[pg.name], formatTiB(free), formatTiB(total))
+	}
+	return sb.String()
+}
+
+// formatTiB formats the bytes in TiB with one decimal place.
+func formatTiB(b uint64) string {
+	return fmt.Sprintf("%.1f", float64(b)/(1<<40))
+}
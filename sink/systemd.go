@@ -0,0 +1,68 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends the state to systemd's notification socket. It does nothing
+// when the sink isn't running under a systemd unit with Type=notify.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// abstract namespace sockets are given with a leading @
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// sdWatchdog tracks keep-alive pings to the systemd watchdog. The interval is
+// half of what systemd expects, so a single slow iteration doesn't trigger a
+// restart.
+type sdWatchdog struct {
+	interval time.Duration
+	lastPing time.Time
+}
+
+// newWatchdog returns the watchdog if systemd has enabled it for this process,
+// otherwise nil.
+func newWatchdog() *sdWatchdog {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	return &sdWatchdog{interval: time.Duration(usec) * time.Microsecond / 2}
+}
+
+// ping notifies the watchdog if the interval has elapsed since the last one.
+func (w *sdWatchdog) ping() {
+	if time.Since(w.lastPing) < w.interval {
+		return
+	}
+	sdNotify("WATCHDOG=1")
+	w.lastPing = time.Now()
+}
+
+// deadline returns when the accept loop must next wake to ping the watchdog.
+func (w *sdWatchdog) deadline() time.Time {
+	return time.Now().Add(w.interval)
+}
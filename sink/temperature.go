@@ -0,0 +1,186 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"time"
+)
+
+// errStandby is returned when a disk is spun down, so its temperature wasn't
+// read rather than waking it.
+var errStandby = errors.New("disk is in standby")
+
+// temperatureMonitor reads the temperature of the disks behind each path and
+// slows or pauses writes to those running hot, which matters in dense JBODs
+// with marginal cooling during long replot sessions. Limits are in celsius,
+// and a path stays throttled until its disk has cooled by the hysteresis.
+type temperatureMonitor struct {
+	slow       int64
+	max        int64
+	hysteresis int64
+	interval   time.Duration
+	smartctl   string
+
+	// paths whose disk couldn't be found or read, so they're only logged once
+	warned map[string]bool
+}
+
+// newTemperatureMonitor returns a monitor for the configured limits, or nil
+// when none are set.
+func newTemperatureMonitor(cfg *ConfigTemperature) *temperatureMonitor {
+	if cfg == nil || (cfg.Slow <= 0 && cfg.Max <= 0) {
+		return nil
+	}
+	m := &temperatureMonitor{
+		slow:       cfg.Slow,
+		max:        cfg.Max,
+		hysteresis: cfg.Hysteresis,
+		interval:   cfg.Interval,
+		smartctl:   cfg.Smartctl,
+		warned:     make(map[string]bool),
+	}
+	if m.hysteresis <= 0 {
+		m.hysteresis = 3
+	}
+	if m.interval <= 0 {
+		m.interval = 5 * time.Minute
+	}
+	if m.smartctl == "" {
+		m.smartctl = "smartctl"
+	}
+	return m
+}
+
+// read returns the disk's temperature, preferring the kernel's hwmon sensor
+// and falling back to smartctl.
+func (m *temperatureMonitor) read(d *disk) (int64, error) {
+	if t, ok := hwmonTemperature(d); ok {
+		return t, nil
+	}
+	return m.smartctlTemperature(d.device)
+}
+
+// smartctlTemperature reads the disk's temperature with smartctl, leaving it
+// alone if it is spun down.
+func (m *temperatureMonitor) smartctlTemperature(device string) (int64, error) {
+	// smartctl's exit status is a bitmask which is often set on healthy
+	// disks, so only the output is relied on
+	out, err := exec.Command(m.smartctl, "-n", "standby", "-A", "-j", device).Output()
+	if len(out) == 0 && err != nil {
+		return 0, fmt.Errorf("failed to run %s: %v", m.smartctl, err)
+	}
+
+	var resp struct {
+		PowerMode   string `json:"power_mode"`
+		Temperature *struct {
+			Current int64 `json:"current"`
+		} `json:"temperature"`
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return 0, fmt.Errorf("failed to parse %s output: %v", m.smartctl, err)
+	}
+	if resp.Temperature == nil {
+		if resp.PowerMode == "STANDBY" || resp.PowerMode == "SLEEP" {
+			return 0, errStandby
+		}
+		return 0, fmt.Errorf("%s reported no temperature for %s", m.smartctl, device)
+	}
+	return resp.Temperature.Current, nil
+}
+
+// apply updates the path for its disk's temperature, logging when it starts
+// or stops being throttled.
+func (m *temperatureMonitor) apply(p *PlotPath, temp int64) {
+	p.temperature.Store(temp)
+
+	switch {
+	case m.max > 0 && temp >= m.max:
+		if !p.hot.Swap(true) {
+			log.Printf("Path %s paused, its disk is at %d°C", p.path, temp)
+		}
+	case p.hot.Load() && temp <= m.max-m.hysteresis:
+		p.hot.Store(false)
+		log.Printf("Path %s resumed, its disk has cooled to %d°C", p.path, temp)
+	}
+
+	switch {
+	case m.slow > 0 && temp >= m.slow:
+		if !p.warm.Swap(true) {
+			log.Printf("Path %s slowed to one plot at a time, its disk is at %d°C", p.path, temp)
+		}
+	case p.warm.Load() && temp <= m.slow-m.hysteresis:
+		p.warm.Store(false)
+		log.Printf("Path %s no longer slowed, its disk has cooled to %d°C", p.path, temp)
+	}
+}
+
+// check reads the temperature of the disks behind the paths, once per disk,
+// and throttles the paths on any running hot.
+func (m *temperatureMonitor) check(paths []*PlotPath) {
+	names := make([]string, 0, len(paths))
+	for _, pp := range paths {
+		names = append(names, pp.path)
+	}
+	disks := pathDisks(names)
+
+	temps := make(map[string]int64)
+	failed := make(map[string]error)
+	for _, pp := range paths {
+		d := disks[pp.path]
+		if d == nil {
+			if !m.warned[pp.path] {
+				m.warned[pp.path] = true
+				log.Printf("Unable to find the disk of %s, not monitoring its temperature", pp.path)
+			}
+			continue
+		}
+
+		temp, ok := temps[d.device]
+		if !ok && failed[d.device] == nil {
+			t, err := m.read(d)
+			if err != nil {
+				failed[d.device] = err
+			} else {
+				temps[d.device], temp, ok = t, t, true
+			}
+		}
+		if !ok {
+			// a spun down disk is cool, so it's left as it was
+			if err := failed[d.device]; !errors.Is(err, errStandby) && !m.warned[pp.path] {
+				m.warned[pp.path] = true
+				log.Printf("Failed to read the temperature of %s for %s: %v", d.device, pp.path, err)
+			}
+			continue
+		}
+		delete(m.warned, pp.path)
+		m.apply(pp, temp)
+	}
+}
+
+// watchTemperatures checks the temperature of the disks behind the
+// destination paths on an interval. It is intended to be ran within its own
+// goroutine.
+func (s *Sink) watchTemperatures() {
+	ticker := time.NewTicker(s.temperature.interval)
+	defer ticker.Stop()
+
+	for {
+		var paths []*PlotPath
+		for _, pg := range s.GroupsNamed("") {
+			pg.sortMutex.RLock()
+			for _, pp := range pg.sortedPlots {
+				if !pp.isRemote() {
+					paths = append(paths, pp)
+				}
+			}
+			pg.sortMutex.RUnlock()
+		}
+		s.temperature.check(paths)
+		<-ticker.C
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// disk is the whole disk a path's filesystem is on.
+type disk struct {
+	// device is the disk's device node, such as /dev/sda
+	device string
+	// sys is the disk's directory in sysfs
+	sys string
+}
+
+// pathDisks returns the disk each path's filesystem is on, leaving out paths
+// whose filesystem isn't on a single block device, such as zfs or network
+// filesystems. Partitions are resolved to the disk they're on.
+func pathDisks(paths []string) map[string]*disk {
+	disks := make(map[string]*disk, len(paths))
+	for p, id := range filesystemIDs(paths) {
+		sys, err := filepath.EvalSymlinks("/sys/dev/block/" + id)
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(sys, "partition")); err == nil {
+			sys = filepath.Dir(sys)
+		}
+		disks[p] = &disk{device: "/dev/" + filepath.Base(sys), sys: sys}
+	}
+	return disks
+}
+
+// hwmonTemperature reads the disk's temperature from the kernel's hwmon
+// sensor, which SATA disks have with the drivetemp module loaded and NVMe
+// drives have on their controller.
+func hwmonTemperature(d *disk) (int64, bool) {
+	for _, pattern := range []string{"device/hwmon/hwmon*/temp1_input", "device/hwmon*/temp1_input"} {
+		matches, _ := filepath.Glob(filepath.Join(d.sys, pattern))
+		for _, m := range matches {
+			b, err := os.ReadFile(m)
+			if err != nil {
+				continue
+			}
+			// reported in millidegrees
+			milli, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+			if err != nil {
+				continue
+			}
+			return milli / 1000, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,21 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+//go:build !linux
+
+package sink
+
+// disk is the whole disk a path's filesystem is on.
+type disk struct {
+	device string
+}
+
+// pathDisks is only supported on Linux, so no temperatures are monitored
+// elsewhere.
+func pathDisks(paths []string) map[string]*disk {
+	return nil
+}
+
+// hwmonTemperature is only supported on Linux.
+func hwmonTemperature(d *disk) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,75 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tempNaming names the files plots are written to in the cache and on the
+// destinations until they are complete and renamed into place.
+type tempNaming struct {
+	prefix    string
+	suffix    string
+	directory string
+}
+
+// newTempNaming returns the naming from the config, which defaults to the
+// plot's filename with a .tmp suffix alongside where it will be stored.
+func newTempNaming(cfg *ConfigTempFiles) (*tempNaming, error) {
+	n := &tempNaming{suffix: ".tmp"}
+	if cfg == nil {
+		return n, nil
+	}
+	n.prefix = cfg.Prefix
+	n.directory = cfg.Directory
+	if cfg.Suffix != nil {
+		n.suffix = *cfg.Suffix
+	}
+
+	if strings.ContainsRune(n.prefix+n.suffix, filepath.Separator) {
+		return nil, errors.New("prefix and suffix can't contain a path separator")
+	}
+	if n.directory != "" {
+		clean := filepath.Clean(n.directory)
+		if filepath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			return nil, errors.New("directory must be a subdirectory within each path")
+		}
+		n.directory = clean
+	} else if strings.HasSuffix(n.suffix, ".plot") || n.suffix == "" {
+		// otherwise harvesters would see in-progress plots
+		return nil, errors.New("suffix can't be empty or end in .plot unless a directory is used")
+	}
+	return n, nil
+}
+
+// path returns the temp file the plot is written to before being renamed to
+// the filename in dir, creating the temp directory when one is used. The temp
+// directory is within dir, so the rename never crosses filesystems.
+func (n *tempNaming) path(dir, filename string) (string, error) {
+	if n.directory != "" {
+		dir = filepath.Join(dir, n.directory)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", err
+		}
+	}
+	return filepath.Join(dir, n.prefix+filename+n.suffix), nil
+}
+
+// commitFile renames the synced temp file into place and syncs the directory,
+// so the plot only ever appears under its final name once all of it is on
+// disk, and the rename survives a crash. Not every filesystem can sync a
+// directory, so only the rename failing is an error.
+func commitFile(tmpfile, file string) error {
+	if err := os.Rename(tmpfile, file); err != nil {
+		return err
+	}
+	if d, err := os.Open(filepath.Dir(file)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
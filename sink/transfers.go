@@ -0,0 +1,283 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"cmp"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/krobertson/chia-plot-sink-multi/plotfile"
+)
+
+const (
+	PhaseReceiving = "receiving"
+	PhaseMoving    = "moving"
+	PhaseWaiting   = "waiting"
+)
+
+// transfer tracks a single plot from when its connection is accepted until it
+// has been moved to its final destination.
+type transfer struct {
+	id        uint64
+	source    string
+	size      uint64
+	group     *PlotGroup
+	plot      *PlotPath
+	cachePlot *PlotPath
+	started   time.Time
+
+	received atomic.Int64
+	moved    atomic.Int64
+	canceled atomic.Bool
+	conn     net.Conn
+	limiter  *RateLimiter
+
+	// priority of the plot, if it is bulk
+	priority string
+
+	// header is the plot's parsed header, if it has one
+	header *plotfile.Header
+
+	// checksum is the plot's sha256 when sidecars or xattrs are written,
+	// and receiveTime how long it took to receive
+	checksum    string
+	receiveTime time.Duration
+
+	// reservation is set for received plots, so their destination can be
+	// changed before the move if it no longer has room
+	reservation *Reservation
+
+	filename   string
+	phase      string
+	phaseStart time.Time
+	mutex      sync.Mutex
+}
+
+// TransferInfo is a point in time copy of a transfer's state.
+type TransferInfo struct {
+	ID          uint64    `json:"id"`
+	Filename    string    `json:"filename"`
+	Source      string    `json:"source"`
+	Size        uint64    `json:"size"`
+	Group       string    `json:"group"`
+	Destination string    `json:"destination"`
+	Cache       string    `json:"cache,omitempty"`
+	Priority    string    `json:"priority,omitempty"`
+	Phase       string    `json:"phase"`
+	Received    int64     `json:"received"`
+	Moved       int64     `json:"moved"`
+	Started     time.Time `json:"started"`
+	PhaseStart  time.Time `json:"phase_start"`
+}
+
+// moveReader applies the bandwidth limits of the transfer's job, if it has
+// one, and of its destination group to reading the plot for its move.
+func (t *transfer) moveReader(r io.Reader) io.Reader {
+	if t.limiter != nil {
+		r = &limitedReader{r: r, l: t.limiter}
+	}
+	if pg, _ := t.destination(); pg != nil && pg.limiter != nil {
+		r = &limitedReader{r: r, l: pg.limiter}
+	}
+	return r
+}
+
+// setFilename records the plot's filename once it has been received.
+func (t *transfer) setFilename(filename string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.filename = filename
+}
+
+// name returns the plot's filename once it has been received.
+func (t *transfer) name() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.filename
+}
+
+// setDestination changes the path the plot will be moved to.
+func (t *transfer) setDestination(pg *PlotGroup, plot *PlotPath) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.group, t.plot = pg, plot
+}
+
+// destination returns the group and path the plot will be moved to.
+func (t *transfer) destination() (*PlotGroup, *PlotPath) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.group, t.plot
+}
+
+// setPhase updates which stage of the pipeline the transfer is in.
+func (t *transfer) setPhase(phase string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.phase = phase
+	t.phaseStart = time.Now()
+}
+
+// info returns a copy of the transfer's current state.
+func (t *transfer) info() TransferInfo {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	ti := TransferInfo{
+		ID:         t.id,
+		Filename:   t.filename,
+		Source:     t.source,
+		Size:       t.size,
+		Priority:   t.priority,
+		Phase:      t.phase,
+		Received:   t.received.Load(),
+		Moved:      t.moved.Load(),
+		Started:    t.started,
+		PhaseStart: t.phaseStart,
+	}
+	if t.group != nil {
+		ti.Group = t.group.name
+	}
+	if t.plot != nil {
+		ti.Destination = t.plot.path
+	}
+	if t.cachePlot != nil {
+		ti.Cache = t.cachePlot.path
+	}
+	return ti
+}
+
+// cancel aborts the transfer. Closing the connection interrupts a receive, and
+// the progress reader stops a move in progress.
+func (t *transfer) cancel() {
+	t.canceled.Store(true)
+	if t.conn != nil {
+		t.conn.Close()
+	}
+}
+
+// startTransfer registers a new in-flight transfer.
+func (s *Sink) startTransfer(conn net.Conn, source string, size uint64, pg *PlotGroup, plot *PlotPath) *transfer {
+	t := &transfer{
+		id:         s.transferID.Add(1),
+		conn:       conn,
+		source:     source,
+		size:       size,
+		group:      pg,
+		plot:       plot,
+		started:    time.Now(),
+		phase:      PhaseReceiving,
+		phaseStart: time.Now(),
+	}
+
+	s.transfersMutex.Lock()
+	defer s.transfersMutex.Unlock()
+	s.transfers[t.id] = t
+	return t
+}
+
+// finishTransfer removes the transfer from the in-flight list.
+func (s *Sink) finishTransfer(t *transfer) {
+	s.transfersMutex.Lock()
+	defer s.transfersMutex.Unlock()
+	delete(s.transfers, t.id)
+}
+
+// claimFilename records the transfer's filename, unless another in-flight
+// transfer already has it. It returns false in that case, so two senders can't
+// write over each other's temporary files.
+func (s *Sink) claimFilename(t *transfer, filename string) bool {
+	s.transfersMutex.Lock()
+	defer s.transfersMutex.Unlock()
+
+	for _, other := range s.transfers {
+		if other != t && other.info().Filename == filename {
+			return false
+		}
+	}
+	t.setFilename(filename)
+	return true
+}
+
+// findTransfer returns the in-flight transfer matching the id or filename.
+func (s *Sink) findTransfer(id uint64, filename string) *transfer {
+	s.transfersMutex.Lock()
+	defer s.transfersMutex.Unlock()
+
+	if t := s.transfers[id]; t != nil {
+		return t
+	}
+	if filename == "" {
+		return nil
+	}
+	for _, t := range s.transfers {
+		if t.info().Filename == filename {
+			return t
+		}
+	}
+	return nil
+}
+
+// Transfers returns the state of all in-flight transfers, ordered by when
+// they started.
+func (s *Sink) Transfers() []TransferInfo {
+	s.transfersMutex.Lock()
+	list := make([]TransferInfo, 0, len(s.transfers))
+	for _, t := range s.transfers {
+		list = append(list, t.info())
+	}
+	s.transfersMutex.Unlock()
+
+	slices.SortFunc(list, func(a, b TransferInfo) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return list
+}
+
+// errTransferCanceled is returned when a transfer is canceled by an operator.
+var errTransferCanceled = errors.New("transfer canceled")
+
+// progressReader counts the bytes read through it so a transfer's progress can
+// be observed while the copy is running. If the canceled flag is set, further
+// reads fail.
+type progressReader struct {
+	r        io.Reader
+	n        *atomic.Int64
+	canceled *atomic.Bool
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	if p.canceled != nil && p.canceled.Load() {
+		return 0, errTransferCanceled
+	}
+	n, err := p.r.Read(b)
+	p.n.Add(int64(n))
+	return n, err
+}
+
+// stallReader sets a read deadline on the connection before every read, so a
+// sender which stops sending fails the read rather than blocking forever.
+type stallReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r *stallReader) Read(b []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	return r.conn.Read(b)
+}
+
+// connReader returns the reader to receive from the connection with, which
+// fails once the sender stalls for longer than the stall timeout.
+func (s *Sink) connReader(conn net.Conn) io.Reader {
+	if s.stallTimeout <= 0 {
+		return conn
+	}
+	return &stallReader{conn: conn, timeout: s.stallTimeout}
+}
@@ -0,0 +1,250 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultVerifyCommand runs Chia's proof of space check against the plot.
+var defaultVerifyCommand = []string{"chia", "plots", "check", "-n", "30", "-g", "{plot}"}
+
+// proofsPattern and invalidPattern match the results in the output of chia
+// plots check.
+var (
+	proofsPattern  = regexp.MustCompile(`Proofs (\d+) / (\d+)`)
+	invalidPattern = regexp.MustCompile(`(\d+) invalid plots`)
+)
+
+// verifier checks newly placed plots in the background, quarantining those
+// which fail, without holding up receiving or moving like a check in the
+// transfer would. Its workers run at the lowest cpu and io priority, so checks
+// yield to the transfers and the harvester.
+type verifier struct {
+	sink       *Sink
+	command    []string
+	minRatio   float64
+	quarantine string
+	channels   []string
+	workers    int
+	queue      chan *placement
+
+	// requireProofs treats output without a proofs result as checking nothing
+	requireProofs bool
+
+	verified    atomic.Int64
+	quarantined atomic.Int64
+	skipped     atomic.Int64
+}
+
+type verifyStatus struct {
+	Queued      int   `json:"queued"`
+	Verified    int64 `json:"verified"`
+	Quarantined int64 `json:"quarantined"`
+	Skipped     int64 `json:"skipped"`
+}
+
+// newVerifier validates the verification settings. Its workers aren't started
+// until start is called.
+func newVerifier(s *Sink, cfg *ConfigVerify) (*verifier, error) {
+	v := &verifier{
+		sink:       s,
+		command:    cfg.Command,
+		minRatio:   cfg.MinRatio,
+		quarantine: cfg.Quarantine,
+		channels:   cfg.Channels,
+	}
+	if len(v.command) == 0 {
+		v.command = defaultVerifyCommand
+	}
+	// chia plots check only reports on plots under the harvester's plot
+	// directories and exits successfully having checked nothing otherwise
+	v.requireProofs = len(v.command) >= 3 && filepath.Base(v.command[0]) == "chia" &&
+		v.command[1] == "plots" && v.command[2] == "check"
+	if v.minRatio == 0 {
+		v.minRatio = 0.7
+	}
+	if v.minRatio < 0 || v.minRatio > 1 {
+		return nil, fmt.Errorf("min_ratio must be between 0 and 1")
+	}
+	if v.quarantine == "" {
+		v.quarantine = "quarantine"
+	}
+	if strings.ContainsRune(v.quarantine, filepath.Separator) || v.quarantine == "." || v.quarantine == ".." {
+		return nil, fmt.Errorf("quarantine must be a directory name, not %q", v.quarantine)
+	}
+
+	v.workers = cfg.Workers
+	if v.workers <= 0 {
+		v.workers = 1
+	}
+	queue := cfg.Queue
+	if queue <= 0 {
+		queue = 1000
+	}
+	v.queue = make(chan *placement, queue)
+	return v, nil
+}
+
+// start runs the verifier's workers.
+func (v *verifier) start() {
+	for i := 0; i < v.workers; i++ {
+		go v.run()
+	}
+}
+
+// enqueue queues the plot to be verified. When the queue is full the plot is
+// skipped rather than waited on, so a backlog never slows placements.
+func (v *verifier) enqueue(p *placement) {
+	if v == nil || p.remote {
+		return
+	}
+	select {
+	case v.queue <- p:
+	default:
+		v.skipped.Add(1)
+		log.Printf("Verification queue is full, skipping %s", p.Filename)
+	}
+}
+
+// run verifies queued plots. It locks itself to a thread with the lowest
+// priority, which the checks it starts inherit. It is intended to be ran
+// within its own goroutine.
+func (v *verifier) run() {
+	runtime.LockOSThread()
+	if err := lowerThreadPriority(); err != nil {
+		log.Printf("Failed to lower the priority of plot verification: %v", err)
+	}
+
+	for p := range v.queue {
+		v.verify(p)
+	}
+}
+
+// verify checks the plot, quarantining it if it fails.
+func (v *verifier) verify(p *placement) {
+	file := filepath.Join(p.Destination, p.Filename)
+	if _, err := os.Stat(file); err != nil {
+		// moved or removed since it was placed
+		v.skipped.Add(1)
+		return
+	}
+
+	start := time.Now()
+	reason, err := v.check(file)
+	if err != nil {
+		v.skipped.Add(1)
+		log.Printf("Failed to verify %s: %v", p.Filename, err)
+		return
+	}
+	if reason == "" {
+		v.verified.Add(1)
+		log.Printf("Verified %s in %s", p.Filename, time.Since(start).Round(time.Second))
+		return
+	}
+
+	v.quarantined.Add(1)
+	v.quarantinePlot(p, file, reason)
+
+	if v.sink.alerts != nil {
+		v.sink.alerts.notify(v.channels, &alert{
+			Rule:    "verify",
+			State:   "firing",
+			Group:   p.Group,
+			Message: fmt.Sprintf("verify: %s on %s failed verification: %s", p.Filename, p.Destination, reason),
+		})
+	}
+}
+
+// quarantinePlot moves the failed plot out of its path, so harvesters scanning the
+// plot directories recursively don't farm it. It goes into the quarantine
+// directory beside the path, which must be on the same filesystem. When it
+// can't be moved there, such as for a path at the root of its own mount, it is
+// renamed in place with a .quarantined extension, which harvesters don't load.
+func (v *verifier) quarantinePlot(p *placement, file, reason string) {
+	dir := filepath.Join(filepath.Dir(filepath.Clean(p.Destination)), v.quarantine)
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = os.Rename(file, filepath.Join(dir, p.Filename))
+	}
+	if err == nil {
+		if err := moveSidecar(p.Filename, p.Destination, dir); err != nil {
+			log.Printf("Failed to move the sidecar of %s: %v", p.Filename, err)
+		}
+		log.Printf("Quarantined %s in %s: %s", p.Filename, dir, reason)
+		return
+	}
+
+	if err := os.Rename(file, file+".quarantined"); err != nil {
+		log.Printf("Failed to quarantine %s: %v", file, err)
+		return
+	}
+	log.Printf("Quarantined %s as %s.quarantined, unable to move it to %s (%v): %s", p.Filename, p.Filename, dir, err, reason)
+}
+
+// check runs the verification command against the file, returning why it
+// failed or an empty string if it passed. The proofs found are compared to the
+// minimum ratio when the output includes them, otherwise the exit status
+// decides, except for chia plots check which must report the proofs. An error
+// is returned when the command couldn't be ran at all or checked nothing, which
+// says nothing about the plot.
+func (v *verifier) check(file string) (string, error) {
+	args := make([]string, len(v.command))
+	for i, a := range v.command {
+		args[i] = strings.ReplaceAll(a, "{plot}", file)
+	}
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return "", err
+	}
+
+	if m := invalidPattern.FindSubmatch(out); m != nil && string(m[1]) != "0" {
+		return "the plot is invalid", nil
+	}
+	if m := proofsPattern.FindSubmatch(out); m != nil {
+		found, _ := strconv.Atoi(string(m[1]))
+		total, _ := strconv.Atoi(string(m[2]))
+		if total > 0 && float64(found)/float64(total) < v.minRatio {
+			return fmt.Sprintf("found %d proofs for %d challenges", found, total), nil
+		}
+		return "", nil
+	}
+	if err != nil {
+		return fmt.Sprintf("%s failed: %v: %s", args[0], err, lastLine(out)), nil
+	}
+	if v.requireProofs {
+		return "", fmt.Errorf("no proofs were reported, the plot may not be in the harvester's plot directories")
+	}
+	return "", nil
+}
+
+// lastLine returns the last non-empty line of the output.
+func lastLine(out []byte) string {
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// status returns the verifier's queue and results.
+func (v *verifier) status() *verifyStatus {
+	if v == nil {
+		return nil
+	}
+	return &verifyStatus{
+		Queued:      len(v.queue),
+		Verified:    v.verified.Load(),
+		Quarantined: v.quarantined.Load(),
+		Skipped:     v.skipped.Load(),
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// ioprioWhoProcess targets a single thread with ioprio_set, and ioprioIdle is
+// the idle io scheduling class shifted into place. x/sys doesn't define them.
+const (
+	ioprioWhoProcess = 1
+	ioprioIdle       = 3 << 13
+)
+
+// lowerThreadPriority sets the calling thread to the lowest cpu priority and
+// the idle io class. Both are per thread on Linux, and inherited by processes
+// it starts.
+func lowerThreadPriority() error {
+	if err := unix.Setpriority(unix.PRIO_PROCESS, 0, 19); err != nil {
+		return err
+	}
+	_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, 0, ioprioIdle)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+//go:build !linux
+
+package sink
+
+// lowerThreadPriority is a no-op outside of Linux, where priorities apply to
+// the whole process rather than a thread.
+func lowerThreadPriority() error {
+	return nil
+}
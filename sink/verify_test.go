@@ -0,0 +1,69 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestVerifyRequiresProofs checks a chia plots check which reports no proofs,
+// as it does for plots outside the harvester's directories, isn't a pass.
+func TestVerifyRequiresProofs(t *testing.T) {
+	bin := t.TempDir()
+	t.Setenv("PATH", bin)
+	chia := filepath.Join(bin, "chia")
+
+	v, err := newVerifier(nil, &ConfigVerify{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(chia, []byte("#!/bin/sh\necho 'Found 0 valid plots'\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if reason, err := v.check("a.plot"); err == nil {
+		t.Errorf("passed without proofs, reason %q", reason)
+	}
+
+	if err := os.WriteFile(chia, []byte("#!/bin/sh\necho 'Proofs 5 / 30, 0.1667'\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if reason, err := v.check("a.plot"); err != nil || reason == "" {
+		t.Errorf("too few proofs gave reason %q, err %v", reason, err)
+	}
+
+	if err := os.WriteFile(chia, []byte("#!/bin/sh\necho 'Proofs 29 / 30, 0.9667'\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if reason, err := v.check("a.plot"); err != nil || reason != "" {
+		t.Errorf("enough proofs gave reason %q, err %v", reason, err)
+	}
+}
+
+// TestVerifyQuarantine checks failed plots are moved out of the path.
+func TestVerifyQuarantine(t *testing.T) {
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "dst")
+	if err := os.Mkdir(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dst, "a.plot")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := newVerifier(nil, &ConfigVerify{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.quarantinePlot(&placement{Destination: dst, Filename: "a.plot"}, file, "bad")
+
+	if _, err := os.Stat(filepath.Join(dir, "quarantine", "a.plot")); err != nil {
+		t.Errorf("plot wasn't quarantined beside the path: %v", err)
+	}
+	if _, err := os.Stat(file); err == nil {
+		t.Error("plot is still in the path")
+	}
+}
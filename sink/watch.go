@@ -0,0 +1,82 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/krobertson/chia-plot-sink-multi/plotfile"
+)
+
+// removalSettle is when the free space of a path is refreshed again after a
+// file is removed from it.
+var removalSettle = []time.Duration{time.Second, 10 * time.Second}
+
+// watchDestinations refreshes the free space of destination paths as soon as
+// files are created or removed in them, such as by replotting cleanup scripts
+// or manual deletes, rather than waiting for the periodic refresh. The paths
+// are watched again every minute, to follow disks mounted after startup. It is
+// intended to be ran within its own goroutine.
+func (s *Sink) watchDestinations() {
+	go s.watcher.run(s.destinationChanged)
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		s.watcher.sync(s.watchedPaths())
+		<-ticker.C
+	}
+}
+
+// watchedPaths returns the local destination paths.
+func (s *Sink) watchedPaths() []string {
+	paths := make([]string, 0)
+	for _, pg := range s.GroupsNamed("") {
+		pg.sortMutex.RLock()
+		for _, pp := range pg.sortedPlots {
+			if !pp.isRemote() {
+				paths = append(paths, pp.path)
+			}
+		}
+		pg.sortMutex.RUnlock()
+	}
+	return paths
+}
+
+// destinationChanged invalidates the free space of the path the file was
+// created or removed in, and keeps the plot index current when deduping. An
+// empty name means the directory changed in unknown ways.
+func (s *Sink) destinationChanged(dir, name string, removed bool) {
+	_, pp := s.FindPath(dir)
+	if pp == nil {
+		return
+	}
+	s.invalidateFreeSpace(pp)
+	if removed {
+		// the event comes as the file is unlinked, before its space is
+		// released, which may take a while for large plots
+		for _, d := range removalSettle {
+			time.AfterFunc(d, func() { s.invalidateFreeSpace(pp) })
+		}
+	}
+
+	if s.index == nil || !strings.HasSuffix(name, ".plot") {
+		return
+	}
+	file := filepath.Join(dir, name)
+	if removed {
+		s.index.remove(file)
+		return
+	}
+	id := plotfile.IDFromFilename(name)
+	if id == "" {
+		h, err := plotfile.ReadFileHeader(file)
+		if err != nil {
+			return
+		}
+		id = h.PlotID()
+	}
+	s.index.add(id, file)
+}
@@ -0,0 +1,133 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"bytes"
+	"log"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchMask is the inotify events which change a directory's plots or free
+// space.
+const watchMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO |
+	unix.IN_CLOSE_WRITE | unix.IN_ONLYDIR
+
+// dirWatch is an inotify watch on a directory, and the device the directory
+// was on when it was added, to catch a disk being mounted over it.
+type dirWatch struct {
+	wd  int32
+	dev uint64
+}
+
+// dirWatcher reports files created and removed within directories through
+// inotify.
+type dirWatcher struct {
+	fd      int
+	watches map[string]dirWatch
+	dirs    map[int32]string
+	mutex   sync.Mutex
+}
+
+func newDirWatcher() (*dirWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &dirWatcher{
+		fd:      fd,
+		watches: make(map[string]dirWatch),
+		dirs:    make(map[int32]string),
+	}, nil
+}
+
+// sync watches the directories, dropping the watches of any others. A
+// directory a disk was mounted or unmounted on since it was watched is watched
+// again, as the watch follows the directory it was added on.
+func (w *dirWatcher) sync(dirs []string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	keep := make(map[string]bool, len(dirs))
+	for _, dir := range dirs {
+		keep[dir] = true
+		dev := DeviceOf(dir)
+		if dw, ok := w.watches[dir]; ok && dw.dev == dev {
+			continue
+		}
+		wd, err := unix.InotifyAddWatch(w.fd, dir, watchMask)
+		if err != nil {
+			log.Printf("Failed to watch %s for changes: %v", dir, err)
+			continue
+		}
+		if dw, ok := w.watches[dir]; ok && dw.wd != int32(wd) {
+			unix.InotifyRmWatch(w.fd, uint32(dw.wd))
+			delete(w.dirs, dw.wd)
+		}
+		w.watches[dir] = dirWatch{wd: int32(wd), dev: dev}
+		w.dirs[int32(wd)] = dir
+	}
+	for dir, dw := range w.watches {
+		if !keep[dir] {
+			unix.InotifyRmWatch(w.fd, uint32(dw.wd))
+			delete(w.watches, dir)
+			delete(w.dirs, dw.wd)
+		}
+	}
+}
+
+// run reads the events, calling changed with the directory and name of each
+// file created or removed. When events were dropped, changed is called for
+// every directory with an empty name. It is intended to be ran within its own
+// goroutine.
+func (w *dirWatcher) run(changed func(dir, name string, removed bool)) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := unix.Read(w.fd, buf)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to read directory changes: %v", err)
+			return
+		}
+
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			name := string(bytes.TrimRight(buf[off+unix.SizeofInotifyEvent:off+unix.SizeofInotifyEvent+int(ev.Len)], "\x00"))
+			off += unix.SizeofInotifyEvent + int(ev.Len)
+
+			w.mutex.Lock()
+			switch {
+			case ev.Mask&unix.IN_Q_OVERFLOW != 0:
+				dirs := make([]string, 0, len(w.watches))
+				for dir := range w.watches {
+					dirs = append(dirs, dir)
+				}
+				w.mutex.Unlock()
+				for _, dir := range dirs {
+					changed(dir, "", false)
+				}
+				continue
+			case ev.Mask&unix.IN_IGNORED != 0:
+				// the directory was removed or its filesystem unmounted
+				if dir, ok := w.dirs[ev.Wd]; ok {
+					delete(w.dirs, ev.Wd)
+					if w.watches[dir].wd == ev.Wd {
+						delete(w.watches, dir)
+					}
+				}
+				w.mutex.Unlock()
+				continue
+			}
+			dir, ok := w.dirs[ev.Wd]
+			w.mutex.Unlock()
+			if ok && name != "" {
+				changed(dir, name, ev.Mask&(unix.IN_DELETE|unix.IN_MOVED_FROM) != 0)
+			}
+		}
+	}
+}
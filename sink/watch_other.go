@@ -0,0 +1,20 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+//go:build !linux
+
+package sink
+
+import (
+	"errors"
+)
+
+// dirWatcher is only supported on Linux, where it uses inotify.
+type dirWatcher struct{}
+
+func newDirWatcher() (*dirWatcher, error) {
+	return nil, errors.New("not supported on this platform")
+}
+
+func (w *dirWatcher) sync(dirs []string) {}
+
+func (w *dirWatcher) run(changed func(dir, name string, removed bool)) {}
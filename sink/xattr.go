@@ -0,0 +1,25 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import "golang.org/x/sys/unix"
+
+// checksumXattr is the extended attribute a plot's sha256 is stored in, so
+// scrub tools can verify it on disk without a separate manifest.
+const checksumXattr = "user.plot_sink.sha256"
+
+// setChecksumXattr stores the checksum on the file.
+func setChecksumXattr(path, checksum string) error {
+	return unix.Setxattr(path, checksumXattr, []byte(checksum), 0)
+}
+
+// checksumFromXattr returns the checksum stored on the file, or an empty
+// string if it has none.
+func checksumFromXattr(path string) string {
+	buf := make([]byte, 128)
+	n, err := unix.Getxattr(path, checksumXattr, buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[:n])
+}
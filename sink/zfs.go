@@ -0,0 +1,43 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package sink
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// zfsTimeout limits how long reading a dataset's properties can take.
+const zfsTimeout = 10 * time.Second
+
+// zfsSpace returns the space available to the dataset containing the path and
+// its size from the dataset's properties. Unlike statfs, these account for the
+// quotas and reservations of the dataset and its parents, and space held by
+// other datasets in the pool.
+func zfsSpace(path string) (free, total uint64, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), zfsTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, "zfs", "list", "-Hp", "-o", "available,used", path).Output()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("unexpected zfs output %q", out)
+	}
+	avail, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid available space %q: %v", fields[0], err)
+	}
+	used, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid used space %q: %v", fields[1], err)
+	}
+	return avail, avail + used, nil
+}
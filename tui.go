@@ -0,0 +1,231 @@
+// Copyright © 2024 Ken Robertson <ken@invalidlogic.com>
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/krobertson/chia-plot-sink-multi/sink"
+	"golang.org/x/sys/unix"
+)
+
+// eventBuffer is used as the log output while the TUI is active, retaining the
+// most recent lines so they can be rendered as the event list.
+type eventBuffer struct {
+	lines []string
+	max   int
+	mutex sync.Mutex
+}
+
+func (e *eventBuffer) Write(p []byte) (int, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for _, l := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		e.lines = append(e.lines, l)
+	}
+	if len(e.lines) > e.max {
+		e.lines = e.lines[len(e.lines)-e.max:]
+	}
+	return len(p), nil
+}
+
+// last returns up to n of the most recent lines.
+func (e *eventBuffer) last(n int) []string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if n > len(e.lines) {
+		n = len(e.lines)
+	}
+	return append([]string(nil), e.lines[len(e.lines)-n:]...)
+}
+
+// tui renders a top-like live view of the sink to the terminal.
+type tui struct {
+	sink   *sink.Sink
+	events *eventBuffer
+	out    io.Writer
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// newTUI switches the terminal to the alternate screen and captures log output
+// so it can be shown as recent events rather than scrolling the display.
+func newTUI() *tui {
+	t := &tui{
+		events: &eventBuffer{max: 200},
+		out:    os.Stdout,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	log.SetOutput(t.events)
+	fmt.Fprint(t.out, "\x1b[?1049h\x1b[?25l")
+	return t
+}
+
+// start begins rendering the sink's state every second.
+func (t *tui) start(s *sink.Sink) {
+	t.sink = s
+	go func() {
+		defer close(t.done)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			t.render()
+			select {
+			case <-ticker.C:
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+}
+
+// close stops rendering and restores the terminal and log output.
+func (t *tui) close() {
+	if t.sink != nil {
+		close(t.stop)
+		<-t.done
+	}
+	fmt.Fprint(t.out, "\x1b[?25h\x1b[?1049l")
+	log.SetOutput(os.Stderr)
+}
+
+// render draws a single frame.
+func (t *tui) render() {
+	width, height := 80, 24
+	if ws, err := unix.IoctlGetWinsize(int(os.Stdout.Fd()), unix.TIOCGWINSZ); err == nil && ws.Col > 0 {
+		width, height = int(ws.Col), int(ws.Row)
+	}
+
+	st := t.sink.Status()
+	lines := make([]string, 0, height)
+
+	// header
+	cacheUsed := 0.0
+	if st.Cache.TotalSpace > 0 {
+		cacheUsed = float64(st.Cache.TotalSpace-st.Cache.FreeSpace) / float64(st.Cache.TotalSpace) * 100
+	}
+	lines = append(lines,
+		fmt.Sprintf("\x1b[1mchia-plot-sink\x1b[0m  %s   transfers: %d   cache: %.0f%% used",
+			time.Now().Format("2006-01-02 15:04:05"), len(st.Transfers), cacheUsed),
+		"",
+		"\x1b[1mACTIVE TRANSFERS\x1b[0m",
+	)
+
+	// active transfers
+	if len(st.Transfers) == 0 {
+		lines = append(lines, "  none")
+	}
+	for _, ti := range st.Transfers {
+		done := ti.Received
+		if ti.Phase == sink.PhaseMoving {
+			done = ti.Moved
+		}
+		pct := 0.0
+		if ti.Size > 0 {
+			pct = float64(done) / float64(ti.Size) * 100
+		}
+		rate := 0.0
+		if secs := time.Since(ti.PhaseStart).Seconds(); secs > 0 {
+			rate = float64(done) / secs
+		}
+		lines = append(lines, fmt.Sprintf("  %-5d %-10s %5.1f%% %10s/s  %-15s %s -> %s",
+			ti.ID, ti.Phase, pct, humanize.IBytes(uint64(rate)), ti.Source, ti.Filename, ti.Destination))
+	}
+
+	// disks
+	lines = append(lines, "", "\x1b[1mDISKS\x1b[0m")
+	for _, gs := range append([]*sink.GroupStatus{st.Cache}, st.Destinations...) {
+		lines = append(lines, fmt.Sprintf("  %s (%d/%d transfers)", gs.Name, gs.Transfers, gs.Concurrency))
+		for _, ps := range gs.Paths {
+			flags := ""
+			if ps.Busy {
+				flags += " [busy]"
+			}
+			if ps.Paused || ps.AdminPaused {
+				flags += " [paused]"
+			}
+			if ps.Disabled {
+				flags += " [disabled]"
+			}
+			if ps.Fault != "" {
+				flags += " [faulted]"
+			}
+			barWidth := width - 60
+			if barWidth < 10 {
+				barWidth = 10
+			}
+			lines = append(lines, fmt.Sprintf("    %-30s %s %10s free%s",
+				ps.Path, fillBar(ps.TotalSpace-ps.FreeSpace, ps.TotalSpace, barWidth),
+				humanize.IBytes(ps.FreeSpace), flags))
+		}
+	}
+
+	// recent events fill whatever is left of the screen
+	lines = append(lines, "", "\x1b[1mRECENT EVENTS\x1b[0m")
+	remaining := height - len(lines) - 1
+	if remaining > 0 {
+		for _, l := range t.events.last(remaining) {
+			lines = append(lines, "  "+l)
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString("\x1b[H\x1b[2J")
+	for i, l := range lines {
+		if i >= height {
+			break
+		}
+		sb.WriteString(truncateANSI(l, width))
+		sb.WriteString("\r\n")
+	}
+	fmt.Fprint(t.out, sb.String())
+}
+
+// fillBar renders a usage bar of the given width.
+func fillBar(used, total uint64, width int) string {
+	filled := 0
+	pct := 0.0
+	if total > 0 {
+		pct = float64(used) / float64(total)
+		filled = int(pct * float64(width))
+	}
+	if filled > width {
+		filled = width
+	}
+	return fmt.Sprintf("[%s%s] %3.0f%%", strings.Repeat("#", filled), strings.Repeat(".", width-filled), pct*100)
+}
+
+// truncateANSI shortens the line to fit the terminal width, not counting escape
+// sequences towards the length.
+func truncateANSI(s string, width int) string {
+	var sb strings.Builder
+	visible := 0
+	escape := false
+	for _, r := range s {
+		switch {
+		case r == '\x1b':
+			escape = true
+		case escape:
+			if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+				escape = false
+			}
+		default:
+			if visible >= width {
+				continue
+			}
+			visible++
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}